@@ -1,10 +1,16 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
+	"strings"
 
+	"github.com/roshanlc/send-to-kindle/internal/convert"
+	"github.com/roshanlc/send-to-kindle/internal/email"
+	"github.com/roshanlc/send-to-kindle/internal/format"
 	"github.com/roshanlc/send-to-kindle/internal/helper"
 	"gopkg.in/yaml.v3"
 )
@@ -19,38 +25,158 @@ type Config struct {
 	To           []string `yaml:"TO"`
 	User         string   `yaml:"SMTPUSERID"`
 	Password     string   `yaml:"SMTPPASSWORD"`
+	Auth         string   `yaml:"SMTPAUTH"`     // PLAIN (default), LOGIN, CRAM-MD5, XOAUTH2 or NONE
+	TLS          string   `yaml:"SMTPTLS"`      // mandatory (default), opportunistic, implicit or none
+	CAFile       string   `yaml:"SMTPCAFILE"`   // PEM bundle trusted in addition to the system roots
+	CertFile     string   `yaml:"SMTPCERTFILE"` // PEM client certificate
+	KeyFile      string   `yaml:"SMTPKEYFILE"`  // PEM key of the client certificate
+	Delivery     string   `yaml:"DELIVERY"`     // smtp (default), sendmail or outbox
+	SendmailPath string   `yaml:"SENDMAILPATH"` // sendmail binary, for sendmail delivery
+	OutboxDir    string   `yaml:"OUTBOXDIR"`    // directory mails are written to, for outbox delivery
+	Subject      string   `yaml:"SUBJECT"`      // text/template of the mail subject, task id by default
+	Body         string   `yaml:"BODY"`         // text/template of the mail body
 	DownloadsDir string   `yaml:"DOWNLOADSDIR"`
+	Mirrors      []string `yaml:"LIBGENMIRRORS"`
+	// client and refresh token for XOAUTH2
+	OAuthTokenURL     string `yaml:"OAUTHTOKENURL"`
+	OAuthClientID     string `yaml:"OAUTHCLIENTID"`
+	OAuthClientSecret string `yaml:"OAUTHCLIENTSECRET"`
+	OAuthRefreshToken string `yaml:"OAUTHREFRESHTOKEN"`
+	// in MB, larger books are recompressed or split into parts, defaultMaxAttachmentMB when not set
+	MaxAttachmentSize int `yaml:"MAXATTACHMENTSIZE"`
+	// Kindles by name, picked with --device. TO is used when there are none.
+	Devices map[string]Device `yaml:"DEVICES"`
 }
 
+// Device is a Kindle books can be sent to
+type Device struct {
+	Email   string `yaml:"EMAIL"`
+	Format  string `yaml:"FORMAT"`  // preferred format, epub or pdf; automatic when empty
+	Default bool   `yaml:"DEFAULT"` // sent to when --device is not given
+}
+
+// attachments grow by a third when base64 encoded, this keeps mails under the 50 MB Send to Kindle limit
+const defaultMaxAttachmentMB = 35
+
 func main() {
 	// setup logger
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 	slog.SetDefault(logger)
 
+	deviceNames := flag.String("device", "", "names of the DEVICES to send to, separated by commas (the default ones when empty)")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: ./send-to-kindle [--device name[,name]] <url|file> [epub|pdf]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+
 	config, err := readConfig()
 	if err != nil {
 		slog.Error(err.Error())
 		return //exit while running deferred functions
 	}
 
-	if len(os.Args) == 1 {
-		slog.Error("no url provided, please provide a single url")
-		fmt.Println("usage: ./send-to-kindle <url>")
+	if len(args) == 0 {
+		slog.Error("no url provided, please provide a single url or file")
+		flag.Usage()
 		return
 	}
 
-	// extract  url from args
-	url := extractURL(os.Args[1])
-	if url == "" {
-		slog.Error("please provide a valid url")
+	to, preferred, err := resolveDevices(config, *deviceNames)
+	if err != nil {
+		slog.Error(err.Error())
 		return
 	}
 
-	slog.Info("extracted url", slog.String("url", url))
+	// a local book is sent as it is, anything else has to be a url
+	source, local := args[0], isLocalFile(args[0])
+	if !local {
+		source = extractURL(source)
+		if source == "" {
+			slog.Error("please provide a valid url or an existing file")
+			return
+		}
+	}
+
+	// optional format to convert to, the one the devices prefer otherwise
+	target := preferred
+	if len(args) > 1 {
+		target, err = convert.ParseTarget(args[1])
+		if err != nil {
+			slog.Error(err.Error())
+			return
+		}
+	}
+
+	slog.Info("extracted source", slog.String("source", source), slog.Bool("local", local), slog.Any("to", to))
 
 	// TODO: add this to database later
 	// process the url
-	process(config, url)
+	process(config, source, local, target, to)
+}
+
+// resolveDevices returns the addresses of the named devices, or of the default ones when
+// names is empty, along with the format they prefer; automatic if they differ.
+// TO is used when no device is named and none is a default.
+func resolveDevices(config *Config, names string) ([]string, format.Format, error) {
+	known := make([]string, 0, len(config.Devices))
+	for name := range config.Devices {
+		known = append(known, name)
+	}
+	slices.Sort(known)
+
+	var picked []string
+	if strings.TrimSpace(names) == "" {
+		for _, name := range known {
+			if config.Devices[name].Default {
+				picked = append(picked, name)
+			}
+		}
+		if len(picked) == 0 {
+			return config.To, "", nil
+		}
+	}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		// names are matched ignoring case, like on the dashboard
+		i := slices.IndexFunc(known, func(k string) bool { return strings.EqualFold(k, name) })
+		if i < 0 {
+			return nil, "", fmt.Errorf("unknown device %q, the config has %s", name, strings.Join(known, ", "))
+		}
+		if !slices.Contains(picked, known[i]) {
+			picked = append(picked, known[i])
+		}
+	}
+
+	var to []string
+	var preferred format.Format
+	for i, name := range picked {
+		device := config.Devices[name]
+		if strings.TrimSpace(device.Email) == "" {
+			return nil, "", fmt.Errorf("device %s has no EMAIL", name)
+		}
+		deviceFormat, err := convert.ParseTarget(device.Format)
+		if err != nil {
+			return nil, "", fmt.Errorf("device %s: %w", name, err)
+		}
+		to = append(to, device.Email)
+		if i == 0 {
+			preferred = deviceFormat
+		} else if deviceFormat != preferred {
+			preferred = "" // one file is sent to all of them
+		}
+	}
+	return to, preferred, nil
+}
+
+// isLocalFile reports whether the argument names an existing regular file
+func isLocalFile(arg string) bool {
+	info, err := os.Stat(arg)
+	return err == nil && info.Mode().IsRegular()
 }
 
 // extractURL takes value from arguments
@@ -80,6 +206,17 @@ func readConfig() (*Config, error) {
 		return nil, err
 	}
 
+	config.Auth = strings.ToUpper(strings.TrimSpace(config.Auth))
+	if config.Auth == "" {
+		config.Auth = email.AuthPlain
+	}
+
+	config.TLS = strings.ToLower(strings.TrimSpace(config.TLS))
+
+	if config.MaxAttachmentSize <= 0 {
+		config.MaxAttachmentSize = defaultMaxAttachmentMB
+	}
+
 	// TODO: also check the validity of Config object
 	// TODO: maybe move config related stuff to internal package
 	return &config, nil
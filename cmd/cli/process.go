@@ -1,56 +1,151 @@
 package main
 
 import (
+	"fmt"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/roshanlc/send-to-kindle/internal/convert"
 	"github.com/roshanlc/send-to-kindle/internal/downloader"
 	"github.com/roshanlc/send-to-kindle/internal/email"
+	"github.com/roshanlc/send-to-kindle/internal/format"
 	"github.com/roshanlc/send-to-kindle/internal/helper"
+	"github.com/roshanlc/send-to-kindle/internal/metadata"
+	"github.com/roshanlc/send-to-kindle/internal/oauth"
+	"github.com/roshanlc/send-to-kindle/internal/shrink"
 	"resty.dev/v3"
 )
 
-// process takes the url, downloads the file and emails it as an attachment
-func process(config *Config, url string) {
+// process takes the url, downloads the file, converts it to target if needed and emails it as an attachment
+// to the given addresses. A local source is a file path, it is sent without downloading.
+func process(config *Config, source string, local bool, target format.Format, to []string) {
 	downloader.SetDownloadDirectory(config.DownloadsDir) // set the downloads directory
+	err := downloader.SetLibgenMirrors(config.Mirrors)
+	if err != nil {
+		slog.Error("process failed while setting libgen mirrors", slog.String("error", err.Error()))
+		return
+	}
 	ctx := helper.GenerateIDWithContext()
-	slog.Info("trying to download file", slog.String("url", url), slog.Any("taskID", helper.GetIDFromContext(ctx)))
+
+	// the cli has no db, refreshed tokens only live for this run
+	var tokens email.TokenSource
+	if config.Auth == email.AuthXOAUTH2 && (config.Delivery == email.DeliverySMTP || config.Delivery == "") {
+		source, err := oauth.NewTokenSource(ctx, oauth.Config{
+			TokenURL:     config.OAuthTokenURL,
+			ClientID:     config.OAuthClientID,
+			ClientSecret: config.OAuthClientSecret,
+		}, nil, config.OAuthRefreshToken)
+		if err != nil {
+			slog.Error("process failed while setting up oauth2 tokens", slog.String("error", err.Error()))
+			return
+		}
+		defer source.Close()
+		tokens = source
+	}
+
+	tlsOptions := email.TLSOptions{
+		Mode:     config.TLS,
+		CAFile:   config.CAFile,
+		CertFile: config.CertFile,
+		KeyFile:  config.KeyFile,
+	}
+	sender, err := email.NewSender(email.Options{
+		Delivery:     config.Delivery,
+		Host:         config.Host,
+		Port:         config.Port,
+		Username:     config.User,
+		Password:     config.Password,
+		Auth:         config.Auth,
+		Token:        tokens,
+		TLS:          tlsOptions,
+		SendmailPath: config.SendmailPath,
+		OutboxDir:    config.OutboxDir,
+	})
+	if err != nil {
+		slog.Error("process failed while setting up mail delivery", slog.String("error", err.Error()))
+		return
+	}
+	templates, err := email.NewTemplates(config.Subject, config.Body)
+	if err != nil {
+		slog.Error("process failed while parsing mail templates", slog.String("error", err.Error()))
+		return
+	}
+	addedAt := time.Now()
 
 	client := resty.New().
 		SetRetryCount(3).
 		SetTimeout(5 * time.Minute)
 
-	filename, ctx, err := downloader.Process(ctx, client, url)
+	if local {
+		slog.Info("using local file", slog.String("filepath", source), slog.Any("taskID", helper.GetIDFromContext(ctx)))
+		_, ctx, err = downloader.ProcessFile(ctx, source)
+	} else {
+		slog.Info("trying to download file", slog.String("url", source), slog.Any("taskID", helper.GetIDFromContext(ctx)))
+		ctx = helper.NewContextWithProgress(ctx, printProgress())
+		_, ctx, err = downloader.Process(ctx, client, source)
+		fmt.Fprintln(os.Stderr) // end the progress line
+	}
 	if err != nil {
 		slog.Error("process failed", slog.String("error", err.Error()))
 		return
 	}
 
-	slog.Info("attempting to email downloaded file:- "+filename, slog.Any("taskID", helper.GetIDFromContext(ctx)))
+	path, err := convert.Convert(ctx, helper.GetFilepathFromContext(ctx), target)
+	if err != nil {
+		slog.Error("process failed while converting", slog.String("error", err.Error()))
+		return
+	}
 
-	details := email.EmailDetails{
-		From:        config.From,
-		To:          config.To,
-		Host:        config.Host,
-		Port:        config.Port,
-		Subject:     helper.GetIDFromContext(ctx).String(),
-		Body:        "Save the attached file(s).",
-		Attachments: []string{helper.GetFilepathFromContext(ctx)},
-		Username:    config.User,
-		Password:    config.Password,
+	// title and author for the mail, the file name stands in for a missing title
+	data := email.MessageData{
+		ID:      helper.GetIDFromContext(ctx).String(),
+		Title:   strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		URL:     source,
+		AddedAt: addedAt,
+	}
+	if detected, _, err := format.Detect(path); err == nil {
+		if meta, err := metadata.Extract(path, detected); err == nil {
+			if meta.Title != "" {
+				data.Title = meta.Title
+			}
+			data.Author = meta.Author()
+		}
 	}
 
-	err = email.Send(ctx, details)
+	// books over the attachment size limit are recompressed or split into parts
+	paths, err := shrink.Fit(ctx, path, int64(config.MaxAttachmentSize)<<20)
 	if err != nil {
-		slog.Error("process failed while sending email", slog.String("error", err.Error()))
+		slog.Error("process failed while fitting file within attachment size", slog.String("error", err.Error()))
 		return
 	}
 
-	path := helper.GetFilepathFromContext(ctx)
-	slog.Info("attempting to deleted downloaded file", slog.String("filepath", path))
-	err = downloader.DeleteDownloadedFile(path)
+	for i, path := range paths {
+		slog.Info("attempting to email downloaded file:- "+filepath.Base(path), slog.Any("taskID", helper.GetIDFromContext(ctx)), slog.Int("part", i+1), slog.Int("parts", len(paths)))
+
+		if len(paths) > 1 {
+			data.Part, data.Parts = i+1, len(paths)
+		}
+		details, err := emailDetails(config, templates, data, path, to)
+		if err != nil {
+			slog.Error("process failed while preparing email", slog.String("error", err.Error()))
+			return
+		}
+
+		err = sender.Send(ctx, details)
+		if err != nil {
+			slog.Error("process failed while sending email", slog.String("error", err.Error()))
+			return
+		}
+	}
+
+	taskID := helper.GetIDFromContext(ctx).String()
+	slog.Info("attempting to delete downloaded files", slog.String("taskID", taskID))
+	err = downloader.DeleteTaskDirectory(taskID)
 	if err != nil {
-		slog.Error("error while deleting downloaded file", slog.String("error", err.Error()), slog.String("filepath", path))
+		slog.Error("error while deleting downloaded files", slog.String("error", err.Error()), slog.String("taskID", taskID))
 	}
 
 	err = client.Close()
@@ -59,3 +154,46 @@ func process(config *Config, url string) {
 		return
 	}
 }
+
+// emailDetails returns the mail carrying a file to the recipients
+func emailDetails(config *Config, templates *email.Templates, data email.MessageData, path string, to []string) (email.EmailDetails, error) {
+	detected, _, err := format.Detect(path)
+	if err != nil {
+		return email.EmailDetails{}, fmt.Errorf("error while detecting file format, %w", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return email.EmailDetails{}, err
+	}
+	data.Format = string(detected)
+	data.Size = info.Size()
+
+	subject, body, err := templates.Render(data)
+	if err != nil {
+		return email.EmailDetails{}, err
+	}
+	return email.EmailDetails{
+		From:        config.From,
+		To:          to,
+		Subject:     subject,
+		Body:        body,
+		Attachments: []string{path},
+	}, nil
+}
+
+// printProgress returns a callback printing the download progress on stderr, at most every 500ms
+func printProgress() helper.ProgressFunc {
+	var last time.Time
+	return func(received, total int64) {
+		if time.Since(last) < 500*time.Millisecond && received != total {
+			return
+		}
+		last = time.Now()
+		const mb = 1024 * 1024
+		if total > 0 {
+			fmt.Fprintf(os.Stderr, "\rdownloading: %3d%% (%.1f/%.1f MB)", received*100/total, float64(received)/mb, float64(total)/mb)
+		} else {
+			fmt.Fprintf(os.Stderr, "\rdownloading: %.1f MB", float64(received)/mb)
+		}
+	}
+}
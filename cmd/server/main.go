@@ -1,24 +1,37 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/joho/godotenv"
 	"github.com/roshanlc/send-to-kindle/config"
 	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/delivery"
 	"github.com/roshanlc/send-to-kindle/internal/downloader"
+	"github.com/roshanlc/send-to-kindle/internal/email"
 	"github.com/roshanlc/send-to-kindle/internal/helper"
+	"github.com/roshanlc/send-to-kindle/internal/mailbox"
+	"github.com/roshanlc/send-to-kindle/internal/mailin"
+	"github.com/roshanlc/send-to-kindle/internal/oauth"
 	"github.com/roshanlc/send-to-kindle/internal/queue"
 	"github.com/roshanlc/send-to-kindle/internal/server"
+	"github.com/roshanlc/send-to-kindle/internal/submit"
+	"github.com/wneessen/go-mail"
 	_ "modernc.org/sqlite"
 )
 
@@ -27,10 +40,32 @@ const testURL = "https://libgen.li/ads.php?md5=7e5412b8ece1fe49f7bfbc6e5ab77809"
 // server will use a single mail client and send from it to the clients
 // just display the email from which it will be sent
 
-var templates = template.Must(template.ParseGlob("templates/*.html"))
+// pagesGlob locates the html templates, relative to the working directory
+const pagesGlob = "templates/*.html"
 
 const DBNAME = "kindle-server.db"
 
+// queueLease is how long a worker holds a task before it is handed to another worker
+const queueLease = 5 * time.Minute
+
+// defaults for optional config values
+const (
+	defaultWorkers         = 2
+	defaultPerHostLimit    = 1
+	defaultShutdownTimeout = 30 * time.Second
+	defaultMaxAttempts     = 5
+	defaultRetryBaseDelay  = time.Minute
+	defaultRetryMaxDelay   = time.Hour
+	// attachments grow by a third when base64 encoded, this keeps mails under the 50 MB Send to Kindle limit
+	defaultMaxAttachmentMB = 35
+	defaultMaxUploadMB     = 100
+	// one connection keeps bulk submissions from looking like a burst of logins to the provider
+	defaultSmtpPoolSize    = 1
+	defaultSmtpIdleTimeout = 2 * time.Minute
+	// Amazon replies within minutes, there is no hurry to see it
+	defaultImapPollInterval = 5 * time.Minute
+)
+
 func main() {
 	// setup logger
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
@@ -49,16 +84,27 @@ func main() {
 		return
 	}
 
+	pages, err := template.ParseGlob(pagesGlob)
+	if err != nil {
+		slog.Error("error while parsing html templates", slog.String("error", err.Error()))
+		return
+	}
+
 	// database setup
-	dbConn, err := sql.Open("sqlite", fmt.Sprint(filepath.Join(config.DBPath, DBNAME), "?_busy_timeout=5000&_journal_mode=WAL"))
+	dbConn, err := sql.Open("sqlite", fmt.Sprint(filepath.Join(config.DBPath, DBNAME), "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"))
 	if err != nil {
-		slog.Error(err.Error())
-	} else {
-		slog.Info("success at db connection")
-		fmt.Println(dbConn.Ping())
+		slog.Error("error while opening database", slog.String("error", err.Error()))
+		return
 	}
 	defer dbConn.Close()
 
+	err = dbConn.Ping()
+	if err != nil {
+		slog.Error("error while connecting to database", slog.String("error", err.Error()))
+		return
+	}
+	slog.Info("success at db connection")
+
 	db, err := database.New(dbConn)
 	if err != nil {
 		slog.Error(err.Error())
@@ -68,24 +114,37 @@ func main() {
 	slog.Info("attempting to setup database")
 	err = db.Setup()
 	if err != nil {
-		slog.Error(err.Error())
-	} else {
-		slog.Info("completed setup database")
+		slog.Error("error while setting up database", slog.String("error", err.Error()))
+		return
+	}
+	slog.Info("completed setup database")
 
+	err = ensureAdmin(db, &config)
+	if err != nil {
+		slog.Error("error while setting up the first admin", slog.String("error", err.Error()))
+		return
 	}
 
-	// task queue
-	q := queue.NewTaskQueue()
+	// task queue, persisted in the same database
+	q, err := queue.NewSQLiteQueue(dbConn, queueLease)
+	if err != nil {
+		slog.Error("error while setting up task queue", slog.String("error", err.Error()))
+		return
+	}
 
 	// cookie store
 	store := sessions.NewCookieStore([]byte(config.SecretKey))
 
+	// tasks from the dashboard and email-in are added the same way
+	submitter := submit.NewService(db, q, config.MaxUploadSize)
+
 	// start the server
 	svr := server.Server{
 		Config:      &config,
 		DB:          db,
-		Templates:   templates,
+		Templates:   pages,
 		TaskQueue:   q,
+		Submit:      submitter,
 		CookieStore: store,
 	}
 
@@ -97,26 +156,103 @@ func main() {
 
 	// set download directory
 	downloader.SetDownloadDirectory(config.STOREPATH)
+	downloader.SetHostLimit(config.PerHostLimit)
 
-	// fetch ongoing tasks from db and add to queue (remaining ones from last run)
-	tasks, err := db.ListTask([]database.TaskState{database.Pending, database.Ongoing})
+	err = downloader.SetLibgenMirrors(config.LibgenMirrors)
 	if err != nil {
-		slog.Error("error while fetching pending and ongoing tasks from db", slog.String("error", err.Error()))
-		slog.Warn("skipping adding leftover tasks due to error")
-	} else {
-		fmt.Println("leftover tasks:", tasks)
+		slog.Error("error while setting libgen mirrors", slog.String("error", err.Error()))
+		return
 	}
 
-	for _, t := range tasks {
-		u, err := helper.GetUUIDFromID(t.ID)
-		if err == nil {
-			// update corresponding taks status in db
-			_ = db.UpdateTask(database.Task{
-				ID:    t.ID,
-				State: database.Pending,
-			})
-			ta := queue.NewTask(u, t.URL)
-			q.Enqueue(ta)
+	// stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// oauth2 access tokens for XOAUTH2 smtp logins, renewed tokens are kept in the db
+	var tokens email.TokenSource
+	smtpOAuth := config.Delivery == email.DeliverySMTP && config.SmtpAuth == email.AuthXOAUTH2
+	imapOAuth := config.ImapHost != "" && config.ImapAuth == email.AuthXOAUTH2
+	if smtpOAuth || imapOAuth {
+		tokenStore, err := oauth.NewDBStore(db, config.SmtpUserID, config.SecretKey)
+		if err != nil {
+			slog.Error("error while setting up oauth2 token store", slog.String("error", err.Error()))
+			return
+		}
+		source, err := oauth.NewTokenSource(ctx, oauth.Config{
+			TokenURL:     config.OAuthTokenURL,
+			ClientID:     config.OAuthClientID,
+			ClientSecret: config.OAuthClientSecret,
+		}, tokenStore, config.OAuthRefreshToken)
+		if err != nil {
+			slog.Error("error while setting up oauth2 tokens", slog.String("error", err.Error()))
+			return
+		}
+		defer source.Close()
+		tokens = source
+	}
+
+	// delivery backend for the mails
+	tlsOptions := email.TLSOptions{
+		Mode:     config.SmtpTLS,
+		CAFile:   config.SmtpCAFile,
+		CertFile: config.SmtpCertFile,
+		KeyFile:  config.SmtpKeyFile,
+	}
+	sender, err := email.NewSender(email.Options{
+		Delivery:     config.Delivery,
+		Host:         config.SmtpHost,
+		Port:         config.SmtpPort,
+		Username:     config.SmtpUserID,
+		Password:     config.SmtpPassword,
+		Auth:         config.SmtpAuth,
+		Token:        tokens,
+		TLS:          tlsOptions,
+		PoolSize:     config.SmtpPoolSize,
+		IdleTimeout:  config.SmtpIdleTimeout,
+		SendmailPath: config.SendmailPath,
+		OutboxDir:    config.OutboxDir,
+	})
+	if err != nil {
+		slog.Error("error while setting up mail delivery", slog.String("error", err.Error()))
+		return
+	}
+
+	templates, err := email.NewTemplates(config.SubjectTemplate, config.BodyTemplate)
+	if err != nil {
+		slog.Error("error while parsing mail templates", slog.String("error", err.Error()))
+		return
+	}
+
+	p := newProcessor(&config, q, db, sender, templates)
+
+	// replies of Amazon in the sender mailbox confirm or reject deliveries
+	var poller *delivery.Poller
+	var mailIn *mailin.Poller
+	if config.ImapHost != "" {
+		imapConfig := mailbox.Config{
+			Host:     config.ImapHost,
+			Port:     config.ImapPort,
+			Username: config.ImapUserID,
+			Password: config.ImapPassword,
+			Auth:     config.ImapAuth,
+			Token:    tokens,
+			TLS:      email.TLSOptions{Mode: config.ImapTLS, CAFile: config.SmtpCAFile},
+			Mailbox:  config.ImapMailbox,
+		}
+		poller, err = delivery.NewPoller(imapConfig, db, config.ImapAuthServID, config.ImapPollInterval)
+		if err != nil {
+			slog.Error("error while setting up delivery confirmation", slog.String("error", err.Error()))
+			return
+		}
+
+		// links and books mailed to the server by the allowed senders become tasks
+		if len(config.AllowedSenders) > 0 {
+			imapConfig.Mailbox = config.SubmitMailbox
+			mailIn, err = mailin.NewPoller(imapConfig, db, submitter, config.AllowedSenders, config.ImapAuthServID, config.ImapPollInterval)
+			if err != nil {
+				slog.Error("error while setting up email-in", slog.String("error", err.Error()))
+				return
+			}
 		}
 	}
 
@@ -133,13 +269,118 @@ func main() {
 	go func() {
 		slog.Info("spinned up a goroutine for task queue processing")
 		defer wg.Done()
-		processTasks(&config, q, db)
+		p.run(ctx)
 	}()
+	if poller != nil {
+		wg.Add(1)
+		go func() {
+			slog.Info("spinned up a goroutine for delivery confirmation")
+			defer wg.Done()
+			poller.Run(ctx)
+		}()
+	}
+	if mailIn != nil {
+		wg.Add(1)
+		go func() {
+			slog.Info("spinned up a goroutine for email-in")
+			defer wg.Done()
+			mailIn.Run(ctx)
+		}()
+	}
+
+	<-ctx.Done()
+	slog.Info("shutting down, waiting for in-flight tasks", slog.String("timeout", config.ShutdownTimeout.String()))
+
+	// in-flight tasks that can't finish in time are handed back to the queue
+	timer := time.AfterFunc(config.ShutdownTimeout, p.abort)
+	defer timer.Stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	err = svr.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Error("error while shutting down server", slog.String("error", err.Error()))
+	}
 
 	wg.Wait()
+
+	// pooled smtp connections are logged out
+	if c, ok := sender.(io.Closer); ok {
+		_ = c.Close()
+	}
 	slog.Info("Exiting...")
 }
 
+// ensureAdmin makes sure there is an admin to manage the users. When there is none,
+// the user of USERNAME is made one, or created with PASSWORD if it does not exist.
+// That admin owns the tasks added before there were accounts, and the addresses of
+// SMTPTO become its default devices when it has none.
+func ensureAdmin(db *database.DB, config *config.ServerConfig) error {
+	admins, err := db.CountAdmins()
+	if err != nil {
+		return err
+	}
+	if admins > 0 {
+		return nil
+	}
+	if config.Username == "" || config.Password == "" {
+		return fmt.Errorf("there is no admin, please provide USERNAME and PASSWORD for the first one")
+	}
+
+	user, err := db.GetUserByEmail(config.Username)
+	switch {
+	case err == nil:
+		err = db.SetUserAdmin(user.ID, true)
+		if err == nil {
+			err = db.SetUserDisabled(user.ID, false)
+		}
+		if err != nil {
+			return fmt.Errorf("error while making user an admin, %w", err)
+		}
+		slog.Info("made user an admin", slog.String("email", user.Email))
+	case errors.Is(err, sql.ErrNoRows):
+		hash, err := helper.HashPassword(config.Password)
+		if err != nil {
+			return fmt.Errorf("error while hashing password, %w", err)
+		}
+		name, _, _ := strings.Cut(config.Username, "@")
+		user.ID, err = db.AddUser(database.User{
+			Name:     name,
+			Email:    config.Username,
+			Password: hash,
+			IsAdmin:  true,
+		})
+		if err != nil {
+			return fmt.Errorf("error while adding user, %w", err)
+		}
+		slog.Info("created admin user", slog.String("email", config.Username))
+	default:
+		return err
+	}
+
+	devices, err := db.ListDevices(user.ID)
+	if err != nil {
+		return fmt.Errorf("error while fetching devices of admin, %w", err)
+	}
+	if len(devices) == 0 {
+		for _, address := range config.SmtpTo {
+			_, err = db.AddDevice(database.Device{UserID: user.ID, Name: address, Email: address, IsDefault: true})
+			if err != nil {
+				return fmt.Errorf("error while adding device of admin, %w", err)
+			}
+		}
+	}
+
+	claimed, err := db.AssignUnownedTasks(user.ID)
+	if err != nil {
+		return fmt.Errorf("error while assigning tasks to user, %w", err)
+	}
+	if claimed > 0 {
+		slog.Info("assigned unowned tasks to admin", slog.String("email", config.Username), slog.Int64("tasks", claimed))
+	}
+	return nil
+}
+
 func readConfig() (config.ServerConfig, error) {
 	config := config.ServerConfig{}
 	err := godotenv.Load()
@@ -148,14 +389,56 @@ func readConfig() (config.ServerConfig, error) {
 	}
 
 	config.SmtpHost = os.Getenv("SMTPHOST")
-	smtpPort, err := strconv.Atoi(os.Getenv("SMTPPORT"))
+	config.SmtpPort, err = getEnvInt("SMTPPORT", 0) // only needed for smtp delivery
 	if err != nil {
 		return config, err
 	}
-	config.SmtpPort = smtpPort
 	config.SmtpUserID = os.Getenv("SMTPUSERID")
 	config.SmtpPassword = os.Getenv("SMTPPASSWORD")
 	config.SmtpFrom = os.Getenv("SMTPFROM")
+	config.SmtpAuth = strings.ToUpper(getEnvString("SMTPAUTH", email.AuthPlain))
+	config.SmtpTLS = strings.ToLower(getEnvString("SMTPTLS", email.TLSMandatory))
+	config.SmtpCAFile = os.Getenv("SMTPCAFILE")
+	config.SmtpCertFile = os.Getenv("SMTPCERTFILE")
+	config.SmtpKeyFile = os.Getenv("SMTPKEYFILE")
+	config.OAuthTokenURL = os.Getenv("OAUTHTOKENURL")
+	config.OAuthClientID = os.Getenv("OAUTHCLIENTID")
+	config.OAuthClientSecret = os.Getenv("OAUTHCLIENTSECRET")
+	config.OAuthRefreshToken = os.Getenv("OAUTHREFRESHTOKEN")
+	config.SubjectTemplate = os.Getenv("SUBJECTTEMPLATE")
+	config.BodyTemplate = os.Getenv("BODYTEMPLATE")
+	config.SmtpPoolSize, err = getEnvInt("SMTPPOOLSIZE", defaultSmtpPoolSize)
+	if err != nil {
+		return config, err
+	}
+	config.SmtpIdleTimeout, err = getEnvDuration("SMTPIDLETIMEOUT", defaultSmtpIdleTimeout)
+	if err != nil {
+		return config, err
+	}
+	config.ImapHost = os.Getenv("IMAPHOST")
+	config.ImapTLS = strings.ToLower(getEnvString("IMAPTLS", email.TLSImplicit))
+	defaultImapPort := 143
+	if config.ImapTLS == email.TLSImplicit {
+		defaultImapPort = 993
+	}
+	config.ImapPort, err = getEnvInt("IMAPPORT", defaultImapPort)
+	if err != nil {
+		return config, err
+	}
+	config.ImapUserID = getEnvString("IMAPUSERID", config.SmtpUserID)
+	config.ImapPassword = getEnvString("IMAPPASSWORD", config.SmtpPassword)
+	config.ImapAuth = strings.ToUpper(getEnvString("IMAPAUTH", email.AuthPlain))
+	config.ImapMailbox = getEnvString("IMAPMAILBOX", mailbox.DefaultMailbox)
+	config.ImapPollInterval, err = getEnvDuration("IMAPPOLLINTERVAL", defaultImapPollInterval)
+	if err != nil {
+		return config, err
+	}
+	config.ImapAuthServID = os.Getenv("IMAPAUTHSERVID")
+	config.AllowedSenders = getEnvList("ALLOWEDSENDERS")
+	config.SubmitMailbox = getEnvString("SUBMITMAILBOX", mailbox.DefaultMailbox)
+	config.Delivery = getEnvString("DELIVERY", email.DeliverySMTP)
+	config.SendmailPath = getEnvString("SENDMAILPATH", mail.SendmailPath)
+	config.OutboxDir = os.Getenv("OUTBOXDIR")
 	config.ServerPort = os.Getenv("SERVERPORT")
 	config.DBPath = os.Getenv("DBPATH")
 	config.STOREPATH = os.Getenv("STOREPATH")
@@ -163,16 +446,91 @@ func readConfig() (config.ServerConfig, error) {
 	config.Password = os.Getenv("PASSWORD")
 	config.SecretKey = os.Getenv("SECRETKEY")
 
-	to := os.Getenv("SMTPTO")
-	var emails []string
-	if to != "" {
-		val := strings.Split(strings.TrimSpace(to), ",")
-		for _, v := range val {
-			emails = append(emails, strings.TrimSpace(v))
-		}
-	}
+	config.SmtpTo = getEnvList("SMTPTO")
+	config.LibgenMirrors = getEnvList("LIBGENMIRRORS")
 
-	config.SmtpTo = emails
+	config.Workers, err = getEnvInt("WORKERS", defaultWorkers)
+	if err != nil {
+		return config, err
+	}
+	config.PerHostLimit, err = getEnvInt("PERHOSTLIMIT", defaultPerHostLimit)
+	if err != nil {
+		return config, err
+	}
+	config.ShutdownTimeout, err = getEnvDuration("SHUTDOWNTIMEOUT", defaultShutdownTimeout)
+	if err != nil {
+		return config, err
+	}
+	config.MaxAttempts, err = getEnvInt("MAXATTEMPTS", defaultMaxAttempts)
+	if err != nil {
+		return config, err
+	}
+	config.RetryBaseDelay, err = getEnvDuration("RETRYBASEDELAY", defaultRetryBaseDelay)
+	if err != nil {
+		return config, err
+	}
+	config.RetryMaxDelay, err = getEnvDuration("RETRYMAXDELAY", defaultRetryMaxDelay)
+	if err != nil {
+		return config, err
+	}
+	maxAttachmentMB, err := getEnvInt("MAXATTACHMENTSIZE", defaultMaxAttachmentMB)
+	if err != nil {
+		return config, err
+	}
+	config.MaxAttachmentSize = int64(maxAttachmentMB) << 20
+	maxUploadMB, err := getEnvInt("MAXUPLOADSIZE", defaultMaxUploadMB)
+	if err != nil {
+		return config, err
+	}
+	config.MaxUploadSize = int64(maxUploadMB) << 20
 
 	return config, nil
 }
+
+// getEnvString reads an env var, returning fallback if it is not set
+func getEnvString(key string, fallback string) string {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return fallback
+	}
+	return val
+}
+
+// getEnvList reads a comma separated env var
+func getEnvList(key string) []string {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return nil
+	}
+	var items []string
+	for _, v := range strings.Split(val, ",") {
+		items = append(items, strings.TrimSpace(v))
+	}
+	return items
+}
+
+// getEnvInt reads an integer env var, returning fallback if it is not set
+func getEnvInt(key string, fallback int) (int, error) {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return n, nil
+}
+
+// getEnvDuration reads a duration env var (e.g. 30s, 5m), returning fallback if it is not set
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return d, nil
+}
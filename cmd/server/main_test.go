@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/roshanlc/send-to-kindle/config"
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/database/dbtest"
+)
+
+func TestEnsureAdmin(t *testing.T) {
+	bootstrap := &config.ServerConfig{Username: "alice@example.com", Password: "s3cret pw", SmtpTo: []string{"alice@kindle.com"}}
+	tests := []struct {
+		name  string
+		users []database.User // present before the start
+		owner string          // email of the user expected to own the unowned tasks, none when empty
+	}{
+		{
+			name:  "no users",
+			owner: "alice@example.com",
+		},
+		{
+			name:  "user without admin role",
+			users: []database.User{{Name: "bob", Email: "bob@example.com", Password: "x"}, {Name: "alice", Email: "alice@example.com", Password: "x", Disabled: true}},
+			owner: "alice@example.com",
+		},
+		{
+			name:  "other users only",
+			users: []database.User{{Name: "bob", Email: "bob@example.com", Password: "x"}},
+			owner: "alice@example.com",
+		},
+		{
+			name:  "admin already",
+			users: []database.User{{Name: "bob", Email: "bob@example.com", Password: "x", IsAdmin: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := dbtest.New(t)
+			for _, user := range tt.users {
+				if _, err := db.AddUser(user); err != nil {
+					t.Fatal(err)
+				}
+			}
+			bob, bobErr := db.GetUserByEmail("bob@example.com")
+			tasks := map[string]int{"c0ffee00-0000-4000-8000-000000000001": 0}
+			if bobErr == nil {
+				tasks["c0ffee00-0000-4000-8000-000000000002"] = bob.ID
+			}
+			for id, owner := range tasks {
+				if err := db.AddTask(database.Task{ID: id, UserID: owner, URL: "https://example.com", State: database.Pending}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := ensureAdmin(db, bootstrap); err != nil {
+				t.Fatal(err)
+			}
+
+			wantOwner := 0
+			if tt.owner != "" {
+				admin, err := db.GetUserByEmail(tt.owner)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !admin.IsAdmin || admin.Disabled {
+					t.Fatalf("%s is admin %v, disabled %v", admin.Email, admin.IsAdmin, admin.Disabled)
+				}
+				wantOwner = admin.ID
+
+				devices, err := db.ListDefaultDevices(admin.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(devices) != 1 || devices[0].Email != "alice@kindle.com" {
+					t.Errorf("admin has devices %v, want the one of SMTPTO", devices)
+				}
+			}
+			if bobErr == nil {
+				devices, err := db.ListDevices(bob.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(devices) != 0 {
+					t.Errorf("bob got devices %v", devices)
+				}
+			}
+			tasks["c0ffee00-0000-4000-8000-000000000001"] = wantOwner
+			for id, want := range tasks {
+				task, err := db.GetTask(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if task.UserID != want {
+					t.Errorf("task %s is owned by %d, want %d", id, task.UserID, want)
+				}
+			}
+		})
+	}
+
+	db, _ := dbtest.New(t)
+	if err := ensureAdmin(db, &config.ServerConfig{}); err == nil {
+		t.Fatal("no admin and no USERNAME was accepted")
+	}
+}
@@ -2,114 +2,524 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
 	"time"
 
 	"github.com/roshanlc/send-to-kindle/config"
+	"github.com/roshanlc/send-to-kindle/internal/convert"
 	"github.com/roshanlc/send-to-kindle/internal/database"
 	"github.com/roshanlc/send-to-kindle/internal/downloader"
 	"github.com/roshanlc/send-to-kindle/internal/email"
+	"github.com/roshanlc/send-to-kindle/internal/format"
 	"github.com/roshanlc/send-to-kindle/internal/helper"
+	"github.com/roshanlc/send-to-kindle/internal/metadata"
 	"github.com/roshanlc/send-to-kindle/internal/queue"
+	"github.com/roshanlc/send-to-kindle/internal/retry"
+	"github.com/roshanlc/send-to-kindle/internal/shrink"
 	"resty.dev/v3"
 )
 
-func processTasks(config *config.ServerConfig, q *queue.TaskQueue, db *database.DB) {
+const progressInterval = time.Second // how often download progress is written to the db
+
+// noKindleErr fails the tasks of users without a default device
+var noKindleErr = errors.New("no Kindle address configured, add a default device to send to")
+
+// processor runs a pool of workers draining the task queue
+type processor struct {
+	config    *config.ServerConfig
+	queue     queue.Queue
+	db        *database.DB
+	client    *resty.Client
+	sender    email.Sender
+	templates *email.Templates // subject and body of the mails
+
+	workCtx context.Context    // context for in-flight tasks
+	abort   context.CancelFunc // cancels in-flight tasks
+}
+
+// newProcessor returns a processor for the given queue
+func newProcessor(config *config.ServerConfig, q queue.Queue, db *database.DB, sender email.Sender, templates *email.Templates) *processor {
 	client := resty.New().
 		SetRetryCount(2).
 		SetTimeout(3 * time.Minute)
 
-	defer client.Close() // clean up
+	workCtx, abort := context.WithCancel(context.Background())
+	return &processor{
+		config:    config,
+		queue:     q,
+		db:        db,
+		client:    client,
+		sender:    sender,
+		templates: templates,
+		workCtx:   workCtx,
+		abort:     abort,
+	}
+}
 
-	for {
-		task := q.Dequeue()
-		slog.Info("taking up task", slog.String("taskID", task.ID.String()))
+// run starts the workers and blocks until all of them have exited.
+// Workers stop taking up new tasks once ctx is done, tasks in flight are
+// allowed to finish unless the processor is aborted.
+func (p *processor) run(ctx context.Context) {
+	defer p.client.Close() // clean up
+
+	var wg sync.WaitGroup
+	for i := range p.config.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slog.Info("started task worker", slog.Int("worker", i))
+			p.work(ctx)
+			slog.Info("stopped task worker", slog.Int("worker", i))
+		}()
+	}
+	wg.Wait()
+}
 
-		ctx := helper.NewContextWithUUID(context.Background(), task.ID)
-		taskDB, err := db.GetTask(task.ID.String()) // get task item from db
-		// TODO: add failure state to task and maybe re-add to queue again ?? also how to handle error of failure state update
+// work takes up tasks from the queue one at a time until ctx is done
+func (p *processor) work(ctx context.Context) {
+	for {
+		task, err := p.queue.Dequeue(ctx)
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
-			slog.Error("error occured while fetching task from db", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
+			slog.Error("error occured while dequeuing task", slog.String("error", err.Error()))
+			time.Sleep(time.Second)
 			continue
 		}
 
-		// skip the task if the state is not pending
-		if taskDB.State != database.Pending {
-			slog.Info("task skipped as it was not pending", slog.String("taskID", task.ID.String()))
-			continue
+		slog.Info("taking up task", slog.String("taskID", task.ID.String()))
+
+		stop := keepClaim(p.queue, task)
+		err = recoverPanic(func() error {
+			return p.processTask(task)
+		})
+		stop()
+
+		switch {
+		case p.workCtx.Err() != nil:
+			// task was interrupted, hand it back to the queue
+			slog.Info("requeuing interrupted task", slog.String("taskID", task.ID.String()))
+			p.requeue(task, 0, "")
+		case err != nil:
+			p.handleFailure(task, err)
+		default:
+			p.ack(task)
 		}
+	}
+}
 
-		taskDB.State = database.Ongoing
-		err = db.UpdateTask(taskDB)
-		if err != nil {
-			slog.Error("process failed while updating task state to ongoing", slog.Any("taskID", task.ID.String()), slog.String("error", err.Error()))
+// recoverPanic runs fn, returning a panic as an error so that a task tripping a bug
+// fails on its own instead of taking down the worker
+func recoverPanic(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("recovered from panic while processing task", slog.Any("panic", r), slog.String("stack", string(debug.Stack())))
+			err = fmt.Errorf("error while processing task: %v", r)
 		}
+	}()
+	return fn()
+}
 
-		filename, ctx, err := downloader.Process(ctx, client, task.URL)
+// handleFailure schedules a retry for transient errors, the task is marked as failed
+// for permanent errors or moved to the dead-letter state once it runs out of attempts.
+func (p *processor) handleFailure(task queue.Task, taskErr error) {
+	slog.Error("task failed", slog.String("taskID", task.ID.String()), slog.String("error", taskErr.Error()))
 
+	taskDB, err := p.db.GetTask(task.ID.String())
+	if errors.Is(err, sql.ErrNoRows) {
+		p.ack(task) // deleted, nothing left to retry
+		return
+	}
+	if err != nil {
+		// the task can't be marked, leave it in the queue to be taken up again later
+		slog.Error("error occured while fetching task from db", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
+		err = p.queue.Release(task, p.config.RetryBaseDelay)
 		if err != nil {
-			slog.Error("error occured while downloading for task", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
-			continue
+			slog.Error("error occured while releasing task", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
 		}
+		return
+	}
+
+	transient := retry.IsTransient(taskErr)
+	if transient && taskDB.Attempts < p.config.MaxAttempts {
+		delay := retry.Backoff(taskDB.Attempts, p.config.RetryBaseDelay, p.config.RetryMaxDelay)
+		slog.Info("scheduling retry for task", slog.String("taskID", task.ID.String()),
+			slog.Int("attempts", taskDB.Attempts), slog.String("delay", delay.String()))
+		p.requeue(task, delay, taskErr.Error())
+		return
+	}
+
+	state := database.Failed
+	if transient {
+		state = database.Dead
+	}
+	err = p.db.UpdateTask(database.Task{
+		ID:       task.ID.String(),
+		State:    state,
+		ErrorMsg: taskErr.Error(),
+	})
+	if err != nil {
+		slog.Error("process failed while updating task state to failure", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
+	}
+	p.cleanup(task) // partial downloads are of no use anymore
+	p.deleteUpload(task)
+	p.ack(task)
+}
+
+// cleanup deletes the files of a task
+func (p *processor) cleanup(task queue.Task) {
+	slog.Info("attempting to delete task files", slog.String("taskID", task.ID.String()))
+	err := downloader.DeleteTaskDirectory(task.ID.String())
+	if err != nil {
+		slog.Error("error while deleting task files", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
+	}
+}
+
+// deleteUpload deletes the uploaded file of a task once it won't be sent anymore
+func (p *processor) deleteUpload(task queue.Task) {
+	err := downloader.DeleteUploadDirectory(task.ID.String())
+	if err != nil {
+		slog.Error("error while deleting uploaded file", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
+	}
+}
+
+// requeue resets a task to pending and releases it back to the queue after delay
+func (p *processor) requeue(task queue.Task, delay time.Duration, errMsg string) {
+	update := database.Task{
+		ID:       task.ID.String(),
+		State:    database.Pending,
+		ErrorMsg: errMsg,
+	}
+	if delay > 0 {
+		update.NextAttemptAt = time.Now().Add(delay)
+	}
+	err := p.db.UpdateTask(update)
+	if err != nil {
+		slog.Error("error occured while updating task state to pending", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
+	}
+
+	err = p.queue.Release(task, delay)
+	if err != nil {
+		slog.Error("error occured while releasing task", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
+	}
+}
+
+// ack removes a finished task from the queue
+func (p *processor) ack(task queue.Task) {
+	err := p.queue.Ack(task)
+	if err != nil {
+		slog.Error("error occured while acking task", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
+	}
+}
+
+// processTask downloads, converts if needed and emails the file for a single task
+func (p *processor) processTask(task queue.Task) error {
+	ctx := helper.NewContextWithUUID(p.workCtx, task.ID)
+	taskDB, err := p.db.GetTask(task.ID.String()) // get task item from db
+	if errors.Is(err, sql.ErrNoRows) {
+		// deleted along with its owner
+		slog.Info("task skipped as it was deleted", slog.String("taskID", task.ID.String()))
+		p.deleteUpload(task)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error occured while fetching task from db: %w", err)
+	}
+
+	// skip the task if it is already finished (or cancelled). An ongoing task means
+	// the previous claim expired before it could be completed, so it is picked up again.
+	if taskDB.State != database.Pending && taskDB.State != database.Ongoing {
+		slog.Info("task skipped as it was not pending", slog.String("taskID", task.ID.String()))
+		p.deleteUpload(task) // a cancelled upload is not sent anymore
+		return nil
+	}
+
+	attempts, err := p.db.IncrementTaskAttempts(task.ID.String())
+	if err != nil {
+		return fmt.Errorf("error occured while updating task attempts: %w", err)
+	}
+
+	err = p.db.UpdateTask(database.Task{
+		ID:    task.ID.String(),
+		State: database.Ongoing,
+	})
+	if errors.Is(err, database.ErrNoRowUpdated) {
+		// deleted since it was fetched, ongoing tasks can't be deleted from now on
+		slog.Info("task skipped as it was deleted", slog.String("taskID", task.ID.String()))
+		p.deleteUpload(task)
+		return nil
+	}
+	if err != nil {
+		slog.Error("process failed while updating task state to ongoing", slog.Any("taskID", task.ID.String()), slog.String("error", err.Error()))
+	}
+
+	var filename string
+	if taskDB.LocalFile != "" {
+		// uploaded and mailed in books are already here
+		slog.Info("using uploaded file for task", slog.String("taskID", task.ID.String()), slog.Int("attempt", attempts))
+		filename, ctx, err = downloader.ProcessFile(ctx, taskDB.LocalFile)
+	} else {
+		slog.Info("downloading file for task", slog.String("taskID", task.ID.String()), slog.Int("attempt", attempts))
+		ctx = helper.NewContextWithProgress(ctx, p.progressReporter(task.ID.String()))
+		filename, ctx, err = downloader.Process(ctx, p.client, task.URL)
+	}
+	if err != nil {
+		return fmt.Errorf("error occured while downloading: %w", err)
+	}
 
-		taskDB, err = db.GetTask(task.ID.String()) // get task item from db
+	// delete the file once done, a retry downloads it again
+	path := helper.GetFilepathFromContext(ctx)
+	defer p.cleanup(task)
+
+	// formats Send to Kindle does not accept, or which the user asked for, are converted
+	path, err = convert.Convert(ctx, path, format.Format(taskDB.TargetFormat))
+	if err != nil {
+		return fmt.Errorf("error occured while converting: %w", err)
+	}
+	filename = filepath.Base(path)
+
+	p.updateMetadata(task, path, filename)
+	if updated, err := p.db.GetTask(task.ID.String()); err == nil {
+		taskDB = updated // title and author for the mail
+	}
+
+	// books over the attachment size limit are recompressed or split into parts
+	paths, err := shrink.Fit(ctx, path, p.config.MaxAttachmentSize)
+	if err != nil {
+		return fmt.Errorf("error occured while fitting file within attachment size: %w", err)
+	}
+
+	completed := database.Task{
+		ID:    task.ID.String(),
+		State: database.Completed,
+	}
+	if len(paths) > 1 {
+		err = p.sendParts(ctx, taskDB, paths)
 		if err != nil {
-			slog.Error("error occured while fetching task from db", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
-			continue
+			return err
 		}
-		taskDB.Title = filename
-		taskDB.State = database.Ongoing
-		err = db.UpdateTask(taskDB)
+	} else {
+		slog.Info("attempting to email downloaded file", slog.Any("taskID", task.ID.String()))
+		details, err := p.emailDetails(taskDB, paths[0], 0, 0)
 		if err != nil {
-			slog.Error("process failed while updating task title", slog.Any("taskID", task.ID.String()), slog.String("error", err.Error()))
+			return err
 		}
-
-		// fetch again
-		taskDB, err = db.GetTask(task.ID.String()) // get task item from db
+		details.MessageID = email.NewMessageID(taskDB.ID, details.From)
+		err = p.sender.Send(ctx, details)
 		if err != nil {
-			slog.Error("error occured while fetching task from db", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
-			continue
+			return fmt.Errorf("process failed while sending email: %w", err)
 		}
+		// replies of Amazon refer to the Message-ID, see the delivery package
+		completed.MessageID = details.MessageID
+		completed.DeliveryStatus = database.DeliverySent
+	}
 
-		slog.Info("attempting to email downloaded file", slog.Any("taskID", task.ID.String()))
+	err = p.db.UpdateTask(completed)
+	if err != nil {
+		slog.Error("process failed while updating task state to completion", slog.Any("taskID", task.ID.String()), slog.String("error", err.Error()))
+	}
+	p.deleteUpload(task)
+	return nil
+}
 
-		details := email.EmailDetails{
-			From:        config.SmtpFrom,
-			To:          config.SmtpTo,
-			Host:        config.SmtpHost,
-			Port:        config.SmtpPort,
-			Subject:     helper.GetIDFromContext(ctx).String(),
-			Body:        "Save the attached file(s).",
-			Attachments: []string{helper.GetFilepathFromContext(ctx)},
-			Username:    config.SmtpUserID,
-			Password:    config.SmtpPassword,
-		}
+// emailDetails returns the mail carrying a file of a task to the devices it was submitted
+// for, part and parts number the file when the book was split
+func (p *processor) emailDetails(taskDB database.Task, path string, part, parts int) (email.EmailDetails, error) {
+	detected, _, err := format.Detect(path)
+	if err != nil {
+		return email.EmailDetails{}, fmt.Errorf("error while detecting file format, %w", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return email.EmailDetails{}, err
+	}
 
-		err = email.Send(ctx, details)
+	subject, body, err := p.templates.Render(email.MessageData{
+		ID:      taskDB.ID,
+		Title:   taskDB.Title,
+		Author:  taskDB.Author,
+		URL:     taskDB.URL,
+		AddedAt: taskDB.AddedAt,
+		Format:  string(detected),
+		Size:    info.Size(),
+		Part:    part,
+		Parts:   parts,
+	})
+	if err != nil {
+		return email.EmailDetails{}, err
+	}
+	if taskDB.ConvertPDF && detected == format.PDF {
+		subject = email.ConvertSubject
+	}
+
+	to, err := p.recipients(taskDB)
+	if err != nil {
+		return email.EmailDetails{}, err
+	}
+
+	return email.EmailDetails{
+		From:        p.config.SmtpFrom,
+		To:          to,
+		Subject:     subject,
+		Body:        body,
+		Attachments: []string{path},
+	}, nil
+}
+
+// recipients returns the Kindle addresses a task was submitted for. Older tasks, and
+// the ones submitted before their owner added a device, go to the default devices of
+// the owner.
+func (p *processor) recipients(taskDB database.Task) ([]string, error) {
+	if len(taskDB.SendTo) > 0 {
+		return taskDB.SendTo, nil
+	}
+	devices, err := p.db.ListDefaultDevices(taskDB.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("error occured while fetching devices of task owner from db: %w", err)
+	}
+	var to []string
+	for _, device := range devices {
+		to = append(to, device.Email)
+	}
+	if len(to) == 0 {
+		return nil, noKindleErr
+	}
+	return to, nil
+}
+
+// sendParts emails each part of a split book on its own, tracking the parts as child
+// tasks of the task. Parts sent by an earlier attempt are not sent again, unless the
+// book was split differently this time.
+func (p *processor) sendParts(ctx context.Context, taskDB database.Task, paths []string) error {
+	parts, err := p.db.ListTaskParts(taskDB.ID)
+	if err != nil {
+		return fmt.Errorf("error occured while fetching task parts from db: %w", err)
+	}
+	if len(parts) != len(paths) {
+		parts = parts[:0]
+		for i, path := range paths {
+			parts = append(parts, database.Task{
+				ID:       helper.GenerateID().String(),
+				UserID:   taskDB.UserID,
+				URL:      taskDB.URL,
+				Title:    filepath.Base(path),
+				State:    database.Pending,
+				ParentID: taskDB.ID,
+				Part:     i + 1,
+			})
+		}
+		// a task deleted in the meantime fails here, and is dropped by handleFailure
+		err = p.db.ReplaceTaskParts(taskDB.ID, parts)
 		if err != nil {
-			slog.Error("process failed while sending email", slog.Any("taskID", task.ID.String()), slog.String("error", err.Error()))
-			taskDB.State = database.Failed
-			taskDB.ErrorMsg = err.Error()
-			err := db.UpdateTask(taskDB)
-			if err != nil {
-				slog.Error("process failed while updating task state to failure", slog.Any("taskID", task.ID.String()), slog.String("error", err.Error()))
-			}
+			return fmt.Errorf("error occured while adding task parts to db: %w", err)
+		}
+	}
+
+	for i, path := range paths {
+		part := parts[i]
+		if part.State == database.Completed {
+			slog.Info("skipping part sent by an earlier attempt", slog.String("taskID", taskDB.ID), slog.Int("part", part.Part))
 			continue
 		}
 
-		taskDB.State = database.Completed
-		err = db.UpdateTask(taskDB)
+		slog.Info("attempting to email part of downloaded file", slog.String("taskID", taskDB.ID), slog.Int("part", part.Part), slog.Int("parts", len(paths)))
+		details, err := p.emailDetails(taskDB, path, part.Part, len(paths))
+		if err == nil {
+			details.MessageID = email.NewMessageID(part.ID, details.From)
+			err = p.sender.Send(ctx, details)
+		}
 		if err != nil {
-			slog.Error("process failed while updating task state to completion", slog.Any("taskID", task.ID.String()), slog.String("error", err.Error()))
+			p.updatePart(database.Task{ID: part.ID, State: database.Failed, ErrorMsg: err.Error()})
+			return fmt.Errorf("process failed while sending part %d of %d: %w", part.Part, len(paths), err)
 		}
+		p.updatePart(database.Task{ID: part.ID, State: database.Completed, MessageID: details.MessageID, DeliveryStatus: database.DeliverySent})
+	}
+	return nil
+}
 
-		// delete the file now
-		path := helper.GetFilepathFromContext(ctx)
-		slog.Info("attempting to deleted downloaded file", slog.Any("taskID", task.ID.String()), slog.String("filepath", path))
-		err = downloader.DeleteDownloadedFile(path)
+// updatePart records the state of a part
+func (p *processor) updatePart(part database.Task) {
+	err := p.db.UpdateTask(part)
+	if err != nil {
+		slog.Error("error occured while updating task part state", slog.String("partID", part.ID), slog.String("error", err.Error()))
+	}
+}
+
+// updateMetadata stores the book details read from the downloaded file,
+// the filename is used as title when the file has none
+func (p *processor) updateMetadata(task queue.Task, path string, filename string) {
+	details := database.Task{
+		ID:    task.ID.String(),
+		Title: filename,
+	}
+	var cover []byte
+	var coverType string
+
+	detected, _, err := format.Detect(path)
+	if err == nil {
+		var meta metadata.Metadata
+		meta, err = metadata.Extract(path, detected)
+		if err == nil {
+			if meta.Title != "" {
+				details.Title = meta.Title
+			}
+			details.Author = meta.Author()
+			details.Language = meta.Language
+			details.Publisher = meta.Publisher
+			cover, coverType = meta.Cover, meta.CoverType
+		}
+	}
+	if err != nil && !errors.Is(err, metadata.UnsupportedErr) {
+		slog.Warn("could not extract book metadata", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
+	}
+
+	err = p.db.UpdateTaskMetadata(details, cover, coverType)
+	if err != nil {
+		slog.Error("process failed while updating task metadata", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
+	}
+}
+
+// progressReporter returns a callback recording the download progress of a task in the db,
+// writes are throttled to one per progressInterval
+func (p *processor) progressReporter(taskID string) helper.ProgressFunc {
+	var last time.Time
+	return func(received, total int64) {
+		if time.Since(last) < progressInterval && received != total {
+			return
+		}
+		last = time.Now()
+		err := p.db.UpdateTaskProgress(taskID, received, total)
 		if err != nil {
-			slog.Error("error while deleting downloaded file", slog.Any("taskID", task.ID.String()), slog.String("error", err.Error()),
-				slog.String("filepath", path))
+			slog.Warn("error occured while updating task progress", slog.String("taskID", taskID), slog.String("error", err.Error()))
 		}
 	}
 }
+
+// keepClaim periodically extends the claim on a task until the returned func is called
+func keepClaim(q queue.Queue, task queue.Task) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(queueLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := q.Extend(task)
+				if err != nil {
+					slog.Error("error occured while extending task claim", slog.String("taskID", task.ID.String()), slog.String("error", err.Error()))
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
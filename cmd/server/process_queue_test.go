@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roshanlc/send-to-kindle/config"
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/database/dbtest"
+	"github.com/roshanlc/send-to-kindle/internal/downloader"
+	"github.com/roshanlc/send-to-kindle/internal/email"
+	"github.com/roshanlc/send-to-kindle/internal/queue"
+)
+
+// panickySender panics on its first mail, as a bug hit by one book would
+type panickySender struct {
+	mu   sync.Mutex
+	sent []email.EmailDetails
+}
+
+func (s *panickySender) Send(ctx context.Context, details email.EmailDetails) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sent) == 0 {
+		s.sent = append(s.sent, email.EmailDetails{})
+		panic("boom")
+	}
+	s.sent = append(s.sent, details)
+	return nil
+}
+
+func TestWorkRecoversFromPanic(t *testing.T) {
+	sender := &panickySender{}
+	p, addTask := testProcessor(t, 1, sender)
+	first, second := addTask(), addTask()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitState := func(id uuid.UUID, want database.TaskState) database.Task {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			task, err := p.db.GetTask(id.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if task.State == want {
+				return task
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("task %s is %s, want %s", id, task.State, want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	failed := waitState(first, database.Failed)
+	if failed.ErrorMsg == "" {
+		t.Error("panicked task has no error message")
+	}
+	// the worker is still around to take up the next task
+	waitState(second, database.Completed)
+}
+
+// recordingQueue records what became of the tasks handed back to it
+type recordingQueue struct {
+	queue.TaskQueue
+	mu       sync.Mutex
+	acked    []uuid.UUID
+	released []uuid.UUID
+}
+
+func (q *recordingQueue) Ack(task queue.Task) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.acked = append(q.acked, task.ID)
+	return nil
+}
+
+func (q *recordingQueue) Release(task queue.Task, delay time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.released = append(q.released, task.ID)
+	return nil
+}
+
+func TestHandleFailureKeepsTaskWhenDBFails(t *testing.T) {
+	db, dbConn := dbtest.New(t)
+	q := &recordingQueue{}
+	p := newProcessor(&config.ServerConfig{MaxAttempts: 3, RetryBaseDelay: time.Second}, q, db, nil, nil)
+
+	// a task deleted in the meantime is dropped from the queue
+	deleted := queue.NewTask(uuid.New(), "https://example.com/book.epub")
+	p.handleFailure(deleted, errors.New("not found"))
+	if len(q.acked) != 1 || q.acked[0] != deleted.ID {
+		t.Fatalf("acked %v, want the deleted task", q.acked)
+	}
+
+	// the task can't be marked failed, so it must stay claimable
+	dbConn.Close()
+	task := queue.NewTask(uuid.New(), "https://example.com/book.epub")
+	p.handleFailure(task, errors.New("not found"))
+	if len(q.acked) != 1 {
+		t.Fatalf("task was acked while its state could not be read")
+	}
+	if len(q.released) != 1 || q.released[0] != task.ID {
+		t.Fatalf("released %v, want the task", q.released)
+	}
+}
+
+// gatedSender holds each mail until it is let through, or the context is done
+type gatedSender struct {
+	started chan string // subject of each mail being sent
+	proceed chan struct{}
+}
+
+func (s *gatedSender) Send(ctx context.Context, details email.EmailDetails) error {
+	s.started <- details.Subject
+	select {
+	case <-s.proceed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// testProcessor returns a processor of workers over a fresh queue, and adds
+// uploaded tasks to it
+func testProcessor(t *testing.T, workers int, sender email.Sender) (*processor, func() uuid.UUID) {
+	t.Helper()
+	dir := t.TempDir()
+	downloader.SetDownloadDirectory(filepath.Join(dir, "downloads"))
+
+	db, dbConn := dbtest.New(t)
+	q, err := queue.NewSQLiteQueue(dbConn, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := email.NewTemplates("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newProcessor(&config.ServerConfig{
+		SmtpFrom:          "books@example.com",
+		Workers:           workers,
+		MaxAttempts:       3,
+		MaxAttachmentSize: 25 << 20,
+	}, q, db, sender, templates)
+
+	// uploaded books need no network
+	book := []byte("%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\ntrailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	addTask := func() uuid.UUID {
+		id := uuid.New()
+		path := filepath.Join(dir, "uploads", id.String(), "book.pdf")
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, book, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		err := db.AddTask(database.Task{
+			ID:        id.String(),
+			URL:       "upload:book.pdf",
+			State:     database.Pending,
+			LocalFile: path,
+			SendTo:    []string{"reader@kindle.com"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Enqueue(queue.NewTask(id, "upload:book.pdf")); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	return p, addTask
+}
+
+// waitSends waits for n mails to be in flight at once
+func waitSends(t *testing.T, sender *gatedSender, n int) {
+	t.Helper()
+	for range n {
+		select {
+		case <-sender.started:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("fewer than %d mails were sent at once", n)
+		}
+	}
+}
+
+func TestWorkersRunConcurrently(t *testing.T) {
+	sender := &gatedSender{started: make(chan string, 3), proceed: make(chan struct{})}
+	p, addTask := testProcessor(t, 2, sender)
+	ids := []uuid.UUID{addTask(), addTask(), addTask()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx)
+		close(done)
+	}()
+
+	// both workers are busy at once, the third task waits for one of them
+	waitSends(t, sender, 2)
+	select {
+	case <-sender.started:
+		t.Fatal("more tasks in flight than workers")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(sender.proceed)
+	waitSends(t, sender, 1)
+
+	cancel()
+	<-done
+	for _, id := range ids {
+		task, err := p.db.GetTask(id.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.State != database.Completed {
+			t.Errorf("task %s is %s, want completed", id, task.State)
+		}
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	t.Run("in flight task finishes", func(t *testing.T) {
+		sender := &gatedSender{started: make(chan string, 2), proceed: make(chan struct{})}
+		p, addTask := testProcessor(t, 1, sender)
+		first, second := addTask(), addTask()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			p.run(ctx)
+			close(done)
+		}()
+		waitSends(t, sender, 1)
+
+		// no new task is taken up once stopped, the one in flight is waited for
+		cancel()
+		select {
+		case <-done:
+			t.Fatal("workers exited before the task in flight finished")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(sender.proceed)
+		<-done
+
+		tests := map[uuid.UUID]database.TaskState{first: database.Completed, second: database.Pending}
+		for id, want := range tests {
+			task, err := p.db.GetTask(id.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if task.State != want {
+				t.Errorf("task %s is %s, want %s", id, task.State, want)
+			}
+		}
+	})
+
+	t.Run("aborted task is requeued", func(t *testing.T) {
+		sender := &gatedSender{started: make(chan string, 2), proceed: make(chan struct{})}
+		p, addTask := testProcessor(t, 1, sender)
+		id := addTask()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			p.run(ctx)
+			close(done)
+		}()
+		waitSends(t, sender, 1)
+		cancel()
+		p.abort()
+		<-done
+
+		task, err := p.db.GetTask(id.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.State != database.Pending || task.ErrorMsg != "" {
+			t.Fatalf("aborted task is %s with %q, want pending", task.State, task.ErrorMsg)
+		}
+		// the task is claimable again
+		claimCtx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+		defer stop()
+		claimed, err := p.queue.Dequeue(claimCtx)
+		if err != nil || claimed.ID != id {
+			t.Fatalf("dequeued %v, %v, want the aborted task", claimed.ID, err)
+		}
+	})
+}
+
+func TestRecoverPanic(t *testing.T) {
+	err := recoverPanic(func() error { panic("boom") })
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("got %v for a panic, want an error naming it", err)
+	}
+	want := errors.New("failed")
+	if err := recoverPanic(func() error { return want }); err != want {
+		t.Fatalf("got %v, want the error returned", err)
+	}
+	if err := recoverPanic(func() error { return nil }); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	p, _ := testProcessor(t, 1, &panickySender{})
+	p.config.SmtpTo = []string{"admin@kindle.com"} // only ever seeds the devices of the first admin
+
+	withDevice, err := p.db.AddUser(database.User{Name: "alice", Email: "alice@example.com", Password: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, device := range []database.Device{
+		{UserID: withDevice, Name: "Paperwhite", Email: "alice@kindle.com", IsDefault: true},
+		{UserID: withDevice, Name: "Scribe", Email: "scribe@kindle.com"},
+	} {
+		if _, err := p.db.AddDevice(device); err != nil {
+			t.Fatal(err)
+		}
+	}
+	withoutDevice, err := p.db.AddUser(database.User{Name: "bob", Email: "bob@example.com", Password: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		task database.Task
+		want []string // none when the task fails
+	}{
+		{"picked devices", database.Task{UserID: withoutDevice, SendTo: []string{"picked@kindle.com"}}, []string{"picked@kindle.com"}},
+		{"default devices of the owner", database.Task{UserID: withDevice}, []string{"alice@kindle.com"}},
+		{"owner without devices", database.Task{UserID: withoutDevice}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.recipients(tt.task)
+			if tt.want == nil {
+				if !errors.Is(err, noKindleErr) {
+					t.Fatalf("got %v, %v, want %v", got, err, noKindleErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendPartsOfDeletedTask(t *testing.T) {
+	sender := &panickySender{}
+	p, _ := testProcessor(t, 1, sender)
+	taskDB := database.Task{ID: uuid.NewString(), URL: "https://example.com/big.epub", State: database.Ongoing}
+	if err := p.db.AddTask(taskDB); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.db.DeleteTask(taskDB.ID); !errors.Is(err, database.ErrNoRowDeleted) {
+		t.Fatalf("deleting an ongoing task gave %v", err)
+	}
+
+	// a worker which fetched the task before it was deleted goes on to split it
+	if err := p.db.UpdateTask(database.Task{ID: taskDB.ID, State: database.Pending}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.db.DeleteTask(taskDB.ID); err != nil {
+		t.Fatal(err)
+	}
+	err := p.sendParts(context.Background(), taskDB, []string{"big-1.epub", "big-2.epub"})
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("got %v, want the task to be missing", err)
+	}
+	if len(sender.sent) != 0 {
+		t.Fatalf("%d parts were sent", len(sender.sent))
+	}
+	parts, err := p.db.ListTaskParts(taskDB.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 0 {
+		t.Fatalf("%d parts were left behind", len(parts))
+	}
+}
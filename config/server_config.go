@@ -3,6 +3,10 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/email"
 )
 
 // holds the necessary configuration details for the server to operate
@@ -13,12 +17,58 @@ type ServerConfig struct {
 	SmtpUserID   string
 	SmtpPassword string
 	SmtpTo       []string
+	Delivery     string // smtp, sendmail or outbox
+	SendmailPath string // sendmail binary, for sendmail delivery
+	OutboxDir    string // directory mails are written to, for outbox delivery
 	ServerPort   string
 	DBPath       string // location to store sqlite db
 	STOREPATH    string // location to store downloaded files
-	Username     string // server login credentials
-	Password     string // server login credentials
+	Username     string // email of the user created when there are none yet
+	Password     string // password of that user
 	SecretKey    string // secret for hashing cookies
+
+	SubjectTemplate string // text/template of the mail subject, task id by default
+	BodyTemplate    string // text/template of the mail body
+
+	SmtpAuth          string // PLAIN, LOGIN, CRAM-MD5 or XOAUTH2
+	OAuthTokenURL     string // token endpoint of the provider, for XOAUTH2
+	OAuthClientID     string
+	OAuthClientSecret string
+	OAuthRefreshToken string // stored encrypted in the db on first start, renewed tokens are kept there
+
+	SmtpTLS      string // mandatory, opportunistic, implicit or none
+	SmtpCAFile   string // PEM bundle trusted in addition to the system roots
+	SmtpCertFile string // PEM client certificate
+	SmtpKeyFile  string // PEM key of the client certificate
+
+	SmtpPoolSize    int           // smtp connections kept open between mails, 0 connects for every mail
+	SmtpIdleTimeout time.Duration // pooled smtp connections unused for this long are closed
+
+	ImapHost         string        // imap server of the sender mailbox, empty disables delivery confirmation
+	ImapPort         int           // 993 for implicit tls, 143 otherwise
+	ImapUserID       string        // SMTPUSERID by default
+	ImapPassword     string        // SMTPPASSWORD by default
+	ImapAuth         string        // PLAIN or XOAUTH2, which uses the oauth2 details of the smtp login
+	ImapTLS          string        // implicit, mandatory (STARTTLS) or none, trusts SMTPCAFILE too
+	ImapMailbox      string        // mailbox Amazon replies arrive in
+	ImapPollInterval time.Duration // time between checks of the mailbox
+	ImapAuthServID   string        // authserv-id in the Authentication-Results headers of the receiving server, e.g. mx.google.com
+
+	AllowedSenders []string // addresses, or @domains, whose mail to SubmitMailbox becomes tasks; empty disables email-in
+	SubmitMailbox  string   // imap mailbox read for mailed in links and books, not ImapMailbox
+	MaxUploadSize  int64    // bytes, larger uploaded or mailed in books are rejected
+
+	LibgenMirrors []string // equivalent libgen sites to fall back to, e.g. https://libgen.li
+
+	Workers         int           // number of tasks processed concurrently
+	PerHostLimit    int           // max downloads from the same host at once, 0 for no limit
+	ShutdownTimeout time.Duration // time given to in-flight tasks to finish on shutdown
+
+	MaxAttempts    int           // attempts made for a task before it is moved to dead-letter state
+	RetryBaseDelay time.Duration // delay before the first retry, doubled on every attempt
+	RetryMaxDelay  time.Duration // upper bound of the retry delay
+
+	MaxAttachmentSize int64 // bytes, larger files are recompressed or split into parts before sending
 }
 
 // Verify checks the values
@@ -46,17 +96,124 @@ func (c *ServerConfig) Verify() error {
 		}
 	}
 
-	if c.Username == "" {
-		return fmt.Errorf("Server credentials (USERNAME) cannot be emtpy.")
-	}
-
-	if c.Password == "" {
-		return fmt.Errorf("Server credentials (PASSWORD) cannot be emtpy.")
+	if (c.Username == "") != (c.Password == "") {
+		return fmt.Errorf("Server credentials (USERNAME and PASSWORD) should be given together.")
 	}
 
 	if c.SecretKey == "" {
 		return fmt.Errorf("SECRETKEY cannot be emtpy.")
 	}
-	// TODO: add verification steps
+	if c.Workers < 1 {
+		return fmt.Errorf("WORKERS should be atleast 1.")
+	}
+
+	if c.PerHostLimit < 0 {
+		return fmt.Errorf("PERHOSTLIMIT cannot be negative.")
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("SHUTDOWNTIMEOUT cannot be negative.")
+	}
+	if c.MaxAttempts < 1 {
+		return fmt.Errorf("MAXATTEMPTS should be atleast 1.")
+	}
+
+	if c.RetryBaseDelay <= 0 || c.RetryMaxDelay < c.RetryBaseDelay {
+		return fmt.Errorf("RETRYBASEDELAY should be positive and not greater than RETRYMAXDELAY.")
+	}
+	switch c.Delivery {
+	case "smtp":
+		if strings.TrimSpace(c.SmtpHost) == "" {
+			return fmt.Errorf("SMTPHOST is empty. Please provide the smtp server for smtp delivery.")
+		}
+		if c.SmtpPort < 1 || c.SmtpPort > 65535 {
+			return fmt.Errorf("SMTPPORT should be a port number, e.g. 587 or 465.")
+		}
+		switch c.SmtpAuth {
+		case "PLAIN", "LOGIN", "CRAM-MD5", "NONE":
+		case "XOAUTH2":
+			if c.OAuthTokenURL == "" || c.OAuthClientID == "" {
+				return fmt.Errorf("OAUTHTOKENURL and OAUTHCLIENTID are needed for XOAUTH2.")
+			}
+		default:
+			return fmt.Errorf("SMTPAUTH should be one of PLAIN, LOGIN, CRAM-MD5, XOAUTH2 or NONE.")
+		}
+		tlsOptions := email.TLSOptions{Mode: c.SmtpTLS, CAFile: c.SmtpCAFile, CertFile: c.SmtpCertFile, KeyFile: c.SmtpKeyFile}
+		err := tlsOptions.Verify()
+		if err != nil {
+			return fmt.Errorf("SMTPTLS, SMTPCAFILE, SMTPCERTFILE or SMTPKEYFILE is not usable: %w", err)
+		}
+		if c.SmtpTLS == email.TLSImplicit && c.SmtpPort == 587 {
+			return fmt.Errorf("SMTPTLS implicit is for SMTPS (port 465), port 587 expects STARTTLS (mandatory).")
+		}
+		if c.SmtpPoolSize < 0 {
+			return fmt.Errorf("SMTPPOOLSIZE cannot be negative.")
+		}
+		if c.SmtpPoolSize > 0 && c.SmtpIdleTimeout <= 0 {
+			return fmt.Errorf("SMTPIDLETIMEOUT should be positive.")
+		}
+	case "sendmail":
+		_, err := os.Stat(c.SendmailPath)
+		if err != nil {
+			return fmt.Errorf("SENDMAILPATH is not usable: %w", err)
+		}
+	case "outbox":
+		if c.OutboxDir == "" {
+			return fmt.Errorf("OUTBOXDIR is empty. Please provide a directory for outbox delivery.")
+		}
+		_, err := os.Stat(c.OutboxDir)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("DELIVERY should be one of smtp, sendmail or outbox.")
+	}
+
+	if c.ImapHost != "" {
+		switch c.ImapAuth {
+		case "PLAIN", "LOGIN":
+			if c.ImapPassword == "" {
+				return fmt.Errorf("IMAPPASSWORD cannot be empty.")
+			}
+		case "XOAUTH2":
+			if c.OAuthTokenURL == "" || c.OAuthClientID == "" {
+				return fmt.Errorf("OAUTHTOKENURL and OAUTHCLIENTID are needed for XOAUTH2.")
+			}
+			if c.ImapUserID != c.SmtpUserID {
+				return fmt.Errorf("IMAPUSERID should be the SMTPUSERID for XOAUTH2, the oauth2 tokens are shared.")
+			}
+		default:
+			return fmt.Errorf("IMAPAUTH should be one of PLAIN, LOGIN or XOAUTH2.")
+		}
+		switch c.ImapTLS {
+		case email.TLSImplicit, email.TLSMandatory, email.TLSNone:
+		default:
+			return fmt.Errorf("IMAPTLS should be one of implicit, mandatory or none.")
+		}
+		if c.ImapUserID == "" {
+			return fmt.Errorf("IMAPUSERID cannot be empty.")
+		}
+		if c.ImapPollInterval <= 0 {
+			return fmt.Errorf("IMAPPOLLINTERVAL should be positive.")
+		}
+		if c.ImapAuthServID == "" {
+			return fmt.Errorf("IMAPAUTHSERVID cannot be empty, senders are authenticated by it.")
+		}
+	}
+
+	if len(c.AllowedSenders) > 0 && c.ImapHost == "" {
+		return fmt.Errorf("IMAPHOST is needed for email-in (ALLOWEDSENDERS).")
+	}
+	// each poller moves its own cursor and skips the mail meant for the other
+	if len(c.AllowedSenders) > 0 && strings.EqualFold(c.SubmitMailbox, c.ImapMailbox) {
+		return fmt.Errorf("SUBMITMAILBOX should differ from IMAPMAILBOX, e.g. a folder of its own.")
+	}
+	if c.MaxUploadSize <= 0 {
+		return fmt.Errorf("MAXUPLOADSIZE should be positive.")
+	}
+
+	if c.MaxAttachmentSize <= 0 {
+		return fmt.Errorf("MAXATTACHMENTSIZE should be positive.")
+	}
 	return nil
 }
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig returns a config which passes Verify, for smtp delivery
+func validConfig(t *testing.T) ServerConfig {
+	t.Helper()
+	return ServerConfig{
+		DBPath:            t.TempDir(),
+		STOREPATH:         t.TempDir(),
+		SecretKey:         "secret",
+		Delivery:          "smtp",
+		SmtpHost:          "smtp.example.net",
+		SmtpPort:          587,
+		SmtpUserID:        "books@example.net",
+		SmtpAuth:          "PLAIN",
+		Workers:           2,
+		MaxAttempts:       3,
+		RetryBaseDelay:    time.Second,
+		RetryMaxDelay:     time.Minute,
+		MaxUploadSize:     50 << 20,
+		MaxAttachmentSize: 25 << 20,
+	}
+}
+
+func TestVerifySmtp(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *ServerConfig)
+		want   string // part of the error, none when empty
+	}{
+		{"valid", func(c *ServerConfig) {}, ""},
+		{"no host", func(c *ServerConfig) { c.SmtpHost = " " }, "SMTPHOST"},
+		{"no port", func(c *ServerConfig) { c.SmtpPort = 0 }, "SMTPPORT"},
+		{"port out of range", func(c *ServerConfig) { c.SmtpPort = 70000 }, "SMTPPORT"},
+		{"implicit tls on 587", func(c *ServerConfig) { c.SmtpTLS = "implicit" }, "SMTPTLS"},
+		{"no host without smtp", func(c *ServerConfig) {
+			c.Delivery, c.OutboxDir, c.SmtpHost, c.SmtpPort = "outbox", c.STOREPATH, "", 0
+		}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig(t)
+			tt.change(&c)
+			err := c.Verify()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyMailIn(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *ServerConfig)
+		want   string // part of the error, none when empty
+	}{
+		{"own mailbox", func(c *ServerConfig) {}, ""},
+		{"same mailbox", func(c *ServerConfig) { c.SubmitMailbox = "INBOX" }, "SUBMITMAILBOX"},
+		{"same mailbox in other case", func(c *ServerConfig) { c.SubmitMailbox = "inbox" }, "SUBMITMAILBOX"},
+		{"same mailbox without email-in", func(c *ServerConfig) { c.SubmitMailbox, c.AllowedSenders = "INBOX", nil }, ""},
+		{"no imap host", func(c *ServerConfig) { c.ImapHost = "" }, "IMAPHOST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig(t)
+			c.ImapHost, c.ImapPort, c.ImapUserID, c.ImapPassword = "imap.example.net", 993, "books@example.net", "secret"
+			c.ImapAuth, c.ImapTLS, c.ImapMailbox = "PLAIN", "implicit", "INBOX"
+			c.ImapPollInterval, c.ImapAuthServID = time.Minute, "mx.example.net"
+			c.AllowedSenders, c.SubmitMailbox = []string{"alice@example.com"}, "Kindle"
+			tt.change(&c)
+			err := c.Verify()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+// Package article turns web pages into EPUBs for reading later, keeping only
+// the main content of the page along with its images
+package article
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+var NoContentErr = errors.New("could not find the main content of the page")
+
+// Article is the readable part of a web page
+type Article struct {
+	URL         *url.URL // address of the page, links and images are relative to it
+	Title       string
+	Authors     []string
+	SiteName    string
+	Language    string
+	Description string
+	Published   time.Time
+	LeadImage   string     // absolute url of the image representing the article
+	Content     *html.Node // cleaned up main content
+}
+
+// Parse reads an html page and extracts its article. contentType is the Content-Type
+// header of the response, used to decode pages which are not utf-8.
+func Parse(r io.Reader, contentType string, pageURL *url.URL) (*Article, error) {
+	r, err := charset.NewReader(r, contentType)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding page, %w", err)
+	}
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing page, %w", err)
+	}
+
+	// links are relative to <base href> when the page has one
+	base := pageURL
+	if href, ok := doc.Find("base[href]").First().Attr("href"); ok {
+		if u, err := pageURL.Parse(href); err == nil {
+			base = u
+		}
+	}
+
+	a := &Article{URL: base}
+	a.readMetadata(doc)
+
+	content := extractContent(doc)
+	if content == nil {
+		return nil, NoContentErr
+	}
+	a.Content = clean(content, base, a.Title)
+	if textLength(a.Content) == 0 {
+		return nil, NoContentErr
+	}
+	return a, nil
+}
+
+// readMetadata fills in the details from JSON-LD, OpenGraph and plain html, in that order of preference
+func (a *Article) readMetadata(doc *goquery.Document) {
+	ld := readJSONLD(doc)
+
+	meta := func(keys ...string) string {
+		for _, k := range keys {
+			sel := doc.Find(fmt.Sprintf(`meta[property=%q], meta[name=%q]`, k, k))
+			if v, ok := sel.First().Attr("content"); ok && strings.TrimSpace(v) != "" {
+				return strings.TrimSpace(v)
+			}
+		}
+		return ""
+	}
+
+	a.Title = firstNonEmpty(ld.Headline, meta("og:title", "twitter:title"), pageTitle(doc), collapse(doc.Find("h1").First().Text()))
+	a.SiteName = firstNonEmpty(ld.Publisher.Name, meta("og:site_name", "application-name"), a.URL.Hostname())
+	a.Description = firstNonEmpty(ld.Description, meta("og:description", "description", "twitter:description"))
+	a.Language = firstNonEmpty(attr(doc.Find("html"), "lang"), meta("og:locale", "language"))
+	a.Language = strings.ReplaceAll(a.Language, "_", "-")
+
+	a.Authors = ld.authors()
+	if len(a.Authors) == 0 {
+		// article:author is often a profile url, which is not a name
+		for _, name := range []string{meta("author"), meta("article:author"), meta("twitter:creator")} {
+			if name != "" && !strings.Contains(name, "://") {
+				a.Authors = []string{name}
+				break
+			}
+		}
+	}
+
+	published := firstNonEmpty(ld.DatePublished, meta("article:published_time", "og:published_time", "date"))
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05Z0700", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, published); err == nil {
+			a.Published = t
+			break
+		}
+	}
+
+	if img := firstNonEmpty(ld.image(), meta("og:image", "og:image:url", "twitter:image")); img != "" {
+		if u, err := a.URL.Parse(img); err == nil {
+			a.LeadImage = u.String()
+		}
+	}
+}
+
+// pageTitle returns the <title>, without the site name many pages append to it
+func pageTitle(doc *goquery.Document) string {
+	title := collapse(doc.Find("title").First().Text())
+	for _, sep := range []string{" | ", " - ", " — ", " :: "} {
+		if i := strings.LastIndex(title, sep); i > 0 && len(title[:i]) >= 15 {
+			return title[:i]
+		}
+	}
+	return title
+}
+
+// linkedData is the part of a schema.org Article in JSON-LD we care about
+type linkedData struct {
+	Type          any    `json:"@type"`
+	Headline      string `json:"headline"`
+	Description   string `json:"description"`
+	DatePublished string `json:"datePublished"`
+	Author        any    `json:"author"`
+	Image         any    `json:"image"`
+	Publisher     struct {
+		Name string `json:"name"`
+	} `json:"publisher"`
+	Graph []json.RawMessage `json:"@graph"`
+}
+
+// articleTypes are the schema.org types describing an article
+var articleTypes = []string{"Article", "NewsArticle", "BlogPosting", "Report", "ScholarlyArticle", "TechArticle", "WebPage"}
+
+// readJSONLD returns the first article found in the JSON-LD scripts of the page
+func readJSONLD(doc *goquery.Document) linkedData {
+	var found linkedData
+	var visit func(raw json.RawMessage) bool
+	visit = func(raw json.RawMessage) bool {
+		var list []json.RawMessage
+		if json.Unmarshal(raw, &list) == nil {
+			for _, item := range list {
+				if visit(item) {
+					return true
+				}
+			}
+			return false
+		}
+		var ld linkedData
+		if json.Unmarshal(raw, &ld) != nil {
+			return false
+		}
+		for _, item := range ld.Graph {
+			if visit(item) {
+				return true
+			}
+		}
+		if ld.isArticle() && ld.Headline != "" {
+			found = ld
+			return true
+		}
+		return false
+	}
+
+	doc.Find(`script[type="application/ld+json"]`).EachWithBreak(func(_ int, s *goquery.Selection) bool {
+		return !visit(json.RawMessage(s.Text()))
+	})
+	return found
+}
+
+// isArticle reports whether @type, a string or a list, is one of articleTypes
+func (ld linkedData) isArticle() bool {
+	var types []string
+	switch t := ld.Type.(type) {
+	case string:
+		types = []string{t}
+	case []any:
+		for _, v := range t {
+			if s, ok := v.(string); ok {
+				types = append(types, s)
+			}
+		}
+	}
+	for _, t := range types {
+		for _, a := range articleTypes {
+			if t == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authors returns the author names, which may be given as a string, an object or a list of either
+func (ld linkedData) authors() []string {
+	var names []string
+	var add func(v any)
+	add = func(v any) {
+		switch v := v.(type) {
+		case string:
+			if v = collapse(v); v != "" && !strings.Contains(v, "://") {
+				names = append(names, v)
+			}
+		case map[string]any:
+			add(v["name"])
+		case []any:
+			for _, item := range v {
+				add(item)
+			}
+		}
+	}
+	add(ld.Author)
+	return names
+}
+
+// image returns the image url, which may be given as a string, an ImageObject or a list of either
+func (ld linkedData) image() string {
+	var get func(v any) string
+	get = func(v any) string {
+		switch v := v.(type) {
+		case string:
+			return v
+		case map[string]any:
+			return get(v["url"])
+		case []any:
+			if len(v) > 0 {
+				return get(v[0])
+			}
+		}
+		return ""
+	}
+	return get(ld.Image)
+}
+
+// attr returns an attribute of the first element of the selection
+func attr(sel *goquery.Selection, name string) string {
+	v, _ := sel.First().Attr(name)
+	return strings.TrimSpace(v)
+}
+
+// firstNonEmpty returns the first value which is not blank
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = collapse(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// collapse trims and collapses whitespace
+func collapse(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,160 @@
+package article
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+	"resty.dev/v3"
+)
+
+// parseFixture parses a saved page as if it was served at pageURL
+func parseFixture(t *testing.T, name string, pageURL string) (*Article, error) {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Parse(f, "text/html; charset=utf-8", u)
+}
+
+// renderContent returns the cleaned up content as html
+func renderContent(t *testing.T, a *Article) string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := html.Render(&b, a.Content); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestParseSavedPage(t *testing.T) {
+	a, err := parseFixture(t, "blog.html", "https://blog.example.com/2026/03/kindles")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Title != "Why Kindles still matter in 2026" {
+		t.Errorf("title %q", a.Title)
+	}
+	if want := []string{"Ada Lovelace", "Charles Babbage"}; !slices.Equal(a.Authors, want) {
+		t.Errorf("authors %v, want %v", a.Authors, want)
+	}
+	if a.SiteName != "The Reading Room" || a.Language != "en-GB" || a.Description != "A look at dedicated e-readers." {
+		t.Errorf("site %q, language %q, description %q", a.SiteName, a.Language, a.Description)
+	}
+	if want := time.Date(2026, 3, 14, 9, 30, 0, 0, time.UTC); !a.Published.Equal(want) {
+		t.Errorf("published %s, want %s", a.Published, want)
+	}
+	if a.LeadImage != "https://blog.example.com/media/lead.jpg" {
+		t.Errorf("lead image %q", a.LeadImage)
+	}
+
+	content := renderContent(t, a)
+	for _, want := range []string{
+		"Phones have swallowed the camera",
+		"Battery life is measured in weeks",
+		"or in bed.",
+		"however clever that app may be.",
+		`<a href="https://blog.example.com/tools/send-to-kindle">a small tool</a>`,
+		`<img src="https://blog.example.com/media/paperwhite.png" alt="A Paperwhite on a desk"/>`,
+		"<figcaption>The Paperwhite, still the one most people buy.</figcaption>",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("content lacks %s", want)
+		}
+	}
+	// page furniture, the repeated title and the scripts are left out
+	for _, junk := range []string{
+		"cookies", "Archive", "Popular posts", "Great post", "Copyright", "Share this post",
+		"/tag/kindle", "<h1", "<h2>Why Kindles", "dataLayer", "font-family", "data:image", "class=",
+	} {
+		if strings.Contains(content, junk) {
+			t.Errorf("content holds %s", junk)
+		}
+	}
+}
+
+func TestParseCharset(t *testing.T) {
+	page := "<html><head><title>Caf\xe9 culture</title></head><body><article>" +
+		"<p>Un caf\xe9 cr\xe8me, s'il vous pla\xeet, et une tartine pour commencer la journ\xe9e.</p>" +
+		"</article></body></html>"
+	u, _ := url.Parse("https://example.fr/cafe")
+	a, err := Parse(strings.NewReader(page), "text/html; charset=iso-8859-1", u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Title != "Café culture" || !strings.Contains(renderContent(t, a), "Un café crème, s&#39;il vous plaît") {
+		t.Fatalf("page was not decoded: %q, %s", a.Title, renderContent(t, a))
+	}
+}
+
+func TestParseNoContent(t *testing.T) {
+	if _, err := parseFixture(t, "gallery.html", "https://example.com/gallery"); !errors.Is(err, NoContentErr) {
+		t.Fatalf("got %v for a page without content, want NoContentErr", err)
+	}
+}
+
+func TestBookOfSavedPage(t *testing.T) {
+	var photo, lead bytes.Buffer
+	if err := png.Encode(&photo, image.NewGray(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&lead, image.NewRGBA(image.Rect(0, 0, 40, 30)), nil); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/media/paperwhite.png":
+			w.Write(photo.Bytes())
+		case "/media/lead.jpg":
+			w.Write(lead.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	a, err := parseFixture(t, "blog.html", srv.URL+"/2026/03/kindles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := resty.New()
+	defer client.Close()
+	book := a.Book(context.Background(), client)
+
+	if book.Title != a.Title || book.Publisher != "The Reading Room" || book.Cover == nil {
+		t.Fatalf("book %q by %q, cover %v", book.Title, book.Publisher, book.Cover != nil)
+	}
+	if len(book.Resources) != 1 || book.Resources[0].Name != "images/1.png" {
+		t.Fatalf("resources %+v", book.Resources)
+	}
+	body := book.Chapters[0].Body
+	for _, want := range []string{
+		"<h1>Why Kindles still matter in 2026</h1>",
+		`<p class="byline">Ada Lovelace, Charles Babbage · The Reading Room · 14 March 2026</p>`,
+		`<img src="images/1.png" alt="A Paperwhite on a desk"/>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("chapter lacks %s", want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package article
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/roshanlc/send-to-kindle/internal/epub"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+	"github.com/roshanlc/send-to-kindle/internal/imaging"
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"resty.dev/v3"
+)
+
+const (
+	maxImages     = 100     // images beyond this are left out of the book
+	maxImageBytes = 5 << 20 // larger images are left out
+	imageWidth    = 1200    // images are downscaled to fit e-reader screens
+	imageHeight   = 1600
+	imageQuality  = 80
+)
+
+// articleStyle lays out web text the way it was written, in spaced paragraphs
+const articleStyle = epub.DefaultStyle + `p { text-indent: 0; margin: 0.7em 0; text-align: left; }
+p.byline { font-style: italic; margin: 0; }
+p.source { font-size: 0.8em; margin-bottom: 1.5em; word-wrap: break-word; }
+figure { margin: 1em 0; text-align: center; }
+figcaption { font-size: 0.85em; font-style: italic; }
+h1 { text-align: left; }
+h2, h3, h4, h5, h6 { text-align: left; margin-top: 1.2em; }
+`
+
+// Book packages the article as an EPUB. Images are downloaded and downscaled,
+// those which can't be fetched or decoded are left out.
+func (a *Article) Book(ctx context.Context, client *resty.Client) *epub.Book {
+	book := &epub.Book{
+		Title:       a.Title,
+		Authors:     a.Authors,
+		Language:    a.Language,
+		Publisher:   a.SiteName,
+		Description: a.Description,
+		Style:       articleStyle,
+	}
+	if book.Title == "" {
+		book.Title = a.URL.Hostname()
+	}
+
+	f := &imageFetcher{ctx: ctx, client: client, names: map[string]string{}}
+	if a.LeadImage != "" {
+		if res, ok := f.fetch(a.LeadImage, "images/cover"); ok {
+			book.Cover = res
+		}
+	}
+
+	// the page images are fetched first, their tags point to the local copies afterwards
+	var images []*xhtml.Node
+	var collect func(n *xhtml.Node)
+	collect = func(n *xhtml.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.DataAtom == atom.Img {
+				images = append(images, c)
+			}
+			collect(c)
+		}
+	}
+	collect(a.Content)
+	for _, img := range images {
+		src := getAttr(img, "src")
+		name, ok := f.names[src]
+		if !ok && len(book.Resources) < maxImages {
+			var res *epub.Resource
+			res, ok = f.fetch(src, fmt.Sprintf("images/%d", len(book.Resources)+1))
+			if ok {
+				book.Resources = append(book.Resources, *res)
+				name = res.Name
+			}
+		}
+		if !ok {
+			img.Parent.RemoveChild(img)
+			continue
+		}
+		img.Attr = []xhtml.Attribute{{Key: "src", Val: name}, {Key: "alt", Val: getAttr(img, "alt")}}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<h1>%s</h1>\n", html.EscapeString(book.Title))
+	var byline []string
+	if len(a.Authors) > 0 {
+		byline = append(byline, strings.Join(a.Authors, ", "))
+	}
+	if a.SiteName != "" {
+		byline = append(byline, a.SiteName)
+	}
+	if !a.Published.IsZero() {
+		byline = append(byline, a.Published.Format("2 January 2006"))
+	}
+	if len(byline) > 0 {
+		fmt.Fprintf(&b, "<p class=\"byline\">%s</p>\n", html.EscapeString(strings.Join(byline, " · ")))
+	}
+	fmt.Fprintf(&b, "<p class=\"source\"><a href=\"%[1]s\">%[1]s</a></p>\n", html.EscapeString(a.URL.String()))
+	for c := a.Content.FirstChild; c != nil; c = c.NextSibling {
+		render(&b, c)
+	}
+
+	book.Chapters = []epub.Chapter{{Title: book.Title, Body: b.String()}}
+	return book
+}
+
+// imageFetcher downloads the images of an article, each url once
+type imageFetcher struct {
+	ctx    context.Context
+	client *resty.Client
+	names  map[string]string // url to resource name
+}
+
+// fetch downloads and downscales an image, name is the resource name without extension
+func (f *imageFetcher) fetch(src string, name string) (*epub.Resource, bool) {
+	taskID := helper.GetIDFromContext(f.ctx).String()
+	data, err := f.download(src)
+	if err == nil {
+		var mediaType string
+		data, mediaType, err = imaging.Resize(data, imageWidth, imageHeight, imageQuality)
+		if err == nil {
+			if mediaType == "image/png" {
+				name += ".png"
+			} else {
+				name += ".jpg"
+			}
+			f.names[src] = name
+			return &epub.Resource{Name: name, MediaType: mediaType, Data: data}, true
+		}
+	}
+	slog.Warn("Skipping article image", slog.String("url", truncate(src, 200)), slog.String("error", err.Error()), slog.String("taskID", taskID))
+	return nil, false
+}
+
+// download returns the bytes of an image url, which may also be a data uri
+func (f *imageFetcher) download(src string) ([]byte, error) {
+	if rest, ok := strings.CutPrefix(src, "data:"); ok {
+		meta, payload, found := strings.Cut(rest, ",")
+		if !found || !strings.HasSuffix(meta, ";base64") {
+			return nil, fmt.Errorf("unsupported data uri")
+		}
+		return base64.StdEncoding.DecodeString(payload)
+	}
+
+	resp, err := f.client.R().SetContext(f.ctx).SetDoNotParseResponse(true).Get(src)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("image request failed with status %d", resp.StatusCode())
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImageBytes {
+		return nil, fmt.Errorf("image is larger than %d bytes", maxImageBytes)
+	}
+	return data, nil
+}
+
+// voidTags are written as self closing tags
+var voidTags = map[atom.Atom]bool{atom.Br: true, atom.Hr: true, atom.Img: true}
+
+// render writes a cleaned up node as XHTML
+func render(b *strings.Builder, n *xhtml.Node) {
+	switch n.Type {
+	case xhtml.TextNode:
+		b.WriteString(html.EscapeString(n.Data))
+	case xhtml.ElementNode:
+		b.WriteString("<" + n.Data)
+		for _, a := range n.Attr {
+			fmt.Fprintf(b, ` %s="%s"`, a.Key, html.EscapeString(a.Val))
+		}
+		if voidTags[n.DataAtom] {
+			b.WriteString("/>")
+			return
+		}
+		b.WriteString(">")
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			render(b, c)
+		}
+		b.WriteString("</" + n.Data + ">")
+		if n.DataAtom != atom.A && !isInline(n.DataAtom) {
+			b.WriteString("\n")
+		}
+	}
+}
+
+// isInline reports tags which are part of the running text
+func isInline(a atom.Atom) bool {
+	switch a {
+	case atom.Em, atom.Strong, atom.U, atom.Del, atom.Ins, atom.Mark, atom.Small, atom.Sub, atom.Sup,
+		atom.Q, atom.Cite, atom.Abbr, atom.Code, atom.Kbd, atom.Samp:
+		return true
+	}
+	return false
+}
+
+// truncate shortens long strings such as data uris for logging
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,366 @@
+package article
+
+import (
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// The content is found the way Arc90's readability does it: paragraphs add to the
+// score of their parent and grandparent, the best scoring element minus its share
+// of link text is taken as the article, along with siblings that look related.
+
+var (
+	unlikelyPattern = regexp.MustCompile(`(?i)banner|breadcrumb|combx|comment|community|cookie|disqus|extra|footer|gdpr|header|legends|menu|related|remark|replies|rss|share|shoutbox|sidebar|skyscraper|social|sponsor|ad-break|agegate|pagination|pager|popup|promo|newsletter|subscribe|signup|navbar|masthead`)
+	maybePattern    = regexp.MustCompile(`(?i)and|article|body|column|content|main|shadow`)
+	positivePattern = regexp.MustCompile(`(?i)article|body|content|entry|hentry|h-entry|main|page|pagination|post|text|blog|story`)
+	negativePattern = regexp.MustCompile(`(?i)-ad-|hidden|^hid$| hid$| hid |^hid |banner|combx|comment|com-|contact|foot|footer|footnote|gdpr|masthead|media|meta|outbrain|promo|related|scroll|share|shoutbox|sidebar|skyscraper|sponsor|shopping|tags|tool|widget`)
+)
+
+// junkTags never hold article content
+const junkTags = "script, style, noscript, iframe, form, button, input, select, textarea, nav, aside, footer, svg, canvas, object, embed, template, link, meta, [hidden], [aria-hidden=true], [role=navigation], [role=complementary], [role=dialog]"
+
+// extractContent returns the element holding the main content, nil if none was found
+func extractContent(doc *goquery.Document) *html.Node {
+	doc.Find(junkTags).Remove()
+
+	// drop blocks whose class or id marks them as page furniture
+	doc.Find("body *").Each(func(_ int, s *goquery.Selection) {
+		node := s.Get(0)
+		if node.DataAtom == atom.Article || node.DataAtom == atom.Main || node.DataAtom == atom.A {
+			return
+		}
+		match := attr(s, "class") + " " + attr(s, "id")
+		if unlikelyPattern.MatchString(match) && !maybePattern.MatchString(match) {
+			s.Remove()
+		}
+	})
+
+	// sites marking up their article body save us the guessing
+	if body := doc.Find(`[itemprop="articleBody"]`).First(); body.Length() > 0 && len(collapse(body.Text())) > 500 {
+		return body.Get(0)
+	}
+
+	scores := map[*html.Node]float64{}
+	var candidates []*html.Node
+	addScore := func(n *html.Node, score float64) {
+		if n == nil || n.Type != html.ElementNode {
+			return
+		}
+		if _, ok := scores[n]; !ok {
+			scores[n] = initialScore(n)
+			candidates = append(candidates, n)
+		}
+		scores[n] += score
+	}
+
+	doc.Find("p, pre, td, blockquote").Each(func(_ int, s *goquery.Selection) {
+		text := collapse(s.Text())
+		if len(text) < 25 {
+			return
+		}
+		score := 1 + float64(strings.Count(text, ",")) + math.Min(float64(len(text))/100, 3)
+		parent := s.Get(0).Parent
+		addScore(parent, score)
+		if parent != nil {
+			addScore(parent.Parent, score/2)
+		}
+	})
+
+	var top *html.Node
+	var topScore float64
+	for _, n := range candidates {
+		score := scores[n] * (1 - linkDensity(goquery.NewDocumentFromNode(n).Selection))
+		scores[n] = score
+		if top == nil || score > topScore {
+			top, topScore = n, score
+		}
+	}
+
+	if top == nil {
+		// no paragraphs to go by, fall back to the usual containers
+		for _, sel := range []string{"article", "main", "body"} {
+			if s := doc.Find(sel).First(); s.Length() > 0 {
+				return s.Get(0)
+			}
+		}
+		return nil
+	}
+	if top.Parent == nil || top.DataAtom == atom.Body {
+		return top
+	}
+
+	// siblings of the top candidate are often parts of the article too
+	threshold := math.Max(10, topScore*0.2)
+	container := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	for sibling := top.Parent.FirstChild; sibling != nil; {
+		next := sibling.NextSibling
+		if sibling == top || related(sibling, scores, threshold) {
+			top.Parent.RemoveChild(sibling)
+			container.AppendChild(sibling)
+		}
+		sibling = next
+	}
+	return container
+}
+
+// related reports whether a sibling of the top candidate belongs to the article
+func related(n *html.Node, scores map[*html.Node]float64, threshold float64) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	if score, ok := scores[n]; ok && score >= threshold {
+		return true
+	}
+	if n.DataAtom != atom.P {
+		return false
+	}
+	s := goquery.NewDocumentFromNode(n).Selection
+	text := collapse(s.Text())
+	density := linkDensity(s)
+	return len(text) > 80 && density < 0.25 ||
+		len(text) > 0 && density == 0 && strings.HasSuffix(text, ".")
+}
+
+// initialScore gives containers a head start by their tag, class and id
+func initialScore(n *html.Node) float64 {
+	score := 0.0
+	switch n.DataAtom {
+	case atom.Article:
+		score += 10
+	case atom.Div, atom.Section, atom.Main:
+		score += 5
+	case atom.Pre, atom.Td, atom.Blockquote:
+		score += 3
+	case atom.Address, atom.Ol, atom.Ul, atom.Dl, atom.Dd, atom.Dt, atom.Li, atom.Form:
+		score -= 3
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Th:
+		score -= 5
+	}
+
+	for _, a := range n.Attr {
+		if a.Key != "class" && a.Key != "id" {
+			continue
+		}
+		if negativePattern.MatchString(a.Val) {
+			score -= 25
+		}
+		if positivePattern.MatchString(a.Val) {
+			score += 25
+		}
+	}
+	return score
+}
+
+// linkDensity is the share of the text of the selection which is inside links
+func linkDensity(s *goquery.Selection) float64 {
+	total := len(collapse(s.Text()))
+	if total == 0 {
+		return 0
+	}
+	links := 0
+	s.Find("a").Each(func(_ int, a *goquery.Selection) {
+		links += len(collapse(a.Text()))
+	})
+	return float64(links) / float64(total)
+}
+
+// allowedTags are kept in the cleaned up content, with the tag they are written as
+var allowedTags = map[atom.Atom]string{
+	atom.P: "p", atom.Div: "div", atom.Br: "br", atom.Hr: "hr",
+	atom.H1: "h2", atom.H2: "h2", atom.H3: "h3", atom.H4: "h4", atom.H5: "h5", atom.H6: "h6", // h1 is the article title
+	atom.Ul: "ul", atom.Ol: "ol", atom.Li: "li", atom.Dl: "dl", atom.Dt: "dt", atom.Dd: "dd",
+	atom.Blockquote: "blockquote", atom.Pre: "pre", atom.Code: "code", atom.Kbd: "kbd", atom.Samp: "samp",
+	atom.Em: "em", atom.I: "em", atom.Strong: "strong", atom.B: "strong", atom.U: "u", atom.S: "del", atom.Del: "del",
+	atom.Ins: "ins", atom.Mark: "mark", atom.Small: "small", atom.Sub: "sub", atom.Sup: "sup", atom.Q: "q",
+	atom.Cite: "cite", atom.Abbr: "abbr", atom.A: "a", atom.Img: "img", atom.Figure: "figure", atom.Figcaption: "figcaption",
+	atom.Table: "table", atom.Caption: "caption", atom.Thead: "thead", atom.Tbody: "tbody", atom.Tfoot: "tfoot",
+	atom.Tr: "tr", atom.Td: "td", atom.Th: "th",
+	// structural elements become plain blocks
+	atom.Section: "div", atom.Article: "div", atom.Main: "div", atom.Header: "div", atom.Center: "div",
+}
+
+// unwrapTags are dropped while their content is kept
+var unwrapTags = map[atom.Atom]bool{atom.Span: true, atom.Font: true, atom.Picture: true, atom.Time: true, atom.Label: true, atom.Details: true, atom.Summary: true}
+
+// clean rebuilds the content with allowed tags and attributes only. Links and images
+// are made absolute, lazily loaded images get their real source and empty blocks,
+// link lists and a heading repeating the title are dropped.
+func clean(n *html.Node, base *url.URL, title string) *html.Node {
+	root := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	titleSeen := false
+
+	var copyChildren func(src, dst *html.Node)
+	copyChildren = func(src, dst *html.Node) {
+		for c := src.FirstChild; c != nil; c = c.NextSibling {
+			switch c.Type {
+			case html.TextNode:
+				dst.AppendChild(&html.Node{Type: html.TextNode, Data: c.Data})
+			case html.ElementNode:
+				if unwrapTags[c.DataAtom] {
+					copyChildren(c, dst)
+					continue
+				}
+				tag, ok := allowedTags[c.DataAtom]
+				if !ok {
+					continue
+				}
+
+				// the title is shown on top already
+				if !titleSeen && (c.DataAtom == atom.H1 || c.DataAtom == atom.H2) && collapse(nodeText(c)) == title {
+					titleSeen = true
+					continue
+				}
+				if (c.DataAtom == atom.Ul || c.DataAtom == atom.Ol) && linkDensity(goquery.NewDocumentFromNode(c).Selection) > 0.5 {
+					continue
+				}
+
+				el := &html.Node{Type: html.ElementNode, Data: tag, DataAtom: atom.Lookup([]byte(tag))}
+				switch c.DataAtom {
+				case atom.A:
+					if href := resolve(base, getAttr(c, "href")); href != "" {
+						el.Attr = []html.Attribute{{Key: "href", Val: href}}
+					}
+				case atom.Img:
+					src := resolve(base, imageSource(c))
+					if src == "" {
+						continue
+					}
+					el.Attr = []html.Attribute{{Key: "src", Val: src}, {Key: "alt", Val: getAttr(c, "alt")}}
+				case atom.Td, atom.Th:
+					for _, key := range []string{"colspan", "rowspan"} {
+						if v := getAttr(c, key); v != "" {
+							el.Attr = append(el.Attr, html.Attribute{Key: key, Val: v})
+						}
+					}
+				}
+				copyChildren(c, el)
+
+				if isEmpty(el) {
+					continue
+				}
+				dst.AppendChild(el)
+			}
+		}
+	}
+	copyChildren(n, root)
+	return root
+}
+
+// isEmpty reports elements left without text or images, which are not empty by nature
+func isEmpty(n *html.Node) bool {
+	switch n.DataAtom {
+	case atom.Br, atom.Hr, atom.Img, atom.Td, atom.Th:
+		return false
+	}
+	if strings.TrimSpace(nodeText(n)) != "" {
+		return false
+	}
+	return !hasImage(n)
+}
+
+// hasImage reports whether the element contains an image
+func hasImage(n *html.Node) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.DataAtom == atom.Img || hasImage(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageSource returns the real source of an image, which lazy loading scripts
+// keep in data attributes or srcset until the image is scrolled into view
+func imageSource(n *html.Node) string {
+	for _, key := range []string{"data-src", "data-original", "data-lazy-src", "data-url"} {
+		if v := getAttr(n, key); v != "" {
+			return v
+		}
+	}
+	src := getAttr(n, "src")
+	if src != "" && !strings.HasPrefix(src, "data:image/gif") && !strings.HasPrefix(src, "data:image/svg") {
+		return src
+	}
+	for _, key := range []string{"srcset", "data-srcset"} {
+		if v := largestFromSrcset(getAttr(n, key)); v != "" {
+			return v
+		}
+	}
+	return src
+}
+
+// largestFromSrcset picks the candidate with the largest width from a srcset
+func largestFromSrcset(srcset string) string {
+	best, bestWidth := "", -1.0
+	for _, candidate := range strings.Split(srcset, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+		width := 0.0
+		if len(fields) > 1 {
+			descriptor := fields[1]
+			var value float64
+			if n, err := strconv.ParseFloat(descriptor[:len(descriptor)-1], 64); err == nil {
+				value = n
+			}
+			if strings.HasSuffix(descriptor, "x") {
+				value *= 1000 // density descriptors, rank them above unknown widths
+			}
+			width = value
+		}
+		if width > bestWidth {
+			best, bestWidth = fields[0], width
+		}
+	}
+	return best
+}
+
+// resolve makes a link absolute, dropping script links
+func resolve(base *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(strings.ToLower(ref), "javascript:") {
+		return ""
+	}
+	if strings.HasPrefix(ref, "data:") {
+		return ref
+	}
+	u, err := base.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	return u.String()
+}
+
+// getAttr returns an attribute of a node
+func getAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return strings.TrimSpace(a.Val)
+		}
+	}
+	return ""
+}
+
+// nodeText returns the text content of a node
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(nodeText(c))
+	}
+	return b.String()
+}
+
+// textLength returns the length of the collapsed text of a node
+func textLength(n *html.Node) int {
+	return len(collapse(nodeText(n)))
+}
@@ -0,0 +1,312 @@
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/roshanlc/send-to-kindle/internal/epub"
+	"github.com/roshanlc/send-to-kindle/internal/format"
+	"github.com/roshanlc/send-to-kindle/internal/imaging"
+	"github.com/roshanlc/send-to-kindle/internal/pdf"
+)
+
+const (
+	maxPageBytes = 64 << 20 // pages larger than this are not read
+	pdfPageDPI   = 150      // resolution the pages are laid out at in pdfs
+	pageQuality  = 90       // jpeg quality of pages which have to be re-encoded
+)
+
+var NoPagesErr = errors.New("comic archive holds no readable pages")
+
+// comicInfo is the ComicInfo.xml metadata written by most comic tools
+type comicInfo struct {
+	Title       string `xml:"Title"`
+	Series      string `xml:"Series"`
+	Number      string `xml:"Number"`
+	Writer      string `xml:"Writer"`
+	Publisher   string `xml:"Publisher"`
+	LanguageISO string `xml:"LanguageISO"`
+	Summary     string `xml:"Summary"`
+}
+
+// page is a decoded page image of a comic
+type page struct {
+	data      []byte
+	mediaType string
+	config    image.Config
+	format    string // as registered with the image package
+}
+
+// comic is the content of a comic archive
+type comic struct {
+	info  comicInfo
+	pages []page
+}
+
+// readComic reads the pages of a comic archive in natural name order.
+// Pages in formats the image package can't decode are skipped.
+func readComic(ctx context.Context, src string) (*comic, error) {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening comic archive, %w", err)
+	}
+	defer r.Close()
+
+	c := &comic{}
+	var files []*zip.File
+	for _, f := range r.File {
+		switch {
+		case f.FileInfo().IsDir(), strings.HasPrefix(f.Name, "__MACOSX/"):
+		case strings.EqualFold(f.Name[strings.LastIndex(f.Name, "/")+1:], "ComicInfo.xml"):
+			data, err := readZipFile(f, 1<<20)
+			if err == nil {
+				_ = xml.Unmarshal(data, &c.info)
+			}
+		case format.IsImageName(f.Name):
+			files = append(files, f)
+		}
+	}
+	slices.SortFunc(files, func(a, b *zip.File) int { return naturalCompare(a.Name, b.Name) })
+
+	for _, f := range files {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		data, err := readZipFile(f, maxPageBytes)
+		if err != nil {
+			return nil, err
+		}
+		config, kind, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			continue // e.g. webp, which can't be decoded
+		}
+		c.pages = append(c.pages, page{data: data, mediaType: "image/" + kind, config: config, format: kind})
+	}
+	if len(c.pages) == 0 {
+		return nil, NoPagesErr
+	}
+	return c, nil
+}
+
+// title returns the title from ComicInfo.xml, or the file name
+func (c *comic) title(src string) string {
+	title := strings.TrimSpace(c.info.Title)
+	if series := strings.TrimSpace(c.info.Series); series != "" {
+		if c.info.Number != "" {
+			series += " #" + strings.TrimSpace(c.info.Number)
+		}
+		if title == "" {
+			title = series
+		} else {
+			title = series + ": " + title
+		}
+	}
+	if title == "" {
+		title = titleFromPath(src)
+	}
+	return title
+}
+
+// authors returns the writers from ComicInfo.xml
+func (c *comic) authors() []string {
+	var authors []string
+	for _, a := range strings.Split(c.info.Writer, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			authors = append(authors, a)
+		}
+	}
+	return authors
+}
+
+// cbzToEPUB puts each page of a comic on a page of its own
+func cbzToEPUB(ctx context.Context, src string, dst string) error {
+	c, err := readComic(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	book := epub.Book{
+		Title:       c.title(src),
+		Authors:     c.authors(),
+		Language:    c.info.LanguageISO,
+		Publisher:   c.info.Publisher,
+		Description: c.info.Summary,
+	}
+	for i, p := range c.pages {
+		name := fmt.Sprintf("images/%04d%s", i+1, imageExtension(p.mediaType))
+		res := epub.Resource{Name: name, MediaType: p.mediaType, Data: p.data}
+		if i == 0 {
+			book.Cover = &res // shown on a page of its own
+			continue
+		}
+		book.Resources = append(book.Resources, res)
+		book.Chapters = append(book.Chapters, epub.Chapter{
+			Body: fmt.Sprintf(`<div class="page"><img src="%s" alt="%d"/></div>`, name, i+1),
+		})
+	}
+	if len(book.Chapters) == 0 {
+		// a single page comic, the cover is all there is
+		book.Chapters = append(book.Chapters, epub.Chapter{
+			Body: fmt.Sprintf(`<div class="page"><img src="%s" alt="1"/></div>`, book.Cover.Name),
+		})
+	}
+	return book.WriteFile(dst)
+}
+
+// cbzToPDF puts each page of a comic on a pdf page sized to the image.
+// JPEG pages are embedded as they are, others are re-encoded as JPEG.
+func cbzToPDF(ctx context.Context, src string, dst string) error {
+	c, err := readComic(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	w := pdf.NewWriter()
+	pagesRef := w.Reserve()
+	var kids pdf.Array
+
+	for _, p := range c.pages {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		data, config, err := pdfJPEG(p)
+		if err != nil {
+			return err
+		}
+
+		colorSpace := pdf.Name("DeviceRGB")
+		if config.ColorModel == color.GrayModel {
+			colorSpace = "DeviceGray"
+		}
+		img := w.Add(pdf.Dict{
+			"Type":             pdf.Name("XObject"),
+			"Subtype":          pdf.Name("Image"),
+			"Width":            config.Width,
+			"Height":           config.Height,
+			"ColorSpace":       colorSpace,
+			"BitsPerComponent": 8,
+			"Filter":           pdf.Name("DCTDecode"),
+		}, data)
+
+		// page size in points, the image fills the whole page
+		width := float64(config.Width) * 72 / pdfPageDPI
+		height := float64(config.Height) * 72 / pdfPageDPI
+		content := fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", width, height)
+		contentRef := w.Add(pdf.Dict{}, []byte(content))
+
+		kids = append(kids, w.Add(pdf.Dict{
+			"Type":      pdf.Name("Page"),
+			"Parent":    pagesRef,
+			"MediaBox":  pdf.Array{0, 0, round2(width), round2(height)},
+			"Contents":  contentRef,
+			"Resources": pdf.Dict{"XObject": pdf.Dict{"Im0": img}},
+		}, nil))
+	}
+	w.Set(pagesRef, pdf.Dict{"Type": pdf.Name("Pages"), "Kids": kids, "Count": len(kids)}, nil)
+
+	catalog := w.Add(pdf.Dict{"Type": pdf.Name("Catalog"), "Pages": pagesRef}, nil)
+	infoDict := pdf.Dict{"Title": pdf.EncodeText(c.title(src)), "Producer": pdf.String("send-to-kindle")}
+	if authors := c.authors(); len(authors) > 0 {
+		infoDict["Author"] = pdf.EncodeText(strings.Join(authors, ", "))
+	}
+	info := w.Add(infoDict, nil)
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteTo(out, pdf.Dict{"Root": catalog, "Info": info})
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// pdfJPEG returns the page as a JPEG a pdf can embed. Only RGB and grayscale
+// baseline data can be passed through, anything else is decoded and re-encoded.
+func pdfJPEG(p page) ([]byte, image.Config, error) {
+	if p.format == "jpeg" && (p.config.ColorModel == color.YCbCrModel || p.config.ColorModel == color.GrayModel) {
+		return p.data, p.config, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(p.data))
+	if err != nil {
+		return nil, image.Config{}, fmt.Errorf("error while decoding page, %w", err)
+	}
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, imaging.Flatten(img), &jpeg.Options{Quality: pageQuality})
+	if err != nil {
+		return nil, image.Config{}, fmt.Errorf("error while encoding page, %w", err)
+	}
+	// grayscale images stay grayscale, so the result tells the color space
+	config, err := jpeg.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, image.Config{}, fmt.Errorf("error while encoding page, %w", err)
+	}
+	return buf.Bytes(), config, nil
+}
+
+// round2 rounds to two decimals, enough precision for page sizes
+func round2(f float64) float64 {
+	return float64(int64(f*100+0.5)) / 100
+}
+
+// readZipFile reads an archive entry of at most limit bytes
+func readZipFile(f *zip.File, limit int64) ([]byte, error) {
+	if f.UncompressedSize64 > uint64(limit) {
+		return nil, fmt.Errorf("%s is too large", f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, limit))
+}
+
+// naturalCompare orders names with numbers by their value, so page2 comes before page10
+func naturalCompare(a, b string) int {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	for a != "" && b != "" {
+		na, restA := leadingDigits(a)
+		nb, restB := leadingDigits(b)
+		if na != "" && nb != "" {
+			// compare numbers by length first, then digit by digit
+			ta, tb := strings.TrimLeft(na, "0"), strings.TrimLeft(nb, "0")
+			if len(ta) != len(tb) {
+				return len(ta) - len(tb)
+			}
+			if c := strings.Compare(ta, tb); c != 0 {
+				return c
+			}
+			a, b = restA, restB
+			continue
+		}
+		if a[0] != b[0] {
+			return int(a[0]) - int(b[0])
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) - len(b)
+}
+
+// leadingDigits splits s into its leading run of digits and the rest
+func leadingDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i], s[i:]
+}
@@ -0,0 +1,193 @@
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/roshanlc/send-to-kindle/internal/format"
+	"github.com/roshanlc/send-to-kindle/internal/pdf"
+)
+
+// encodeImage encodes img as a jpeg for names ending in .jpg, as a png otherwise
+func encodeImage(t *testing.T, name string, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	if strings.HasSuffix(name, ".jpg") {
+		err = jpeg.Encode(&buf, img, nil)
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeComic writes a comic archive of the given entries, in that order
+func writeComic(t *testing.T, path string, entries [][2]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	z := zip.NewWriter(f)
+	for _, e := range entries {
+		w, err := z.Create(e[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testComic writes a comic of three readable pages, stored out of order, with
+// a grayscale png, a jpeg and a color png
+func testComic(t *testing.T) string {
+	t.Helper()
+	gray := image.NewGray(image.Rect(0, 0, 300, 450))
+	rgb := image.NewRGBA(image.Rect(0, 0, 300, 450))
+	small := image.NewNRGBA(image.Rect(0, 0, 150, 300))
+	small.Set(10, 10, color.NRGBA{255, 0, 0, 128})
+
+	path := filepath.Join(t.TempDir(), "saga_01.cbz")
+	writeComic(t, path, [][2]string{
+		{"Saga/page10.png", string(encodeImage(t, "page10.png", small))},
+		{"Saga/page2.jpg", string(encodeImage(t, "page2.jpg", rgb))},
+		{"Saga/page1.png", string(encodeImage(t, "page1.png", gray))},
+		{"Saga/page3.webp", "RIFF\x00\x00\x00\x00WEBPVP8 "}, // can't be decoded
+		{"__MACOSX/Saga/._page1.png", "resource fork"},
+		{"Saga/ComicInfo.xml", `<ComicInfo><Title>Chapter One</Title><Series>Saga</Series><Number>1</Number>
+			<Writer>Brian K. Vaughan, Fiona Staples</Writer><Publisher>Image</Publisher><LanguageISO>en</LanguageISO></ComicInfo>`},
+	})
+	return path
+}
+
+func TestCBZToEPUB(t *testing.T) {
+	src := testComic(t)
+	if f, _, err := format.Detect(src); err != nil || f != format.CBZ {
+		t.Fatalf("comic detected as %s, %v", f, err)
+	}
+	dst, err := Convert(context.Background(), src, format.Unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Ext(dst) != ".epub" {
+		t.Fatalf("converted to %s", dst)
+	}
+
+	entries := readEntries(t, dst)
+	opf := entries["OEBPS/content.opf"]
+	for _, want := range []string{
+		"<dc:title>Saga #1: Chapter One</dc:title>",
+		"<dc:creator>Brian K. Vaughan</dc:creator>",
+		"<dc:creator>Fiona Staples</dc:creator>",
+		"<dc:publisher>Image</dc:publisher>",
+		`href="images/0001.png" media-type="image/png" properties="cover-image"`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("package lacks %s", want)
+		}
+	}
+	// the first page is the cover, the others follow in natural order
+	pages := map[string]string{
+		"OEBPS/chapter-001.xhtml": `<img src="images/0002.jpg" alt="2"/>`,
+		"OEBPS/chapter-002.xhtml": `<img src="images/0003.png" alt="3"/>`,
+	}
+	for name, want := range pages {
+		if !strings.Contains(entries[name], want) {
+			t.Errorf("%s lacks %s", name, want)
+		}
+	}
+	if _, ok := entries["OEBPS/chapter-003.xhtml"]; ok {
+		t.Error("page which can't be decoded was added")
+	}
+}
+
+func TestCBZToPDF(t *testing.T) {
+	dst, err := Convert(context.Background(), testComic(t), format.PDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := pdf.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := f.Dict(f.Trailer["Info"])
+	if got := pdf.Text(info["Title"]); got != "Saga #1: Chapter One" {
+		t.Errorf("title %q", got)
+	}
+	if got := pdf.Text(info["Author"]); got != "Brian K. Vaughan, Fiona Staples" {
+		t.Errorf("author %q", got)
+	}
+
+	pages := f.Dict(f.Dict(f.Trailer["Root"])["Pages"])
+	kids, _ := pages["Kids"].(pdf.Array)
+	if len(kids) != 3 || fmt.Sprint(pages["Count"]) != "3" {
+		t.Fatalf("%d pages, count %v", len(kids), pages["Count"])
+	}
+	tests := []struct {
+		mediaBox   string
+		colorSpace pdf.Name
+	}{
+		{"[0 0 144 216]", "DeviceGray"},
+		{"[0 0 144 216]", "DeviceRGB"},
+		{"[0 0 72 144]", "DeviceRGB"},
+	}
+	for i, tt := range tests {
+		page := f.Dict(kids[i])
+		if got := fmt.Sprint(page["MediaBox"]); got != tt.mediaBox {
+			t.Errorf("page %d has media box %s, want %s", i+1, got, tt.mediaBox)
+		}
+		img := f.Dict(f.Dict(page["Resources"])["XObject"].(pdf.Dict)["Im0"])
+		if img["ColorSpace"] != tt.colorSpace || img["Filter"] != pdf.Name("DCTDecode") {
+			t.Errorf("page %d image is %v with %v, want %s", i+1, img["ColorSpace"], img["Filter"], tt.colorSpace)
+		}
+	}
+}
+
+func TestCBZWithoutPages(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "empty.cbz")
+	writeComic(t, src, [][2]string{
+		{"page1.webp", "RIFF\x00\x00\x00\x00WEBPVP8 "},
+		{"ComicInfo.xml", "<ComicInfo><Title>Nothing</Title></ComicInfo>"},
+	})
+	for _, convert := range []converterFunc{cbzToEPUB, cbzToPDF} {
+		if err := convert(context.Background(), src, filepath.Join(dir, "out")); !errors.Is(err, NoPagesErr) {
+			t.Errorf("got %v, want NoPagesErr", err)
+		}
+	}
+}
+
+func TestNaturalCompare(t *testing.T) {
+	names := []string{"page10.jpg", "Page2.jpg", "page1.jpg", "page02b.jpg", "cover.jpg", "page100.jpg", "page001.jpg", "page2a.jpg"}
+	slices.SortStableFunc(names, naturalCompare)
+	want := []string{"cover.jpg", "page1.jpg", "page001.jpg", "Page2.jpg", "page2a.jpg", "page02b.jpg", "page10.jpg", "page100.jpg"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("got %v, want %v", names, want)
+	}
+}
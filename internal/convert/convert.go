@@ -0,0 +1,135 @@
+// Package convert turns documents Send to Kindle does not accept into ones it does
+package convert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/roshanlc/send-to-kindle/internal/format"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+)
+
+var (
+	UnsupportedConversionErr = errors.New("conversion is not supported")
+	InvalidTargetErr         = errors.New("invalid target format, expected epub or pdf")
+)
+
+// Targets are the formats files can be converted to
+var Targets = []format.Format{format.EPUB, format.PDF}
+
+// converterFunc converts the file at src into a new file at dst
+type converterFunc func(ctx context.Context, src string, dst string) error
+
+// conversion is a pair of source and target formats
+type conversion struct {
+	from, to format.Format
+}
+
+var converters = map[conversion]converterFunc{
+	{format.FB2, format.EPUB}:      fb2ToEPUB,
+	{format.CBZ, format.EPUB}:      cbzToEPUB,
+	{format.CBZ, format.PDF}:       cbzToPDF,
+	{format.Markdown, format.EPUB}: markdownToEPUB,
+	{format.TXT, format.EPUB}:      textToEPUB,
+}
+
+// ParseTarget validates a target format chosen by the user, empty means automatic
+func ParseTarget(s string) (format.Format, error) {
+	f := format.Format(strings.ToLower(strings.TrimSpace(s)))
+	if f == format.Unknown {
+		return f, nil
+	}
+	for _, t := range Targets {
+		if f == t {
+			return f, nil
+		}
+	}
+	return format.Unknown, fmt.Errorf("%w, got %q", InvalidTargetErr, s)
+}
+
+// Convertible reports whether files of the format can be converted into one accepted by Send to Kindle
+func Convertible(f format.Format) bool {
+	_, ok := converters[conversion{f, defaultTarget}]
+	return ok
+}
+
+// defaultTarget is used for formats Send to Kindle does not accept when no target was chosen
+const defaultTarget = format.EPUB
+
+// Convert converts the file at path into target and returns the path of the result,
+// which is written next to it. With an empty target only formats not accepted by
+// Send to Kindle are converted, to EPUB. Files already in the target format, or in an
+// accepted format without a matching converter, are returned unchanged.
+// The original file is removed once the conversion succeeds.
+func Convert(ctx context.Context, path string, target format.Format) (string, error) {
+	taskID := helper.GetIDFromContext(ctx).String()
+
+	source, mediaType, err := format.Detect(path)
+	if err != nil {
+		return "", fmt.Errorf("error while detecting file format, %w", err)
+	}
+	source = format.Refine(source, path)
+
+	if target == format.Unknown {
+		if source.KindleSupported() {
+			return path, nil
+		}
+		target = defaultTarget
+	}
+	if source == target {
+		return path, nil
+	}
+
+	convert, ok := converters[conversion{source, target}]
+	if !ok {
+		if source.KindleSupported() {
+			slog.Warn("Conversion not supported, sending file as is", slog.String("from", string(source)),
+				slog.String("to", string(target)), slog.String("taskID", taskID))
+			return path, nil
+		}
+		if source == format.Unknown {
+			return "", fmt.Errorf("%w: got %s", format.UnsupportedFormatErr, mediaType)
+		}
+		return "", fmt.Errorf("%w from %s to %s", UnsupportedConversionErr, source, target)
+	}
+
+	dst := strings.TrimSuffix(path, filepath.Ext(path)) + target.Extension()
+	if dst == path {
+		dst = path + target.Extension()
+	}
+	partPath := dst + ".part"
+
+	slog.Info("Converting file", slog.String("from", string(source)), slog.String("to", string(target)), slog.String("taskID", taskID))
+	err = convert(ctx, path, partPath)
+	if err != nil {
+		_ = os.Remove(partPath)
+		return "", fmt.Errorf("error while converting %s to %s, %w", source, target, err)
+	}
+
+	err = os.Rename(partPath, dst)
+	if err != nil {
+		_ = os.Remove(partPath)
+		return "", fmt.Errorf("error while saving converted file, %w", err)
+	}
+
+	// the original is of no use anymore
+	err = os.Remove(path)
+	if err != nil {
+		slog.Warn("Could not delete original file", slog.String("filepath", path), slog.String("error", err.Error()), slog.String("taskID", taskID))
+	}
+
+	slog.Info("Converted file", slog.String("filepath", dst), slog.String("taskID", taskID))
+	return dst, nil
+}
+
+// titleFromPath returns the file name without its extension, as a title of last resort
+func titleFromPath(path string) string {
+	name := filepath.Base(path)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	return strings.TrimSpace(strings.NewReplacer("_", " ").Replace(name))
+}
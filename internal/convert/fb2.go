@@ -0,0 +1,421 @@
+package convert
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/roshanlc/send-to-kindle/internal/epub"
+	"golang.org/x/net/html/charset"
+)
+
+var NoFB2BodyErr = errors.New("fb2 file has no body")
+
+// node is an element (or, with an empty name, a text run) of an FB2 document
+type node struct {
+	name     string
+	attrs    map[string]string // by local name, as FB2 mixes xlink and l prefixes
+	children []*node
+	text     string
+}
+
+// child returns the first child element with the given name, nil if there is none
+func (n *node) child(name string) *node {
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// all returns the child elements with the given name
+func (n *node) all(name string) []*node {
+	if n == nil {
+		return nil
+	}
+	var nodes []*node
+	for _, c := range n.children {
+		if c.name == name {
+			nodes = append(nodes, c)
+		}
+	}
+	return nodes
+}
+
+// plainText returns the text content of the node
+func (n *node) plainText() string {
+	if n == nil {
+		return ""
+	}
+	if n.name == "" {
+		return n.text
+	}
+	var b strings.Builder
+	for _, c := range n.children {
+		if c.name == "p" && b.Len() > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(c.plainText())
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// parseFB2 reads the whole document into a tree. FB2 files are often not utf-8,
+// so the encoding declared in the xml header is honoured.
+func parseFB2(r io.Reader) (*node, error) {
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = charset.NewReaderLabel
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+
+	root := &node{name: "#document"}
+	stack := []*node{root}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing fb2, %w", err)
+		}
+		parent := stack[len(stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &node{name: t.Name.Local, attrs: map[string]string{}}
+			for _, a := range t.Attr {
+				n.attrs[a.Name.Local] = a.Value
+			}
+			parent.children = append(parent.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			parent.children = append(parent.children, &node{text: string(t)})
+		}
+	}
+
+	book := root.child("FictionBook")
+	if book == nil {
+		return nil, fmt.Errorf("fb2 root element not found")
+	}
+	return book, nil
+}
+
+// fb2Converter renders the bodies of an FB2 document into chapters
+type fb2Converter struct {
+	images  map[string]string // binary id to resource name
+	idFiles map[string]string // element id to the chapter file holding it
+	inText  int               // > 0 while rendering the content of a paragraph, images are inline there
+}
+
+// fb2ToEPUB converts a FictionBook 2 document
+func fb2ToEPUB(ctx context.Context, src string, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	book, err := parseFB2(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	out := epub.Book{}
+	c := &fb2Converter{images: map[string]string{}, idFiles: map[string]string{}}
+
+	// embedded images
+	for i, bin := range book.all("binary") {
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(bin.plainText()), ""))
+		if err != nil {
+			continue // a broken image should not fail the book
+		}
+		mediaType := bin.attrs["content-type"]
+		if !strings.HasPrefix(mediaType, "image/") {
+			mediaType = http.DetectContentType(data)
+		}
+		name := fmt.Sprintf("images/%d%s", i+1, imageExtension(mediaType))
+		c.images[bin.attrs["id"]] = name
+		out.Resources = append(out.Resources, epub.Resource{Name: name, MediaType: mediaType, Data: data})
+	}
+
+	desc := book.child("description")
+	if info := desc.child("title-info"); info != nil {
+		out.Title = info.child("book-title").plainText()
+		out.Language = info.child("lang").plainText()
+		out.Description = info.child("annotation").plainText()
+		for _, a := range info.all("author") {
+			if name := authorName(a); name != "" {
+				out.Authors = append(out.Authors, name)
+			}
+		}
+		if cover := info.child("coverpage"); cover != nil {
+			if img := cover.child("image"); img != nil {
+				id := strings.TrimPrefix(img.attrs["href"], "#")
+				for i, r := range out.Resources {
+					if r.Name == c.images[id] {
+						out.Cover = &r
+						out.Resources = slices.Delete(out.Resources, i, i+1)
+						break
+					}
+				}
+			}
+		}
+	}
+	if publish := desc.child("publish-info"); publish != nil {
+		out.Publisher = publish.child("publisher").plainText()
+	}
+	if out.Title == "" {
+		out.Title = titleFromPath(src)
+	}
+
+	// chapters are the top level sections of every body, the first body is the main
+	// text and any other (usually notes) follows it
+	type part struct {
+		title string
+		nodes []*node
+	}
+	var parts []part
+	for i, body := range book.all("body") {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if i > 0 {
+			// notes stay together instead of making a chapter of every note
+			title := body.child("title").plainText()
+			if title == "" {
+				title = "Notes"
+			}
+			parts = append(parts, part{title: title, nodes: body.children})
+			continue
+		}
+
+		// content before the first section (title, epigraphs) gets a chapter of its own
+		var intro []*node
+		var sections []part
+		for _, n := range body.children {
+			switch {
+			case n.name == "section":
+				sections = append(sections, part{title: n.child("title").plainText(), nodes: []*node{n}})
+			case n.name != "" && len(sections) == 0:
+				intro = append(intro, n)
+			case n.name != "":
+				last := &sections[len(sections)-1]
+				last.nodes = append(last.nodes, n)
+			}
+		}
+		if len(intro) > 0 {
+			parts = append(parts, part{title: body.child("title").plainText(), nodes: intro})
+		}
+		parts = append(parts, sections...)
+	}
+	if len(parts) == 0 {
+		return NoFB2BodyErr
+	}
+
+	// links may point into any chapter, so ids are located first
+	for i, p := range parts {
+		for _, n := range p.nodes {
+			c.collectIDs(n, epub.ChapterName(i))
+		}
+	}
+	for _, p := range parts {
+		var b strings.Builder
+		for _, n := range p.nodes {
+			c.render(&b, n, 1)
+		}
+		out.Chapters = append(out.Chapters, epub.Chapter{Title: p.title, Body: b.String()})
+	}
+
+	return out.WriteFile(dst)
+}
+
+// authorName joins the name parts of an FB2 author
+func authorName(a *node) string {
+	var parts []string
+	for _, field := range []string{"first-name", "middle-name", "last-name"} {
+		if s := a.child(field).plainText(); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if len(parts) == 0 {
+		return a.child("nickname").plainText()
+	}
+	return strings.Join(parts, " ")
+}
+
+// collectIDs records the chapter file of every element with an id
+func (c *fb2Converter) collectIDs(n *node, file string) {
+	if id := n.attrs["id"]; id != "" {
+		c.idFiles[id] = file
+	}
+	for _, child := range n.children {
+		c.collectIDs(child, file)
+	}
+}
+
+// fb2Tags maps FB2 elements with a direct XHTML equivalent
+var fb2Tags = map[string]string{
+	"p":             "p",
+	"emphasis":      "em",
+	"strong":        "strong",
+	"strikethrough": "del",
+	"sub":           "sub",
+	"sup":           "sup",
+	"code":          "code",
+	"cite":          "blockquote",
+	"table":         "table",
+	"tr":            "tr",
+	"td":            "td",
+	"th":            "th",
+}
+
+// render writes a node as XHTML, depth is the section nesting used for headings
+func (c *fb2Converter) render(b *strings.Builder, n *node, depth int) {
+	if n.name == "" {
+		b.WriteString(html.EscapeString(n.text))
+		return
+	}
+
+	id := ""
+	if n.attrs["id"] != "" {
+		id = fmt.Sprintf(` id="%s"`, html.EscapeString(n.attrs["id"]))
+	}
+
+	switch n.name {
+	case "section":
+		fmt.Fprintf(b, "<div class=\"section\"%s>\n", id)
+		c.renderChildren(b, n, depth+1)
+		b.WriteString("</div>\n")
+	case "title":
+		level := min(depth, 6)
+		fmt.Fprintf(b, "<h%d%s>", level, id)
+		first := true
+		for _, p := range n.children {
+			if p.name != "p" {
+				continue
+			}
+			if !first {
+				b.WriteString("<br/>")
+			}
+			first = false
+			c.renderText(b, p, depth)
+		}
+		fmt.Fprintf(b, "</h%d>\n", level)
+	case "subtitle":
+		fmt.Fprintf(b, "<p class=\"noindent\"%s><strong>", id)
+		c.renderText(b, n, depth)
+		b.WriteString("</strong></p>\n")
+	case "empty-line":
+		b.WriteString("<p class=\"noindent\">&#160;</p>\n")
+	case "epigraph", "annotation":
+		fmt.Fprintf(b, "<blockquote class=\"%s\"%s>\n", n.name, id)
+		c.renderChildren(b, n, depth)
+		b.WriteString("</blockquote>\n")
+	case "text-author":
+		b.WriteString("<p class=\"noindent\"><em>")
+		c.renderText(b, n, depth)
+		b.WriteString("</em></p>\n")
+	case "poem", "stanza":
+		fmt.Fprintf(b, "<div class=\"%s\"%s>\n", n.name, id)
+		c.renderChildren(b, n, depth+1)
+		b.WriteString("</div>\n")
+	case "v":
+		b.WriteString("<p class=\"noindent\">")
+		c.renderText(b, n, depth)
+		b.WriteString("</p>\n")
+	case "image":
+		name, ok := c.images[strings.TrimPrefix(n.attrs["href"], "#")]
+		if !ok {
+			return
+		}
+		img := fmt.Sprintf(`<img src="%s" alt="%s"/>`, html.EscapeString(name), html.EscapeString(n.attrs["alt"]))
+		if c.inText > 0 {
+			b.WriteString(img)
+		} else {
+			fmt.Fprintf(b, "<div class=\"image\"%s>%s</div>\n", id, img)
+		}
+	case "a":
+		href := n.attrs["href"]
+		if target, ok := strings.CutPrefix(href, "#"); ok {
+			file, found := c.idFiles[target]
+			if !found {
+				c.renderChildren(b, n, depth) // dangling link, keep the text
+				return
+			}
+			href = file + "#" + target
+		}
+		fmt.Fprintf(b, `<a href="%s"%s>`, html.EscapeString(href), id)
+		c.renderChildren(b, n, depth)
+		b.WriteString("</a>")
+	default:
+		tag, ok := fb2Tags[n.name]
+		if !ok {
+			c.renderChildren(b, n, depth) // unknown element, keep its content
+			return
+		}
+		fmt.Fprintf(b, "<%s%s>", tag, id)
+		if isBlockContainer(n.name) {
+			c.renderChildren(b, n, depth)
+		} else {
+			c.renderText(b, n, depth)
+		}
+		fmt.Fprintf(b, "</%s>", tag)
+		if tag == "p" || tag == "blockquote" || tag == "table" || tag == "tr" {
+			b.WriteString("\n")
+		}
+	}
+}
+
+// renderText renders the children of an element holding text
+func (c *fb2Converter) renderText(b *strings.Builder, n *node, depth int) {
+	c.inText++
+	c.renderChildren(b, n, depth)
+	c.inText--
+}
+
+// renderChildren renders the children of an element
+func (c *fb2Converter) renderChildren(b *strings.Builder, n *node, depth int) {
+	for _, child := range n.children {
+		if child.name == "" && n.name != "" && isBlockContainer(n.name) && strings.TrimSpace(child.text) == "" {
+			continue // whitespace between block elements
+		}
+		c.render(b, child, depth)
+	}
+}
+
+// isBlockContainer reports elements which only hold other blocks
+func isBlockContainer(name string) bool {
+	switch name {
+	case "section", "body", "epigraph", "annotation", "poem", "stanza", "cite", "title", "table", "tr":
+		return true
+	}
+	return false
+}
+
+// imageExtension returns a file extension for an image media type
+func imageExtension(mediaType string) string {
+	switch mediaType {
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/svg+xml":
+		return ".svg"
+	default:
+		return ".jpg"
+	}
+}
@@ -0,0 +1,159 @@
+package convert
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/roshanlc/send-to-kindle/internal/format"
+)
+
+// copyTestdata copies a file of testdata into a temporary directory
+func copyTestdata(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readEntries returns the entries of an archive
+func readEntries(t *testing.T, path string) map[string]string {
+	t.Helper()
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	entries := map[string]string{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[f.Name] = string(data)
+	}
+	return entries
+}
+
+func TestFB2ToEPUB(t *testing.T) {
+	src := copyTestdata(t, "book.fb2")
+	dst, err := Convert(context.Background(), src, format.Unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Ext(dst) != ".epub" {
+		t.Fatalf("converted to %s", dst)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Error("original was kept")
+	}
+	if f, _, err := format.Detect(dst); err != nil || f != format.EPUB {
+		t.Fatalf("result detected as %s, %v", f, err)
+	}
+
+	entries := readEntries(t, dst)
+	contains := map[string][]string{
+		"OEBPS/content.opf": {
+			"<dc:title>A Wizard of Earthsea</dc:title>",
+			"<dc:creator>Ursula K. Le Guin</dc:creator>",
+			"<dc:creator>anon</dc:creator>",
+			"<dc:publisher>Parnassus &amp; Co</dc:publisher>",
+			"<dc:description>A boy learns true names.</dc:description>",
+			`href="images/1.png" media-type="image/png" properties="cover-image"`,
+			`href="images/2.png" media-type="image/png"`,
+		},
+		// title and epigraph before the first section
+		"OEBPS/chapter-001.xhtml": {
+			"<h1>A Wizard of Earthsea</h1>",
+			`<blockquote class="epigraph">`,
+			"<em>The Creation of Éa</em>",
+		},
+		"OEBPS/chapter-002.xhtml": {
+			`<div class="section" id="ch1">`,
+			"<h2>Chapter 1<br/>Warriors in the Mist</h2>",
+			`<a href="chapter-004.xhtml#n1">1</a>`,
+			"<em>single</em>",
+			`<p>A map: <img src="images/2.png" alt=""/></p>`,
+			"<p>See nowhere &lt;here&gt;.</p>",
+		},
+		"OEBPS/chapter-003.xhtml": {
+			"<strong>The Shadow</strong>",
+			`<div class="stanza">`,
+			`<a href="chapter-002.xhtml#ch1">back</a>`,
+		},
+		"OEBPS/chapter-004.xhtml": {
+			`<div class="section" id="n1">`,
+			"An island of the Archipelago.",
+		},
+		"OEBPS/toc.ncx": {
+			"<text>Chapter 1 Warriors in the Mist</text>",
+			"<text>Notes</text>",
+		},
+	}
+	for name, wants := range contains {
+		for _, want := range wants {
+			if !strings.Contains(entries[name], want) {
+				t.Errorf("%s lacks %s", name, want)
+			}
+		}
+	}
+	if _, ok := entries["OEBPS/chapter-005.xhtml"]; ok {
+		t.Error("notes were split into several chapters")
+	}
+	if _, ok := entries["OEBPS/images/3.jpg"]; ok {
+		t.Error("broken image was added")
+	}
+}
+
+func TestParseFB2Encoding(t *testing.T) {
+	// "Привет" in windows-1251, as many older FB2 files are
+	doc := "<?xml version=\"1.0\" encoding=\"windows-1251\"?>\n" +
+		"<FictionBook><body><section><p>\xcf\xf0\xe8\xe2\xe5\xf2 &mdash; world</p></section></body></FictionBook>"
+	book, err := parseFB2(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := book.child("body").plainText(), "Привет — world"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestFB2ToEPUBInvalid(t *testing.T) {
+	tests := map[string]string{
+		"no body":    `<FictionBook><description><title-info><book-title>Empty</book-title></title-info></description></FictionBook>`,
+		"other root": `<html><body><p>text</p></body></html>`,
+		"truncated":  "<FictionBook><body><section><p>unclosed",
+	}
+	for name, doc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "book.fb2")
+			if err := os.WriteFile(src, []byte(doc), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			err := fb2ToEPUB(context.Background(), src, filepath.Join(dir, "book.epub"))
+			if err == nil {
+				t.Fatal("invalid document was converted")
+			}
+			if name == "no body" && !errors.Is(err, NoFB2BodyErr) {
+				t.Fatalf("got %v, want NoFB2BodyErr", err)
+			}
+		})
+	}
+}
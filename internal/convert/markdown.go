@@ -0,0 +1,438 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/roshanlc/send-to-kindle/internal/epub"
+)
+
+// maxChapterBytes keeps chapter documents small, e-readers get slow with large ones
+const maxChapterBytes = 200 << 10
+
+// block is a rendered top level block, level is set for headings
+type block struct {
+	html  string
+	level int
+	text  string // plain text of headings
+}
+
+var (
+	atxHeading    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	setextLine    = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	thematicBreak = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	fenceOpen     = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})")
+	listItem      = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])([ \t]+|$)`)
+	chapterLine   = regexp.MustCompile(`(?i)^(chapter|part|book|prologue|epilogue)\b([ \t]+([0-9]+|[ivxlcdm]+)\b)?`)
+)
+
+// markdownToEPUB converts a Markdown document, chapters start at the top level headings
+func markdownToEPUB(ctx context.Context, src string, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	blocks := renderMarkdown(splitLines(data))
+
+	title := ""
+	counts := map[int]int{}
+	for _, b := range blocks {
+		if b.level > 0 {
+			counts[b.level]++
+			if title == "" && b.level == 1 {
+				title = b.text
+			}
+		}
+	}
+	if title == "" {
+		title = titleFromPath(src)
+	}
+
+	// split at the highest heading level which occurs more than once
+	splitLevel := 0
+	for level := 1; level <= 2; level++ {
+		if counts[level] > 1 {
+			splitLevel = level
+			break
+		}
+	}
+
+	book := epub.Book{Title: title, Chapters: chapters(blocks, splitLevel)}
+	return book.WriteFile(dst)
+}
+
+// textToEPUB converts a plain text file. Paragraphs are separated by blank lines and
+// lines such as "Chapter 12" standing alone start a new chapter.
+func textToEPUB(ctx context.Context, src string, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	var blocks []block
+	var para []string
+	flush := func() {
+		if len(para) == 0 {
+			return
+		}
+		text := strings.Join(para, " ")
+		if len(para) == 1 && len(text) < 80 && chapterLine.MatchString(text) {
+			blocks = append(blocks, block{html: "<h2>" + html.EscapeString(text) + "</h2>", level: 2, text: text})
+		} else {
+			blocks = append(blocks, block{html: "<p>" + html.EscapeString(text) + "</p>"})
+		}
+		para = para[:0]
+	}
+	for _, line := range splitLines(data) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			flush()
+			continue
+		}
+		para = append(para, line)
+	}
+	flush()
+
+	book := epub.Book{Title: titleFromPath(src), Chapters: chapters(blocks, 2)}
+	return book.WriteFile(dst)
+}
+
+// chapters groups blocks into chapters starting at headings of splitLevel (0 for none),
+// chapters too large for e-readers continue in untitled documents
+func chapters(blocks []block, splitLevel int) []epub.Chapter {
+	var result []epub.Chapter
+	var body strings.Builder
+	title := ""
+	flush := func() {
+		if body.Len() > 0 {
+			result = append(result, epub.Chapter{Title: title, Body: body.String()})
+		}
+		body.Reset()
+		title = ""
+	}
+	for _, b := range blocks {
+		if splitLevel > 0 && b.level == splitLevel || body.Len()+len(b.html) > maxChapterBytes {
+			flush()
+		}
+		if b.level > 0 && b.level <= max(splitLevel, 1) && title == "" && body.Len() == 0 {
+			title = b.text
+		}
+		body.WriteString(b.html)
+		body.WriteString("\n")
+	}
+	flush()
+	if len(result) == 0 {
+		result = append(result, epub.Chapter{Body: "<p></p>"})
+	}
+	return result
+}
+
+// splitLines splits text into lines, dropping a byte order mark and expanding tabs
+func splitLines(data []byte) []string {
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	text = strings.ReplaceAll(text, "\t", "    ")
+	return strings.Split(text, "\n")
+}
+
+// renderMarkdown renders the common subset of Markdown: headings, paragraphs,
+// emphasis, code, block quotes, lists, links and rules. Raw HTML is shown as text.
+func renderMarkdown(lines []string) []block {
+	var blocks []block
+	var para []string
+
+	flushPara := func() {
+		if len(para) > 0 {
+			blocks = append(blocks, block{html: "<p>" + renderInline(strings.Join(para, "\n")) + "</p>"})
+			para = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "":
+			flushPara()
+
+		case fenceOpen.MatchString(line):
+			flushPara()
+			m := fenceOpen.FindStringSubmatch(line)
+			fence := m[2]
+			var code []string
+			for i++; i < len(lines); i++ {
+				if strings.HasPrefix(strings.TrimSpace(lines[i]), fence[:3]) && strings.Trim(strings.TrimSpace(lines[i]), fence[:1]) == "" {
+					break
+				}
+				code = append(code, strings.TrimPrefix(lines[i], m[1]))
+			}
+			blocks = append(blocks, block{html: "<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>"})
+
+		case atxHeading.MatchString(line):
+			flushPara()
+			m := atxHeading.FindStringSubmatch(line)
+			blocks = append(blocks, heading(len(m[1]), m[2]))
+
+		case len(para) > 0 && setextLine.MatchString(line):
+			level := 2
+			if strings.TrimSpace(line)[0] == '=' {
+				level = 1
+			}
+			text := strings.Join(para, " ")
+			para = nil
+			blocks = append(blocks, heading(level, text))
+
+		case thematicBreak.MatchString(line):
+			flushPara()
+			blocks = append(blocks, block{html: "<hr/>"})
+
+		case strings.HasPrefix(trimmed, ">"):
+			flushPara()
+			var quoted []string
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+				l := strings.TrimSpace(lines[i])
+				if rest, ok := strings.CutPrefix(l, ">"); ok {
+					l = strings.TrimPrefix(rest, " ")
+				}
+				quoted = append(quoted, l)
+			}
+			blocks = append(blocks, block{html: "<blockquote>\n" + joinBlocks(renderMarkdown(quoted)) + "</blockquote>"})
+
+		case listItem.MatchString(line):
+			flushPara()
+			var items [][]string
+			ordered := !strings.ContainsAny(listItem.FindStringSubmatch(line)[2], "-*+")
+			for i < len(lines) {
+				m := listItem.FindStringSubmatch(lines[i])
+				if m == nil || ordered == strings.ContainsAny(m[2], "-*+") {
+					break // a different kind of marker starts a new list
+				}
+				indent := len(m[0])
+				item := []string{lines[i][indent:]}
+				// the item continues with indented lines and lazy paragraph lines
+				for i++; i < len(lines); i++ {
+					l := lines[i]
+					if strings.TrimSpace(l) == "" {
+						if i+1 < len(lines) && leadingSpaces(lines[i+1]) >= 2 {
+							item = append(item, "")
+							continue
+						}
+						break
+					}
+					if leadingSpaces(l) >= 2 {
+						item = append(item, strings.TrimPrefix(l, strings.Repeat(" ", min(indent, leadingSpaces(l)))))
+						continue
+					}
+					if listItem.MatchString(l) || startsBlock(l) {
+						break
+					}
+					item = append(item, l)
+				}
+				items = append(items, item)
+				if i < len(lines) && strings.TrimSpace(lines[i]) == "" && i+1 < len(lines) && listItem.MatchString(lines[i+1]) {
+					i++ // loose list, items separated by blank lines
+				}
+			}
+			i--
+
+			tag := "ul"
+			if ordered {
+				tag = "ol"
+			}
+			var b strings.Builder
+			b.WriteString("<" + tag + ">\n")
+			for _, item := range items {
+				inner := renderMarkdown(item)
+				// tight items hold a single paragraph, shown without the paragraph
+				if len(inner) == 1 && strings.HasPrefix(inner[0].html, "<p>") {
+					b.WriteString("<li>" + strings.TrimSuffix(strings.TrimPrefix(inner[0].html, "<p>"), "</p>") + "</li>\n")
+				} else {
+					b.WriteString("<li>" + joinBlocks(inner) + "</li>\n")
+				}
+			}
+			b.WriteString("</" + tag + ">")
+			blocks = append(blocks, block{html: b.String()})
+
+		case len(para) == 0 && leadingSpaces(line) >= 4:
+			var code []string
+			for ; i < len(lines) && (leadingSpaces(lines[i]) >= 4 || strings.TrimSpace(lines[i]) == ""); i++ {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+			}
+			i--
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			blocks = append(blocks, block{html: "<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>"})
+
+		default:
+			para = append(para, strings.TrimLeft(line, " "))
+		}
+	}
+	flushPara()
+	return blocks
+}
+
+// heading returns a heading block
+func heading(level int, text string) block {
+	text = strings.TrimSpace(text)
+	return block{
+		html:  fmt.Sprintf("<h%d>%s</h%d>", level, renderInline(text), level),
+		level: level,
+		text:  plainInline(text),
+	}
+}
+
+// startsBlock reports whether a line interrupts a paragraph
+func startsBlock(line string) bool {
+	return atxHeading.MatchString(line) || thematicBreak.MatchString(line) ||
+		fenceOpen.MatchString(line) || strings.HasPrefix(strings.TrimSpace(line), ">")
+}
+
+// leadingSpaces counts the spaces at the start of line
+func leadingSpaces(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// joinBlocks concatenates rendered blocks
+func joinBlocks(blocks []block) string {
+	var b strings.Builder
+	for _, bl := range blocks {
+		b.WriteString(bl.html)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+var (
+	linkPattern     = regexp.MustCompile(`^!?\[((?:[^\[\]\\]|\\.)*)\]\(\s*<?([^\s>)]*)>?(?:\s+"[^"]*")?\s*\)`)
+	autolinkPattern = regexp.MustCompile(`^<((?:https?|mailto):[^\s<>]+)>`)
+	tagPattern      = regexp.MustCompile(`<[^>]*>`)
+)
+
+// renderInline renders the inline markup of a paragraph or heading
+func renderInline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_{}[]()#+-.!<>|~\"'", s[i+1]) >= 0:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			b.WriteString("<br/>\n")
+			i += 2
+			continue
+
+		case c == ' ' && strings.HasPrefix(s[i:], "  \n"):
+			b.WriteString("<br/>\n")
+			i += 3
+			for i < len(s) && s[i] == ' ' {
+				i++
+			}
+			continue
+
+		case c == '`':
+			run := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+			fence := s[i : i+run]
+			if end := strings.Index(s[i+run:], fence); end >= 0 {
+				code := strings.TrimSpace(strings.ReplaceAll(s[i+run:i+run+end], "\n", " "))
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += run + end + run
+				continue
+			}
+			b.WriteString(fence)
+			i += run
+			continue
+
+		case c == '[' || c == '!' && strings.HasPrefix(s[i:], "!["):
+			if m := linkPattern.FindStringSubmatch(s[i:]); m != nil {
+				if c == '!' {
+					// images are not fetched, their description stands in for them
+					if m[1] != "" {
+						b.WriteString("<em>" + renderInline(m[1]) + "</em>")
+					}
+				} else {
+					fmt.Fprintf(&b, `<a href="%s">%s</a>`, html.EscapeString(m[2]), renderInline(m[1]))
+				}
+				i += len(m[0])
+				continue
+			}
+
+		case c == '<':
+			if m := autolinkPattern.FindStringSubmatch(s[i:]); m != nil {
+				fmt.Fprintf(&b, `<a href="%s">%s</a>`, html.EscapeString(m[1]), html.EscapeString(m[1]))
+				i += len(m[0])
+				continue
+			}
+
+		case c == '*' || c == '_':
+			if n, tag, inner, ok := emphasis(s, i); ok {
+				b.WriteString("<" + tag + ">" + renderInline(inner) + "</" + tag + ">")
+				i += n
+				continue
+			}
+		}
+		b.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+	return b.String()
+}
+
+// emphasis matches emphasis starting at s[i]. Returns the length of the whole
+// span, the tag to use and the emphasized text.
+func emphasis(s string, i int) (int, string, string, bool) {
+	c := s[i]
+	// underscores within words are not emphasis
+	if c == '_' && i > 0 && isWordByte(s[i-1]) {
+		return 0, "", "", false
+	}
+	for _, delim := range []string{strings.Repeat(string(c), 2), string(c)} {
+		if !strings.HasPrefix(s[i:], delim) {
+			continue
+		}
+		start := i + len(delim)
+		if start >= len(s) || s[start] == ' ' || s[start] == '\n' {
+			continue
+		}
+		for j := start + 1; j <= len(s)-len(delim); j++ {
+			if !strings.HasPrefix(s[j:], delim) || s[j-1] == ' ' || s[j-1] == '\\' {
+				continue
+			}
+			end := j + len(delim)
+			if c == '_' && end < len(s) && isWordByte(s[end]) {
+				continue
+			}
+			// a single delimiter must not close on the start of a double one
+			if len(delim) == 1 && end < len(s) && s[end] == c {
+				j++
+				continue
+			}
+			tag := "em"
+			if len(delim) == 2 {
+				tag = "strong"
+			}
+			return end - i, tag, s[start:j], true
+		}
+	}
+	return 0, "", "", false
+}
+
+// isWordByte reports letters and digits, treating any non ascii byte as a letter
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// plainInline strips the inline markup, for headings used as titles
+func plainInline(s string) string {
+	s = html.UnescapeString(tagPattern.ReplaceAllString(renderInline(s), ""))
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// apiTokenColumns are the columns read by scanAPIToken, in order
+const apiTokenColumns = `id,user_id,name,token_hash,prefix,expires_at,last_used_at,added_at`
+
+// lastUsedPrecision is how often the last use of a token is written, not on every request
+const lastUsedPrecision = time.Minute
+
+// scanAPIToken reads a token selected with apiTokenColumns
+func scanAPIToken(row rowScanner) (APIToken, error) {
+	var token APIToken
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		&token.TokenHash,
+		&token.Prefix,
+		&expiresAt,
+		&lastUsedAt,
+		&token.AddedAt,
+	)
+	if err != nil {
+		return APIToken{}, err
+	}
+	token.ExpiresAt = expiresAt.Time
+	token.LastUsedAt = lastUsedAt.Time
+	return token, nil
+}
+
+// GetAPITokenByHash retrieves the token with the given hash
+func (db *DB) GetAPITokenByHash(tokenHash string) (APIToken, error) {
+	query := `SELECT ` + apiTokenColumns + ` FROM api_tokens WHERE token_hash = ?;`
+	return scanAPIToken(db.Database.QueryRow(query, tokenHash))
+}
+
+// ListAPITokens retrieves the tokens of a user, newest first
+func (db *DB) ListAPITokens(userID int) ([]APIToken, error) {
+	query := `SELECT ` + apiTokenColumns + ` FROM api_tokens WHERE user_id = ? ORDER BY added_at DESC, id DESC;`
+	result, err := db.Database.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var tokens []APIToken
+	for result.Next() {
+		token, err := scanAPIToken(result)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, result.Err()
+}
+
+// AddAPIToken adds a token, names are unique per user
+func (db *DB) AddAPIToken(token APIToken) (int, error) {
+	if token.UserID == 0 {
+		return 0, fmt.Errorf("userID cannot be empty")
+	}
+	if strings.TrimSpace(token.Name) == "" {
+		return 0, fmt.Errorf("name cannot be empty")
+	}
+	if token.TokenHash == "" {
+		return 0, fmt.Errorf("token hash cannot be empty")
+	}
+
+	var expiresAt sql.NullTime
+	if !token.ExpiresAt.IsZero() {
+		expiresAt.Time = token.ExpiresAt.UTC()
+		expiresAt.Valid = true
+	}
+
+	query := `INSERT INTO api_tokens (user_id,name,token_hash,prefix,expires_at) VALUES(?,?,?,?,?);`
+	result, err := db.Database.Exec(query,
+		token.UserID,
+		token.Name,
+		token.TokenHash,
+		token.Prefix,
+		expiresAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// TouchAPIToken records that a token was just used, atmost once every lastUsedPrecision
+func (db *DB) TouchAPIToken(token APIToken) error {
+	now := time.Now().UTC()
+	if now.Sub(token.LastUsedAt) < lastUsedPrecision {
+		return nil
+	}
+	_, err := db.Database.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?;`, now, token.ID)
+	return err
+}
+
+// DeleteAPIToken revokes a token of a user
+func (db *DB) DeleteAPIToken(userID, tokenID int) error {
+	result, err := db.Database.Exec(`DELETE FROM api_tokens WHERE id = ? AND user_id = ?;`, tokenID, userID)
+	if err != nil {
+		return err
+	}
+
+	r, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if r == 0 {
+		return ErrNoRowDeleted
+	}
+	return nil
+}
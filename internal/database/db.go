@@ -3,6 +3,7 @@ package database
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 )
 
 const (
@@ -37,6 +38,113 @@ BEGIN
 END;`
 )
 
+// migrations are applied in order on top of the tables created by tablesQuery.
+// The number of applied migrations is tracked with PRAGMA user_version,
+// so new migrations must only ever be appended.
+var migrations = []string{
+	// 1: retry bookkeeping and dead-letter state, sqlite can't alter a CHECK so the table is rebuilt
+	`CREATE TABLE tasks_new(
+id TEXT PRIMARY KEY,
+user_id INT,
+url TEXT NOT NULL,
+title TEXT,
+state TEXT NOT NULL CHECK (state IN ('pending', 'ongoing', 'complete', 'failed', 'dead')),
+error_message TEXT DEFAULT NULL,
+attempts INT NOT NULL DEFAULT 0,        -- number of processing attempts made so far
+next_attempt_at DATETIME DEFAULT NULL,  -- when the next retry is due
+added_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO tasks_new(id, user_id, url, title, state, error_message, added_at, updated_at)
+SELECT id, user_id, url, title, state, error_message, added_at, updated_at FROM tasks;
+DROP TABLE tasks;
+ALTER TABLE tasks_new RENAME TO tasks;`,
+
+	// 2: download progress
+	`ALTER TABLE tasks ADD COLUMN bytes_received INT NOT NULL DEFAULT 0;
+ALTER TABLE tasks ADD COLUMN bytes_total INT NOT NULL DEFAULT -1; -- -1 when size is unknown`,
+
+	// 3: book metadata
+	`ALTER TABLE tasks ADD COLUMN author TEXT;
+ALTER TABLE tasks ADD COLUMN language TEXT;
+ALTER TABLE tasks ADD COLUMN publisher TEXT;
+ALTER TABLE tasks ADD COLUMN cover BLOB;      -- cover thumbnail
+ALTER TABLE tasks ADD COLUMN cover_type TEXT; -- media type of cover`,
+
+	// 4: format the file is converted to, empty for automatic
+	`ALTER TABLE tasks ADD COLUMN target_format TEXT NOT NULL DEFAULT '';`,
+
+	// 5: parts of a book split to fit the attachment size limit are tracked as child tasks
+	`ALTER TABLE tasks ADD COLUMN parent_id TEXT DEFAULT NULL;
+ALTER TABLE tasks ADD COLUMN part INT NOT NULL DEFAULT 0; -- 1 based number of the part
+CREATE INDEX idx_tasks_parent_id ON tasks(parent_id);`,
+
+	// 6: attached PDFs are sent with the convert subject
+	`ALTER TABLE tasks ADD COLUMN convert_pdf INT NOT NULL DEFAULT 0;`,
+
+	// 7: oauth2 tokens of the smtp account, encrypted by the application
+	`CREATE TABLE oauth_tokens(
+name TEXT PRIMARY KEY,        -- account the tokens belong to
+refresh_token BLOB NOT NULL,
+access_token BLOB DEFAULT NULL,
+expires_at DATETIME DEFAULT NULL, -- when the access token expires
+updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`,
+
+	// 8: delivery confirmation from the replies of Amazon
+	`ALTER TABLE tasks ADD COLUMN message_id TEXT DEFAULT NULL;            -- Message-ID of the mail carrying the book
+ALTER TABLE tasks ADD COLUMN delivery_status TEXT NOT NULL DEFAULT ''; -- sent, delivered or rejected
+CREATE INDEX idx_tasks_message_id ON tasks(message_id);
+CREATE TABLE mailbox_cursors(
+name TEXT PRIMARY KEY,      -- mailbox being polled
+uid_validity INT NOT NULL,  -- uids are only comparable within the same validity
+last_uid INT NOT NULL       -- last message handled
+);`,
+
+	// 9: books uploaded or mailed in instead of downloaded
+	`ALTER TABLE tasks ADD COLUMN local_file TEXT DEFAULT NULL; -- path of the uploaded file, the url is not downloaded when set`,
+
+	// 10: history is listed per user
+	`CREATE INDEX idx_tasks_user_id ON tasks(user_id);`,
+
+	// 11: roles, admins manage the users
+	`ALTER TABLE users ADD COLUMN is_admin INT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN disabled INT NOT NULL DEFAULT 0; -- disabled users can't log in`,
+
+	// 12: Kindle devices of the users replace users.smtp_to, every address becomes a default device
+	`CREATE TABLE devices(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+user_id INT NOT NULL,
+name TEXT NOT NULL,
+email TEXT NOT NULL,
+is_default INT NOT NULL DEFAULT 0,   -- picked when a submission names no devices
+format TEXT NOT NULL DEFAULT '',     -- preferred format, empty for automatic
+added_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+UNIQUE(user_id, name)
+);
+INSERT INTO devices(user_id, name, email, is_default)
+WITH RECURSIVE split(user_id, address, rest) AS (
+  SELECT id, '', smtp_to || ',' FROM users WHERE smtp_to IS NOT NULL AND smtp_to != ''
+  UNION ALL
+  SELECT user_id, trim(substr(rest, 1, instr(rest, ',') - 1)), substr(rest, instr(rest, ',') + 1) FROM split WHERE rest != ''
+)
+SELECT DISTINCT user_id, address, address, 1 FROM split WHERE address != '';
+ALTER TABLE tasks ADD COLUMN send_to TEXT DEFAULT NULL; -- addresses of the devices picked on submission`,
+
+	// 13: personal api tokens for clients without the session cookie
+	`CREATE TABLE api_tokens(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+user_id INT NOT NULL,
+name TEXT NOT NULL,
+token_hash TEXT NOT NULL UNIQUE,  -- sha256 of the token, the token itself is only shown once
+prefix TEXT NOT NULL,             -- start of the token, tells tokens apart in the list
+expires_at DATETIME DEFAULT NULL, -- never expires when NULL
+last_used_at DATETIME DEFAULT NULL,
+added_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+UNIQUE(user_id, name)
+);`,
+}
+
 var (
 	ErrNilDBConn    = errors.New("nil database connection")
 	ErrNoRowDeleted = errors.New("no matching row could be found to delete")
@@ -76,6 +184,11 @@ func (d *DB) Setup() error {
 		return err
 	}
 
+	err = migrate(tx)
+	if err != nil {
+		return err
+	}
+
 	_, err = tx.Exec(triggerQuery)
 	if err != nil {
 		return err
@@ -87,3 +200,23 @@ func (d *DB) Setup() error {
 	}
 	return nil
 }
+
+// migrate applies the migrations which have not been applied yet
+func migrate(tx *sql.Tx) error {
+	var version int
+	err := tx.QueryRow(`PRAGMA user_version;`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		_, err = tx.Exec(migrations[i])
+		if err != nil {
+			return fmt.Errorf("error while applying migration %d: %w", i+1, err)
+		}
+	}
+
+	// pragma does not support placeholders
+	_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d;`, len(migrations)))
+	return err
+}
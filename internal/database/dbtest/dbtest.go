@@ -0,0 +1,31 @@
+// Package dbtest provides set up databases for tests
+package dbtest
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	_ "modernc.org/sqlite"
+)
+
+// New returns a set up database in a temporary file, along with its connection.
+// A file is used so that every connection of the pool sees the same database.
+// The connection is closed when the test ends.
+func New(t testing.TB) (*database.DB, *sql.DB) {
+	t.Helper()
+	dbConn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "db.sqlite")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbConn.Close() })
+	db, err := database.New(dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	return db, dbConn
+}
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// deviceColumns are the columns read by scanDevice, in order
+const deviceColumns = `id,user_id,name,email,is_default,format,added_at`
+
+// scanDevice reads a device selected with deviceColumns
+func scanDevice(row rowScanner) (Device, error) {
+	var device Device
+	err := row.Scan(
+		&device.ID,
+		&device.UserID,
+		&device.Name,
+		&device.Email,
+		&device.IsDefault,
+		&device.Format,
+		&device.AddedAt,
+	)
+	if err != nil {
+		return Device{}, err
+	}
+	return device, nil
+}
+
+func validateDevice(device *Device) error {
+	if device.UserID == 0 {
+		return fmt.Errorf("userID cannot be empty")
+	}
+	if strings.TrimSpace(device.Name) == "" {
+		return fmt.Errorf("name cannot be empty")
+	}
+	if strings.TrimSpace(device.Email) == "" {
+		return fmt.Errorf("email cannot be empty")
+	}
+	return nil
+}
+
+// GetDevice retrieves a device of a user
+func (db *DB) GetDevice(userID, deviceID int) (Device, error) {
+	query := `SELECT ` + deviceColumns + ` FROM devices WHERE id = ? AND user_id = ?;`
+	return scanDevice(db.Database.QueryRow(query, deviceID, userID))
+}
+
+// ListDevices retrieves the devices of a user, by name
+func (db *DB) ListDevices(userID int) ([]Device, error) {
+	query := `SELECT ` + deviceColumns + ` FROM devices WHERE user_id = ? ORDER BY name COLLATE NOCASE;`
+	result, err := db.Database.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var devices []Device
+	for result.Next() {
+		device, err := scanDevice(result)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, result.Err()
+}
+
+// ListDefaultDevices retrieves the devices of a user which are picked when a submission
+// names none
+func (db *DB) ListDefaultDevices(userID int) ([]Device, error) {
+	devices, err := db.ListDevices(userID)
+	if err != nil {
+		return nil, err
+	}
+	defaults := devices[:0]
+	for _, device := range devices {
+		if device.IsDefault {
+			defaults = append(defaults, device)
+		}
+	}
+	return defaults, nil
+}
+
+// AddDevice adds a device, names are unique per user
+func (db *DB) AddDevice(device Device) (int, error) {
+	err := validateDevice(&device)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `INSERT INTO devices (user_id,name,email,is_default,format) VALUES(?,?,?,?,?);`
+	result, err := db.Database.Exec(query,
+		device.UserID,
+		device.Name,
+		device.Email,
+		device.IsDefault,
+		device.Format,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// UpdateDevice replaces the name, email, default flag and format of a device of the user
+func (db *DB) UpdateDevice(device Device) error {
+	err := validateDevice(&device)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE devices SET name = ?, email = ?, is_default = ?, format = ? WHERE id = ? AND user_id = ?;`
+	result, err := db.Database.Exec(query,
+		device.Name,
+		device.Email,
+		device.IsDefault,
+		device.Format,
+		device.ID,
+		device.UserID,
+	)
+	if err != nil {
+		return err
+	}
+
+	r, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if r == 0 {
+		return ErrNoRowUpdated
+	}
+	return nil
+}
+
+// DeleteDevice deletes a device of a user
+func (db *DB) DeleteDevice(userID, deviceID int) error {
+	result, err := db.Database.Exec(`DELETE FROM devices WHERE id = ? AND user_id = ?;`, deviceID, userID)
+	if err != nil {
+		return err
+	}
+
+	r, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if r == 0 {
+		return ErrNoRowDeleted
+	}
+	return nil
+}
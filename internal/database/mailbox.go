@@ -0,0 +1,27 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// GetMailboxCursor retrieves how far a mailbox was read, a zero cursor when it wasn't yet
+func (db *DB) GetMailboxCursor(name string) (MailboxCursor, error) {
+	query := `SELECT uid_validity,last_uid FROM mailbox_cursors WHERE name = ?;`
+
+	cursor := MailboxCursor{Name: name}
+	err := db.Database.QueryRow(query, name).Scan(&cursor.UIDValidity, &cursor.LastUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return cursor, nil
+	}
+	return cursor, err
+}
+
+// SaveMailboxCursor inserts or replaces the cursor of a mailbox
+func (db *DB) SaveMailboxCursor(cursor MailboxCursor) error {
+	query := `INSERT INTO mailbox_cursors(name, uid_validity, last_uid) VALUES(?,?,?)
+ON CONFLICT(name) DO UPDATE SET uid_validity = excluded.uid_validity, last_uid = excluded.last_uid;`
+
+	_, err := db.Database.Exec(query, cursor.Name, cursor.UIDValidity, cursor.LastUID)
+	return err
+}
@@ -11,18 +11,53 @@ const (
 	Pending   TaskState = "pending"
 	Ongoing   TaskState = "ongoing"
 	Failed    TaskState = "failed"
+	Dead      TaskState = "dead" // failed after exhausting all retries
+)
+
+// DeliveryStatus tells what became of the mail carrying a book
+type DeliveryStatus string
+
+const (
+	DeliverySent      DeliveryStatus = "sent"      // accepted by the mail server, no word from Amazon yet
+	DeliveryDelivered DeliveryStatus = "delivered" // confirmed by Amazon
+	DeliveryRejected  DeliveryStatus = "rejected"  // refused by Amazon, the reason is in ErrorMsg
 )
 
 // Task holds details about a task entity
 type Task struct {
-	ID        string    `json:"id"`
-	UserID    int       `json:"user_id,omitempty"`
-	URL       string    `json:"url"`
-	Title     string    `json:"title"`
-	State     TaskState `json:"state"`
-	ErrorMsg  string    `json:"error_msg,omitempty"`
-	AddedAt   time.Time `json:"added_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID             string         `json:"id"`
+	UserID         int            `json:"user_id,omitempty"`
+	URL            string         `json:"url"`
+	Title          string         `json:"title"`
+	State          TaskState      `json:"state"`
+	ErrorMsg       string         `json:"error_msg,omitempty"`
+	Attempts       int            `json:"attempts"`
+	NextAttemptAt  time.Time      `json:"next_attempt_at,omitzero"`
+	BytesReceived  int64          `json:"bytes_received"`
+	BytesTotal     int64          `json:"bytes_total"` // -1 when size is unknown
+	Author         string         `json:"author,omitempty"`
+	Language       string         `json:"language,omitempty"`
+	Publisher      string         `json:"publisher,omitempty"`
+	HasCover       bool           `json:"has_cover"`
+	TargetFormat   string         `json:"target_format,omitempty"`   // empty for automatic
+	ConvertPDF     bool           `json:"convert_pdf"`               // have Send to Kindle convert a PDF to Kindle format
+	ParentID       string         `json:"parent_id,omitempty"`       // task a part belongs to
+	Part           int            `json:"part,omitempty"`            // 1 based number of a part
+	Parts          []Task         `json:"parts,omitempty"`           // parts a book was split into, filled in by ListTask
+	MessageID      string         `json:"message_id,omitempty"`      // Message-ID of the mail carrying the book
+	DeliveryStatus DeliveryStatus `json:"delivery_status,omitempty"` // empty until the mail is sent
+	LocalFile      string         `json:"-"`                         // uploaded file sent instead of downloading URL
+	SendTo         []string       `json:"send_to,omitempty"`         // Kindle addresses, the default devices of the owner when empty
+	AddedAt        time.Time      `json:"added_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+}
+
+// ProgressPercent returns the download progress in percent, -1 if the size is unknown
+func (t Task) ProgressPercent() int {
+	if t.BytesTotal <= 0 {
+		return -1
+	}
+	return int(t.BytesReceived * 100 / t.BytesTotal)
 }
 
 type User struct {
@@ -30,6 +65,51 @@ type User struct {
 	Name     string    `json:"name"`
 	Email    string    `json:"email"`
 	Password string    `json:"-"`
-	SmtpTo   []string  `json:"smtp_to"`
+	IsAdmin  bool      `json:"is_admin"` // may manage the users
+	Disabled bool      `json:"disabled"` // can't log in or mail in books
 	AddedAt  time.Time `json:"added_at"`
 }
+
+// Device is a Kindle of a user, books are mailed to its address
+type Device struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Name      string    `json:"name"`       // e.g. Paperwhite, unique per user
+	Email     string    `json:"email"`      // Send to Kindle address
+	IsDefault bool      `json:"is_default"` // picked when a submission names no devices
+	Format    string    `json:"format"`     // preferred format, empty for automatic
+	AddedAt   time.Time `json:"added_at"`
+}
+
+// APIToken lets a client act as its user without the session cookie
+type APIToken struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	Name       string    `json:"name"`                  // e.g. iPhone shortcut, unique per user
+	TokenHash  string    `json:"-"`                     // sha256 of the token
+	Prefix     string    `json:"prefix"`                // start of the token, shown in the list
+	ExpiresAt  time.Time `json:"expires_at,omitzero"`   // zero for never
+	LastUsedAt time.Time `json:"last_used_at,omitzero"` // zero until it is used
+	AddedAt    time.Time `json:"added_at"`
+}
+
+// Expired reports whether the token can't be used anymore
+func (t APIToken) Expired() bool {
+	return !t.ExpiresAt.IsZero() && !time.Now().Before(t.ExpiresAt)
+}
+
+// OAuthToken holds the oauth2 tokens of an account, encrypted by the caller
+type OAuthToken struct {
+	Name         string
+	RefreshToken []byte
+	AccessToken  []byte // nil when no access token was issued yet
+	ExpiresAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// MailboxCursor marks how far a mailbox has been read
+type MailboxCursor struct {
+	Name        string
+	UIDValidity uint32
+	LastUID     uint32
+}
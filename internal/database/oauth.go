@@ -0,0 +1,45 @@
+package database
+
+import (
+	"database/sql"
+)
+
+// GetOAuthToken retrieves the tokens of an account, sql.ErrNoRows when there are none
+func (db *DB) GetOAuthToken(name string) (OAuthToken, error) {
+	query := `SELECT refresh_token,access_token,expires_at,updated_at FROM oauth_tokens WHERE name = ?;`
+
+	token := OAuthToken{Name: name}
+	var expiresAt sql.NullTime
+	err := db.Database.QueryRow(query, name).Scan(
+		&token.RefreshToken,
+		&token.AccessToken,
+		&expiresAt,
+		&token.UpdatedAt,
+	)
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	if expiresAt.Valid {
+		token.ExpiresAt = expiresAt.Time
+	}
+	return token, nil
+}
+
+// SaveOAuthToken inserts or replaces the tokens of an account
+func (db *DB) SaveOAuthToken(token OAuthToken) error {
+	query := `INSERT INTO oauth_tokens(name, refresh_token, access_token, expires_at, updated_at)
+VALUES(?,?,?,?,CURRENT_TIMESTAMP)
+ON CONFLICT(name) DO UPDATE SET
+refresh_token = excluded.refresh_token,
+access_token = excluded.access_token,
+expires_at = excluded.expires_at,
+updated_at = CURRENT_TIMESTAMP;`
+
+	var expiresAt sql.NullTime
+	if !token.ExpiresAt.IsZero() {
+		expiresAt.Time = token.ExpiresAt.UTC()
+		expiresAt.Valid = true
+	}
+	_, err := db.Database.Exec(query, token.Name, token.RefreshToken, token.AccessToken, expiresAt)
+	return err
+}
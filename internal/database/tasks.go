@@ -6,27 +6,48 @@ import (
 	"strings"
 )
 
-// GetTask retrieves a task
-func (db *DB) GetTask(taskID string) (Task, error) {
-	query := `SELECT user_id,url,title,state,error_message,added_at,updated_at FROM tasks WHERE id = ?;`
-	result := db.Database.QueryRow(query, taskID)
+// taskColumns are the columns read by scanTask, in order
+const taskColumns = `id,user_id,url,title,state,error_message,attempts,next_attempt_at,bytes_received,bytes_total,author,language,publisher,cover IS NOT NULL,target_format,convert_pdf,parent_id,part,message_id,delivery_status,local_file,send_to,added_at,updated_at`
 
-	if err := result.Err(); err != nil {
-		return Task{}, err
-	}
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
 
-	task := Task{
-		ID: taskID,
-	}
+// scanTask reads a task selected with taskColumns
+func scanTask(row rowScanner) (Task, error) {
+	task := Task{}
 	var userID sql.NullInt32
 	var title sql.NullString
 	var errMsg sql.NullString
+	var nextAttemptAt sql.NullTime
+	var author, language, publisher sql.NullString
 	var stateText string
-	err := result.Scan(&userID,
+	var parentID, messageID, localFile, sendTo sql.NullString
+	var deliveryStatus string
+	err := row.Scan(
+		&task.ID,
+		&userID,
 		&task.URL,
 		&title,
 		&stateText,
 		&errMsg,
+		&task.Attempts,
+		&nextAttemptAt,
+		&task.BytesReceived,
+		&task.BytesTotal,
+		&author,
+		&language,
+		&publisher,
+		&task.HasCover,
+		&task.TargetFormat,
+		&task.ConvertPDF,
+		&parentID,
+		&task.Part,
+		&messageID,
+		&deliveryStatus,
+		&localFile,
+		&sendTo,
 		&task.AddedAt,
 		&task.UpdatedAt)
 
@@ -48,9 +69,34 @@ func (db *DB) GetTask(taskID string) (Task, error) {
 		task.ErrorMsg = errMsg.String
 	}
 
+	if nextAttemptAt.Valid {
+		task.NextAttemptAt = nextAttemptAt.Time
+	}
+
+	task.Author = author.String
+	task.Language = language.String
+	task.Publisher = publisher.String
+	task.ParentID = parentID.String
+	task.MessageID = messageID.String
+	task.LocalFile = localFile.String
+	task.SendTo = toReceipientArray(sendTo.String)
+	task.DeliveryStatus = DeliveryStatus(deliveryStatus)
+
 	return task, nil
 }
 
+// GetTask retrieves a task
+func (db *DB) GetTask(taskID string) (Task, error) {
+	query := `SELECT ` + taskColumns + ` FROM tasks WHERE id = ?;`
+	result := db.Database.QueryRow(query, taskID)
+
+	if err := result.Err(); err != nil {
+		return Task{}, err
+	}
+
+	return scanTask(result)
+}
+
 func validateTask(task *Task) error {
 	if task.ID == "" {
 		return fmt.Errorf("taskID cannot be empty")
@@ -80,7 +126,22 @@ func (db *DB) AddTask(task Task) error {
 	}
 	defer tx.Rollback()
 
-	query := `INSERT INTO tasks(id, user_id, url, title, state, error_message) VALUES(?,?,?,?,?,?);`
+	err = insertTask(tx, task)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// insertTask inserts a task in the transaction
+func insertTask(tx *sql.Tx, task Task) error {
+	query := `INSERT INTO tasks(id, user_id, url, title, state, error_message, target_format, convert_pdf, parent_id, part, local_file, send_to) VALUES(?,?,?,?,?,?,?,?,?,?,?,?);`
 	var userID sql.NullInt32
 	if task.UserID != 0 {
 		userID.Int32 = int32(task.UserID)
@@ -98,28 +159,42 @@ func (db *DB) AddTask(task Task) error {
 		errMsg.Valid = true
 	}
 
-	_, err = tx.Exec(query,
+	var parentID sql.NullString
+	if task.ParentID != "" {
+		parentID.String = task.ParentID
+		parentID.Valid = true
+	}
+
+	var localFile sql.NullString
+	if task.LocalFile != "" {
+		localFile.String = task.LocalFile
+		localFile.Valid = true
+	}
+
+	var sendTo sql.NullString
+	if len(task.SendTo) > 0 {
+		sendTo.String = fromReceipientArray(task.SendTo)
+		sendTo.Valid = true
+	}
+
+	_, err := tx.Exec(query,
 		task.ID,
 		userID,
 		task.URL,
 		title,
 		string(task.State),
 		errMsg,
+		task.TargetFormat,
+		task.ConvertPDF,
+		parentID,
+		task.Part,
+		localFile,
+		sendTo,
 	)
-
-	if err != nil {
-		return err
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return err
 }
 
-// DeleteTask deletes a task
+// DeleteTask deletes a task along with its parts, unless it is being processed
 func (db *DB) DeleteTask(taskID string) error {
 	tx, err := db.Database.Begin()
 	if err != nil {
@@ -127,9 +202,15 @@ func (db *DB) DeleteTask(taskID string) error {
 	}
 	defer tx.Rollback()
 
-	query := `DELETE FROM tasks WHERE id = ?;`
-	result, err := tx.Exec(query, taskID)
+	// a worker adding parts of an ongoing task would leave them without it
+	query := `DELETE FROM tasks WHERE id = ? AND state != ?;`
+	result, err := tx.Exec(query, taskID, Ongoing)
+
+	if err != nil {
+		return err
+	}
 
+	_, err = tx.Exec(`DELETE FROM tasks WHERE parent_id = ?;`, taskID)
 	if err != nil {
 		return err
 	}
@@ -150,7 +231,8 @@ func (db *DB) DeleteTask(taskID string) error {
 	return nil
 }
 
-// UpdateTask updates a task row. Supports updating the state, title, URL and ErrorMessage of the task only.
+// UpdateTask updates a task row. Supports updating the state, title, URL, ErrorMessage, NextAttemptAt,
+// MessageID and DeliveryStatus of the task only.
 // Only provide value for the property to be updated. Keep them empty if field is not be updated.
 func (db *DB) UpdateTask(task Task) error {
 	if task.ID == "" {
@@ -184,6 +266,18 @@ func (db *DB) UpdateTask(task Task) error {
 		queryParts = append(queryParts, "url = ?")
 		args = append(args, task.URL)
 	}
+	if !task.NextAttemptAt.IsZero() {
+		queryParts = append(queryParts, "next_attempt_at = ?")
+		args = append(args, task.NextAttemptAt.UTC())
+	}
+	if task.MessageID != "" {
+		queryParts = append(queryParts, "message_id = ?")
+		args = append(args, task.MessageID)
+	}
+	if task.DeliveryStatus != "" {
+		queryParts = append(queryParts, "delivery_status = ?")
+		args = append(args, string(task.DeliveryStatus))
+	}
 
 	query := fmt.Sprintf(
 		`UPDATE tasks SET %s WHERE id = ?;`,
@@ -213,12 +307,12 @@ func (db *DB) UpdateTask(task Task) error {
 	return nil
 }
 
-// ListTask retrieve tasks from db
-func (db *DB) ListTask(state []TaskState) ([]Task, error) {
+// ListTask retrieve the tasks of a user from db, parts of split books are listed under their task
+func (db *DB) ListTask(userID int, state []TaskState) ([]Task, error) {
 	var query string
-	var args []any
+	args := []any{userID}
 	if len(state) == 0 {
-		query = `SELECT id,user_id,url,title,state,error_message,added_at,updated_at FROM tasks ORDER BY added_at DESC;`
+		query = `SELECT ` + taskColumns + ` FROM tasks WHERE user_id = ? AND parent_id IS NULL ORDER BY added_at DESC;`
 	} else {
 		tmp := make([]string, 0, len(state))
 		for _, s := range state {
@@ -227,9 +321,138 @@ func (db *DB) ListTask(state []TaskState) ([]Task, error) {
 		}
 
 		query = fmt.Sprintf(
-			`SELECT id,user_id,url,title,state,error_message,added_at,updated_at FROM tasks WHERE state IN (%s) ORDER BY added_at DESC;`,
-			strings.Join(tmp, ","))
+			`SELECT %s FROM tasks WHERE user_id = ? AND parent_id IS NULL AND state IN (%s) ORDER BY added_at DESC;`,
+			taskColumns, strings.Join(tmp, ","))
+	}
+	tasks, err := db.queryTasks(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.attachParts(userID, tasks)
+	if err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// TaskFilter narrows down the tasks returned by FindTasks
+type TaskFilter struct {
+	States []TaskState // any state when empty
+	Search string      // matched against the title, author and url, ignoring case
+	Limit  int         // all tasks when 0
+	Offset int
+}
+
+// FindTasks retrieves a page of the tasks of a user matching the filter, newest first,
+// along with the number of matching tasks. Parts are listed under their task.
+func (db *DB) FindTasks(userID int, filter TaskFilter) ([]Task, int, error) {
+	where := []string{"user_id = ?", "parent_id IS NULL"}
+	args := []any{userID}
+	if len(filter.States) > 0 {
+		tmp := make([]string, 0, len(filter.States))
+		for _, s := range filter.States {
+			tmp = append(tmp, "?")
+			args = append(args, string(s))
+		}
+		where = append(where, fmt.Sprintf("state IN (%s)", strings.Join(tmp, ",")))
+	}
+	if filter.Search != "" {
+		pattern := "%" + likeEscaper.Replace(filter.Search) + "%"
+		where = append(where, `(title LIKE ? ESCAPE '\' OR author LIKE ? ESCAPE '\' OR url LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern, pattern)
+	}
+	conditions := strings.Join(where, " AND ")
+
+	var total int
+	err := db.Database.QueryRow(`SELECT COUNT(*) FROM tasks WHERE `+conditions+`;`, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1 // no limit in sqlite
+	}
+	query := fmt.Sprintf(`SELECT %s FROM tasks WHERE %s ORDER BY added_at DESC, id LIMIT ? OFFSET ?;`, taskColumns, conditions)
+	tasks, err := db.queryTasks(query, append(args, limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = db.attachParts(userID, tasks)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tasks, total, nil
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns, for use with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// attachParts fills in the parts of the tasks of a user
+func (db *DB) attachParts(userID int, tasks []Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	parts, err := db.queryTasks(`SELECT `+taskColumns+` FROM tasks WHERE user_id = ? AND parent_id IS NOT NULL ORDER BY part;`, userID)
+	if err != nil {
+		return err
+	}
+	byParent := map[string][]Task{}
+	for _, part := range parts {
+		byParent[part.ParentID] = append(byParent[part.ParentID], part)
+	}
+	for i := range tasks {
+		tasks[i].Parts = byParent[tasks[i].ID]
+	}
+	return nil
+}
+
+// ListTaskParts retrieves the parts of a split book, in order
+func (db *DB) ListTaskParts(parentID string) ([]Task, error) {
+	return db.queryTasks(`SELECT `+taskColumns+` FROM tasks WHERE parent_id = ? ORDER BY part;`, parentID)
+}
+
+// ReplaceTaskParts makes parts the parts of a split book. sql.ErrNoRows is returned
+// when the book was deleted in the meantime, its parts would be left behind otherwise.
+func (db *DB) ReplaceTaskParts(parentID string, parts []Task) error {
+	for i := range parts {
+		err := validateTask(&parts[i])
+		if err != nil {
+			return err
+		}
 	}
+
+	tx, err := db.Database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// writing first takes the lock, the book can't be deleted before the commit
+	_, err = tx.Exec(`DELETE FROM tasks WHERE parent_id = ?;`, parentID)
+	if err != nil {
+		return err
+	}
+	var exists int
+	err = tx.QueryRow(`SELECT 1 FROM tasks WHERE id = ?;`, parentID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		part.ParentID = parentID
+		err = insertTask(tx, part)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// queryTasks runs a query selecting taskColumns
+func (db *DB) queryTasks(query string, args ...any) ([]Task, error) {
 	result, err := db.Database.Query(query, args...)
 
 	if err != nil {
@@ -241,56 +464,61 @@ func (db *DB) ListTask(state []TaskState) ([]Task, error) {
 	defer result.Close()
 
 	for result.Next() {
-		task := Task{}
-		var userID sql.NullInt32
-		var title sql.NullString
-		var errMsg sql.NullString
-		var stateText string
-		err := result.Scan(
-			&task.ID,
-			&userID,
-			&task.URL,
-			&title,
-			&stateText,
-			&errMsg,
-			&task.AddedAt,
-			&task.UpdatedAt)
-
+		task, err := scanTask(result)
 		if err != nil {
 			return nil, err
 		}
+		tasks = append(tasks, task)
+	}
 
-		if title.Valid {
-			task.Title = title.String
-		}
+	return tasks, result.Err()
+}
 
-		task.State = TaskState(stateText)
+// DeleteCompletedTasks deletes the completed tasks of a user
+func (db *DB) DeleteCompletedTasks(userID int) error {
+	tx, err := db.Database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-		if userID.Valid {
-			task.UserID = int(userID.Int32)
-		}
+	query := `DELETE FROM tasks WHERE user_id = ? AND state IN (?,?,?) AND parent_id IS NULL;`
+	_, err = tx.Exec(query, userID, Completed, Failed, Dead)
 
-		if errMsg.Valid {
-			task.ErrorMsg = errMsg.String
-		}
+	if err != nil {
+		return err
+	}
 
-		tasks = append(tasks, task)
+	// parts go along with their task
+	_, err = tx.Exec(`DELETE FROM tasks WHERE parent_id IS NOT NULL AND parent_id NOT IN (SELECT id FROM tasks);`)
+	if err != nil {
+		return err
 	}
 
-	return tasks, nil
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
-// DeleteTask deletes completed tasks
-func (db *DB) DeleteCompletedTasks() error {
+// ResetTask makes a task pending again as if it was just added, its parts are deleted
+func (db *DB) ResetTask(taskID string) error {
 	tx, err := db.Database.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	query := `DELETE FROM tasks WHERE state IN (?,?);`
-	_, err = tx.Exec(query, Completed, Failed)
+	query := `UPDATE tasks SET state = ?, error_message = NULL, attempts = 0, next_attempt_at = NULL,
+bytes_received = 0, message_id = NULL, delivery_status = '' WHERE id = ?;`
+	result, err := tx.Exec(query, string(Pending), taskID)
+	if err != nil {
+		return err
+	}
 
+	_, err = tx.Exec(`DELETE FROM tasks WHERE parent_id = ?;`, taskID)
 	if err != nil {
 		return err
 	}
@@ -300,5 +528,109 @@ func (db *DB) DeleteCompletedTasks() error {
 		return err
 	}
 
+	r, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if r == 0 {
+		return ErrNoRowUpdated
+	}
+	return nil
+}
+
+// IncrementTaskAttempts increases the attempts counter of a task and returns the new count
+func (db *DB) IncrementTaskAttempts(taskID string) (int, error) {
+	query := `UPDATE tasks SET attempts = attempts + 1 WHERE id = ? RETURNING attempts;`
+
+	var attempts int
+	err := db.Database.QueryRow(query, taskID).Scan(&attempts)
+	if err != nil {
+		return 0, err
+	}
+	return attempts, nil
+}
+
+// UpdateTaskProgress records the download progress of a task
+func (db *DB) UpdateTaskProgress(taskID string, received, total int64) error {
+	query := `UPDATE tasks SET bytes_received = ?, bytes_total = ? WHERE id = ?;`
+	_, err := db.Database.Exec(query, received, total, taskID)
+	return err
+}
+
+// UpdateTaskMetadata stores the book details of a task. Title, author, language and
+// publisher are updated when non-empty, the cover when data is provided.
+func (db *DB) UpdateTaskMetadata(task Task, cover []byte, coverType string) error {
+	var (
+		queryParts []string
+		args       []any
+	)
+
+	if task.Title != "" {
+		queryParts = append(queryParts, "title = ?")
+		args = append(args, task.Title)
+	}
+	if task.Author != "" {
+		queryParts = append(queryParts, "author = ?")
+		args = append(args, task.Author)
+	}
+	if task.Language != "" {
+		queryParts = append(queryParts, "language = ?")
+		args = append(args, task.Language)
+	}
+	if task.Publisher != "" {
+		queryParts = append(queryParts, "publisher = ?")
+		args = append(args, task.Publisher)
+	}
+	if len(cover) > 0 {
+		queryParts = append(queryParts, "cover = ?", "cover_type = ?")
+		args = append(args, cover, coverType)
+	}
+	if len(queryParts) == 0 {
+		return nil
+	}
+
+	query := fmt.Sprintf(`UPDATE tasks SET %s WHERE id = ?;`, strings.Join(queryParts, ","))
+	args = append(args, task.ID)
+	result, err := db.Database.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	r, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if r == 0 {
+		return ErrNoRowUpdated
+	}
 	return nil
 }
+
+// GetTaskCover retrieves the cover thumbnail of a task along with its media type
+func (db *DB) GetTaskCover(taskID string) ([]byte, string, error) {
+	query := `SELECT cover, cover_type FROM tasks WHERE id = ? AND cover IS NOT NULL;`
+
+	var cover []byte
+	var coverType sql.NullString
+	err := db.Database.QueryRow(query, taskID).Scan(&cover, &coverType)
+	if err != nil {
+		return nil, "", err
+	}
+	return cover, coverType.String, nil
+}
+
+// GetTaskByMessageID retrieves the task whose mail had the given Message-ID
+func (db *DB) GetTaskByMessageID(messageID string) (Task, error) {
+	query := `SELECT ` + taskColumns + ` FROM tasks WHERE message_id = ?;`
+	return scanTask(db.Database.QueryRow(query, messageID))
+}
+
+// AssignUnownedTasks makes the user the owner of the tasks which have none, such as
+// the ones added before there were accounts
+func (db *DB) AssignUnownedTasks(userID int) (int64, error) {
+	result, err := db.Database.Exec(`UPDATE tasks SET user_id = ? WHERE user_id IS NULL;`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -1,31 +1,24 @@
 package database
 
 import (
-	"database/sql"
 	"fmt"
 	"strings"
 )
 
-// GetUserByID retreives a user by id
-func (db *DB) GetUserByID(userID int) (User, error) {
-	query := `SELECT name,email,password,smtp_to,added_at FROM users WHERE id = ?;`
-
-	result := db.Database.QueryRow(query, userID)
+// userColumns are the columns read by scanUser, in order
+const userColumns = `id,name,email,password,is_admin,disabled,added_at`
 
-	if err := result.Err(); err != nil {
-		return User{}, err
-	}
-
-	user := User{
-		ID: userID,
-	}
-
-	var smtpTo sql.NullString
+// scanUser reads a user selected with userColumns
+func scanUser(row rowScanner) (User, error) {
+	var user User
 
-	err := result.Scan(&user.Name,
+	err := row.Scan(
+		&user.ID,
+		&user.Name,
 		&user.Email,
 		&user.Password,
-		&smtpTo,
+		&user.IsAdmin,
+		&user.Disabled,
 		&user.AddedAt,
 	)
 
@@ -33,50 +26,47 @@ func (db *DB) GetUserByID(userID int) (User, error) {
 		return User{}, err
 	}
 
-	if smtpTo.Valid {
-		user.SmtpTo = toReceipientArray(smtpTo.String)
-	}
-
 	return user, nil
 }
 
-// GetUserByEmail retrieves a user by email
+// GetUserByID retreives a user by id
+func (db *DB) GetUserByID(userID int) (User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = ?;`
+	return scanUser(db.Database.QueryRow(query, userID))
+}
+
+// GetUserByEmail retrieves a user by email, ignoring case
 func (db *DB) GetUserByEmail(userEmail string) (User, error) {
 	if userEmail == "" {
 		return User{}, fmt.Errorf("please provide a valid non-empty email")
 	}
-	query := `SELECT id,name,email,password,smtp_to,added_at FROM users WHERE email = ?;`
-
-	result := db.Database.QueryRow(query, userEmail)
-
-	if err := result.Err(); err != nil {
-		return User{}, err
-	}
-
-	var user User
-	var smtpTo sql.NullString
-
-	err := result.Scan(
-		&user.ID,
-		&user.Name,
-		&user.Email,
-		&user.Password,
-		&smtpTo,
-		&user.AddedAt,
-	)
+	query := `SELECT ` + userColumns + ` FROM users WHERE email = ? COLLATE NOCASE;`
+	return scanUser(db.Database.QueryRow(query, userEmail))
+}
 
+// ListUsers retrieves all users, oldest first
+func (db *DB) ListUsers() ([]User, error) {
+	result, err := db.Database.Query(`SELECT ` + userColumns + ` FROM users ORDER BY id;`)
 	if err != nil {
-		return User{}, err
+		return nil, err
 	}
-
-	if smtpTo.Valid {
-		user.SmtpTo = toReceipientArray(smtpTo.String)
+	defer result.Close()
+
+	var users []User
+	for result.Next() {
+		user, err := scanUser(result)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
 	}
-
-	return user, nil
+	return users, result.Err()
 }
 
 func toReceipientArray(value string) []string {
+	if value == "" {
+		return nil
+	}
 	return strings.Split(value, ",")
 }
 
@@ -110,13 +100,13 @@ func (db *DB) AddUser(user User) (int, error) {
 	}
 	defer tx.Rollback()
 
-	query := `INSERT INTO users (name,email,password,smtp_to) VALUES(?,?,?,?);`
+	query := `INSERT INTO users (name,email,password,is_admin) VALUES(?,?,?,?);`
 
 	result, err := tx.Exec(query,
 		user.Name,
 		user.Email,
 		user.Password,
-		fromReceipientArray(user.SmtpTo),
+		user.IsAdmin,
 	)
 
 	if err != nil {
@@ -135,7 +125,7 @@ func (db *DB) AddUser(user User) (int, error) {
 	return int(id), nil
 }
 
-// DeleteUser deletes a user by id
+// DeleteUser deletes a user by id, along with the tasks, devices and api tokens of the user
 func (db *DB) DeleteUser(userID int) error {
 	tx, err := db.Database.Begin()
 	if err != nil {
@@ -151,6 +141,22 @@ func (db *DB) DeleteUser(userID int) error {
 		return err
 	}
 
+	// parts carry the owner of their task too
+	_, err = tx.Exec(`DELETE FROM tasks WHERE user_id = ?;`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM devices WHERE user_id = ?;`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM api_tokens WHERE user_id = ?;`, userID)
+	if err != nil {
+		return err
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		return err
@@ -199,11 +205,6 @@ func (db *DB) UpdateUser(user User) error {
 		args = append(args, user.Password)
 	}
 
-	if len(user.SmtpTo) != 0 {
-		queryParts = append(queryParts, "smtp_to = ?")
-		args = append(args, fromReceipientArray(user.SmtpTo))
-	}
-
 	query := fmt.Sprintf(`UPDATE users SET %s WHERE id=?;`,
 		strings.Join(queryParts, ","))
 
@@ -230,3 +231,36 @@ func (db *DB) UpdateUser(user User) error {
 	}
 	return nil
 }
+
+// CountAdmins returns the number of admins which are not disabled
+func (db *DB) CountAdmins() (int, error) {
+	var count int
+	err := db.Database.QueryRow(`SELECT COUNT(*) FROM users WHERE is_admin = 1 AND disabled = 0;`).Scan(&count)
+	return count, err
+}
+
+// SetUserAdmin grants or revokes the admin role of a user
+func (db *DB) SetUserAdmin(userID int, isAdmin bool) error {
+	return db.setUserColumn(userID, "is_admin", isAdmin)
+}
+
+// SetUserDisabled disables or enables a user, disabled users can't log in
+func (db *DB) SetUserDisabled(userID int, disabled bool) error {
+	return db.setUserColumn(userID, "disabled", disabled)
+}
+
+// setUserColumn sets a column UpdateUser can't set, as its zero value means unchanged there
+func (db *DB) setUserColumn(userID int, column string, value any) error {
+	result, err := db.Database.Exec(fmt.Sprintf(`UPDATE users SET %s = ? WHERE id = ?;`, column), value, userID)
+	if err != nil {
+		return err
+	}
+	r, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if r == 0 {
+		return ErrNoRowUpdated
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package delivery
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/mailbox"
+)
+
+// cursorName keys the mailbox cursor of the poller
+const cursorName = "delivery"
+
+// Poller checks the mailbox of the sender for replies of Amazon and records them on the tasks
+type Poller struct {
+	reader   *mailbox.Reader
+	db       *database.DB
+	servID   string // authserv-id of the receiving server, which has to authenticate Amazon
+	interval time.Duration
+}
+
+// NewPoller returns a poller reading the mailbox every interval. Replies only count
+// when the receiving server identified by servID authenticated them as Amazon's.
+func NewPoller(config mailbox.Config, db *database.DB, servID string, interval time.Duration) (*Poller, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("poll interval should be positive")
+	}
+	servID = strings.TrimSpace(servID)
+	if servID == "" {
+		return nil, fmt.Errorf("authserv-id of the receiving server is required")
+	}
+	reader, err := mailbox.NewReader(config, db, cursorName)
+	if err != nil {
+		return nil, err
+	}
+	return &Poller{reader: reader, db: db, servID: servID, interval: interval}, nil
+}
+
+// Run polls until ctx is cancelled. Failures are logged, the next poll tries again.
+func (p *Poller) Run(ctx context.Context) {
+	slog.Info("Polling mailbox for delivery replies", slog.String("interval", p.interval.String()))
+	p.reader.Run(ctx, p.interval, p.handle)
+}
+
+// Poll reads the new mail once
+func (p *Poller) Poll(ctx context.Context) error {
+	return p.reader.Read(ctx, p.handle)
+}
+
+// handle records a reply on the task it is about
+func (p *Poller) handle(ctx context.Context, msg mailbox.Message) error {
+	outcome, reason := Classify(msg, p.servID)
+	if outcome == Unrelated {
+		return nil
+	}
+
+	task, err := p.match(msg)
+	if errors.Is(err, sql.ErrNoRows) {
+		slog.Warn("Reply of Amazon matches no task", slog.String("subject", msg.Subject), slog.String("messageID", msg.MessageID))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch outcome {
+	case Delivered:
+		if task.DeliveryStatus == database.DeliveryRejected {
+			return nil // a rejection of a part was seen already, it stays rejected
+		}
+		slog.Info("Amazon confirmed delivery", slog.String("taskID", task.ID))
+		return p.db.UpdateTask(database.Task{ID: task.ID, DeliveryStatus: database.DeliveryDelivered})
+	case Rejected:
+		slog.Warn("Amazon rejected delivery", slog.String("taskID", task.ID), slog.String("reason", reason))
+		err = p.reject(task.ID, reason)
+		if err != nil {
+			return err
+		}
+		if task.ParentID != "" {
+			// the book is incomplete without the part
+			return p.reject(task.ParentID, fmt.Sprintf("part %d: %s", task.Part, reason))
+		}
+	}
+	return nil
+}
+
+// reject marks a task as failed with the reason of Amazon
+func (p *Poller) reject(taskID string, reason string) error {
+	return p.db.UpdateTask(database.Task{
+		ID:             taskID,
+		State:          database.Failed,
+		ErrorMsg:       "Rejected by Send to Kindle: " + reason,
+		DeliveryStatus: database.DeliveryRejected,
+	})
+}
+
+// match finds the task a reply is about, by the Message-IDs it refers to and then by
+// the task ids in its subject and text. sql.ErrNoRows when there is none.
+func (p *Poller) match(msg mailbox.Message) (database.Task, error) {
+	for _, id := range referencedIDs(msg) {
+		task, err := p.db.GetTaskByMessageID(id)
+		if !errors.Is(err, sql.ErrNoRows) {
+			return task, err
+		}
+	}
+	for _, id := range taskIDs(msg) {
+		task, err := p.db.GetTask(id)
+		if !errors.Is(err, sql.ErrNoRows) {
+			return task, err
+		}
+	}
+	return database.Task{}, sql.ErrNoRows
+}
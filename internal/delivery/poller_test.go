@@ -0,0 +1,145 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/database/dbtest"
+	"github.com/roshanlc/send-to-kindle/internal/email"
+	"github.com/roshanlc/send-to-kindle/internal/mailbox"
+)
+
+// startIMAP serves an in-memory mailbox holding the samples, in order
+func startIMAP(t *testing.T, samples ...string) mailbox.Config {
+	t.Helper()
+	user := imapmemserver.NewUser("books@example.net", "secret")
+	if err := user.Create("INBOX", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range samples {
+		raw, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := user.Append("INBOX", bytes.NewReader(raw), &imap.AppendOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mem := imapmemserver.New()
+	mem.AddUser(user)
+
+	server := imapserver.New(&imapserver.Options{
+		NewSession: func(*imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return mem.NewSession(), nil, nil
+		},
+		Caps:         imap.CapSet{imap.CapIMAP4rev1: {}},
+		InsecureAuth: true,
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	return mailbox.Config{
+		Host:     "127.0.0.1",
+		Port:     ln.Addr().(*net.TCPAddr).Port,
+		Username: "books@example.net",
+		Password: "secret",
+		TLS:      email.TLSOptions{Mode: email.TLSNone},
+	}
+}
+
+// addSentTask adds a task whose mail went out with the given Message-ID
+func addSentTask(t *testing.T, db *database.DB, id, messageID string) {
+	t.Helper()
+	err := db.AddTask(database.Task{ID: id, URL: "https://example.com/" + id, State: database.Pending})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UpdateTask(database.Task{ID: id, State: database.Completed, MessageID: messageID, DeliveryStatus: database.DeliverySent})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPollerPoll(t *testing.T) {
+	db, _ := dbtest.New(t)
+
+	const (
+		internalError = "6f1c2b8e-3d4a-4b5c-9d6e-7f8a9b0c1d2e" // rejected with E999
+		notApproved   = "1a2b3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d" // sender not on the approved list
+		delivered     = "9e8d7c6b-5a4f-4e3d-8c2b-1a0f9e8d7c6b" // delivered, then forged rejections
+		unsupported   = "4d3c2b1a-0f9e-4d8c-b7a6-5f4e3d2c1b0a" // matched by the task id in the text
+		unanswered    = "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d"
+	)
+	addSentTask(t, db, internalError, internalError+".1705320000@example.net")
+	addSentTask(t, db, notApproved, notApproved+".1705323000@example.net")
+	addSentTask(t, db, delivered, delivered+".1705320100@example.net")
+	addSentTask(t, db, unsupported, unsupported+".1705320200@example.net")
+	addSentTask(t, db, unanswered, unanswered+".1705320300@example.net")
+
+	config := startIMAP(t,
+		"verify-request.eml",
+		"rejected-e999.eml",
+		"delivered.eml",
+		"forged-rejection.eml",
+		"lookalike.eml",
+		"promotion.eml",
+		"rejected-approved-list.eml",
+		"rejected-html.eml",
+	)
+	p, err := NewPoller(config, db, servID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id     string
+		state  database.TaskState
+		status database.DeliveryStatus
+		reason string
+	}{
+		{internalError, database.Failed, database.DeliveryRejected, "E999 - Send to Kindle Internal Error."},
+		{notApproved, database.Failed, database.DeliveryRejected, "not on your Approved Personal Document E-mail List"},
+		{delivered, database.Completed, database.DeliveryDelivered, ""},
+		{unsupported, database.Failed, database.DeliveryRejected, "There was a problem with the document(s)"},
+		{unanswered, database.Completed, database.DeliverySent, ""},
+	}
+	for _, tt := range tests {
+		task, err := db.GetTask(tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.State != tt.state || task.DeliveryStatus != tt.status {
+			t.Errorf("task %s is %s/%s, want %s/%s", tt.id, task.State, task.DeliveryStatus, tt.state, tt.status)
+		}
+		if !strings.Contains(task.ErrorMsg, tt.reason) || (tt.reason == "") != (task.ErrorMsg == "") {
+			t.Errorf("task %s has error %q, want one with %q", tt.id, task.ErrorMsg, tt.reason)
+		}
+	}
+
+	// read mail is not handled again
+	if err := db.UpdateTask(database.Task{ID: internalError, State: database.Completed, DeliveryStatus: database.DeliverySent}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if task, _ := db.GetTask(internalError); task.DeliveryStatus != database.DeliverySent {
+		t.Errorf("reply was handled again, delivery status %s", task.DeliveryStatus)
+	}
+}
@@ -0,0 +1,122 @@
+// Package delivery confirms that books reached the Kindle by reading the replies
+// Send to Kindle mails to the sender address
+package delivery
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/roshanlc/send-to-kindle/internal/mailbox"
+)
+
+// Outcome is what a reply of Amazon says about a mail
+type Outcome int
+
+const (
+	Unrelated Outcome = iota // not about a delivery, e.g. a newsletter
+	Delivered
+	Rejected
+)
+
+// maxReasonLength caps the reason kept in Task.ErrorMsg
+const maxReasonLength = 500
+
+// The replies of Send to Kindle follow a few templates. A rejection names an error
+// code like "E999 - Send to Kindle Internal Error", or says the sender is not on the
+// approved list; their subjects are looked for too, as the text of some is only html.
+var (
+	errorCodePattern    = regexp.MustCompile(`\bE\d{3}\s*[-–:]\s*[^.]+\.?`)
+	approvedListPattern = regexp.MustCompile(`(?i)[^.]*\bnot on your approved personal document e-?mail list[^.]*\.?`)
+	rejectedSubjects    = []string{
+		"there was a problem with the document(s) you sent to kindle",
+		"your document(s) could not be delivered",
+		"your document could not be delivered",
+		"we could not deliver your document",
+	}
+	rejectedTemplates = []string{
+		"the following document(s) failed to deliver",
+		"could not be delivered due to the following error",
+	}
+	deliveredPhrases = []string{
+		"has been delivered", "have been delivered", "was delivered", "were delivered",
+		"successfully delivered", "is now available", "are now available", "sent to your kindle library",
+	}
+)
+
+var uuidPattern = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+// amazonDomainPattern matches the domains Amazon sends from, stores included
+var amazonDomainPattern = regexp.MustCompile(`^([a-z0-9-]+\.)*(amazon\.(com|ca|cn|de|es|fr|in|it|nl|pl|se|sg|ae|sa|eg|com\.(au|br|mx|tr|be)|co\.(uk|jp))|kindle\.com)$`)
+
+// fromAmazon reports mail sent by Amazon, e.g. do-not-reply@amazon.com or a kindle.com
+// address, which the receiving server identified by servID authenticated
+func fromAmazon(msg mailbox.Message, servID string) bool {
+	at := strings.LastIndex(msg.From, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(msg.From[at+1:])
+	return amazonDomainPattern.MatchString(domain) && msg.Authenticated(servID)
+}
+
+// Classify tells what a reply says and, for rejections, the reason Amazon gave. Only
+// mail of Amazon which the receiving server identified by servID authenticated counts.
+func Classify(msg mailbox.Message, servID string) (Outcome, string) {
+	if !fromAmazon(msg, servID) {
+		return Unrelated, ""
+	}
+
+	// lines of the templates are wrapped anywhere
+	subject := strings.Join(strings.Fields(msg.Subject), " ")
+	text := strings.Join(strings.Fields(msg.Text), " ")
+
+	if codes := errorCodePattern.FindAllString(text, -1); len(codes) > 0 {
+		return Rejected, truncate(strings.Join(codes, " "), maxReasonLength)
+	}
+	if sentence := approvedListPattern.FindString(text); sentence != "" {
+		return Rejected, truncate(strings.TrimSpace(sentence), maxReasonLength)
+	}
+	if containsAny(strings.ToLower(subject), rejectedSubjects) || containsAny(strings.ToLower(text), rejectedTemplates) {
+		return Rejected, truncate(subject, maxReasonLength)
+	}
+	if containsAny(strings.ToLower(subject+" "+text), deliveredPhrases) {
+		return Delivered, ""
+	}
+	return Unrelated, ""
+}
+
+// referencedIDs returns the Message-IDs the reply refers to, the direct parent first
+func referencedIDs(msg mailbox.Message) []string {
+	ids := append([]string{}, msg.InReplyTo...)
+	for i := len(msg.References) - 1; i >= 0; i-- {
+		ids = append(ids, msg.References[i])
+	}
+	return ids
+}
+
+// taskIDs returns the task ids mentioned in the subject and text of the reply, the
+// default subject is the task id and Message-IDs start with it
+func taskIDs(msg mailbox.Message) []string {
+	return uuidPattern.FindAllString(msg.Subject+"\n"+msg.Text, -1)
+}
+
+func containsAny(s string, phrases []string) bool {
+	for _, phrase := range phrases {
+		if strings.Contains(s, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncate shortens s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "…"
+}
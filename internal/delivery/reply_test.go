@@ -0,0 +1,102 @@
+package delivery
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/roshanlc/send-to-kindle/internal/mailbox"
+)
+
+// servID is the authserv-id of the receiving server in the samples
+const servID = "mx.example.net"
+
+// readSample parses a mail of testdata
+func readSample(t *testing.T, name string) mailbox.Message {
+	t.Helper()
+	raw, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mailbox.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		sample  string
+		outcome Outcome
+		reason  string // contained in the reason
+	}{
+		{"rejected-e999.eml", Rejected, "E999 - Send to Kindle Internal Error."},
+		{"rejected-approved-list.eml", Rejected, "is not on your Approved Personal Document E-mail List"},
+		{"rejected-html.eml", Rejected, "There was a problem with the document(s) you sent to Kindle"},
+		{"delivered.eml", Delivered, ""},
+		{"verify-request.eml", Unrelated, ""},
+		{"promotion.eml", Unrelated, ""},
+		{"forged-rejection.eml", Unrelated, ""},
+		{"lookalike.eml", Unrelated, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sample, func(t *testing.T) {
+			outcome, reason := Classify(readSample(t, tt.sample), servID)
+			if outcome != tt.outcome {
+				t.Fatalf("outcome %d, want %d (reason %q)", outcome, tt.outcome, reason)
+			}
+			if !strings.Contains(reason, tt.reason) || (tt.reason == "") != (reason == "") {
+				t.Fatalf("reason %q, want one with %q", reason, tt.reason)
+			}
+		})
+	}
+
+	// replies only count when the configured server vouched for them
+	if outcome, _ := Classify(readSample(t, "rejected-e999.eml"), "mx.other.net"); outcome != Unrelated {
+		t.Fatalf("outcome %d with results of another server, want Unrelated", outcome)
+	}
+}
+
+func TestFromAmazon(t *testing.T) {
+	tests := map[string]bool{
+		"do-not-reply@amazon.com":               true,
+		"kindle-support@amazon.co.uk":           true,
+		"digital-no-reply@amazon.co.jp":         true,
+		"no-reply@email.amazon.com":             true,
+		"service@kindle.com":                    true,
+		"do-not-reply@amazon.com.attacker.test": false,
+		"do-not-reply@notamazon.com":            false,
+		"do-not-reply@amazon.evil":              false,
+		"someone@kindle.com.evil":               false,
+		"amazon.com":                            false,
+	}
+	for from, want := range tests {
+		domain := from[strings.LastIndex(from, "@")+1:]
+		msg := mailbox.Message{
+			From:        from,
+			AuthServID:  servID,
+			AuthResults: []mailbox.AuthResult{{Method: "dkim", Result: "pass", Domain: domain}},
+		}
+		if got := fromAmazon(msg, servID); got != want {
+			t.Errorf("fromAmazon(%s) = %v, want %v", from, got, want)
+		}
+	}
+}
+
+func TestReferences(t *testing.T) {
+	msg := mailbox.Message{
+		InReplyTo:  []string{"c@example.net"},
+		References: []string{"a@example.net", "b@example.net", "c@example.net"},
+		Subject:    "Re: 6f1c2b8e-3d4a-4b5c-9d6e-7f8a9b0c1d2e",
+		Text:       "about 4d3c2b1a-0f9e-4d8c-b7a6-5f4e3d2c1b0a",
+	}
+	if got, want := referencedIDs(msg), []string{"c@example.net", "c@example.net", "b@example.net", "a@example.net"}; !slices.Equal(got, want) {
+		t.Errorf("referencedIDs = %v, want %v", got, want)
+	}
+	if got, want := taskIDs(msg), []string{"6f1c2b8e-3d4a-4b5c-9d6e-7f8a9b0c1d2e", "4d3c2b1a-0f9e-4d8c-b7a6-5f4e3d2c1b0a"}; !slices.Equal(got, want) {
+		t.Errorf("taskIDs = %v, want %v", got, want)
+	}
+}
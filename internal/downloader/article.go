@@ -0,0 +1,49 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/roshanlc/send-to-kindle/internal/article"
+	"github.com/roshanlc/send-to-kindle/internal/format"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+	"resty.dev/v3"
+)
+
+// saveArticle extracts the article of the web page in partPath and saves it as an
+// EPUB named after its title, next to the page. The page is removed once saved.
+// Returns article.NoContentErr, keeping the page, when there is no article to extract.
+func saveArticle(ctx context.Context, client *resty.Client, partPath string, pageURL *url.URL, contentType string) (string, error) {
+	taskID := helper.GetIDFromContext(ctx).String()
+
+	f, err := os.Open(partPath)
+	if err != nil {
+		return "", fmt.Errorf("error while reading page, %w", err)
+	}
+	a, err := article.Parse(f, contentType, pageURL)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	book := a.Book(ctx, client)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+
+	filename := format.FixExtension(SanitizeFilename(book.Title, taskID), format.EPUB)
+	filePath := filepath.Join(filepath.Dir(partPath), filename)
+	err = book.WriteFile(filePath + partSuffix)
+	if err == nil {
+		err = os.Rename(filePath+partSuffix, filePath)
+	}
+	if err != nil {
+		_ = os.Remove(filePath + partSuffix)
+		return "", fmt.Errorf("error while saving article, %w", err)
+	}
+	_ = os.Remove(partPath)
+	return filename, nil
+}
@@ -2,6 +2,8 @@ package downloader
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -10,71 +12,152 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
 
-	"github.com/PuerkitoBio/goquery"
+	"github.com/roshanlc/send-to-kindle/internal/article"
+	"github.com/roshanlc/send-to-kindle/internal/convert"
+	"github.com/roshanlc/send-to-kindle/internal/format"
 	"github.com/roshanlc/send-to-kindle/internal/helper"
 	"resty.dev/v3"
 )
 
-const adsTerm = "ads.php?"
-
 var downloadDir = "./downloads" // should be configurable, take from .env file // Also add a cleanup logic cron
 
 var (
 	NilRestyClientErr     = errors.New("no resty clienty provided, expected a resty client reference")
 	Non200StatusErr       = errors.New("recived a non 200 status code")
 	NoLinkFoundAdsPageErr = errors.New("could not extract download link from ads page")
+	ChecksumMismatchErr   = errors.New("md5 checksum of downloaded file does not match, file is corrupted or truncated")
 )
 
+// StatusError is returned when a server responds with an unexpected status code
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s, got: %d", Non200StatusErr.Error(), e.Code)
+}
+
+func (e *StatusError) Unwrap() error {
+	return Non200StatusErr
+}
+
+// Temporary reports whether the status is worth retrying later (5xx or 429)
+func (e *StatusError) Temporary() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests
+}
+
 // SetDownloadDir sets the directory for saving the downloaded file
 func SetDownloadDirectory(dir string) {
 	downloadDir = dir
 }
 
 // Process takes the url and attempts to download the file
-func Process(ctx context.Context, client *resty.Client, url string) (string, context.Context, error) {
-	// 1. Check if the url is libgen ads site from which download link is to be extracted or it is download url itself
-	// 2. if libgen ads site, extract the download link
-	// 3. Proceed to download from the url
+func Process(ctx context.Context, client *resty.Client, rawURL string) (string, context.Context, error) {
+	// 1. Check if any registered resolver handles the url, else it is download url itself
+	// 2. if resolver found, resolve the download link(s)
+	// 3. Proceed to download from the links, in order, until one succeeds
 	// 4. Save the file to a directory
 	if client == nil {
 		return "", ctx, NilRestyClientErr
 	}
 
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", ctx, fmt.Errorf("could not parse url: %w", err)
+	}
+
+	res, ok := defaultRegistry.Lookup(u)
+	if !ok {
+		return downloadAndSave(ctx, client, rawURL, "", false)
+	}
+
+	var expectedMD5 string
+	if c, ok := res.(ChecksumResolver); ok {
+		expectedMD5 = c.ExpectedMD5(u)
+	}
+
+	sources := []*url.URL{u}
+	if m, ok := res.(MirroredResolver); ok {
+		sources = m.Mirrors(u)
+	}
+
 	taskID := helper.GetIDFromContext(ctx).String()
-	downloadLink := url
-	if isAdsPage(url) {
-		slog.Info("Extracting download link from ads page:", slog.String("url", url), slog.String("taskID", taskID))
-		resp, err := client.R().Get(url)
-		if err != nil {
-			return "", ctx, err
+	for _, source := range sources {
+		slog.Info("Resolving download links", slog.String("resolver", res.Name()), slog.String("url", source.String()), slog.String("taskID", taskID))
+		var links []string
+		links, err = res.Resolve(ctx, client, source)
+		if err == nil && len(links) == 0 {
+			err = fmt.Errorf("no links found")
 		}
-
-		if resp.StatusCode() != http.StatusOK {
-			return "", ctx, fmt.Errorf("%w, got: %d", Non200StatusErr, resp.StatusCode())
+		if err != nil {
+			err = fmt.Errorf("%s resolver failed for %s: %w", res.Name(), source.Host, err)
+			if ctx.Err() != nil {
+				return "", ctx, err
+			}
+			slog.Warn("Resolving failed, trying next mirror", slog.String("url", source.String()), slog.String("error", err.Error()), slog.String("taskID", taskID))
+			continue
 		}
 
-		downloadLink, err = extractDownloadLink(resp)
-		if err != nil {
-			return "", ctx, err
+		for _, link := range links {
+			var filename string
+			var newCtx context.Context
+			filename, newCtx, err = downloadAndSave(ctx, client, link, expectedMD5, true)
+			if err == nil {
+				return filename, newCtx, nil
+			}
+			if ctx.Err() != nil {
+				return "", ctx, err
+			}
+			slog.Warn("Download failed, trying next link", slog.String("url", link), slog.String("error", err.Error()), slog.String("taskID", taskID))
 		}
 	}
-
-	return downloadAndSave(ctx, client, downloadLink)
+	return "", ctx, err
 }
 
 // downloadAndSave downloads a file form the provided link and saves it under
-// the downloads(read from env var during start) directory
-func downloadAndSave(ctx context.Context, client *resty.Client, url string) (string, context.Context, error) {
-	resp, err := client.R().Get(url)
+// the downloads(read from env var during start) directory.
+// The file is verified against expectedMD5 unless it is empty, and its content is
+// checked to be in a format accepted by Send to Kindle. A web page is only accepted
+// when the link was not resolved, as resolved links are expected to serve files, and
+// is saved as an EPUB of its article.
+func downloadAndSave(ctx context.Context, client *resty.Client, link string, expectedMD5 string, resolved bool) (string, context.Context, error) {
+	taskID := helper.GetIDFromContext(ctx).String()
+
+	// each task gets its own directory, so tasks can't overwrite each other's files
+	dir := TaskDirectory(taskID)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return "", ctx, fmt.Errorf("error while creating task directory, %w", err)
+	}
+
+	// the file is written to a temporary part file until it is complete
+	partPath, err := partFile(dir, taskID, link)
 	if err != nil {
 		return "", ctx, err
 	}
-	taskID := helper.GetIDFromContext(ctx).String()
-	slog.Info("Downloaded file from url", slog.String("url", url), slog.String("taskID", taskID))
+	header, finalURL, err := fetchResumable(ctx, client, link, partPath)
+	if err != nil {
+		return "", ctx, err
+	}
+	slog.Info("Downloaded file from url", slog.String("url", link), slog.String("taskID", taskID))
+
+	if expectedMD5 != "" {
+		got, err := fileMD5(partPath)
+		if err != nil {
+			return "", ctx, fmt.Errorf("error while computing checksum, %w", err)
+		}
+		if !strings.EqualFold(got, expectedMD5) {
+			_ = os.Remove(partPath)
+			return "", ctx, fmt.Errorf("%w: expected %s, got %s", ChecksumMismatchErr, expectedMD5, got)
+		}
+		slog.Info("Verified file checksum", slog.String("md5", got), slog.String("taskID", taskID))
+	}
 
-	contentDisposition := resp.Header().Get("Content-Disposition")
+	contentDisposition := header.Get("Content-Disposition")
 	var filename string
 
 	if contentDisposition != "" {
@@ -84,29 +167,55 @@ func downloadAndSave(ctx context.Context, client *resty.Client, url string) (str
 		}
 	}
 
-	// Fallback to use task ID
-	if filename == "" {
-		filename = taskID // taskID as fallback name
-		t, _, _ := mime.ParseMediaType(resp.Header().Get("Content-Type"))
-		if t != "" {
-			exts, _ := mime.ExtensionsByType(t)
-			if len(exts) > 0 {
-				filename += exts[0]
-			}
+	// check what was actually served, error pages and captchas come with a 200 too
+	detected, mediaType, err := format.Detect(partPath)
+	if err != nil {
+		return "", ctx, fmt.Errorf("error while detecting file format, %w", err)
+	}
+	if detected == format.HTML && (resolved || (filename != "" && !format.HTML.HasExtension(filename))) {
+		_ = os.Remove(partPath)
+		return "", ctx, fmt.Errorf("%w: expected a file but got a web page", format.UnsupportedFormatErr)
+	}
+	if detected == format.HTML {
+		// a web page is sent as the article it holds, the raw page is the fallback
+		// when no article can be found in it
+		filename, err := saveArticle(ctx, client, partPath, finalURL, header.Get("Content-Type"))
+		if err == nil {
+			filePath := filepath.Join(dir, filename)
+			slog.Info("Saved article", slog.String("filepath", filePath), slog.String("taskID", taskID))
+			return filename, helper.NewContextWithFilePath(ctx, filePath), nil
+		}
+		if !errors.Is(err, article.NoContentErr) {
+			return "", ctx, err
+		}
+		slog.Warn("No article found in page, sending it as is", slog.String("url", link), slog.String("taskID", taskID))
+	}
+	nameHint := filename
+	if nameHint == "" {
+		rawPath, _, _ := strings.Cut(link, "?")
+		nameHint = path.Base(rawPath)
+	}
+	detected = format.Refine(detected, nameHint)
+	// formats which can be converted are accepted, they are converted before sending
+	if !convert.Convertible(detected) {
+		err = format.Check(detected, mediaType)
+		if err != nil {
+			_ = os.Remove(partPath)
+			return "", ctx, err
 		}
 	}
 
-	filename = strings.TrimSpace(filename) // trim the spaces
-	filePath := downloadDir + "/" + filename
-	out, err := os.Create(filePath)
-
-	if err != nil {
-		return "", ctx, fmt.Errorf("error while creating file, %w", err)
+	// Fallback to use task ID
+	if filename == "" {
+		filename = taskID // taskID as fallback name
 	}
 
-	_, err = io.Copy(out, resp.Body)
+	// extension follows the content, not the (possibly wrong) name or Content-Type
+	filename = format.FixExtension(SanitizeFilename(filename, taskID), detected)
+	filePath := filepath.Join(dir, filename)
+	err = os.Rename(partPath, filePath) // atomic within the same directory
 	if err != nil {
-		return "", ctx, fmt.Errorf("error while saving response, %w", err)
+		return "", ctx, fmt.Errorf("error while saving file, %w", err)
 	}
 
 	slog.Info("Saved file", slog.String("filepath", filePath), slog.String("taskID", taskID))
@@ -114,43 +223,44 @@ func downloadAndSave(ctx context.Context, client *resty.Client, url string) (str
 	return filename, newCtx, nil
 }
 
-// deleteDownloadedFile deletes the download file
-func DeleteDownloadedFile(path string) error {
-	err := os.Remove(path)
+// fileMD5 returns the hex encoded md5 of a file
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return "", err
 	}
-	slog.Info("Deleted file", slog.String("filepath", path))
-	return nil
-}
+	defer f.Close()
 
-// isAdsPage checks if the given urls if an ads page (not advertisement, more like file description)
-// which contains download link to file.
-// Example: https://libgen.li/ads.php?md5=7e5412b8ece1fe49f7bfbc6e5ab77809
-func isAdsPage(url string) bool {
-	if strings.Contains(url, adsTerm) {
-		return true
+	hash := md5.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
 	}
-	return false
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// TaskDirectory returns the directory holding the files of a task
+func TaskDirectory(taskID string) string {
+	return filepath.Join(downloadDir, SanitizeFilename(taskID, "unknown"))
 }
 
-// extractDownloadLink extracts download link from ads page of libgen by parsing the html doc.
-// Example: https://libgen.li/get.php?md5=7e5412b8ece1fe49f7bfbc6e5ab77809&key=HIUDRYJW8JKVNH5A
-func extractDownloadLink(resp *resty.Response) (string, error) {
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
+// DeleteTaskDirectory deletes the directory of a task along with any file in it
+func DeleteTaskDirectory(taskID string) error {
+	dir := TaskDirectory(taskID)
+	err := os.RemoveAll(dir)
 	if err != nil {
-		return "", err
-	}
-	val, exists := doc.Find("a[href] > h2").Parent().Attr("href")
-	if !exists {
-		return "", NoLinkFoundAdsPageErr
+		return err
 	}
+	slog.Info("Deleted task directory", slog.String("path", dir))
+	return nil
+}
 
-	parsedURL, err := url.Parse(resp.Request.URL)
+// deleteDownloadedFile deletes the download file
+func DeleteDownloadedFile(path string) error {
+	err := os.Remove(path)
 	if err != nil {
-		return "", fmt.Errorf("could not parse url: %w", err)
+		return err
 	}
-
-	link := fmt.Sprintf("%s://%s/%s", parsedURL.Scheme, parsedURL.Host, val)
-	return link, nil
+	slog.Info("Deleted file", slog.String("filepath", path))
+	return nil
 }
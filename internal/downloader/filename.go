@@ -0,0 +1,77 @@
+package downloader
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxFilenameBytes keeps names well under the 255 byte limit of most filesystems
+const maxFilenameBytes = 200
+
+// reservedNames are device names Windows won't create files for, whatever the extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFilename turns a filename suggested by a remote server into a safe
+// name for the local filesystem. Directory components, control characters and
+// characters reserved on common filesystems are dropped, reserved device names
+// are prefixed with an underscore, the name is normalized to NFC and shortened
+// to maxFilenameBytes while keeping the extension.
+// Returns fallback if nothing usable is left.
+func SanitizeFilename(name string, fallback string) string {
+	name = norm.NFC.String(name)
+
+	// keep only the last path element, for both / and \ separators
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r):
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+
+	// no hidden files, and no "." or ".." names
+	name = strings.Trim(strings.TrimSpace(name), ". ")
+	if name == "" {
+		return fallback
+	}
+	stem, _, _ := strings.Cut(name, ".")
+	if reservedNames[strings.ToUpper(strings.TrimSpace(stem))] {
+		name = "_" + name
+	}
+
+	return truncateFilename(name, maxFilenameBytes)
+}
+
+// truncateFilename shortens name to at most max bytes without splitting
+// a rune, keeping the extension intact when it is reasonably short
+func truncateFilename(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) > max/4 {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+
+	limit := max - len(ext)
+	for limit > 0 && !utf8.RuneStart(base[limit]) {
+		limit--
+	}
+	return strings.TrimSpace(base[:limit]) + ext
+}
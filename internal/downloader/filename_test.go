@@ -0,0 +1,53 @@
+package downloader
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	longRunes := strings.Repeat("é", 150) // two bytes each
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "The Art of Computer Programming.pdf", "The Art of Computer Programming.pdf"},
+		{"unix path", "../../etc/passwd", "passwd"},
+		{"windows path", `C:\Users\me\book.epub`, "book.epub"},
+		{"mixed separators", `a/b\c.mobi`, "c.mobi"},
+		{"trailing separator", "books/", "fallback"},
+		{"dot dot", "..", "fallback"},
+		{"hidden", ".bashrc", "bashrc"},
+		{"trailing dots and spaces", " book.epub. . ", "book.epub"},
+		{"control characters", "bo\x00ok\n\t.e\x7fpub", "book.epub"},
+		{"invalid utf-8", "bo\xffok.pdf", "book.pdf"},
+		{"reserved characters", `what? "why": <a|b>*.pdf`, "what_ _why__ _a_b__.pdf"},
+		{"reserved name", "CON", "_CON"},
+		{"reserved name with extension", "nul.txt", "_nul.txt"},
+		{"reserved name lowercase", "com1.tar.gz", "_com1.tar.gz"},
+		{"not reserved", "CONSOLE.pdf", "CONSOLE.pdf"},
+		{"not reserved number", "COM10.pdf", "COM10.pdf"},
+		{"nfc", "Cafe\u0301.epub", "Caf\u00e9.epub"},
+		{"empty", "", "fallback"},
+		{"only control", "\x01\x02", "fallback"},
+		{"long", long + ".epub", long[:maxFilenameBytes-len(".epub")] + ".epub"},
+		{"long extension", "book." + long, ("book." + long)[:maxFilenameBytes]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeFilename(tt.in, "fallback"); got != tt.want {
+				t.Fatalf("SanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	// truncation doesn't split a rune
+	got := SanitizeFilename(longRunes+".pdf", "fallback")
+	if len(got) > maxFilenameBytes || !utf8.ValidString(got) || !strings.HasSuffix(got, ".pdf") {
+		t.Fatalf("got %q (%d bytes) for a long name of two byte runes", got, len(got))
+	}
+}
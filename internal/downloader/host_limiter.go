@@ -0,0 +1,82 @@
+package downloader
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// hosts caps the downloads from the same host, see SetHostLimit
+var hosts = newHostLimiter(0)
+
+// SetHostLimit sets the max downloads from the same host at once,
+// zero or less for no limit
+func SetHostLimit(limit int) {
+	hosts = newHostLimiter(limit)
+}
+
+// hostLimiter caps the number of downloads talking to the same host at once
+type hostLimiter struct {
+	limit  int
+	lock   sync.Mutex
+	active map[string]int // host -> number of downloads in flight
+	freed  chan struct{}  // closed and replaced whenever a slot is freed
+}
+
+// newHostLimiter returns a hostLimiter allowing limit downloads per host.
+// A limit of zero or less disables the check.
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{
+		limit:  limit,
+		active: map[string]int{},
+		freed:  make(chan struct{}),
+	}
+}
+
+// acquire blocks until a slot is free for the host or ctx is done.
+// The returned func frees up the slot.
+func (h *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	if h.limit <= 0 {
+		return func() {}, nil
+	}
+	for {
+		h.lock.Lock()
+		if h.active[host] < h.limit {
+			h.active[host]++
+			h.lock.Unlock()
+			var once sync.Once
+			return func() { once.Do(func() { h.release(host) }) }, nil
+		}
+		freed := h.freed
+		h.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-freed:
+		}
+	}
+}
+
+// release frees up a slot previously reserved for the host
+func (h *hostLimiter) release(host string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.active[host]--
+	if h.active[host] <= 0 {
+		delete(h.active, host)
+	}
+	close(h.freed)
+	h.freed = make(chan struct{})
+}
+
+// hostOf returns the lowercased host of a url, or the raw url if it can't be parsed
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return strings.ToLower(u.Hostname())
+}
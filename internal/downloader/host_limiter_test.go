@@ -0,0 +1,123 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"resty.dev/v3"
+)
+
+func TestHostLimiter(t *testing.T) {
+	h := newHostLimiter(1)
+	ctx := context.Background()
+
+	release, err := h.acquire(ctx, "libgen.li")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// other hosts are not held up
+	other, err := h.acquire(ctx, "libgen.gs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	// the host is at its limit until the slot is freed
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := h.acquire(short, "libgen.li"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v while the host was at its limit, want DeadlineExceeded", err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		next, err := h.acquire(ctx, "libgen.li")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- next
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("slot acquired while the host was at its limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	release() // freeing twice frees one slot only
+	next := <-acquired
+	if n := h.active["libgen.li"]; n != 1 {
+		t.Fatalf("%d downloads in flight, want 1", n)
+	}
+	next()
+	if len(h.active) != 0 {
+		t.Fatalf("hosts left in flight: %v", h.active)
+	}
+
+	// no limit
+	h = newHostLimiter(0)
+	for range 3 {
+		if _, err := h.acquire(ctx, "libgen.li"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHostOf(t *testing.T) {
+	tests := map[string]string{
+		"https://LibGen.li/ads.php?md5=abc":  "libgen.li",
+		"http://cdn.example.com:8080/b.epub": "cdn.example.com",
+		"upload:book.pdf":                    "upload:book.pdf",
+	}
+	for in, want := range tests {
+		if got := hostOf(in); got != want {
+			t.Errorf("hostOf(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestFetchHoldsHostOfFile checks the limit applies to the host serving the file
+func TestFetchHoldsHostOfFile(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("book"))
+	}))
+	defer srv.Close()
+
+	old := hosts
+	defer func() { hosts = old }()
+	SetHostLimit(1)
+
+	client := resty.New()
+	defer client.Close()
+	ctx := context.Background()
+	partPath := filepath.Join(t.TempDir(), "book.part")
+
+	// the host of the file is busy, the download waits for it
+	release, err := hosts.acquire(ctx, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := fetchResumable(short, client, srv.URL, partPath); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v while the host was busy, want DeadlineExceeded", err)
+	}
+	release()
+
+	// a busy host the file was not found on doesn't hold it up
+	release, err = hosts.acquire(ctx, "libgen.li")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, _, err := fetchResumable(ctx, client, srv.URL, partPath); err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts.active) != 1 {
+		t.Fatalf("slot of the file host was not freed: %v", hosts.active)
+	}
+}
@@ -0,0 +1,135 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+	"resty.dev/v3"
+)
+
+const adsPage = "ads.php"
+
+var md5Pattern = regexp.MustCompile(`^[a-fA-F0-9]{32}$`)
+
+// LibgenResolver extracts the download link from libgen ads pages
+// (not advertisement, more like file description).
+// Example: https://libgen.li/ads.php?md5=7e5412b8ece1fe49f7bfbc6e5ab77809
+type LibgenResolver struct {
+	lock    sync.RWMutex
+	mirrors []*url.URL // equivalent libgen sites, tried in order
+}
+
+// SetMirrors sets the equivalent libgen sites to fall back to, e.g. https://libgen.li
+func (l *LibgenResolver) SetMirrors(mirrors []string) error {
+	parsed := make([]*url.URL, 0, len(mirrors))
+	for _, m := range mirrors {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		u, err := url.Parse(m)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid libgen mirror %q, expected scheme and host like https://libgen.li", m)
+		}
+		parsed = append(parsed, u)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.mirrors = parsed
+	return nil
+}
+
+// Name identifies the resolver
+func (l *LibgenResolver) Name() string {
+	return "libgen"
+}
+
+// Match checks if the given url is an ads page which contains download link to file
+func (l *LibgenResolver) Match(u *url.URL) bool {
+	return path.Base(u.Path) == adsPage && u.RawQuery != ""
+}
+
+// Mirrors returns the ads page followed by the same page on every other mirror
+func (l *LibgenResolver) Mirrors(u *url.URL) []*url.URL {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	urls := []*url.URL{u}
+	for _, m := range l.mirrors {
+		if strings.EqualFold(m.Host, u.Host) {
+			continue
+		}
+		mirrored := *u
+		mirrored.Scheme = m.Scheme
+		mirrored.Host = m.Host
+		urls = append(urls, &mirrored)
+	}
+	return urls
+}
+
+// ExpectedMD5 returns the md5 query parameter of the ads page
+func (l *LibgenResolver) ExpectedMD5(u *url.URL) string {
+	sum := u.Query().Get("md5")
+	if !md5Pattern.MatchString(sum) {
+		return ""
+	}
+	return strings.ToLower(sum)
+}
+
+// Resolve fetches the ads page and extracts the download link from it
+func (l *LibgenResolver) Resolve(ctx context.Context, client *resty.Client, u *url.URL) ([]string, error) {
+	taskID := helper.GetIDFromContext(ctx).String()
+	slog.Info("Extracting download link from ads page:", slog.String("url", u.String()), slog.String("taskID", taskID))
+
+	resp, err := client.R().SetContext(ctx).Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode() != http.StatusOK {
+		return nil, &StatusError{Code: resp.StatusCode()}
+	}
+
+	link, err := extractDownloadLink(resp.Body, u)
+	if err != nil {
+		return nil, err
+	}
+	return []string{link}, nil
+}
+
+// extractDownloadLink extracts download link from ads page of libgen by parsing the html doc.
+// The GET heading is a link on some mirrors and wrapped in one on others.
+// Example: https://libgen.li/get.php?md5=7e5412b8ece1fe49f7bfbc6e5ab77809&key=HIUDRYJW8JKVNH5A
+func extractDownloadLink(body io.Reader, pageURL *url.URL) (string, error) {
+	doc, err := goquery.NewDocumentFromReader(body)
+	if err != nil {
+		return "", err
+	}
+	val, exists := doc.Find("a[href] > h2").Parent().Attr("href")
+	if !exists {
+		val, exists = doc.Find("h2 > a[href]").Attr("href")
+	}
+	if !exists {
+		return "", NoLinkFoundAdsPageErr
+	}
+
+	ref, err := url.Parse(val)
+	if err != nil {
+		return "", fmt.Errorf("could not parse url: %w", err)
+	}
+
+	// links on the page are relative to the site root
+	root := &url.URL{Scheme: pageURL.Scheme, Host: pageURL.Host, Path: "/"}
+	return root.ResolveReference(ref).String(), nil
+}
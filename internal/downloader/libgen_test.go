@@ -0,0 +1,171 @@
+package downloader
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+	"resty.dev/v3"
+)
+
+func TestExtractDownloadLink(t *testing.T) {
+	page, _ := url.Parse("https://libgen.li/ads.php?md5=7e5412b8ece1fe49f7bfbc6e5ab77809")
+	tests := []struct {
+		fixture string
+		want    string
+		wantErr error
+	}{
+		{
+			fixture: "li.html", // relative link wrapping the heading
+			want:    "https://libgen.li/get.php?md5=7e5412b8ece1fe49f7bfbc6e5ab77809&key=HIUDRYJW8JKVNH5A",
+		},
+		{
+			fixture: "gs.html", // absolute link to a download host
+			want:    "https://cdn2.booksdl.lc/get.php?md5=7e5412b8ece1fe49f7bfbc6e5ab77809&key=Q2W3E4R5T6Y7U8I9",
+		},
+		{
+			fixture: "h2-link.html", // link inside the heading
+			want:    "https://libgen.li/get.php?md5=7e5412b8ece1fe49f7bfbc6e5ab77809&key=ZXCVBNM123456789",
+		},
+		{
+			fixture: "nolink.html",
+			wantErr: NoLinkFoundAdsPageErr,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", "libgen", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			got, err := extractDownloadLink(f, page)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLibgenResolverMatch(t *testing.T) {
+	var l LibgenResolver
+	tests := []struct {
+		rawURL string
+		match  bool
+		md5    string
+	}{
+		{"https://libgen.li/ads.php?md5=7E5412B8ECE1FE49F7BFBC6E5AB77809", true, "7e5412b8ece1fe49f7bfbc6e5ab77809"},
+		{"https://libgen.gs/ads.php?md5=not-a-sum", true, ""},
+		{"https://libgen.li/ads.php", false, ""},
+		{"https://libgen.li/get.php?md5=7e5412b8ece1fe49f7bfbc6e5ab77809", false, "7e5412b8ece1fe49f7bfbc6e5ab77809"},
+		{"https://example.com/book.epub", false, ""},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.rawURL)
+		if got := l.Match(u); got != tt.match {
+			t.Errorf("Match(%s) = %v, want %v", tt.rawURL, got, tt.match)
+		}
+		if got := l.ExpectedMD5(u); got != tt.md5 {
+			t.Errorf("ExpectedMD5(%s) = %q, want %q", tt.rawURL, got, tt.md5)
+		}
+	}
+}
+
+func TestLibgenResolverMirrors(t *testing.T) {
+	var l LibgenResolver
+	err := l.SetMirrors([]string{"https://libgen.li", " https://LIBGEN.GS ", "", "http://libgen.vg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://libgen.gs/ads.php?md5=7e5412b8ece1fe49f7bfbc6e5ab77809")
+
+	var got []string
+	for _, m := range l.Mirrors(u) {
+		got = append(got, m.String())
+	}
+	want := []string{
+		"https://libgen.gs/ads.php?md5=7e5412b8ece1fe49f7bfbc6e5ab77809", // the given page first
+		"https://libgen.li/ads.php?md5=7e5412b8ece1fe49f7bfbc6e5ab77809",
+		"http://libgen.vg/ads.php?md5=7e5412b8ece1fe49f7bfbc6e5ab77809",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	if err := l.SetMirrors([]string{"libgen.li"}); err == nil {
+		t.Fatal("mirror without scheme was accepted")
+	}
+}
+
+// TestProcessLibgenFallback has the first mirror fail and the second serve the book
+func TestProcessLibgenFallback(t *testing.T) {
+	book := []byte("%PDF-1.4\n1 0 obj << /Type /Catalog >> endobj\ntrailer << /Root 1 0 R >>\n%%EOF\n")
+	sum := md5.Sum(book)
+	md5Hex := hex.EncodeToString(sum[:])
+
+	var downMirrorHits int
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downMirrorHits++
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	fixture, err := os.ReadFile(filepath.Join("testdata", "libgen", "li.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ads.php":
+			w.Write(fixture)
+		case "/get.php":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("Content-Disposition", `attachment; filename="taocp.pdf"`)
+			w.Write(book)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer up.Close()
+
+	SetDownloadDirectory(t.TempDir())
+	if err := SetLibgenMirrors([]string{down.URL, up.URL}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLibgenMirrors(nil)
+
+	client := resty.New()
+	defer client.Close()
+	ctx := helper.GenerateIDWithContext()
+
+	filename, _, err := Process(ctx, client, down.URL+"/ads.php?md5="+md5Hex)
+	if err != nil {
+		t.Fatalf("process: %v", err)
+	}
+	if downMirrorHits == 0 {
+		t.Fatal("the given mirror was not tried first")
+	}
+	got, err := os.ReadFile(filepath.Join(TaskDirectory(helper.GetIDFromContext(ctx).String()), filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(book) {
+		t.Fatal("saved file differs from the served book")
+	}
+	if filepath.Ext(filename) != ".pdf" {
+		t.Fatalf("saved as %s, want a .pdf", filename)
+	}
+}
@@ -0,0 +1,83 @@
+package downloader
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"resty.dev/v3"
+)
+
+// Resolver turns the url of a source page into direct links of the file(s) to download.
+// Resolvers are registered with Register and looked up by Process for every url.
+type Resolver interface {
+	// Name identifies the resolver in logs
+	Name() string
+	// Match reports whether the resolver handles the given url
+	Match(u *url.URL) bool
+	// Resolve returns direct file links for the url, in the order they should be tried
+	Resolve(ctx context.Context, client *resty.Client, u *url.URL) ([]string, error)
+}
+
+// MirroredResolver is implemented by resolvers whose sources are served by several
+// equivalent mirrors. Process falls back through the mirrors, in order, when resolving
+// or downloading from one of them fails.
+type MirroredResolver interface {
+	Resolver
+	// Mirrors returns the url followed by its equivalents on the other mirrors
+	Mirrors(u *url.URL) []*url.URL
+}
+
+// ChecksumResolver is implemented by resolvers which know the md5 of the file behind a url.
+// Process verifies the downloaded file against it.
+type ChecksumResolver interface {
+	Resolver
+	// ExpectedMD5 returns the hex encoded md5 of the file, empty if unknown
+	ExpectedMD5(u *url.URL) string
+}
+
+// Registry holds the resolvers in the order they were registered
+type Registry struct {
+	lock      sync.RWMutex
+	resolvers []Resolver
+}
+
+// NewRegistry returns a registry with the given resolvers
+func NewRegistry(resolvers ...Resolver) *Registry {
+	return &Registry{resolvers: resolvers}
+}
+
+// Register adds a resolver to the registry
+func (r *Registry) Register(res Resolver) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.resolvers = append(r.resolvers, res)
+}
+
+// Lookup returns the first registered resolver matching the url
+func (r *Registry) Lookup(u *url.URL) (Resolver, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, res := range r.resolvers {
+		if res.Match(u) {
+			return res, true
+		}
+	}
+	return nil, false
+}
+
+var (
+	libgen          = &LibgenResolver{}
+	defaultRegistry = NewRegistry(libgen) // registry used by Process
+)
+
+// Register adds a resolver to the registry used by Process.
+// Resolvers registered earlier take precedence.
+func Register(res Resolver) {
+	defaultRegistry.Register(res)
+}
+
+// SetLibgenMirrors sets the mirrors (e.g. https://libgen.li) the libgen resolver falls back to
+func SetLibgenMirrors(mirrors []string) error {
+	return libgen.SetMirrors(mirrors)
+}
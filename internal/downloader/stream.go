@@ -0,0 +1,216 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+	"resty.dev/v3"
+)
+
+const (
+	partSuffix  = ".part"         // suffix of files still being downloaded
+	maxResumes  = 5               // times an interrupted download is resumed
+	resumeDelay = 2 * time.Second // wait before resuming an interrupted download
+)
+
+var UnexpectedRangeErr = errors.New("server responded with an unexpected range")
+
+// partFile returns the part file a task downloads link to. The file is named after
+// the link, so a transfer is only resumed from the source it started with, parts
+// left by other sources are deleted as their bytes can't be mixed in.
+func partFile(dir string, taskID string, link string) (string, error) {
+	sum := sha256.Sum256([]byte(link))
+	partPath := filepath.Join(dir, taskID+"-"+hex.EncodeToString(sum[:8])+partSuffix)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("error while listing part files, %w", err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if path == partPath || !strings.HasSuffix(entry.Name(), partSuffix) {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("error while deleting part file of another source, %w", err)
+		}
+	}
+	return partPath, nil
+}
+
+// fetchResumable streams the body of url into partPath. An interrupted transfer is
+// resumed with a Range request from the bytes already in partPath, which also lets
+// a later attempt of the same task pick up where this one stopped. Each request
+// holds a slot of the host limit while it runs.
+// Returns the headers and, after redirects, the url of the final response.
+func fetchResumable(ctx context.Context, client *resty.Client, link string, partPath string) (http.Header, *url.URL, error) {
+	taskID := helper.GetIDFromContext(ctx).String()
+
+	var err error
+	for attempt := 0; attempt <= maxResumes; attempt++ {
+		if attempt > 0 {
+			slog.Warn("Download interrupted, resuming", slog.String("url", link), slog.Int("attempt", attempt),
+				slog.String("error", err.Error()), slog.String("taskID", taskID))
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-time.After(resumeDelay):
+			}
+		}
+
+		// wait for a slot of the host actually serving the file, not the page it was found on
+		var release func()
+		release, err = hosts.acquire(ctx, hostOf(link))
+		if err != nil {
+			return nil, nil, err
+		}
+		var header http.Header
+		var final *url.URL
+		header, final, err = fetchOnce(ctx, client, link, partPath)
+		release()
+		if err == nil {
+			return header, final, nil
+		}
+
+		// no point in resuming if the server refuses to serve the file
+		var statusErr *StatusError
+		if ctx.Err() != nil || (errors.As(err, &statusErr) && !statusErr.Temporary()) {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, err
+}
+
+// fetchOnce makes a single request for link, appending to partPath if the server honours the range
+func fetchOnce(ctx context.Context, client *resty.Client, link string, partPath string) (http.Header, *url.URL, error) {
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
+	}
+
+	req := client.R().
+		SetContext(ctx).
+		SetDoNotParseResponse(true).
+		SetHeader("Accept-Encoding", "identity") // ranges must refer to the raw file bytes
+	if offset > 0 {
+		req.SetHeader("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := req.Get(link)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	final := resp.RawResponse.Request.URL
+
+	progress := helper.GetProgressFromContext(ctx)
+	flags := os.O_CREATE | os.O_WRONLY
+	var total int64 = -1
+
+	switch resp.StatusCode() {
+	case http.StatusOK:
+		// whole file, start from scratch
+		offset = 0
+		flags |= os.O_TRUNC
+		total = resp.RawResponse.ContentLength
+	case http.StatusPartialContent:
+		start, size, ok := parseContentRange(resp.Header().Get("Content-Range"))
+		if !ok || start != offset {
+			_ = os.Remove(partPath)
+			return nil, nil, UnexpectedRangeErr
+		}
+		flags |= os.O_APPEND
+		total = size
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the part file may already hold the whole file
+		_, size, ok := parseContentRange(resp.Header().Get("Content-Range"))
+		if ok && size == offset {
+			progress(offset, size)
+			return resp.Header(), final, nil
+		}
+		_ = os.Remove(partPath)
+		return nil, nil, UnexpectedRangeErr
+	default:
+		return nil, nil, &StatusError{Code: resp.StatusCode()}
+	}
+
+	out, err := os.OpenFile(partPath, flags, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while creating file, %w", err)
+	}
+	defer out.Close()
+
+	progress(offset, total)
+	pw := &progressWriter{received: offset, total: total, report: progress}
+	n, err := io.Copy(io.MultiWriter(out, pw), resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while saving response, %w", err)
+	}
+	if total >= 0 && offset+n < total {
+		return nil, nil, fmt.Errorf("error while saving response, %w", io.ErrUnexpectedEOF)
+	}
+
+	return resp.Header(), final, nil
+}
+
+// parseContentRange parses "bytes start-end/size" or "bytes */size".
+// Size is -1 when the server does not know it.
+func parseContentRange(value string) (start int64, size int64, ok bool) {
+	value, found := strings.CutPrefix(strings.TrimSpace(value), "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	rng, sizeText, found := strings.Cut(value, "/")
+	if !found {
+		return 0, 0, false
+	}
+
+	size = -1
+	if sizeText != "*" {
+		s, err := strconv.ParseInt(sizeText, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		size = s
+	}
+
+	if rng == "*" {
+		return 0, size, true
+	}
+	startText, _, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(startText, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, size, true
+}
+
+// progressWriter reports the number of bytes written through it
+type progressWriter struct {
+	received int64
+	total    int64
+	report   helper.ProgressFunc
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.received += int64(len(b))
+	p.report(p.received, p.total)
+	return len(b), nil
+}
@@ -0,0 +1,79 @@
+package downloader
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+	"resty.dev/v3"
+)
+
+// TestResumeSameSourceOnly has a task resume a download from the source it started
+// with, and start over when the part file came from another source
+func TestResumeSameSourceOnly(t *testing.T) {
+	book := []byte("%PDF-1.4\n1 0 obj << /Type /Catalog >> endobj\n" + strings.Repeat("% filler\n", 200) + "trailer << /Root 1 0 R >>\n%%EOF\n")
+	other := bytes.Repeat([]byte("x"), len(book)/2) // what a failed mirror left behind
+
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "book.pdf", time.Time{}, bytes.NewReader(book))
+	}))
+	defer srv.Close()
+
+	SetDownloadDirectory(t.TempDir())
+	client := resty.New()
+	defer client.Close()
+
+	tests := []struct {
+		name   string
+		source string // link the part file was downloaded from
+		part   []byte
+		ranged bool // whether the download is resumed
+	}{
+		{"same source", srv.URL + "/book.pdf", book[:len(book)/2], true},
+		{"other source", "https://libgen.li/get.php?md5=abc", other, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges = nil
+			ctx := helper.GenerateIDWithContext()
+			taskID := helper.GetIDFromContext(ctx).String()
+			dir := TaskDirectory(taskID)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			partPath, err := partFile(dir, taskID, tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(partPath, tt.part, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			filename, _, err := downloadAndSave(ctx, client, srv.URL+"/book.pdf", "", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, book) {
+				t.Fatal("saved file differs from the served book")
+			}
+			if resumed := len(ranges) == 1 && ranges[0] != ""; resumed != tt.ranged {
+				t.Fatalf("requests had ranges %q, resumed %v, want %v", ranges, resumed, tt.ranged)
+			}
+			if _, err := os.Stat(partPath); !os.IsNotExist(err) {
+				t.Fatal("part file was left behind")
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/roshanlc/send-to-kindle/internal/convert"
+	"github.com/roshanlc/send-to-kindle/internal/format"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+)
+
+var UploadTooLargeErr = errors.New("uploaded file is too large")
+
+// uploadsDir holds the uploaded files under the download directory
+const uploadsDir = "uploads"
+
+// UploadDirectory returns the directory holding the uploaded file of a task. It is
+// kept apart from the task directory, which is deleted after every attempt.
+func UploadDirectory(taskID string) string {
+	return filepath.Join(downloadDir, uploadsDir, SanitizeFilename(taskID, "unknown"))
+}
+
+// SaveUpload stores a book uploaded for a task and returns its path. Files over maxSize
+// bytes, 0 for no limit, and files Send to Kindle does not accept are rejected.
+func SaveUpload(taskID string, name string, r io.Reader, maxSize int64) (string, error) {
+	dir := UploadDirectory(taskID)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return "", fmt.Errorf("error while creating upload directory, %w", err)
+	}
+	path, err := saveUpload(dir, taskID, name, r, maxSize)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	slog.Info("Saved uploaded file", slog.String("filepath", path), slog.String("taskID", taskID))
+	return path, nil
+}
+
+// saveUpload writes and checks the upload in dir
+func saveUpload(dir string, taskID string, name string, r io.Reader, maxSize int64) (string, error) {
+	partPath := filepath.Join(dir, taskID+partSuffix)
+	f, err := os.Create(partPath)
+	if err != nil {
+		return "", fmt.Errorf("error while creating upload file, %w", err)
+	}
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		return "", fmt.Errorf("error while saving upload, %w", err)
+	}
+	if maxSize > 0 && n > maxSize {
+		return "", fmt.Errorf("%w: limit is %d MB", UploadTooLargeErr, maxSize>>20)
+	}
+
+	detected, err := checkFile(partPath, name)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, format.FixExtension(SanitizeFilename(name, taskID), detected))
+	err = os.Rename(partPath, path)
+	if err != nil {
+		return "", fmt.Errorf("error while saving upload, %w", err)
+	}
+	return path, nil
+}
+
+// checkFile returns the format of a local file, name hints at it. Files Send to Kindle
+// does not accept, and which can't be converted, are rejected like downloads are.
+func checkFile(path string, name string) (format.Format, error) {
+	detected, mediaType, err := format.Detect(path)
+	if err != nil {
+		return detected, fmt.Errorf("error while detecting file format, %w", err)
+	}
+	detected = format.Refine(detected, name)
+	if !convert.Convertible(detected) {
+		err = format.Check(detected, mediaType)
+		if err != nil {
+			return detected, err
+		}
+	}
+	return detected, nil
+}
+
+// ProcessFile takes a local file, such as an upload, in place of a url. It is checked
+// like a download and copied into the task directory, the original is left alone.
+// Returns the filename and a context holding the path of the copy, like Process.
+func ProcessFile(ctx context.Context, localPath string) (string, context.Context, error) {
+	taskID := helper.GetIDFromContext(ctx).String()
+
+	detected, err := checkFile(localPath, filepath.Base(localPath))
+	if err != nil {
+		return "", ctx, err
+	}
+
+	dir := TaskDirectory(taskID)
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return "", ctx, fmt.Errorf("error while creating task directory, %w", err)
+	}
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		return "", ctx, fmt.Errorf("error while opening file, %w", err)
+	}
+	defer src.Close()
+
+	filename := format.FixExtension(SanitizeFilename(filepath.Base(localPath), taskID), detected)
+	filePath := filepath.Join(dir, filename)
+	dst, err := os.Create(filePath)
+	if err != nil {
+		return "", ctx, fmt.Errorf("error while copying file, %w", err)
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		return "", ctx, fmt.Errorf("error while copying file, %w", err)
+	}
+
+	slog.Info("Copied local file", slog.String("filepath", filePath), slog.String("taskID", taskID))
+	return filename, helper.NewContextWithFilePath(ctx, filePath), nil
+}
+
+// DeleteUploadDirectory deletes the uploaded file of a task, if there is one
+func DeleteUploadDirectory(taskID string) error {
+	dir := UploadDirectory(taskID)
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	slog.Info("Deleted upload directory", slog.String("path", dir))
+	return nil
+}
@@ -5,21 +5,42 @@ import (
 	"fmt"
 	"log/slog"
 	"strings"
+	"time"
 
 	"github.com/roshanlc/send-to-kindle/internal/helper"
 	"github.com/wneessen/go-mail"
 )
 
+// delivery backends
+const (
+	DeliverySMTP     = "smtp"     // send through an smtp server
+	DeliverySendmail = "sendmail" // hand over to the sendmail binary of the host
+	DeliveryOutbox   = "outbox"   // write .eml files to a directory, nothing is sent
+)
+
+// Sender delivers emails
+type Sender interface {
+	Send(ctx context.Context, details EmailDetails) error
+}
+
+// EmailDetails is a single message to deliver
 type EmailDetails struct {
 	From        string
 	To          []string
-	Host        string
-	Port        int
 	Subject     string
 	Body        string
 	Attachments []string
-	Username    string
-	Password    string
+	MessageID   string // without angle brackets, generated by the mail library when empty
+}
+
+// NewMessageID returns a Message-ID for the mail of a task, in the domain of the
+// sender address. Replies refer to it, which ties them back to the task.
+func NewMessageID(taskID string, from string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 && at < len(from)-1 {
+		domain = strings.Trim(from[at+1:], "> ")
+	}
+	return fmt.Sprintf("%s.%d@%s", taskID, time.Now().UnixNano(), domain)
 }
 
 // verify verfies the EmailDetails for necessary details
@@ -29,26 +50,69 @@ func (e *EmailDetails) verify() error {
 		return fmt.Errorf("From field should not be empty")
 	case len(e.To) == 0:
 		return fmt.Errorf("To field should not be empty. Atleast one receiver is required.")
-	case strings.TrimSpace(e.Host) == "":
-		return fmt.Errorf("Host field should not be empty")
-	case e.Port == 0:
-		return fmt.Errorf("Port field should be non-zero")
 	case strings.TrimSpace(e.Subject) == "":
 		return fmt.Errorf("Subject field should not be empty")
 	case strings.TrimSpace(e.Body) == "":
 		return fmt.Errorf("Body field should not be empty")
-	case strings.TrimSpace(e.Username) == "":
-		return fmt.Errorf("Username field should not be empty")
-	case strings.TrimSpace(e.Password) == "":
-		return fmt.Errorf("Password field should not be empty")
 	}
 
 	return nil
 }
 
-func Send(ctx context.Context, details EmailDetails) error {
+// Options selects and configures a delivery backend. Only the settings of the
+// chosen backend are used.
+type Options struct {
+	Delivery string // one of the Delivery constants, smtp when empty
+
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Auth     string      // smtp auth mechanism, one of the Auth constants
+	Token    TokenSource // access tokens for XOAUTH2
+	TLS      TLSOptions
+
+	PoolSize    int           // smtp connections kept open between mails, 0 connects for every mail
+	IdleTimeout time.Duration // pooled connections unused for this long are closed
+
+	SendmailPath string // mail.SendmailPath when empty
+
+	OutboxDir string
+}
+
+// NewSender returns the sender for the configured delivery backend
+func NewSender(o Options) (Sender, error) {
+	switch o.Delivery {
+	case DeliverySMTP, "":
+		s := &SMTPSender{Host: o.Host, Port: o.Port, Username: o.Username, Password: o.Password, Auth: o.Auth, Token: o.Token, TLS: o.TLS}
+		if o.PoolSize > 0 {
+			return NewSMTPPool(*s, o.PoolSize, o.IdleTimeout)
+		}
+		if err := s.verify(); err != nil {
+			return nil, fmt.Errorf("error while validating smtp details: %w", err)
+		}
+		return s, nil
+	case DeliverySendmail:
+		path := o.SendmailPath
+		if path == "" {
+			path = mail.SendmailPath
+		}
+		return &SendmailSender{Path: path}, nil
+	case DeliveryOutbox:
+		if strings.TrimSpace(o.OutboxDir) == "" {
+			return nil, fmt.Errorf("outbox directory should not be empty")
+		}
+		return &OutboxSender{Dir: o.OutboxDir}, nil
+	default:
+		return nil, fmt.Errorf("unknown delivery backend %q, expected smtp, sendmail or outbox", o.Delivery)
+	}
+}
+
+// newMessage builds the message for the details, attachments which are not valid
+// files are skipped
+func newMessage(ctx context.Context, details EmailDetails) (*mail.Msg, error) {
 	if err := details.verify(); err != nil {
-		return fmt.Errorf("error while validating email details: %w", err)
+		return nil, fmt.Errorf("error while validating email details: %w", err)
 	}
 
 	taskID := helper.GetIDFromContext(ctx).String()
@@ -56,15 +120,18 @@ func Send(ctx context.Context, details EmailDetails) error {
 	msg := mail.NewMsg()
 	err := msg.From(details.From)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("error while setting From address, %w", err)
 	}
 
 	err = msg.To(details.To...)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("error while setting To address, %w", err)
 	}
 
 	msg.Subject(details.Subject)
+	if details.MessageID != "" {
+		msg.SetMessageIDWithValue(details.MessageID)
+	}
 	msg.SetBodyString(mail.TypeTextPlain, details.Body)
 	if len(details.Attachments) > 0 {
 		for _, item := range details.Attachments {
@@ -75,28 +142,5 @@ func Send(ctx context.Context, details EmailDetails) error {
 			}
 		}
 	}
-
-	slog.Info("Creating email client object", slog.String("taskID", taskID))
-	client, err := mail.NewClient(details.Host,
-		mail.WithPort(details.Port),
-		mail.WithTLSPolicy(mail.DefaultTLSPolicy),
-		mail.WithSMTPAuth(mail.SMTPAuthPlain),
-		mail.WithUsername(details.Username),
-		mail.WithPassword(details.Password),
-		mail.WithTLSPolicy(mail.TLSMandatory),
-	)
-	if err != nil {
-		return fmt.Errorf("error while constructing email client, %w", err)
-	}
-
-	slog.Info("Attempting to send email", slog.String("taskID", taskID))
-
-	// send the email
-	err = client.DialAndSend(msg)
-	if err != nil {
-		return fmt.Errorf("error while sending email, %w", err)
-	}
-	slog.Info("Email sent successfully", slog.String("taskID", taskID))
-
-	return nil
+	return msg, nil
 }
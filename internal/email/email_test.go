@@ -0,0 +1,181 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+)
+
+// testDetails returns a mail with an attachment in dir
+func testDetails(t *testing.T, dir string) EmailDetails {
+	t.Helper()
+	attachment := filepath.Join(dir, "book.epub")
+	if err := os.WriteFile(attachment, []byte("not really an epub"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return EmailDetails{
+		From:        "books@example.net",
+		To:          []string{"alice@kindle.com"},
+		Subject:     "Convert",
+		Body:        "Sent by send-to-kindle",
+		Attachments: []string{attachment, filepath.Join(dir, "missing.pdf")},
+		MessageID:   "task.1@example.net",
+	}
+}
+
+// checkMail parses a written mail and checks its headers and attachment
+func checkMail(t *testing.T, r io.Reader) {
+	t.Helper()
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string]string{
+		"From":       "<books@example.net>",
+		"To":         "<alice@kindle.com>",
+		"Subject":    "Convert",
+		"Message-Id": "<task.1@example.net>",
+	}
+	for name, want := range headers {
+		if got := msg.Header.Get(name); got != want {
+			t.Errorf("%s is %q, want %q", name, got, want)
+		}
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `filename="book.epub"`) {
+		t.Error("attachment is missing")
+	}
+	if strings.Contains(string(body), "missing.pdf") {
+		t.Error("file which does not exist was attached")
+	}
+}
+
+func TestOutboxSender(t *testing.T) {
+	dir := t.TempDir()
+	outbox := filepath.Join(dir, "outbox")
+	if err := os.Mkdir(outbox, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSender(Options{Delivery: DeliveryOutbox, OutboxDir: outbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	taskID := uuid.New()
+	ctx := helper.NewContextWithUUID(context.Background(), taskID)
+	for range 2 {
+		if err := s.Send(ctx, testDetails(t, dir)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	invalid := testDetails(t, dir)
+	invalid.To = nil
+	if err := s.Send(ctx, invalid); err == nil {
+		t.Fatal("mail without a receiver was written")
+	}
+
+	entries, err := os.ReadDir(outbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("outbox holds %d files, want 2", len(entries))
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), "-"+taskID.String()+".eml") {
+			t.Errorf("unexpected file %s", e.Name())
+		}
+		f, err := os.Open(filepath.Join(outbox, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMail(t, f)
+		f.Close()
+	}
+
+	s = &OutboxSender{Dir: filepath.Join(dir, "does-not-exist")}
+	if err := s.Send(ctx, testDetails(t, dir)); err == nil {
+		t.Fatal("mail was written to a missing directory")
+	}
+}
+
+func TestSendmailSender(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to stand in for sendmail")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "sent.eml")
+	script := filepath.Join(dir, "sendmail")
+	err = os.WriteFile(script, []byte("#!"+sh+"\ncat > '"+out+"'\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSender(Options{Delivery: DeliverySendmail, SendmailPath: script})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Send(helper.GenerateIDWithContext(), testDetails(t, dir)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	checkMail(t, f)
+
+	s = &SendmailSender{Path: filepath.Join(dir, "missing")}
+	if err := s.Send(helper.GenerateIDWithContext(), testDetails(t, dir)); err == nil {
+		t.Fatal("sending with a missing sendmail succeeded")
+	}
+}
+
+func TestNewSender(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		want    Sender // only its type is compared, nil for an error
+	}{
+		{"smtp", Options{Host: "smtp.example.net", Port: 587, Username: "u", Password: "p"}, &SMTPSender{}},
+		{"sendmail", Options{Delivery: DeliverySendmail}, &SendmailSender{}},
+		{"outbox", Options{Delivery: DeliveryOutbox, OutboxDir: "/tmp/outbox"}, &OutboxSender{}},
+		{"outbox without directory", Options{Delivery: DeliveryOutbox, OutboxDir: " "}, nil},
+		{"unknown", Options{Delivery: "carrier-pigeon"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewSender(tt.options)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("got %T, want an error", s)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := fmt.Sprintf("%T", s), fmt.Sprintf("%T", tt.want); got != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+		})
+	}
+
+	s, _ := NewSender(Options{Delivery: DeliverySendmail})
+	if s.(*SendmailSender).Path == "" {
+		t.Error("sendmail path was not defaulted")
+	}
+}
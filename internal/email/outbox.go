@@ -0,0 +1,54 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+)
+
+// OutboxSender writes mails as .eml files into a directory instead of sending them,
+// for dry runs or for another program to pick up
+type OutboxSender struct {
+	Dir string
+}
+
+// Send writes the mail to the outbox. Files appear complete, as they are written
+// under a temporary name first.
+func (s *OutboxSender) Send(ctx context.Context, details EmailDetails) error {
+	msg, err := newMessage(ctx, details)
+	if err != nil {
+		return err
+	}
+
+	taskID := helper.GetIDFromContext(ctx).String()
+
+	tmp, err := os.CreateTemp(s.Dir, ".outbox-*.tmp")
+	if err != nil {
+		return fmt.Errorf("error while creating outbox file, %w", err)
+	}
+	_, err = msg.WriteTo(tmp)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("error while writing outbox file, %w", err)
+	}
+
+	// names sort in the order the mails were written
+	name := filepath.Join(s.Dir, fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), taskID))
+	err = os.Rename(tmp.Name(), name)
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("error while saving outbox file, %w", err)
+	}
+	slog.Info("Email written to outbox", slog.String("filepath", name), slog.String("taskID", taskID))
+	return nil
+}
@@ -0,0 +1,33 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+)
+
+// SendmailSender hands mails over to the sendmail binary of the host, which
+// takes care of delivering them
+type SendmailSender struct {
+	Path string // location of the sendmail binary
+}
+
+// Send pipes the mail to sendmail
+func (s *SendmailSender) Send(ctx context.Context, details EmailDetails) error {
+	msg, err := newMessage(ctx, details)
+	if err != nil {
+		return err
+	}
+
+	taskID := helper.GetIDFromContext(ctx).String()
+	slog.Info("Attempting to send email with sendmail", slog.String("path", s.Path), slog.String("taskID", taskID))
+
+	err = msg.WriteToSendmailWithContext(ctx, s.Path)
+	if err != nil {
+		return fmt.Errorf("error while sending email with sendmail, %w", err)
+	}
+	slog.Info("Email handed over to sendmail", slog.String("taskID", taskID))
+	return nil
+}
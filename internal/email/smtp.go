@@ -0,0 +1,141 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+	"github.com/wneessen/go-mail"
+)
+
+// smtp authentication mechanisms
+const (
+	AuthPlain   = "PLAIN"
+	AuthLogin   = "LOGIN"
+	AuthCramMD5 = "CRAM-MD5"
+	AuthXOAUTH2 = "XOAUTH2" // oauth2 access token in place of the password
+	AuthNone    = "NONE"    // no login, for relays which trust their network
+)
+
+// TokenSource returns oauth2 access tokens for XOAUTH2 logins
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// SMTPSender sends mails through an smtp server
+type SMTPSender struct {
+	Host     string
+	Port     int
+	Username string
+	Password string      // unused with XOAUTH2
+	Auth     string      // one of the Auth constants, PLAIN when empty
+	Token    TokenSource // access tokens for XOAUTH2
+	TLS      TLSOptions
+}
+
+// verify checks the server details
+func (s *SMTPSender) verify() error {
+	switch {
+	case strings.TrimSpace(s.Host) == "":
+		return fmt.Errorf("Host field should not be empty")
+	case s.Port == 0:
+		return fmt.Errorf("Port field should be non-zero")
+	case s.Auth != AuthNone && strings.TrimSpace(s.Username) == "":
+		return fmt.Errorf("Username field should not be empty")
+	}
+	if err := s.TLS.Verify(); err != nil {
+		return err
+	}
+
+	switch s.Auth {
+	case AuthNone:
+	case AuthPlain, AuthLogin, AuthCramMD5, "":
+		if strings.TrimSpace(s.Password) == "" {
+			return fmt.Errorf("Password field should not be empty")
+		}
+	case AuthXOAUTH2:
+		if s.Token == nil {
+			return fmt.Errorf("Token field should be set for XOAUTH2")
+		}
+	default:
+		return fmt.Errorf("unknown smtp auth %q, expected PLAIN, LOGIN, CRAM-MD5, XOAUTH2 or NONE", s.Auth)
+	}
+	return nil
+}
+
+// Send connects to the server and sends the mail
+func (s *SMTPSender) Send(ctx context.Context, details EmailDetails) error {
+	if err := s.verify(); err != nil {
+		return fmt.Errorf("error while validating smtp details: %w", err)
+	}
+	msg, err := newMessage(ctx, details)
+	if err != nil {
+		return err
+	}
+
+	taskID := helper.GetIDFromContext(ctx).String()
+
+	slog.Info("Creating email client object", slog.String("taskID", taskID))
+	client, err := s.newClient(ctx)
+	if err != nil {
+		return fmt.Errorf("error while constructing email client, %w", err)
+	}
+
+	slog.Info("Attempting to send email", slog.String("taskID", taskID))
+
+	// send the email
+	err = client.DialAndSendWithContext(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("error while sending email, %w", err)
+	}
+	slog.Info("Email sent successfully", slog.String("taskID", taskID))
+
+	return nil
+}
+
+// newClient returns a client for the server, it is not connected yet. XOAUTH2
+// logins get a fresh access token.
+func (s *SMTPSender) newClient(ctx context.Context) (*mail.Client, error) {
+	tlsConfig, err := s.TLS.Config(s.Host)
+	if err != nil {
+		return nil, err
+	}
+	opts := []mail.Option{mail.WithPort(s.Port), mail.WithTLSConfig(tlsConfig)}
+	switch s.TLS.Mode {
+	case TLSMandatory, "":
+		opts = append(opts, mail.WithTLSPolicy(mail.TLSMandatory))
+	case TLSOpportunistic:
+		opts = append(opts, mail.WithTLSPolicy(mail.TLSOpportunistic))
+	case TLSImplicit:
+		opts = append(opts, mail.WithSSL())
+	case TLSNone:
+		opts = append(opts, mail.WithTLSPolicy(mail.NoTLS))
+	}
+
+	auth, password := mail.SMTPAuthType(s.Auth), s.Password
+	switch s.Auth {
+	case "":
+		auth = mail.SMTPAuthPlain
+	case AuthXOAUTH2:
+		password, err = s.Token.Token(ctx)
+		if err != nil {
+			return nil, err
+		}
+	case AuthNone:
+		return mail.NewClient(s.Host, opts...)
+	}
+	// go-mail refuses to send these in plain text unless told so explicitly
+	if s.TLS.Mode == TLSNone {
+		switch auth {
+		case mail.SMTPAuthPlain:
+			auth = mail.SMTPAuthPlainNoEnc
+		case mail.SMTPAuthLogin:
+			auth = mail.SMTPAuthLoginNoEnc
+		}
+	}
+
+	opts = append(opts, mail.WithSMTPAuth(auth), mail.WithUsername(s.Username), mail.WithPassword(password))
+	return mail.NewClient(s.Host, opts...)
+}
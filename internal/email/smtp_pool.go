@@ -0,0 +1,224 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+	"github.com/wneessen/go-mail"
+)
+
+var PoolClosedErr = errors.New("smtp pool is closed")
+
+// SMTPPool sends mails through an smtp server over a few long lived connections,
+// so that bulk submissions don't redo the handshake and login for every book.
+// Connections are opened on demand, checked with a NOOP before every message,
+// reset after it and reopened when they turn out to be broken.
+type SMTPPool struct {
+	server      SMTPSender
+	idleTimeout time.Duration
+
+	slots chan struct{} // one per connection in use, limits the open connections
+
+	mu     sync.Mutex
+	idle   []*pooledConn // connections waiting for the next message, last used at the end
+	closed bool
+	done   chan struct{} // stops the reaper
+}
+
+// pooledConn is a connected client of the pool
+type pooledConn struct {
+	client   *mail.Client
+	lastUsed time.Time
+}
+
+// NewSMTPPool returns a pool of at most size connections to the server. Connections
+// unused for idleTimeout are closed, servers drop idle sessions after a few minutes.
+func NewSMTPPool(server SMTPSender, size int, idleTimeout time.Duration) (*SMTPPool, error) {
+	if err := server.verify(); err != nil {
+		return nil, fmt.Errorf("error while validating smtp details: %w", err)
+	}
+	if size < 1 {
+		return nil, fmt.Errorf("pool size should be atleast 1")
+	}
+	if idleTimeout <= 0 {
+		return nil, fmt.Errorf("idle timeout should be positive")
+	}
+
+	p := &SMTPPool{
+		server:      server,
+		idleTimeout: idleTimeout,
+		slots:       make(chan struct{}, size),
+		done:        make(chan struct{}),
+	}
+	go p.reap()
+	return p, nil
+}
+
+// Send sends the mail over a pooled connection. A message failing on a reused
+// connection without an answer from the server is sent once more on a new one.
+func (p *SMTPPool) Send(ctx context.Context, details EmailDetails) error {
+	msg, err := newMessage(ctx, details)
+	if err != nil {
+		return err
+	}
+
+	taskID := helper.GetIDFromContext(ctx).String()
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	conn, reused, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Attempting to send email", slog.Bool("reusedConnection", reused), slog.String("taskID", taskID))
+	err = conn.client.Send(msg)
+	if err != nil && reused && !msg.IsDelivered() && isConnErr(err) {
+		slog.Warn("Pooled smtp connection is broken, reconnecting", slog.String("error", err.Error()), slog.String("taskID", taskID))
+		p.discard(conn)
+		conn, err = p.dial(ctx)
+		if err != nil {
+			return err
+		}
+		err = conn.client.Send(msg)
+	}
+	switch {
+	case err != nil && msg.IsDelivered():
+		// the server took the mail, only the reset after it failed
+		slog.Warn("Dropping smtp connection after delivery", slog.String("error", err.Error()), slog.String("taskID", taskID))
+		p.discard(conn)
+	case err != nil:
+		p.discard(conn) // the session is in an unknown state after a failure
+		return fmt.Errorf("error while sending email, %w", err)
+	default:
+		p.put(conn)
+	}
+	slog.Info("Email sent successfully", slog.String("taskID", taskID))
+
+	return nil
+}
+
+// Close closes the idle connections and stops the pool, mails sent afterwards fail
+func (p *SMTPPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	close(p.done)
+	for _, conn := range idle {
+		p.discard(conn)
+	}
+	return nil
+}
+
+// get returns an idle connection when there is one, a new one otherwise
+func (p *SMTPPool) get(ctx context.Context) (*pooledConn, bool, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, false, PoolClosedErr
+	}
+	var conn *pooledConn
+	if n := len(p.idle); n > 0 {
+		conn = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+	}
+	p.mu.Unlock()
+
+	if conn != nil {
+		if time.Since(conn.lastUsed) < p.idleTimeout {
+			return conn, true, nil
+		}
+		p.discard(conn) // likely dropped by the server already
+	}
+	conn, err := p.dial(ctx)
+	return conn, false, err
+}
+
+// dial opens and logs into a new connection
+func (p *SMTPPool) dial(ctx context.Context) (*pooledConn, error) {
+	client, err := p.server.newClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error while constructing email client, %w", err)
+	}
+	err = client.DialWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error while connecting to smtp server, %w", err)
+	}
+	slog.Info("Opened smtp connection", slog.String("host", p.server.Host))
+	return &pooledConn{client: client}, nil
+}
+
+// put hands a healthy connection back to the pool
+func (p *SMTPPool) put(conn *pooledConn) {
+	conn.lastUsed = time.Now()
+	p.mu.Lock()
+	if !p.closed {
+		p.idle = append(p.idle, conn)
+		conn = nil
+	}
+	p.mu.Unlock()
+	if conn != nil {
+		p.discard(conn)
+	}
+}
+
+// discard closes a connection which is not in the pool
+func (p *SMTPPool) discard(conn *pooledConn) {
+	_ = conn.client.Close() // QUIT fails on broken connections, nothing to do about it
+}
+
+// reap closes connections idle for longer than the idle timeout until the pool is closed
+func (p *SMTPPool) reap() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		var expired []*pooledConn
+		p.mu.Lock()
+		// idle is ordered by last use, the expired connections are at the front
+		for len(p.idle) > 0 && time.Since(p.idle[0].lastUsed) >= p.idleTimeout {
+			expired = append(expired, p.idle[0])
+			p.idle = p.idle[1:]
+		}
+		p.mu.Unlock()
+
+		for _, conn := range expired {
+			p.discard(conn)
+		}
+		if len(expired) > 0 {
+			slog.Info("Closed idle smtp connections", slog.Int("count", len(expired)))
+		}
+	}
+}
+
+// isConnErr reports failures without a reply from the server, such as a dropped
+// connection. Replies like a rejected recipient would fail again on a new one.
+func isConnErr(err error) bool {
+	var sendErr *mail.SendError
+	if errors.As(err, &sendErr) {
+		return sendErr.ErrorCode() == 0
+	}
+	return true
+}
@@ -0,0 +1,248 @@
+package email
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+)
+
+// testSMTPServer is a minimal smtp server accepting any login and mail
+type testSMTPServer struct {
+	ln       net.Listener
+	dropIdle bool // drop the connection once a mail is through, as servers do with idle sessions
+
+	mu       sync.Mutex
+	conns    int      // connections opened
+	quits    int      // connections closed with QUIT
+	messages int      // mails accepted
+	auths    []string // login mechanisms used
+}
+
+// newTestSMTPServer starts a server on a local port, it is stopped with the test
+func newTestSMTPServer(t *testing.T) *testSMTPServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveSMTP(t, ln)
+}
+
+// serveSMTP runs a server on ln until the test is over
+func serveSMTP(t *testing.T, ln net.Listener) *testSMTPServer {
+	s := &testSMTPServer{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// sender returns a sender logging into the server with PLAIN over plain text
+func (s *testSMTPServer) sender() SMTPSender {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return SMTPSender{
+		Host:     "127.0.0.1",
+		Port:     addr.Port,
+		Username: "books",
+		Password: "secret",
+		TLS:      TLSOptions{Mode: TLSNone},
+	}
+}
+
+// counts returns the connections opened and closed with QUIT, and the mails accepted
+func (s *testSMTPServer) counts() (conns, quits, messages int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns, s.quits, s.messages
+}
+
+// mechanisms returns the login mechanisms used
+func (s *testSMTPServer) mechanisms() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.auths)
+}
+
+func (s *testSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+	}
+	readLine := func() (string, bool) {
+		line, err := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err == nil
+	}
+
+	reply("220 localhost ESMTP")
+	for {
+		line, ok := readLine()
+		if !ok {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			reply("250-localhost", "250-AUTH PLAIN LOGIN", "250 8BITMIME")
+		case "HELO", "MAIL", "RCPT", "NOOP":
+			reply("250 OK")
+		case "RSET":
+			reply("250 OK")
+			if s.dropIdle {
+				return
+			}
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			s.mu.Lock()
+			s.auths = append(s.auths, mechanism)
+			s.mu.Unlock()
+			steps := 0
+			if mechanism == "LOGIN" {
+				steps = 2
+			} else if initial == "" {
+				steps = 1
+			}
+			for range steps {
+				reply("334 ")
+				if _, ok := readLine(); !ok {
+					return
+				}
+			}
+			reply("235 2.7.0 Authentication successful")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			for {
+				line, ok := readLine()
+				if !ok {
+					return
+				}
+				if line == "." {
+					break
+				}
+			}
+			s.mu.Lock()
+			s.messages++
+			s.mu.Unlock()
+			reply("250 OK queued")
+		case "QUIT":
+			s.mu.Lock()
+			s.quits++
+			s.mu.Unlock()
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func TestSMTPPoolReusesConnections(t *testing.T) {
+	server := newTestSMTPServer(t)
+	pool, err := NewSMTPPool(server.sender(), 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		if err := pool.Send(helper.GenerateIDWithContext(), testDetails(t, t.TempDir())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conns, _, messages := server.counts(); conns != 1 || messages != 3 {
+		t.Fatalf("%d mails over %d connections, want 3 over 1", messages, conns)
+	}
+
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { _, quits, _ := server.counts(); return quits == 1 })
+	if err := pool.Send(helper.GenerateIDWithContext(), testDetails(t, t.TempDir())); !errors.Is(err, PoolClosedErr) {
+		t.Fatalf("got %v after closing, want PoolClosedErr", err)
+	}
+}
+
+func TestSMTPPoolIdleExpiry(t *testing.T) {
+	server := newTestSMTPServer(t)
+	pool, err := NewSMTPPool(server.sender(), 2, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	if err := pool.Send(helper.GenerateIDWithContext(), testDetails(t, t.TempDir())); err != nil {
+		t.Fatal(err)
+	}
+	// the reaper logs out of the idle connection
+	waitFor(t, func() bool { _, quits, _ := server.counts(); return quits == 1 })
+
+	if err := pool.Send(helper.GenerateIDWithContext(), testDetails(t, t.TempDir())); err != nil {
+		t.Fatal(err)
+	}
+	if conns, _, messages := server.counts(); conns != 2 || messages != 2 {
+		t.Fatalf("%d mails over %d connections, want 2 over 2", messages, conns)
+	}
+}
+
+func TestSMTPPoolReconnects(t *testing.T) {
+	server := newTestSMTPServer(t)
+	server.dropIdle = true
+	pool, err := NewSMTPPool(server.sender(), 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	// the pooled connection turns out to be dropped when taken up again, the mail
+	// is sent over a new one
+	for range 2 {
+		if err := pool.Send(helper.GenerateIDWithContext(), testDetails(t, t.TempDir())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conns, _, messages := server.counts(); conns != 2 || messages != 2 {
+		t.Fatalf("%d mails over %d connections, want 2 over 2", messages, conns)
+	}
+}
+
+func TestNewSMTPPool(t *testing.T) {
+	server := SMTPSender{Host: "smtp.example.net", Port: 587, Username: "u", Password: "p"}
+	if _, err := NewSMTPPool(server, 0, time.Minute); err == nil {
+		t.Error("pool without connections was created")
+	}
+	if _, err := NewSMTPPool(server, 1, 0); err == nil {
+		t.Error("pool without idle timeout was created")
+	}
+	server.Host = ""
+	if _, err := NewSMTPPool(server, 1, time.Minute); err == nil {
+		t.Error("pool without host was created")
+	}
+}
+
+// waitFor waits a few seconds for cond to hold
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
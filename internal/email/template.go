@@ -0,0 +1,105 @@
+package email
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// default templates, the subject only has to be unique for Send to Kindle
+const (
+	DefaultSubject = "{{.ID}}"
+	DefaultBody    = "Save the attached file(s)."
+)
+
+// ConvertSubject makes Send to Kindle convert an attached PDF to Kindle format
+const ConvertSubject = "convert"
+
+// MessageData holds the task fields available to the subject and body templates
+type MessageData struct {
+	ID      string
+	Title   string
+	Author  string
+	URL     string
+	AddedAt time.Time
+	Format  string // format of the attached file, e.g. epub
+	Size    int64  // size of the attached file in bytes
+	Part    int    // 1 based number of the part of a split book, 0 when it was not split
+	Parts   int    // number of parts of a split book
+}
+
+// SizeText returns the attachment size for people, e.g. 1.4 MB
+func (d MessageData) SizeText() string {
+	const kb, mb = 1 << 10, 1 << 20
+	switch {
+	case d.Size >= mb:
+		return fmt.Sprintf("%.1f MB", float64(d.Size)/mb)
+	case d.Size >= kb:
+		return fmt.Sprintf("%.1f KB", float64(d.Size)/kb)
+	default:
+		return fmt.Sprintf("%d B", d.Size)
+	}
+}
+
+// Templates builds the subject and body of mails from text/template strings
+type Templates struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// NewTemplates parses the subject and body templates, empty ones are replaced by the defaults.
+// Templates referring to fields MessageData does not have are rejected.
+func NewTemplates(subject, body string) (*Templates, error) {
+	if strings.TrimSpace(subject) == "" {
+		subject = DefaultSubject
+	}
+	if strings.TrimSpace(body) == "" {
+		body = DefaultBody
+	}
+
+	t := &Templates{}
+	var err error
+	t.subject, err = template.New("subject").Parse(subject)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing subject template, %w", err)
+	}
+	t.body, err = template.New("body").Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing body template, %w", err)
+	}
+
+	// unknown fields only show up when executing, they should fail at startup instead
+	_, _, err = t.Render(MessageData{})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Render returns the subject and body for a task. A subject which comes out empty,
+// e.g. for a title that is not known, falls back to the task id and an empty body
+// to the default body.
+func (t *Templates) Render(data MessageData) (subject string, body string, err error) {
+	var b strings.Builder
+	err = t.subject.Execute(&b, data)
+	if err != nil {
+		return "", "", fmt.Errorf("error while rendering subject template, %w", err)
+	}
+	// headers are a single line
+	subject = strings.Join(strings.Fields(b.String()), " ")
+	if subject == "" {
+		subject = data.ID
+	}
+
+	b.Reset()
+	err = t.body.Execute(&b, data)
+	if err != nil {
+		return "", "", fmt.Errorf("error while rendering body template, %w", err)
+	}
+	body = b.String()
+	if strings.TrimSpace(body) == "" {
+		body = DefaultBody
+	}
+	return subject, body, nil
+}
@@ -0,0 +1,86 @@
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTemplatesRender(t *testing.T) {
+	data := MessageData{
+		ID:      "0b5d4c1e",
+		Title:   "The Art of Computer Programming",
+		Author:  "Donald Knuth",
+		URL:     "https://libgen.li/ads.php?md5=abc",
+		AddedAt: time.Date(2026, 3, 14, 9, 30, 0, 0, time.UTC),
+		Format:  "epub",
+		Size:    1468006,
+		Part:    2,
+		Parts:   3,
+	}
+	tests := []struct {
+		name        string
+		subject     string
+		body        string
+		wantSubject string
+		wantBody    string
+	}{
+		{"defaults", "", " ", "0b5d4c1e", DefaultBody},
+		{
+			"fields",
+			"{{.Title}} by {{.Author}}{{if .Parts}} ({{.Part}}/{{.Parts}}){{end}}",
+			"{{.Format}}, {{.SizeText}}, added {{.AddedAt.Format \"2006-01-02\"}} from {{.URL}}",
+			"The Art of Computer Programming by Donald Knuth (2/3)",
+			"epub, 1.4 MB, added 2026-03-14 from https://libgen.li/ads.php?md5=abc",
+		},
+		{"subject on one line", "{{.Title}}\n\t{{.Author}}\r\n", "", "The Art of Computer Programming Donald Knuth", DefaultBody},
+		{"empty subject falls back", "{{if false}}x{{end}}  ", "{{if false}}x{{end}}\n", "0b5d4c1e", DefaultBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			templates, err := NewTemplates(tt.subject, tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			subject, body, err := templates.Render(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if subject != tt.wantSubject || body != tt.wantBody {
+				t.Fatalf("got %q, %q, want %q, %q", subject, body, tt.wantSubject, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestNewTemplatesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject string
+		body    string
+		want    string // part of the error
+	}{
+		{"subject syntax", "{{.Title", "", "parsing subject template"},
+		{"body syntax", "", "{{if .Title}}no end", "parsing body template"},
+		{"unknown subject field", "{{.Name}}", "", "rendering subject template"},
+		{"unknown body field", "", "{{.Publisher}}", "rendering body template"},
+		{"unknown function", "{{upper .Title}}", "", "parsing subject template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTemplates(tt.subject, tt.body)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSizeText(t *testing.T) {
+	tests := map[int64]string{0: "0 B", 1023: "1023 B", 1024: "1.0 KB", 1536: "1.5 KB", 5 << 20: "5.0 MB"}
+	for size, want := range tests {
+		if got := (MessageData{Size: size}).SizeText(); got != want {
+			t.Errorf("SizeText() of %d = %q, want %q", size, got, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package email
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// encryption of the smtp connection
+const (
+	TLSMandatory     = "mandatory"     // STARTTLS, fail when the server does not offer it
+	TLSOpportunistic = "opportunistic" // STARTTLS when the server offers it, plain text otherwise
+	TLSImplicit      = "implicit"      // TLS from the first byte, SMTPS on port 465
+	TLSNone          = "none"          // plain text, only for relays on a trusted network
+)
+
+// TLSOptions configures the encryption of the smtp connection
+type TLSOptions struct {
+	Mode     string // one of the TLS constants, mandatory when empty
+	CAFile   string // PEM bundle trusted in addition to the system roots, e.g. a private CA
+	CertFile string // PEM client certificate, for relays which authenticate clients by certificate
+	KeyFile  string // PEM key of the client certificate
+}
+
+// Verify checks the options and loads the files they refer to
+func (o *TLSOptions) Verify() error {
+	switch o.Mode {
+	case TLSMandatory, TLSOpportunistic, TLSImplicit, TLSNone, "":
+	default:
+		return fmt.Errorf("unknown tls mode %q, expected mandatory, opportunistic, implicit or none", o.Mode)
+	}
+	_, err := o.Config("")
+	return err
+}
+
+// Config returns the tls configuration for connections to host
+func (o *TLSOptions) Config(host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading CA file, %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool() // not available on every platform
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA file %s holds no PEM certificates", o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, fmt.Errorf("client certificate and key should be given together")
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading client certificate, %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
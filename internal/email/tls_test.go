@@ -0,0 +1,170 @@
+package email
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+)
+
+// writeCert writes a self signed certificate for 127.0.0.1 and its key to dir
+func writeCert(t *testing.T, dir string) (certFile string, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test relay"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSOptionsVerify(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir)
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		options TLSOptions
+		want    string // part of the error, none when empty
+	}{
+		{"default", TLSOptions{}, ""},
+		{"mandatory", TLSOptions{Mode: TLSMandatory}, ""},
+		{"opportunistic", TLSOptions{Mode: TLSOpportunistic}, ""},
+		{"implicit", TLSOptions{Mode: TLSImplicit}, ""},
+		{"none", TLSOptions{Mode: TLSNone}, ""},
+		{"unknown mode", TLSOptions{Mode: "starttls"}, "unknown tls mode"},
+		{"private CA", TLSOptions{CAFile: certFile}, ""},
+		{"missing CA file", TLSOptions{CAFile: filepath.Join(dir, "missing.pem")}, "reading CA file"},
+		{"CA file without certificates", TLSOptions{CAFile: notPEM}, "holds no PEM certificates"},
+		{"client certificate", TLSOptions{CertFile: certFile, KeyFile: keyFile}, ""},
+		{"certificate without key", TLSOptions{CertFile: certFile}, "given together"},
+		{"key without certificate", TLSOptions{KeyFile: keyFile}, "given together"},
+		{"key not matching", TLSOptions{CertFile: certFile, KeyFile: notPEM}, "loading client certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.options.Verify()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+
+	config, err := (&TLSOptions{CAFile: certFile, CertFile: certFile, KeyFile: keyFile}).Config("smtp.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServerName != "smtp.example.net" || config.RootCAs == nil || len(config.Certificates) != 1 || config.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("config is %+v", config)
+	}
+}
+
+// TestTLSNoneLogin logs in over plain text, which go-mail only allows for the NoEnc
+// variants of PLAIN and LOGIN
+func TestTLSNoneLogin(t *testing.T) {
+	for _, auth := range []string{"", AuthPlain, AuthLogin} {
+		server := newTestSMTPServer(t)
+		s := server.sender()
+		s.Auth = auth
+		if err := s.Send(helper.GenerateIDWithContext(), testDetails(t, t.TempDir())); err != nil {
+			t.Fatalf("auth %q: %v", auth, err)
+		}
+		want := auth
+		if want == "" {
+			want = AuthPlain
+		}
+		if got := server.mechanisms(); !slices.Equal(got, []string{want}) {
+			t.Fatalf("auth %q: server saw %v", auth, got)
+		}
+	}
+
+	// the server offers no STARTTLS, mandatory tls must not fall back to plain text
+	server := newTestSMTPServer(t)
+	s := server.sender()
+	s.TLS.Mode = TLSMandatory
+	if err := s.Send(helper.GenerateIDWithContext(), testDetails(t, t.TempDir())); err == nil {
+		t.Fatal("mail was sent without tls")
+	}
+	if _, _, messages := server.counts(); messages != 0 {
+		t.Fatal("server got the mail")
+	}
+}
+
+func TestTLSImplicitPrivateCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := serveSMTP(t, ln)
+
+	s := server.sender()
+	s.TLS = TLSOptions{Mode: TLSImplicit}
+	if err := s.Send(helper.GenerateIDWithContext(), testDetails(t, dir)); err == nil {
+		t.Fatal("certificate of an unknown CA was trusted")
+	}
+
+	s.TLS.CAFile = certFile
+	if err := s.Send(helper.GenerateIDWithContext(), testDetails(t, dir)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, messages := server.counts(); messages != 1 {
+		t.Fatalf("server got %d mails, want 1", messages)
+	}
+}
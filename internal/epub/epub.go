@@ -0,0 +1,357 @@
+// Package epub writes EPUB 3 books, with an NCX table of contents for older readers
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var NoChaptersErr = errors.New("epub needs at least one chapter")
+
+// Book holds the contents of an EPUB to be written
+type Book struct {
+	Identifier  string // unique id of the book, a random urn:uuid is used when empty
+	Title       string
+	Authors     []string
+	Language    string // BCP 47 language tag, "en" when empty
+	Publisher   string
+	Description string
+	Modified    time.Time // time.Now when zero
+
+	Cover     *Resource  // optional cover image, also shown as the first page
+	Chapters  []Chapter  // in reading order
+	Resources []Resource // images and other files referenced by the chapters
+	Style     string     // stylesheet for the chapters, DefaultStyle when empty
+}
+
+// Chapter is a single XHTML document of the book
+type Chapter struct {
+	Title string // entry in the table of contents, chapters without a title are left out
+	Body  string // well formed XHTML content of the <body> element
+}
+
+// Resource is a file referenced from chapters, e.g. an image
+type Resource struct {
+	Name      string // path relative to the chapters, e.g. "images/1.jpg"
+	MediaType string
+	Data      []byte
+}
+
+// DefaultStyle is a small stylesheet suited to e-readers
+const DefaultStyle = `body { margin: 0 2%; line-height: 1.4; }
+h1, h2, h3, h4, h5, h6 { text-align: center; page-break-after: avoid; }
+p { margin: 0; text-indent: 1.5em; text-align: justify; }
+p.noindent, h1 + p, h2 + p, h3 + p { text-indent: 0; }
+blockquote { margin: 1em 2em; }
+pre { white-space: pre-wrap; font-size: 0.85em; }
+img { max-width: 100%; }
+div.image { text-align: center; margin: 1em 0; }
+div.page { text-align: center; margin: 0; padding: 0; page-break-after: always; }
+div.page img { max-height: 100%; }
+`
+
+const contentDir = "OEBPS"
+
+// ChapterName returns the file name of the i-th chapter (0 based), for links between chapters
+func ChapterName(i int) string {
+	return fmt.Sprintf("chapter-%03d.xhtml", i+1)
+}
+
+// WriteFile writes the book to path
+func (b *Book) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = b.Write(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Write writes the book as an EPUB container
+func (b *Book) Write(w io.Writer) error {
+	if len(b.Chapters) == 0 {
+		return NoChaptersErr
+	}
+
+	data := b.templateData()
+	z := zip.NewWriter(w)
+
+	// the mimetype must be the first entry and stored uncompressed
+	mt, err := z.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(mt, "application/epub+zip")
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name string
+		tmpl *template.Template
+	}{
+		{"META-INF/container.xml", containerTmpl},
+		{contentDir + "/content.opf", opfTmpl},
+		{contentDir + "/nav.xhtml", navTmpl},
+		{contentDir + "/toc.ncx", ncxTmpl},
+		{contentDir + "/cover.xhtml", coverTmpl},
+	}
+	for _, f := range files {
+		if f.tmpl == coverTmpl && b.Cover == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		err = f.tmpl.Execute(&buf, data)
+		if err != nil {
+			return fmt.Errorf("error while rendering %s, %w", f.name, err)
+		}
+		err = writeEntry(z, f.name, buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	style := b.Style
+	if style == "" {
+		style = DefaultStyle
+	}
+	err = writeEntry(z, contentDir+"/style.css", []byte(style))
+	if err != nil {
+		return err
+	}
+
+	for i, ch := range data.Chapters {
+		var buf bytes.Buffer
+		title := ch.Title
+		if title == "" {
+			title = data.Title
+		}
+		err = chapterTmpl.Execute(&buf, map[string]any{"Language": data.Language, "Title": title, "Body": b.Chapters[i].Body})
+		if err != nil {
+			return fmt.Errorf("error while rendering chapter %d, %w", i+1, err)
+		}
+		err = writeEntry(z, contentDir+"/"+ch.Href, buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range data.Resources {
+		err = writeEntry(z, contentDir+"/"+r.Href, r.data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return z.Close()
+}
+
+// writeEntry adds a compressed file to the archive
+func writeEntry(z *zip.Writer, name string, data []byte) error {
+	w, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// manifest items and toc entries as used by the templates
+type (
+	item struct {
+		ID, Href, MediaType, Properties, Title string
+		data                                   []byte
+	}
+	navPoint struct {
+		Title, Href string
+		Order       int
+	}
+	packageData struct {
+		Identifier, Title, Language, Publisher, Description, Modified string
+		Authors                                                       []string
+		Cover                                                         *item
+		Chapters                                                      []item
+		Resources                                                     []item
+		TOC                                                           []navPoint
+	}
+)
+
+// templateData prepares the values shared by the package documents
+func (b *Book) templateData() packageData {
+	d := packageData{
+		Identifier:  b.Identifier,
+		Title:       strings.TrimSpace(b.Title),
+		Language:    b.Language,
+		Publisher:   b.Publisher,
+		Description: b.Description,
+		Authors:     b.Authors,
+	}
+	if d.Identifier == "" {
+		d.Identifier = "urn:uuid:" + uuid.NewString()
+	}
+	if d.Title == "" {
+		d.Title = "Untitled"
+	}
+	if d.Language == "" {
+		d.Language = "en"
+	}
+	modified := b.Modified
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+	d.Modified = modified.UTC().Format("2006-01-02T15:04:05Z")
+
+	if b.Cover != nil {
+		d.Cover = &item{ID: "cover-image", Href: b.Cover.Name, MediaType: b.Cover.MediaType, Properties: "cover-image", data: b.Cover.Data}
+		d.Resources = append(d.Resources, *d.Cover)
+	}
+	for i, r := range b.Resources {
+		d.Resources = append(d.Resources, item{ID: fmt.Sprintf("res-%d", i+1), Href: r.Name, MediaType: r.MediaType, data: r.Data})
+	}
+
+	for i, ch := range b.Chapters {
+		href := ChapterName(i)
+		d.Chapters = append(d.Chapters, item{ID: fmt.Sprintf("chapter-%d", i+1), Href: href, Title: ch.Title})
+		if strings.TrimSpace(ch.Title) != "" {
+			d.TOC = append(d.TOC, navPoint{Title: strings.TrimSpace(ch.Title), Href: href, Order: len(d.TOC) + 1})
+		}
+	}
+	// the table of contents must not be empty
+	if len(d.TOC) == 0 {
+		d.TOC = append(d.TOC, navPoint{Title: d.Title, Href: ChapterName(0), Order: 1})
+	}
+	return d
+}
+
+// x escapes text for xml
+var funcs = template.FuncMap{"x": html.EscapeString}
+
+var containerTmpl = template.Must(template.New("container").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="` + contentDir + `/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`))
+
+var opfTmpl = template.Must(template.New("opf").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id" xml:lang="{{x .Language}}">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">{{x .Identifier}}</dc:identifier>
+    <dc:title>{{x .Title}}</dc:title>
+    <dc:language>{{x .Language}}</dc:language>
+{{- range .Authors}}
+    <dc:creator>{{x .}}</dc:creator>
+{{- end}}
+{{- if .Publisher}}
+    <dc:publisher>{{x .Publisher}}</dc:publisher>
+{{- end}}
+{{- if .Description}}
+    <dc:description>{{x .Description}}</dc:description>
+{{- end}}
+    <meta property="dcterms:modified">{{.Modified}}</meta>
+{{- if .Cover}}
+    <meta name="cover" content="cover-image"/>
+{{- end}}
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+{{- if .Cover}}
+    <item id="cover" href="cover.xhtml" media-type="application/xhtml+xml"/>
+{{- end}}
+{{- range .Chapters}}
+    <item id="{{.ID}}" href="{{x .Href}}" media-type="application/xhtml+xml"/>
+{{- end}}
+{{- range .Resources}}
+    <item id="{{.ID}}" href="{{x .Href}}" media-type="{{x .MediaType}}"{{if .Properties}} properties="{{.Properties}}"{{end}}/>
+{{- end}}
+  </manifest>
+  <spine toc="ncx">
+{{- if .Cover}}
+    <itemref idref="cover" linear="yes"/>
+{{- end}}
+{{- range .Chapters}}
+    <itemref idref="{{.ID}}"/>
+{{- end}}
+  </spine>
+</package>
+`))
+
+var navTmpl = template.Must(template.New("nav").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="{{x .Language}}" lang="{{x .Language}}">
+<head><title>{{x .Title}}</title></head>
+<body>
+  <nav epub:type="toc" id="toc">
+    <h1>Contents</h1>
+    <ol>
+{{- range .TOC}}
+      <li><a href="{{x .Href}}">{{x .Title}}</a></li>
+{{- end}}
+    </ol>
+  </nav>
+</body>
+</html>
+`))
+
+var ncxTmpl = template.Must(template.New("ncx").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head>
+    <meta name="dtb:uid" content="{{x .Identifier}}"/>
+    <meta name="dtb:depth" content="1"/>
+    <meta name="dtb:totalPageCount" content="0"/>
+    <meta name="dtb:maxPageNumber" content="0"/>
+  </head>
+  <docTitle><text>{{x .Title}}</text></docTitle>
+  <navMap>
+{{- range .TOC}}
+    <navPoint id="nav-{{.Order}}" playOrder="{{.Order}}">
+      <navLabel><text>{{x .Title}}</text></navLabel>
+      <content src="{{x .Href}}"/>
+    </navPoint>
+{{- end}}
+  </navMap>
+</ncx>
+`))
+
+var coverTmpl = template.Must(template.New("cover").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="{{x .Language}}" lang="{{x .Language}}">
+<head>
+  <title>{{x .Title}}</title>
+  <link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body epub:type="cover">
+  <div class="page"><img src="{{x .Cover.Href}}" alt="{{x .Title}}"/></div>
+</body>
+</html>
+`))
+
+var chapterTmpl = template.Must(template.New("chapter").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="{{x .Language}}" lang="{{x .Language}}">
+<head>
+  <title>{{x .Title}}</title>
+  <link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+{{.Body}}
+</body>
+</html>
+`))
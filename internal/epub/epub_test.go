@@ -0,0 +1,151 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// readBook writes the book and returns its entries in archive order
+func readBook(t *testing.T, b *Book) ([]*zip.File, map[string][]byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string][]byte{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[f.Name] = data
+	}
+	return r.File, entries
+}
+
+func TestBookWrite(t *testing.T) {
+	book := &Book{
+		Title:    "Tom & Jerry <Collected>",
+		Authors:  []string{"William Hanna", "Joseph Barbera"},
+		Language: "en-US",
+		Cover:    &Resource{Name: "images/cover.jpg", MediaType: "image/jpeg", Data: []byte("cover")},
+		Chapters: []Chapter{
+			{Title: "One & Only", Body: `<p>First <img src="images/1.png" alt=""/></p>`},
+			{Body: "<p>Untitled part</p>"},
+			{Title: "Two", Body: `<p><a href="` + ChapterName(0) + `">back</a></p>`},
+		},
+		Resources: []Resource{{Name: "images/1.png", MediaType: "image/png", Data: []byte("png")}},
+	}
+	files, entries := readBook(t, book)
+
+	// readers find the type from the first entry, which must not be compressed
+	if files[0].Name != "mimetype" || files[0].Method != zip.Store || string(entries["mimetype"]) != "application/epub+zip" {
+		t.Fatalf("first entry is %s with method %d", files[0].Name, files[0].Method)
+	}
+	for _, name := range []string{"META-INF/container.xml", "OEBPS/content.opf", "OEBPS/nav.xhtml", "OEBPS/toc.ncx",
+		"OEBPS/cover.xhtml", "OEBPS/style.css", "OEBPS/chapter-001.xhtml", "OEBPS/chapter-003.xhtml",
+		"OEBPS/images/cover.jpg", "OEBPS/images/1.png"} {
+		if _, ok := entries[name]; !ok {
+			t.Errorf("%s is missing", name)
+		}
+	}
+
+	// every document is well formed xml
+	for name, data := range entries {
+		if !strings.HasSuffix(name, ".xml") && !strings.HasSuffix(name, ".opf") &&
+			!strings.HasSuffix(name, ".xhtml") && !strings.HasSuffix(name, ".ncx") {
+			continue
+		}
+		dec := xml.NewDecoder(bytes.NewReader(data))
+		for {
+			_, err := dec.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s is not well formed: %v", name, err)
+			}
+		}
+	}
+
+	var opf struct {
+		Title    string   `xml:"metadata>title"`
+		Creators []string `xml:"metadata>creator"`
+		Items    []struct {
+			ID         string `xml:"id,attr"`
+			Href       string `xml:"href,attr"`
+			Properties string `xml:"properties,attr"`
+		} `xml:"manifest>item"`
+		Spine []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"spine>itemref"`
+	}
+	if err := xml.Unmarshal(entries["OEBPS/content.opf"], &opf); err != nil {
+		t.Fatal(err)
+	}
+	if opf.Title != book.Title || !slices.Equal(opf.Creators, book.Authors) {
+		t.Errorf("metadata is %q by %v", opf.Title, opf.Creators)
+	}
+	var spine []string
+	for _, ref := range opf.Spine {
+		spine = append(spine, ref.IDRef)
+	}
+	if want := []string{"cover", "chapter-1", "chapter-2", "chapter-3"}; !slices.Equal(spine, want) {
+		t.Errorf("spine is %v, want %v", spine, want)
+	}
+	for _, item := range opf.Items {
+		if item.ID == "cover-image" && item.Properties != "cover-image" {
+			t.Error("cover image is not marked")
+		}
+	}
+
+	// chapters without a title are left out of the table of contents
+	var ncx struct {
+		Labels []string `xml:"navMap>navPoint>navLabel>text"`
+	}
+	if err := xml.Unmarshal(entries["OEBPS/toc.ncx"], &ncx); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"One & Only", "Two"}; !slices.Equal(ncx.Labels, want) {
+		t.Errorf("table of contents is %v, want %v", ncx.Labels, want)
+	}
+}
+
+func TestBookWriteDefaults(t *testing.T) {
+	_, entries := readBook(t, &Book{Chapters: []Chapter{{Body: "<p>text</p>"}}})
+	if _, ok := entries["OEBPS/cover.xhtml"]; ok {
+		t.Error("cover page written for a book without cover")
+	}
+	if string(entries["OEBPS/style.css"]) != DefaultStyle {
+		t.Error("default style is not used")
+	}
+	opf := string(entries["OEBPS/content.opf"])
+	for _, want := range []string{"<dc:title>Untitled</dc:title>", "<dc:language>en</dc:language>", "urn:uuid:"} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("package lacks %s", want)
+		}
+	}
+	// the table of contents is never empty
+	if !strings.Contains(string(entries["OEBPS/nav.xhtml"]), `href="chapter-001.xhtml"`) {
+		t.Error("table of contents is empty")
+	}
+
+	if err := (&Book{Title: "Empty"}).Write(io.Discard); !errors.Is(err, NoChaptersErr) {
+		t.Fatalf("got %v for a book without chapters, want NoChaptersErr", err)
+	}
+}
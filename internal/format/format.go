@@ -0,0 +1,252 @@
+package format
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Format identifies the type of a document
+type Format string
+
+const (
+	Unknown Format = ""
+	EPUB    Format = "epub"
+	PDF     Format = "pdf"
+	DOC     Format = "doc"
+	DOCX    Format = "docx"
+	TXT     Format = "txt"
+	RTF     Format = "rtf"
+	HTML    Format = "html"
+	JPEG    Format = "jpeg"
+	PNG     Format = "png"
+	GIF     Format = "gif"
+	BMP     Format = "bmp"
+
+	// not accepted by Send to Kindle, but can be converted
+	FB2      Format = "fb2"
+	CBZ      Format = "cbz"
+	Markdown Format = "md"
+)
+
+var UnsupportedFormatErr = errors.New("file format is not accepted by Send to Kindle")
+
+// details holds what is known about each format
+type details struct {
+	extensions []string // first one is preferred
+	mimeType   string
+	kindle     bool // accepted by Send to Kindle
+}
+
+var formats = map[Format]details{
+	EPUB: {[]string{".epub"}, "application/epub+zip", true},
+	PDF:  {[]string{".pdf"}, "application/pdf", true},
+	DOC:  {[]string{".doc"}, "application/msword", true},
+	DOCX: {[]string{".docx"}, "application/vnd.openxmlformats-officedocument.wordprocessingml.document", true},
+	TXT:  {[]string{".txt"}, "text/plain", true},
+	RTF:  {[]string{".rtf"}, "application/rtf", true},
+	HTML: {[]string{".html", ".htm"}, "text/html", true},
+	JPEG: {[]string{".jpg", ".jpeg"}, "image/jpeg", true},
+	PNG:  {[]string{".png"}, "image/png", true},
+	GIF:  {[]string{".gif"}, "image/gif", true},
+	BMP:  {[]string{".bmp"}, "image/bmp", true},
+
+	FB2:      {[]string{".fb2"}, "application/x-fictionbook+xml", false},
+	CBZ:      {[]string{".cbz"}, "application/vnd.comicbook+zip", false},
+	Markdown: {[]string{".md", ".markdown"}, "text/markdown", false},
+}
+
+// Extension returns the preferred file extension (with the dot) of the format
+func (f Format) Extension() string {
+	d, ok := formats[f]
+	if !ok {
+		return ""
+	}
+	return d.extensions[0]
+}
+
+// MIMEType returns the media type of the format
+func (f Format) MIMEType() string {
+	d, ok := formats[f]
+	if !ok {
+		return "application/octet-stream"
+	}
+	return d.mimeType
+}
+
+// KindleSupported reports whether Send to Kindle accepts the format
+func (f Format) KindleSupported() bool {
+	return formats[f].kindle
+}
+
+// HasExtension reports whether the filename carries one of the extensions of the format
+func (f Format) HasExtension(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, e := range formats[f].extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// FixExtension returns filename with its extension replaced by the one of the format,
+// unless it already carries a valid one. A trailing extension which is not a
+// known one (e.g. a part of a title) is kept and the correct one appended.
+func FixExtension(filename string, f Format) string {
+	if f == Unknown || f.HasExtension(filename) {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	if ext != "" && mime.TypeByExtension(ext) != "" {
+		filename = strings.TrimSuffix(filename, ext)
+	}
+	return filename + f.Extension()
+}
+
+// Detect sniffs the content of a file. Returns the detected format along with
+// the sniffed media type, which is useful in errors for unknown formats.
+func Detect(path string) (Format, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Unknown, "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return Unknown, "", err
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		return PDF, PDF.MIMEType(), nil
+	case bytes.HasPrefix(head, []byte("{\\rtf")):
+		return RTF, RTF.MIMEType(), nil
+	case bytes.HasPrefix(head, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}):
+		// OLE compound file, the container of legacy office documents
+		return DOC, DOC.MIMEType(), nil
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return detectZip(path)
+	case bytes.HasPrefix(head, []byte("BM")) && len(head) > 14:
+		return BMP, BMP.MIMEType(), nil
+	case bytes.Contains(head, []byte("<FictionBook")):
+		return FB2, FB2.MIMEType(), nil
+	}
+
+	sniffed := http.DetectContentType(head)
+	mediaType, _, _ := mime.ParseMediaType(sniffed)
+	switch mediaType {
+	case "image/jpeg":
+		return JPEG, mediaType, nil
+	case "image/png":
+		return PNG, mediaType, nil
+	case "image/gif":
+		return GIF, mediaType, nil
+	case "text/html":
+		return HTML, mediaType, nil
+	case "text/plain":
+		if validUTF8Prefix(head) {
+			return TXT, mediaType, nil
+		}
+	}
+	return Unknown, sniffed, nil
+}
+
+// Refine narrows a detected format using the filename, for formats which
+// can't be told apart by their content alone (e.g. Markdown is plain text)
+func Refine(f Format, filename string) Format {
+	if f == TXT && Markdown.HasExtension(filename) {
+		return Markdown
+	}
+	return f
+}
+
+// validUTF8Prefix checks b is valid utf-8, allowing a rune cut off at the end
+func validUTF8Prefix(b []byte) bool {
+	for i := 0; i < utf8.UTFMax && len(b) > 0; i++ {
+		if utf8.Valid(b) {
+			return true
+		}
+		b = b[:len(b)-1]
+	}
+	return utf8.Valid(b)
+}
+
+// detectZip tells apart the zip based formats by their entries.
+// An archive holding nothing but images is taken as a comic book.
+func detectZip(path string) (Format, string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return Unknown, "application/zip", nil // corrupt archive
+	}
+	defer r.Close()
+
+	images, others := 0, 0
+	for _, file := range r.File {
+		switch {
+		case file.FileInfo().IsDir():
+		case IsImageName(file.Name):
+			images++
+		case !isComicExtra(file.Name):
+			others++
+		}
+
+		switch {
+		case file.Name == "mimetype":
+			rc, err := file.Open()
+			if err != nil {
+				continue
+			}
+			content, _ := io.ReadAll(io.LimitReader(rc, 64))
+			rc.Close()
+			if strings.TrimSpace(string(content)) == EPUB.MIMEType() {
+				return EPUB, EPUB.MIMEType(), nil
+			}
+		case file.Name == "word/document.xml":
+			return DOCX, DOCX.MIMEType(), nil
+		}
+	}
+	if images > 0 && others == 0 {
+		return CBZ, CBZ.MIMEType(), nil
+	}
+	return Unknown, "application/zip", nil
+}
+
+// IsImageName reports whether the filename has the extension of an image format
+func IsImageName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch ext {
+	case ".jpg", ".jpeg", ".png", ".gif", ".bmp", ".webp":
+		return true
+	}
+	return false
+}
+
+// isComicExtra reports files commonly found in comic archives besides the pages
+func isComicExtra(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base, ".") || strings.EqualFold(base, "ComicInfo.xml") ||
+		strings.EqualFold(base, "Thumbs.db") || strings.HasPrefix(name, "__MACOSX/")
+}
+
+// Check returns UnsupportedFormatErr if the format is not accepted by Send to Kindle
+func Check(f Format, mediaType string) error {
+	if f.KindleSupported() {
+		return nil
+	}
+	if f == Unknown {
+		return fmt.Errorf("%w: got %s", UnsupportedFormatErr, mediaType)
+	}
+	return fmt.Errorf("%w: got %s", UnsupportedFormatErr, f)
+}
@@ -0,0 +1,137 @@
+package format
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// zipOf returns a zip archive of the given entries, in that order
+func zipOf(t *testing.T, entries ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for i := 0; i < len(entries); i += 2 {
+		w, err := z.Create(entries[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(entries[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		want    Format
+		media   string // sniffed media type, only checked when set
+	}{
+		{"pdf", []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n"), PDF, "application/pdf"},
+		{"rtf", []byte(`{\rtf1\ansi Hello}`), RTF, ""},
+		{"doc", []byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1" + strings.Repeat("\x00", 100)), DOC, ""},
+		{"bmp", append([]byte("BM"), make([]byte, 60)...), BMP, ""},
+		{"truncated bmp", []byte("BM"), Unknown, ""},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), PNG, ""},
+		{"jpeg", []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF\x00"), JPEG, ""},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), GIF, ""},
+		{"html", []byte("<!DOCTYPE html><html><body>captcha</body></html>"), HTML, "text/html"},
+		{"fb2", []byte(`<?xml version="1.0" encoding="utf-8"?><FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">`), FB2, ""},
+		{"text", []byte("Call me Ishmael."), TXT, "text/plain"},
+		{"text with cut rune", append(bytes.Repeat([]byte("a"), 511), "é"[0]), TXT, ""},
+		{"binary", []byte{0x00, 0x01, 0x02, 0x03, 0xff}, Unknown, "application/octet-stream"},
+		{"empty", nil, TXT, ""},
+		{"epub", zipOf(t, "mimetype", "application/epub+zip", "OEBPS/content.opf", "<package/>"), EPUB, "application/epub+zip"},
+		{"docx", zipOf(t, "[Content_Types].xml", "<Types/>", "word/document.xml", "<w:document/>"), DOCX, ""},
+		{"cbz", zipOf(t, "Saga/", "", "Saga/page1.jpg", "x", "Saga/page2.PNG", "x", "ComicInfo.xml", "<ComicInfo/>", "__MACOSX/Saga/._page1.jpg", "x"), CBZ, ""},
+		{"zip of images and text", zipOf(t, "page1.jpg", "x", "notes.txt", "x"), Unknown, "application/zip"},
+		{"zip with other mimetype", zipOf(t, "mimetype", "application/vnd.oasis.opendocument.text"), Unknown, "application/zip"},
+		{"corrupt zip", []byte("PK\x03\x04 not really"), Unknown, "application/zip"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, tt.content, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, media, err := Detect(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("detected %q, want %q", got, tt.want)
+			}
+			if tt.media != "" && !strings.HasPrefix(media, tt.media) {
+				t.Fatalf("media type %q, want %q", media, tt.media)
+			}
+		})
+	}
+
+	if _, _, err := Detect(filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("got %v for a missing file", err)
+	}
+}
+
+func TestRefine(t *testing.T) {
+	tests := []struct {
+		f        Format
+		filename string
+		want     Format
+	}{
+		{TXT, "README.md", Markdown},
+		{TXT, "notes.MARKDOWN", Markdown},
+		{TXT, "notes.txt", TXT},
+		{HTML, "page.md", HTML},
+		{TXT, "", TXT},
+	}
+	for _, tt := range tests {
+		if got := Refine(tt.f, tt.filename); got != tt.want {
+			t.Errorf("Refine(%q, %q) = %q, want %q", tt.f, tt.filename, got, tt.want)
+		}
+	}
+}
+
+func TestFixExtension(t *testing.T) {
+	tests := []struct {
+		filename string
+		f        Format
+		want     string
+	}{
+		{"book.epub", EPUB, "book.epub"},
+		{"page.HTM", HTML, "page.HTM"},
+		{"book.zip", EPUB, "book.epub"},
+		{"download.php", PDF, "download.pdf"},
+		{"Vol. 2", PDF, "Vol. 2.pdf"},
+		{"Mr. Smith Goes", EPUB, "Mr. Smith Goes.epub"},
+		{"book", Unknown, "book"},
+	}
+	for _, tt := range tests {
+		if got := FixExtension(tt.filename, tt.f); got != tt.want {
+			t.Errorf("FixExtension(%q, %q) = %q, want %q", tt.filename, tt.f, got, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, f := range []Format{EPUB, PDF, DOCX, HTML, PNG} {
+		if err := Check(f, f.MIMEType()); err != nil {
+			t.Errorf("%s was refused: %v", f, err)
+		}
+	}
+	for _, f := range []Format{FB2, CBZ, Markdown, Unknown} {
+		if err := Check(f, "application/zip"); !errors.Is(err, UnsupportedFormatErr) {
+			t.Errorf("got %v for %q, want UnsupportedFormatErr", err, f)
+		}
+	}
+}
@@ -11,6 +11,10 @@ import (
 
 const ctxTaskKey = "taskID"
 const ctxFilepathKey = "filepath"
+const ctxProgressKey = "progress"
+
+// ProgressFunc receives the bytes received so far and the total size (-1 if unknown)
+type ProgressFunc func(received, total int64)
 
 // GenerateID returns a new UUID
 func GenerateID() uuid.UUID {
@@ -52,6 +56,21 @@ func GetFilepathFromContext(ctx context.Context) string {
 	return val
 }
 
+// NewContextWithProgress creates a context having a progress callback
+func NewContextWithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, ctxProgressKey, fn)
+}
+
+// GetProgressFromContext retrieves the progress callback from given context.
+// Returns a no-op callback incase it does not exist.
+func GetProgressFromContext(ctx context.Context) ProgressFunc {
+	val, _ := ctx.Value(ctxProgressKey).(ProgressFunc)
+	if val == nil {
+		return func(received, total int64) {}
+	}
+	return val
+}
+
 // IsFilepathValid checks if filepath is valid
 func IsFilepathValid(filepath string) bool {
 	if strings.TrimSpace(filepath) == "" {
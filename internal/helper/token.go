@@ -0,0 +1,28 @@
+package helper
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// APITokenPrefix starts every api token, it tells them apart from other secrets
+const APITokenPrefix = "stk_"
+
+// GenerateAPIToken returns a new random api token
+func GenerateAPIToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return APITokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashAPIToken returns the hash api tokens are stored and looked up by. Tokens are
+// random, so unlike passwords a fast hash is enough.
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
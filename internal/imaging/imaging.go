@@ -0,0 +1,94 @@
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	_ "image/gif" // register decoder
+)
+
+// Downscale shrinks the image to fit within maxWidth x maxHeight, keeping the aspect ratio.
+// Images that already fit are returned as is. Pixels are area averaged, which keeps
+// text and line art readable unlike nearest neighbour sampling.
+func Downscale(img image.Image, maxWidth, maxHeight int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= maxWidth && h <= maxHeight || w == 0 || h == 0 {
+		return img
+	}
+
+	scale := min(float64(maxWidth)/float64(w), float64(maxHeight)/float64(h))
+	nw := max(1, int(float64(w)*scale))
+	nh := max(1, int(float64(h)*scale))
+
+	// work on RGBA for fast pixel access
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(bounds)
+		draw.Draw(src, bounds, img, bounds.Min, draw.Src)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, nw, nh))
+	for y := range nh {
+		y0 := bounds.Min.Y + y*h/nh
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*h/nh)
+		for x := range nw {
+			x0 := bounds.Min.X + x*w/nw
+			x1 := max(x0+1, bounds.Min.X+(x+1)*w/nw)
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(src.Pix[i])
+					g += uint32(src.Pix[i+1])
+					b += uint32(src.Pix[i+2])
+					a += uint32(src.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// Resize decodes an image, downscales it to fit within maxWidth x maxHeight and
+// encodes it again. PNGs stay PNG (they are usually line art or have transparency),
+// everything else becomes JPEG. Returns the encoded image and its media type.
+func Resize(data []byte, maxWidth, maxHeight int, quality int) ([]byte, string, error) {
+	img, kind, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("error while decoding image, %w", err)
+	}
+
+	img = Downscale(img, maxWidth, maxHeight)
+
+	var buf bytes.Buffer
+	if kind == "png" {
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		err = enc.Encode(&buf, img)
+		return buf.Bytes(), "image/png", err
+	}
+
+	err = jpeg.Encode(&buf, Flatten(img), &jpeg.Options{Quality: quality})
+	return buf.Bytes(), "image/jpeg", err
+}
+
+// Flatten draws the image over a white background, as jpeg has no transparency
+func Flatten(img image.Image) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Over)
+	return dst
+}
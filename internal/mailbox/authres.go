@@ -0,0 +1,133 @@
+package mailbox
+
+import (
+	"strings"
+)
+
+// AuthResult is a check reported in an Authentication-Results header (RFC 8601)
+type AuthResult struct {
+	Method string // dkim, spf or dmarc
+	Result string // pass, fail, none...
+	Domain string // header.d of dkim, domain of smtp.mailfrom of spf, header.from of dmarc
+}
+
+// Authenticated reports whether the server identified by authServID vouched for the
+// domain of the sender, with a passing DMARC check, or DKIM signature or SPF check of
+// exactly that domain. Only the topmost Authentication-Results header counts, it is
+// the one the receiving server added; anyone can add more further down.
+func (m Message) Authenticated(authServID string) bool {
+	if authServID == "" || !strings.EqualFold(m.AuthServID, authServID) {
+		return false
+	}
+	_, domain, ok := strings.Cut(m.From, "@")
+	if !ok || domain == "" {
+		return false
+	}
+	for _, r := range m.AuthResults {
+		if r.Result == "pass" && strings.EqualFold(r.Domain, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuthResults reads an Authentication-Results header value, returning the
+// authserv-id and the dkim, spf and dmarc checks
+func parseAuthResults(value string) (string, []AuthResult) {
+	parts := splitOutsideQuotes(stripComments(value), ';')
+	fields := strings.Fields(parts[0])
+	if len(fields) == 0 {
+		return "", nil
+	}
+	servID := fields[0]
+
+	var results []AuthResult
+	for _, part := range parts[1:] {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		method, result, ok := strings.Cut(fields[0], "=")
+		if !ok {
+			continue // "none" when nothing was checked
+		}
+		method, _, _ = strings.Cut(method, "/") // method version
+		r := AuthResult{Method: strings.ToLower(method), Result: strings.ToLower(result)}
+
+		props := map[string]string{}
+		for _, field := range fields[1:] {
+			if k, v, ok := strings.Cut(field, "="); ok {
+				props[strings.ToLower(k)] = strings.Trim(v, `"`)
+			}
+		}
+		switch r.Method {
+		case "dkim":
+			r.Domain = props["header.d"]
+			if r.Domain == "" {
+				_, r.Domain, _ = strings.Cut(props["header.i"], "@")
+			}
+		case "spf":
+			r.Domain = props["smtp.mailfrom"]
+			if _, domain, ok := strings.Cut(r.Domain, "@"); ok {
+				r.Domain = domain
+			}
+		case "dmarc":
+			r.Domain = props["header.from"]
+		default:
+			continue
+		}
+		results = append(results, r)
+	}
+	return servID, results
+}
+
+// stripComments drops the parenthesized comments of a header value
+func stripComments(s string) string {
+	var b strings.Builder
+	depth := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && (quoted || depth > 0):
+			if depth == 0 {
+				b.WriteByte(c)
+				b.WriteByte(s[i+1])
+			}
+			i++
+			continue
+		case c == '"' && depth == 0:
+			quoted = !quoted
+		case c == '(' && !quoted:
+			depth++
+			continue
+		case c == ')' && !quoted && depth > 0:
+			depth--
+			b.WriteByte(' ')
+			continue
+		}
+		if depth == 0 {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// splitOutsideQuotes splits s at sep, except within quoted strings
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
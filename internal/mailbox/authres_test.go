@@ -0,0 +1,132 @@
+package mailbox
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseAuthResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		servID string
+		want   []AuthResult
+	}{
+		{
+			name: "gmail",
+			value: `mx.google.com;
+       dkim=pass header.i=@example.com header.s=s1 header.b=Abc/De+f;
+       spf=pass (google.com: domain of alice@example.com designates 192.0.2.1 as permitted sender) smtp.mailfrom=alice@example.com;
+       dmarc=pass (p=REJECT sp=REJECT dis=NONE) header.from=example.com`,
+			servID: "mx.google.com",
+			want: []AuthResult{
+				{"dkim", "pass", "example.com"},
+				{"spf", "pass", "example.com"},
+				{"dmarc", "pass", "example.com"},
+			},
+		},
+		{
+			name: "fastmail",
+			value: `mx3.messagingengine.com;
+    dkim=pass (2048-bit rsa key sha256) header.d=mail.example.org header.i=@mail.example.org header.b=xyz header.a=rsa-sha256 header.s=fm1 x-bits=2048;
+    spf=softfail smtp.mailfrom=bounce@lists.example.org smtp.helo=out.example.org`,
+			servID: "mx3.messagingengine.com",
+			want: []AuthResult{
+				{"dkim", "pass", "mail.example.org"},
+				{"spf", "softfail", "lists.example.org"},
+			},
+		},
+		{
+			name:   "version and quoted values",
+			value:  `mail.example.net 1; DKIM/1=Pass header.d="example.com;evil.com"; spf=none smtp.mailfrom=example.com`,
+			servID: "mail.example.net",
+			want: []AuthResult{
+				{"dkim", "pass", "example.com;evil.com"},
+				{"spf", "none", "example.com"},
+			},
+		},
+		{
+			name:   "comment hiding a result",
+			value:  `mx.example.net; spf=fail (dkim=pass header.d=example.com) smtp.mailfrom=example.com`,
+			servID: "mx.example.net",
+			want:   []AuthResult{{"spf", "fail", "example.com"}},
+		},
+		{
+			name:   "nothing checked",
+			value:  `mx.example.net; none`,
+			servID: "mx.example.net",
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servID, got := parseAuthResults(tt.value)
+			if servID != tt.servID {
+				t.Errorf("authserv-id %q, want %q", servID, tt.servID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// rawMail returns a mail from alice@example.com with the given headers on top
+func rawMail(headers ...string) []byte {
+	headers = append(headers,
+		"From: Alice <alice@example.com>",
+		"To: books@example.net",
+		"Subject: a book",
+		"Content-Type: text/plain",
+	)
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\nhttps://example.com/book.epub\r\n")
+}
+
+func TestMessageAuthenticated(t *testing.T) {
+	const servID = "mx.example.net"
+	tests := []struct {
+		name string
+		raw  []byte
+		want bool
+	}{
+		{"dkim pass", rawMail("Authentication-Results: mx.example.net; dkim=pass header.d=example.com"), true},
+		{"spf pass", rawMail("Authentication-Results: mx.example.net; spf=pass smtp.mailfrom=alice@example.com"), true},
+		{"dmarc pass", rawMail("Authentication-Results: mx.example.net; dmarc=pass header.from=example.com"), true},
+		{"other domain", rawMail("Authentication-Results: mx.example.net; dkim=pass header.d=evil.com; spf=pass smtp.mailfrom=evil.com"), false},
+		{"parent domain", rawMail("Authentication-Results: mx.example.net; dkim=pass header.d=com"), false},
+		{"failed checks", rawMail("Authentication-Results: mx.example.net; dkim=fail header.d=example.com; spf=softfail smtp.mailfrom=example.com; dmarc=fail header.from=example.com"), false},
+		{"other server", rawMail("Authentication-Results: mx.evil.com; dkim=pass header.d=example.com"), false},
+		{"no header", rawMail(), false},
+		{"forged below", rawMail(
+			"Authentication-Results: mx.example.net; dkim=none; spf=fail smtp.mailfrom=example.com",
+			"Received: from evil.com",
+			"Authentication-Results: mx.example.net; dkim=pass header.d=example.com",
+		), false},
+		{"forged below a pass", rawMail(
+			"Authentication-Results: mx.example.net; dkim=pass header.d=example.com",
+			"Authentication-Results: mx.example.net; dkim=fail header.d=example.com",
+		), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := Parse(tt.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.From != "alice@example.com" {
+				t.Fatalf("from %q", msg.From)
+			}
+			if got := msg.Authenticated(servID); got != tt.want {
+				t.Fatalf("got %v, want %v (results %s %v)", got, tt.want, msg.AuthServID, msg.AuthResults)
+			}
+		})
+	}
+
+	msg, _ := Parse(rawMail("Authentication-Results: mx.example.net; dkim=pass header.d=example.com"))
+	if msg.Authenticated("") {
+		t.Error("authenticated without a trusted server")
+	}
+}
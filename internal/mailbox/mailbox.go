@@ -0,0 +1,262 @@
+// Package mailbox reads new mail from an IMAP mailbox, remembering in the database
+// how far it got so that every message is handled once
+package mailbox
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/email"
+)
+
+// DefaultMailbox is read when Config.Mailbox is empty
+const DefaultMailbox = "INBOX"
+
+// lookback limits the first read of a mailbox, older mail was not meant for us
+const lookback = 24 * time.Hour
+
+// fetchBatch is the number of messages fetched per command, bodies are held in memory
+// and mailed in books can be large
+const fetchBatch = 5
+
+// Config holds the details of the imap account
+type Config struct {
+	Host     string
+	Port     int
+	Username string
+	Password string            // unused with XOAUTH2
+	Auth     string            // email.AuthPlain or email.AuthXOAUTH2, plain LOGIN when empty
+	Token    email.TokenSource // access tokens for XOAUTH2
+	TLS      email.TLSOptions  // mandatory uses STARTTLS, implicit IMAPS on port 993
+	Mailbox  string            // DefaultMailbox when empty
+}
+
+// Verify checks the values
+func (c *Config) Verify() error {
+	switch {
+	case strings.TrimSpace(c.Host) == "":
+		return fmt.Errorf("Host field should not be empty")
+	case c.Port == 0:
+		return fmt.Errorf("Port field should be non-zero")
+	case strings.TrimSpace(c.Username) == "":
+		return fmt.Errorf("Username field should not be empty")
+	case c.TLS.Mode == email.TLSOpportunistic:
+		return fmt.Errorf("opportunistic tls is not supported for imap, use mandatory or implicit")
+	}
+	if err := c.TLS.Verify(); err != nil {
+		return err
+	}
+
+	switch c.Auth {
+	case email.AuthPlain, email.AuthLogin, "":
+		if strings.TrimSpace(c.Password) == "" {
+			return fmt.Errorf("Password field should not be empty")
+		}
+	case email.AuthXOAUTH2:
+		if c.Token == nil {
+			return fmt.Errorf("Token field should be set for XOAUTH2")
+		}
+	default:
+		return fmt.Errorf("unknown imap auth %q, expected PLAIN, LOGIN or XOAUTH2", c.Auth)
+	}
+	return nil
+}
+
+// Reader hands out the messages which arrived in a mailbox since the last read
+type Reader struct {
+	config Config
+	db     *database.DB
+	name   string // key of the cursor, readers of different purposes keep their own
+}
+
+// NewReader returns a reader of the configured mailbox, name identifies its cursor
+func NewReader(config Config, db *database.DB, name string) (*Reader, error) {
+	if err := config.Verify(); err != nil {
+		return nil, fmt.Errorf("error while validating imap details: %w", err)
+	}
+	if config.Mailbox == "" {
+		config.Mailbox = DefaultMailbox
+	}
+	return &Reader{config: config, db: db, name: name}, nil
+}
+
+// Read connects to the server and calls handle for every new message, oldest first.
+// The cursor only moves past handled messages, a message whose handler fails is
+// read again next time. The first read, and one after the mailbox was recreated,
+// only looks at the mail of the last day.
+func (r *Reader) Read(ctx context.Context, handle func(ctx context.Context, msg Message) error) error {
+	cursor, err := r.db.GetMailboxCursor(r.name)
+	if err != nil {
+		return fmt.Errorf("error while loading mailbox cursor, %w", err)
+	}
+
+	client, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = client.Logout().Wait() }()
+
+	// the client does not take a context, closing it aborts the pending command
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+
+	selected, err := client.Select(r.config.Mailbox, &imap.SelectOptions{ReadOnly: true}).Wait()
+	if err != nil {
+		return fmt.Errorf("error while selecting mailbox %s, %w", r.config.Mailbox, err)
+	}
+
+	criteria := &imap.SearchCriteria{}
+	if cursor.UIDValidity != selected.UIDValidity {
+		slog.Info("Reading mailbox from the start", slog.String("mailbox", r.config.Mailbox), slog.String("reader", r.name))
+		cursor = database.MailboxCursor{Name: r.name, UIDValidity: selected.UIDValidity}
+		criteria.Since = time.Now().Add(-lookback)
+	} else {
+		criteria.UID = []imap.UIDSet{{imap.UIDRange{Start: imap.UID(cursor.LastUID + 1), Stop: 0}}}
+	}
+
+	search, err := client.UIDSearch(criteria, nil).Wait()
+	if err != nil {
+		return fmt.Errorf("error while searching mailbox, %w", err)
+	}
+	var uids []imap.UID
+	for _, uid := range search.AllUIDs() {
+		// a range up to * always matches the last message, even an old one
+		if uint32(uid) > cursor.LastUID {
+			uids = append(uids, uid)
+		}
+	}
+	slices.Sort(uids)
+
+	for len(uids) > 0 {
+		batch := uids[:min(fetchBatch, len(uids))]
+		uids = uids[len(batch):]
+
+		messages, err := r.fetch(client, batch)
+		if err != nil {
+			return err
+		}
+		for _, msg := range messages {
+			err = handle(ctx, msg)
+			if err != nil {
+				return fmt.Errorf("error while handling message %d, %w", msg.UID, err)
+			}
+			cursor.LastUID = msg.UID
+			err = r.db.SaveMailboxCursor(cursor)
+			if err != nil {
+				return fmt.Errorf("error while saving mailbox cursor, %w", err)
+			}
+		}
+		// skipped messages at the end of the batch are done with too
+		cursor.LastUID = uint32(batch[len(batch)-1])
+	}
+
+	// a new mailbox without matching mail still needs its validity remembered
+	return r.db.SaveMailboxCursor(cursor)
+}
+
+// Run reads the mailbox every interval until ctx is cancelled. Failures are logged,
+// the next read tries again.
+func (r *Reader) Run(ctx context.Context, interval time.Duration, handle func(ctx context.Context, msg Message) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := r.Read(ctx, handle)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("error while reading mailbox", slog.String("reader", r.name), slog.String("error", err.Error()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// connect dials the server and logs in
+func (r *Reader) connect(ctx context.Context) (*imapclient.Client, error) {
+	tlsConfig, err := r.config.TLS.Config(r.config.Host)
+	if err != nil {
+		return nil, err
+	}
+	options := &imapclient.Options{TLSConfig: tlsConfig}
+	address := net.JoinHostPort(r.config.Host, strconv.Itoa(r.config.Port))
+
+	var client *imapclient.Client
+	switch r.config.TLS.Mode {
+	case email.TLSImplicit:
+		client, err = imapclient.DialTLS(address, options)
+	case email.TLSNone:
+		client, err = imapclient.DialInsecure(address, options)
+	default:
+		client, err = imapclient.DialStartTLS(address, options)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while connecting to imap server, %w", err)
+	}
+
+	if r.config.Auth == email.AuthXOAUTH2 {
+		var token string
+		token, err = r.config.Token.Token(ctx)
+		if err == nil {
+			err = client.Authenticate(&xoauth2{username: r.config.Username, token: token})
+		}
+	} else {
+		err = client.Login(r.config.Username, r.config.Password).Wait()
+	}
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error while logging into imap server, %w", err)
+	}
+	return client, nil
+}
+
+// fetch downloads and parses the messages, ordered by uid. Messages which can't
+// be parsed are logged and skipped, they would fail every time.
+func (r *Reader) fetch(client *imapclient.Client, uids []imap.UID) ([]Message, error) {
+	section := &imap.FetchItemBodySection{Peek: true} // leave the messages unread for people
+	buffers, err := client.Fetch(imap.UIDSetNum(uids...), &imap.FetchOptions{
+		UID:         true,
+		BodySection: []*imap.FetchItemBodySection{section},
+	}).Collect()
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching messages, %w", err)
+	}
+
+	messages := make([]Message, 0, len(buffers))
+	for _, buf := range buffers {
+		msg, err := Parse(buf.FindBodySection(section))
+		if err != nil {
+			slog.Warn("Skipping message which could not be parsed", slog.Int("uid", int(buf.UID)), slog.String("error", err.Error()))
+			continue
+		}
+		msg.UID = uint32(buf.UID)
+		messages = append(messages, msg)
+	}
+	slices.SortFunc(messages, func(a, b Message) int { return cmp.Compare(a.UID, b.UID) })
+	return messages, nil
+}
+
+// xoauth2 is the SASL XOAUTH2 mechanism of Google and Microsoft
+type xoauth2 struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2) Start() (string, []byte, error) {
+	return email.AuthXOAUTH2, []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next answers the error details sent on a failed login, the server then fails the command
+func (a *xoauth2) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
@@ -0,0 +1,173 @@
+package mailbox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset" // bodies in charsets other than utf-8
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// maxTextSize caps the text kept of a message
+const maxTextSize = 1 << 20
+
+// Message is a received mail
+type Message struct {
+	UID         uint32
+	MessageID   string   // without angle brackets
+	InReplyTo   []string // Message-IDs the mail answers
+	References  []string // Message-IDs of the thread
+	From        string   // address of the sender, as claimed by the mail, see Authenticated
+	Subject     string
+	Date        time.Time
+	Text        string // plain text body, html bodies are converted with the targets of links kept
+	Attachments []Attachment
+
+	AuthServID  string       // authserv-id of the topmost Authentication-Results header
+	AuthResults []AuthResult // checks reported in that header
+}
+
+// Attachment is a file attached to a mail
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Parse reads a raw mail
+func Parse(raw []byte) (Message, error) {
+	r, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return Message{}, err
+	}
+	defer r.Close()
+
+	var msg Message
+	msg.MessageID, _ = r.Header.MessageID()
+	msg.InReplyTo, _ = r.Header.MsgIDList("In-Reply-To")
+	msg.References, _ = r.Header.MsgIDList("References")
+	msg.Subject, _ = r.Header.Subject()
+	msg.Date, _ = r.Header.Date()
+	if from, err := r.Header.AddressList("From"); err == nil && len(from) > 0 {
+		msg.From = from[0].Address
+	}
+	if results := r.Header.Values("Authentication-Results"); len(results) > 0 {
+		msg.AuthServID, msg.AuthResults = parseAuthResults(results[0])
+	}
+
+	// the plain text alternative is preferred, html is the fallback
+	var plain, htmlText string
+	for {
+		part, err := r.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !message.IsUnknownCharset(err) {
+			return Message{}, fmt.Errorf("error while reading message part, %w", err)
+		}
+		var contentType, filename string
+		switch h := part.Header.(type) {
+		case *mail.AttachmentHeader:
+			contentType, _, _ = h.ContentType()
+			filename, _ = h.Filename()
+		case *mail.InlineHeader:
+			var params map[string]string
+			contentType, params, _ = h.ContentType()
+			if !strings.HasPrefix(contentType, "text/") {
+				filename = params["name"] // files some clients attach inline
+			}
+		}
+		if filename != "" {
+			data, err := io.ReadAll(part.Body)
+			if err != nil {
+				return Message{}, fmt.Errorf("error while reading attachment, %w", err)
+			}
+			msg.Attachments = append(msg.Attachments, Attachment{Filename: filename, ContentType: contentType, Data: data})
+			continue
+		}
+
+		body, err := io.ReadAll(io.LimitReader(part.Body, maxTextSize))
+		if err != nil {
+			return Message{}, fmt.Errorf("error while reading message part, %w", err)
+		}
+		switch {
+		case contentType == "text/plain" && plain == "":
+			plain = string(body)
+		case contentType == "text/html" && htmlText == "":
+			htmlText = htmlToText(body)
+		}
+	}
+	msg.Text = plain
+	if strings.TrimSpace(msg.Text) == "" {
+		msg.Text = htmlText
+	}
+	return msg, nil
+}
+
+// htmlToText returns the text of an html document, a line per block
+func htmlToText(doc []byte) string {
+	root, err := html.Parse(bytes.NewReader(doc))
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			b.WriteString(strings.Join(strings.Fields(n.Data), " "))
+			b.WriteByte(' ')
+			return
+		case n.Type == html.ElementNode && (n.DataAtom == atom.Script || n.DataAtom == atom.Style || n.DataAtom == atom.Head):
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		if n.Type == html.ElementNode && n.DataAtom == atom.A {
+			// shared links are often only in the markup
+			if href := attr(n, "href"); strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") {
+				b.WriteString("<" + href + "> ")
+			}
+		}
+		if n.Type == html.ElementNode && isBlock(n.DataAtom) {
+			b.WriteByte('\n')
+		}
+	}
+	walk(root)
+
+	// drop the blanks left by the markup
+	var lines []string
+	for line := range strings.Lines(b.String()) {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// isBlock reports elements which start a new line
+func isBlock(a atom.Atom) bool {
+	switch a {
+	case atom.P, atom.Div, atom.Br, atom.Tr, atom.Li, atom.Table, atom.Td, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Blockquote:
+		return true
+	}
+	return false
+}
+
+// attr returns the value of an attribute of n
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,217 @@
+// Package mailin creates tasks from mail sent to the server: links in the text
+// and attached books are submitted like on the dashboard
+package mailin
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/downloader"
+	"github.com/roshanlc/send-to-kindle/internal/format"
+	"github.com/roshanlc/send-to-kindle/internal/mailbox"
+	"github.com/roshanlc/send-to-kindle/internal/submit"
+)
+
+// cursorName keys the mailbox cursor of the poller
+const cursorName = "submission"
+
+// maxURLs caps the links taken from a single mail, signatures and footers are full of them
+const maxURLs = 10
+
+// taskNamespace derives the ids of mailed in tasks, see taskID
+var taskNamespace = uuid.MustParse("5d1c7a36-2f0e-4f43-9a8e-3c6b1f0d8e21")
+
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"'()\[\]]+`)
+
+// Poller reads mail sent to the server and submits what it carries
+type Poller struct {
+	db       *database.DB
+	reader   *mailbox.Reader
+	submit   *submit.Service
+	allowed  []string // lower case addresses, or domains starting with @
+	servID   string   // authserv-id of the receiving server, see mailbox.Message.Authenticated
+	interval time.Duration
+}
+
+// NewPoller returns a poller reading the mailbox every interval. Only mail from the
+// allowed senders is taken, an entry like @example.com allows a whole domain. The From
+// address is easily forged, so the receiving server identified by servID also has to
+// vouch for its domain. Tasks belong to the user with the address of the sender, mail
+// from senders without an enabled account is ignored.
+func NewPoller(config mailbox.Config, db *database.DB, service *submit.Service, allowed []string, servID string, interval time.Duration) (*Poller, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("poll interval should be positive")
+	}
+	servID = strings.TrimSpace(servID)
+	if servID == "" {
+		return nil, fmt.Errorf("authserv-id of the receiving server is required")
+	}
+	p := &Poller{db: db, submit: service, servID: servID, interval: interval}
+	for _, sender := range allowed {
+		if sender = strings.ToLower(strings.TrimSpace(sender)); sender != "" {
+			p.allowed = append(p.allowed, sender)
+		}
+	}
+	if len(p.allowed) == 0 {
+		return nil, fmt.Errorf("atleast one allowed sender is required")
+	}
+	reader, err := mailbox.NewReader(config, db, cursorName)
+	if err != nil {
+		return nil, err
+	}
+	p.reader = reader
+	return p, nil
+}
+
+// Run polls until ctx is cancelled
+func (p *Poller) Run(ctx context.Context) {
+	slog.Info("Polling mailbox for submissions", slog.String("interval", p.interval.String()))
+	p.reader.Run(ctx, p.interval, p.handle)
+}
+
+// Poll reads the new mail once
+func (p *Poller) Poll(ctx context.Context) error {
+	return p.reader.Read(ctx, p.handle)
+}
+
+// allows reports whether mail from the address may submit books
+func (p *Poller) allows(address string) bool {
+	address = strings.ToLower(address)
+	for _, sender := range p.allowed {
+		if address == sender || (strings.HasPrefix(sender, "@") && strings.HasSuffix(address, sender)) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle submits the links and attachments of a mail. Only failures of the database
+// are returned, the mail is read again then; anything else would fail every time.
+func (p *Poller) handle(ctx context.Context, msg mailbox.Message) error {
+	if !p.allows(msg.From) {
+		slog.Info("Ignoring mail from sender which is not allowed", slog.String("from", msg.From), slog.String("subject", msg.Subject))
+		return nil
+	}
+	if !msg.Authenticated(p.servID) {
+		slog.Warn("Ignoring mail whose sender could not be authenticated", slog.String("from", msg.From), slog.String("subject", msg.Subject),
+			slog.String("authservID", msg.AuthServID), slog.Any("results", msg.AuthResults))
+		return nil
+	}
+
+	// a subject like the one of Send to Kindle asks for PDFs to be converted
+	opts := submit.Options{ConvertPDF: slices.Contains(strings.Fields(strings.ToLower(msg.Subject)), "convert")}
+
+	// tasks are sent to the devices of their owner, there is nowhere to send them otherwise
+	user, err := p.db.GetUserByEmail(msg.From)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		slog.Info("Ignoring mail from sender without an account", slog.String("from", msg.From), slog.String("subject", msg.Subject))
+		return nil
+	case err != nil:
+		return fmt.Errorf("error while looking up sender, %w", err)
+	case user.Disabled:
+		slog.Info("Ignoring mail from disabled user", slog.String("from", msg.From), slog.String("subject", msg.Subject))
+		return nil
+	}
+	opts.UserID = user.ID
+
+	// a mail is read again when handling it failed halfway, tasks added the
+	// first time keep their id and are not added twice
+	var added, n int
+	for _, attachment := range msg.Attachments {
+		n++
+		opts.TaskID = taskID(user.ID, msg, n)
+		exists, err := p.taskExists(opts.TaskID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			added++
+			continue
+		}
+		taskID, err := p.submit.AddFile(attachment.Filename, bytes.NewReader(attachment.Data), opts)
+		if errors.Is(err, format.UnsupportedFormatErr) || errors.Is(err, downloader.UploadTooLargeErr) {
+			slog.Warn("Skipping mailed in attachment", slog.String("filename", attachment.Filename), slog.String("from", msg.From), slog.String("error", err.Error()))
+			continue
+		}
+		if err != nil && taskID == "" {
+			return err
+		}
+		slog.Info("Added task from mailed in attachment", slog.String("taskID", taskID), slog.String("filename", attachment.Filename), slog.String("from", msg.From))
+		added++
+	}
+
+	for _, link := range extractURLs(msg.Text) {
+		n++
+		opts.TaskID = taskID(user.ID, msg, n)
+		exists, err := p.taskExists(opts.TaskID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			added++
+			continue
+		}
+		taskID, err := p.submit.AddURL(link, opts)
+		if errors.Is(err, submit.InvalidURLErr) {
+			continue
+		}
+		if err != nil && taskID == "" {
+			return err
+		}
+		slog.Info("Added task from mailed in link", slog.String("taskID", taskID), slog.String("url", link), slog.String("from", msg.From))
+		added++
+	}
+
+	if added == 0 {
+		slog.Warn("Mail from allowed sender carried no links or books", slog.String("from", msg.From), slog.String("subject", msg.Subject))
+	}
+	return nil
+}
+
+// taskID returns the id of the n-th task of msg, the same every time the mail is read
+func taskID(userID int, msg mailbox.Message, n int) string {
+	key := msg.MessageID
+	if key == "" {
+		key = fmt.Sprintf("uid %d %d", msg.UID, msg.Date.Unix())
+	}
+	return uuid.NewSHA1(taskNamespace, fmt.Appendf(nil, "%d/%s/%d", userID, key, n)).String()
+}
+
+// taskExists reports whether the task was added already
+func (p *Poller) taskExists(taskID string) (bool, error) {
+	_, err := p.db.GetTask(taskID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("error while looking up mailed in task, %w", err)
+	}
+	return true, nil
+}
+
+// extractURLs returns the distinct http links in text, in order
+func extractURLs(text string) []string {
+	var urls []string
+	for _, link := range urlPattern.FindAllString(text, -1) {
+		// punctuation ending a sentence is not part of the link
+		link = strings.TrimRight(link, ".,;:!?")
+		if !slices.Contains(urls, link) {
+			urls = append(urls, link)
+		}
+		if len(urls) == maxURLs {
+			break
+		}
+	}
+	return urls
+}
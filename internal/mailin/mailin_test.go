@@ -0,0 +1,199 @@
+package mailin
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/database/dbtest"
+	"github.com/roshanlc/send-to-kindle/internal/mailbox"
+	"github.com/roshanlc/send-to-kindle/internal/queue"
+	"github.com/roshanlc/send-to-kindle/internal/submit"
+)
+
+const servID = "mx.example.net"
+
+// newTestPoller returns a poller allowing alice@example.com and @example.org, which
+// submits to a fresh database
+func newTestPoller(t *testing.T) (*Poller, *database.DB, int) {
+	t.Helper()
+	db, dbConn := dbtest.New(t)
+	q, err := queue.NewSQLiteQueue(dbConn, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := db.AddUser(database.User{Name: "Alice", Email: "alice@example.com", Password: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddDevice(database.Device{UserID: userID, Name: "Paperwhite", Email: "alice@kindle.com", IsDefault: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Poller{
+		db:      db,
+		submit:  submit.NewService(db, q, 0),
+		allowed: []string{"alice@example.com", "@example.org"},
+		servID:  servID,
+	}
+	return p, db, userID
+}
+
+func TestPollerAllows(t *testing.T) {
+	p, _, _ := newTestPoller(t)
+	tests := map[string]bool{
+		"alice@example.com":   true,
+		"Alice@Example.COM":   true,
+		"bob@example.org":     true,
+		"bob@example.com":     false,
+		"bob@evilexample.org": false,
+		"":                    false,
+	}
+	for address, want := range tests {
+		if got := p.allows(address); got != want {
+			t.Errorf("allows(%q) = %v, want %v", address, got, want)
+		}
+	}
+}
+
+func TestPollerHandle(t *testing.T) {
+	pass := []mailbox.AuthResult{{Method: "dkim", Result: "pass", Domain: "example.com"}}
+	tests := []struct {
+		name    string
+		msg     mailbox.Message
+		disable bool // disable the account of alice
+		tasks   int
+	}{
+		{
+			name:  "authenticated",
+			msg:   mailbox.Message{From: "alice@example.com", AuthServID: servID, AuthResults: pass, Text: "https://example.com/a.epub and https://example.com/b.epub."},
+			tasks: 2,
+		},
+		{
+			name: "forged from",
+			msg:  mailbox.Message{From: "alice@example.com", Text: "https://example.com/a.epub"},
+		},
+		{
+			name: "signed by another domain",
+			msg: mailbox.Message{From: "alice@example.com", AuthServID: servID, Text: "https://example.com/a.epub",
+				AuthResults: []mailbox.AuthResult{{Method: "dkim", Result: "pass", Domain: "evil.com"}}},
+		},
+		{
+			name: "results of another server",
+			msg:  mailbox.Message{From: "alice@example.com", AuthServID: "mx.evil.com", AuthResults: pass, Text: "https://example.com/a.epub"},
+		},
+		{
+			name: "failed checks",
+			msg: mailbox.Message{From: "alice@example.com", AuthServID: servID, Text: "https://example.com/a.epub",
+				AuthResults: []mailbox.AuthResult{{Method: "spf", Result: "softfail", Domain: "example.com"}}},
+		},
+		{
+			name: "allowed sender without an account",
+			msg: mailbox.Message{From: "bob@example.org", AuthServID: servID, Text: "https://example.com/a.epub",
+				AuthResults: []mailbox.AuthResult{{Method: "dkim", Result: "pass", Domain: "example.org"}}},
+		},
+		{
+			name:    "disabled user",
+			msg:     mailbox.Message{From: "alice@example.com", AuthServID: servID, AuthResults: pass, Text: "https://example.com/a.epub"},
+			disable: true,
+		},
+		{
+			name: "sender not allowed",
+			msg: mailbox.Message{From: "mallory@example.net", AuthServID: servID, Text: "https://example.com/a.epub",
+				AuthResults: []mailbox.AuthResult{{Method: "dkim", Result: "pass", Domain: "example.net"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, db, userID := newTestPoller(t)
+			if tt.disable {
+				if err := db.SetUserDisabled(userID, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := p.handle(context.Background(), tt.msg); err != nil {
+				t.Fatal(err)
+			}
+			var total int
+			if err := db.Database.QueryRow(`SELECT COUNT(*) FROM tasks;`).Scan(&total); err != nil {
+				t.Fatal(err)
+			}
+			tasks, _, err := db.FindTasks(userID, database.TaskFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != tt.tasks || len(tasks) != tt.tasks {
+				t.Fatalf("got %d tasks, %d of them of alice, want %d", total, len(tasks), tt.tasks)
+			}
+			for _, task := range tasks {
+				if !slices.Equal(task.SendTo, []string{"alice@kindle.com"}) {
+					t.Errorf("task %s sent to %v", task.ID, task.SendTo)
+				}
+			}
+		})
+	}
+}
+
+func TestPollerHandleAgain(t *testing.T) {
+	p, db, userID := newTestPoller(t)
+	pass := []mailbox.AuthResult{{Method: "dkim", Result: "pass", Domain: "example.com"}}
+	msg := mailbox.Message{UID: 7, MessageID: "1@example.com", From: "alice@example.com", AuthServID: servID, AuthResults: pass,
+		Text: "https://example.com/a.epub and https://example.com/b.epub"}
+	taskURLs := func() []string {
+		t.Helper()
+		tasks, _, err := db.FindTasks(userID, database.TaskFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var urls []string
+		for _, task := range tasks {
+			urls = append(urls, task.URL)
+		}
+		slices.Sort(urls)
+		return urls
+	}
+
+	if err := p.handle(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	// handling failed after the first link, the mail is read again
+	if _, err := db.Database.Exec(`DELETE FROM tasks WHERE url = ?;`, "https://example.com/b.epub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.handle(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://example.com/a.epub", "https://example.com/b.epub"}
+	if got := taskURLs(); !slices.Equal(got, want) {
+		t.Fatalf("got tasks %v, want %v", got, want)
+	}
+
+	// another mail with the same links adds them again
+	msg.UID, msg.MessageID = 8, "2@example.com"
+	if err := p.handle(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := taskURLs(); len(got) != 4 {
+		t.Fatalf("got tasks %v, want 4", got)
+	}
+}
+
+func TestExtractURLs(t *testing.T) {
+	text := "Read https://example.com/a.epub. Also <https://example.com/b?x=1>, and https://example.com/a.epub again.\n" +
+		"(see http://example.org/c) or ftp://example.com/d"
+	want := []string{"https://example.com/a.epub", "https://example.com/b?x=1", "http://example.org/c"}
+	if got := extractURLs(text); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	var many string
+	for i := range 2 * maxURLs {
+		many += "https://example.com/" + string(rune('a'+i)) + " "
+	}
+	if got := extractURLs(many); len(got) != maxURLs {
+		t.Fatalf("got %d urls, want %d", len(got), maxURLs)
+	}
+}
@@ -0,0 +1,151 @@
+package metadata
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// container is META-INF/container.xml, pointing to the OPF package
+type container struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+// opfPackage is the part of the OPF package document we care about
+type opfPackage struct {
+	Metadata struct {
+		Titles     []string `xml:"title"`
+		Creators   []string `xml:"creator"`
+		Languages  []string `xml:"language"`
+		Publishers []string `xml:"publisher"`
+		Meta       []struct {
+			Name    string `xml:"name,attr"`
+			Content string `xml:"content,attr"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+	Manifest []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+}
+
+// extractEPUB reads the metadata from the OPF package of an EPUB
+func extractEPUB(filePath string) (Metadata, error) {
+	r, err := zip.OpenReader(filePath)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("error while opening epub, %w", err)
+	}
+	defer r.Close()
+
+	var c container
+	err = decodeXML(&r.Reader, "META-INF/container.xml", &c)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if len(c.Rootfiles) == 0 {
+		return Metadata{}, fmt.Errorf("epub container has no rootfile")
+	}
+	opfPath := c.Rootfiles[0].FullPath
+
+	var pkg opfPackage
+	err = decodeXML(&r.Reader, opfPath, &pkg)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	meta := Metadata{
+		Title:     first(pkg.Metadata.Titles),
+		Authors:   pkg.Metadata.Creators,
+		Language:  first(pkg.Metadata.Languages),
+		Publisher: first(pkg.Metadata.Publishers),
+	}
+
+	if href := coverHref(&pkg); href != "" {
+		// hrefs are relative to the OPF file and may be escaped
+		if unescaped, err := url.PathUnescape(href); err == nil {
+			href = unescaped
+		}
+		coverPath := path.Join(path.Dir(opfPath), href)
+		meta.Cover, _ = readEntry(&r.Reader, coverPath, maxCoverBytes)
+	}
+	return meta, nil
+}
+
+// coverHref finds the cover image in the manifest, in the EPUB 3 way, the EPUB 2 way
+// and finally by guessing from the item names
+func coverHref(pkg *opfPackage) string {
+	for _, item := range pkg.Manifest {
+		if strings.Contains(" "+item.Properties+" ", " cover-image ") {
+			return item.Href
+		}
+	}
+
+	var coverID string
+	for _, m := range pkg.Metadata.Meta {
+		if m.Name == "cover" {
+			coverID = m.Content
+		}
+	}
+	for _, item := range pkg.Manifest {
+		if coverID != "" && item.ID == coverID {
+			return item.Href
+		}
+	}
+
+	for _, item := range pkg.Manifest {
+		if strings.HasPrefix(item.MediaType, "image/") &&
+			(strings.Contains(strings.ToLower(item.ID), "cover") || strings.Contains(strings.ToLower(item.Href), "cover")) {
+			return item.Href
+		}
+	}
+	return ""
+}
+
+// decodeXML unmarshals a zip entry
+func decodeXML(r *zip.Reader, name string, v any) error {
+	data, err := readEntry(r, name, 4<<20)
+	if err != nil {
+		return err
+	}
+	err = xml.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("error while parsing %s, %w", name, err)
+	}
+	return nil
+}
+
+// readEntry reads a zip entry of at most limit bytes
+func readEntry(r *zip.Reader, name string, limit int64) ([]byte, error) {
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+		if f.UncompressedSize64 > uint64(limit) {
+			return nil, fmt.Errorf("%s is too large", name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(io.LimitReader(rc, limit))
+	}
+	return nil, fmt.Errorf("%s not found in epub", name)
+}
+
+// first returns the first value or empty
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,173 @@
+package metadata
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/roshanlc/send-to-kindle/internal/epub"
+	"github.com/roshanlc/send-to-kindle/internal/format"
+)
+
+// pngImage returns a png of the given size
+func pngImage(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := range width {
+		img.Set(x, height/2, color.RGBA{200, 30, 30, 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeZip writes an archive of the given entries
+func writeZip(t *testing.T, path string, entries map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	z := zip.NewWriter(f)
+	for name, data := range entries {
+		w, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractEPUB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "book.epub")
+	book := epub.Book{
+		Title:     "  The   Hobbit ",
+		Authors:   []string{"J. R. R.\n Tolkien", " "},
+		Language:  "en-GB",
+		Publisher: "Allen & Unwin",
+		Cover:     &epub.Resource{Name: "images/cover.png", MediaType: "image/png", Data: pngImage(t, 600, 900)},
+		Chapters:  []epub.Chapter{{Title: "An Unexpected Party", Body: "<p>In a hole in the ground</p>"}},
+	}
+	if err := book.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := Extract(path, format.EPUB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "The Hobbit" || meta.Language != "en-GB" || meta.Publisher != "Allen & Unwin" {
+		t.Errorf("got %q, %q, %q", meta.Title, meta.Language, meta.Publisher)
+	}
+	if want := []string{"J. R. R. Tolkien"}; !slices.Equal(meta.Authors, want) {
+		t.Errorf("authors %q, want %q", meta.Authors, want)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(meta.Cover))
+	if err != nil {
+		t.Fatalf("cover is not an image: %v", err)
+	}
+	if meta.CoverType == "" || config.Width > thumbnailWidth || config.Height > thumbnailHeight {
+		t.Errorf("cover is %s of %dx%d", meta.CoverType, config.Width, config.Height)
+	}
+}
+
+func TestExtractEPUBBroken(t *testing.T) {
+	dir := t.TempDir()
+	const container = `<container><rootfiles><rootfile full-path="content/book.opf"/></rootfiles></container>`
+	tests := map[string]map[string]string{
+		"no container":  {"mimetype": "application/epub+zip"},
+		"no rootfile":   {"META-INF/container.xml": `<container><rootfiles/></container>`},
+		"no package":    {"META-INF/container.xml": container},
+		"broken opf":    {"META-INF/container.xml": container, "content/book.opf": "<package><metadata>"},
+		"not a zip":     nil,
+		"opf too large": {"META-INF/container.xml": container, "content/book.opf": string(make([]byte, 5<<20))},
+	}
+	for name, entries := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name+".epub")
+			if entries == nil {
+				if err := os.WriteFile(path, []byte("plain text"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				writeZip(t, path, entries)
+			}
+			if meta, err := Extract(path, format.EPUB); err == nil {
+				t.Fatalf("got %+v, want an error", meta)
+			}
+		})
+	}
+
+	// a cover which can't be read does not hide the rest
+	path := filepath.Join(dir, "bad-cover.epub")
+	writeZip(t, path, map[string]string{
+		"META-INF/container.xml": container,
+		"content/book.opf": `<package><metadata><title>Dune</title></metadata>
+			<manifest><item id="c" href="my%20cover.jpg" media-type="image/jpeg" properties="cover-image"/></manifest></package>`,
+		"content/my cover.jpg": "not a jpeg",
+	})
+	meta, err := Extract(path, format.EPUB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "Dune" || meta.Cover != nil || meta.CoverType != "" {
+		t.Fatalf("got %q with a %d byte %q cover", meta.Title, len(meta.Cover), meta.CoverType)
+	}
+}
+
+func TestCoverHref(t *testing.T) {
+	tests := []struct {
+		name string
+		opf  string
+		want string
+	}{
+		{
+			name: "epub 3 property",
+			opf: `<package><manifest><item id="a" href="a.jpg" media-type="image/jpeg"/>
+				<item id="b" href="b.jpg" media-type="image/jpeg" properties="svg cover-image"/></manifest></package>`,
+			want: "b.jpg",
+		},
+		{
+			name: "epub 2 meta",
+			opf: `<package><metadata><meta name="cover" content="img1"/></metadata>
+				<manifest><item id="img1" href="front.png" media-type="image/png"/></manifest></package>`,
+			want: "front.png",
+		},
+		{
+			name: "guessed from the name",
+			opf: `<package><manifest><item id="x" href="cover.xhtml" media-type="application/xhtml+xml"/>
+				<item id="y" href="images/Cover.jpeg" media-type="image/jpeg"/></manifest></package>`,
+			want: "images/Cover.jpeg",
+		},
+		{
+			name: "none",
+			opf:  `<package><manifest><item id="x" href="1.jpg" media-type="image/jpeg"/></manifest></package>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pkg opfPackage
+			if err := xml.Unmarshal([]byte(tt.opf), &pkg); err != nil {
+				t.Fatal(err)
+			}
+			if got := coverHref(&pkg); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package metadata
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/roshanlc/send-to-kindle/internal/format"
+	"github.com/roshanlc/send-to-kindle/internal/imaging"
+)
+
+// cover thumbnails are kept small, they are only shown in the history
+const (
+	thumbnailWidth   = 160
+	thumbnailHeight  = 240
+	thumbnailQuality = 80
+	maxCoverBytes    = 10 << 20 // covers larger than this are skipped
+)
+
+var UnsupportedErr = errors.New("metadata extraction is not supported for this format")
+
+// Metadata holds details about a book
+type Metadata struct {
+	Title     string
+	Authors   []string
+	Language  string
+	Publisher string
+	Cover     []byte // thumbnail of the cover image
+	CoverType string // media type of Cover
+}
+
+// Author returns the authors joined by commas
+func (m Metadata) Author() string {
+	return strings.Join(m.Authors, ", ")
+}
+
+// Extract reads the metadata of an EPUB or PDF file
+func Extract(path string, f format.Format) (Metadata, error) {
+	var meta Metadata
+	var err error
+	switch f {
+	case format.EPUB:
+		meta, err = extractEPUB(path)
+	case format.PDF:
+		meta, err = extractPDF(path)
+	default:
+		return Metadata{}, UnsupportedErr
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	meta.Title = clean(meta.Title)
+	meta.Language = clean(meta.Language)
+	meta.Publisher = clean(meta.Publisher)
+	authors := meta.Authors[:0]
+	for _, a := range meta.Authors {
+		if a = clean(a); a != "" {
+			authors = append(authors, a)
+		}
+	}
+	meta.Authors = authors
+
+	if len(meta.Cover) > 0 {
+		meta.Cover, meta.CoverType, err = imaging.Resize(meta.Cover, thumbnailWidth, thumbnailHeight, thumbnailQuality)
+		if err != nil {
+			// a broken cover should not hide the rest
+			meta.Cover, meta.CoverType = nil, ""
+		}
+	}
+	return meta, nil
+}
+
+// clean collapses whitespace
+func clean(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,113 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/roshanlc/send-to-kindle/internal/pdf"
+)
+
+// dcNamespace is the Dublin Core namespace used in XMP packets
+const dcNamespace = "http://purl.org/dc/elements/1.1/"
+
+// extractPDF reads the metadata from the Info dictionary and the XMP packet of a PDF.
+// The Info dictionary wins, XMP fills in what it lacks.
+func extractPDF(path string) (Metadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	f, err := pdf.Parse(data)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("error while parsing pdf, %w", err)
+	}
+
+	var meta Metadata
+	if info := f.Dict(f.Trailer["Info"]); info != nil {
+		meta.Title = pdf.Text(f.Resolve(info["Title"]))
+		if author := pdf.Text(f.Resolve(info["Author"])); author != "" {
+			meta.Authors = []string{author}
+		}
+	}
+
+	catalog := f.Dict(f.Trailer["Root"])
+	if catalog == nil {
+		return meta, nil
+	}
+	meta.Language = pdf.Text(f.Resolve(catalog["Lang"]))
+
+	ref, ok := catalog["Metadata"].(pdf.Ref)
+	if !ok || f.Objects[ref.Num] == nil {
+		return meta, nil
+	}
+	packet, err := f.Decode(f.Objects[ref.Num])
+	if err != nil {
+		return meta, nil // metadata stream is optional
+	}
+
+	xmp := parseXMP(packet)
+	if meta.Title == "" {
+		meta.Title = first(xmp["title"])
+	}
+	if len(meta.Authors) == 0 {
+		meta.Authors = xmp["creator"]
+	}
+	if meta.Language == "" {
+		meta.Language = first(xmp["language"])
+	}
+	meta.Publisher = first(xmp["publisher"])
+	return meta, nil
+}
+
+// parseXMP collects the values of the Dublin Core properties of an XMP packet,
+// keyed by property name. Values inside rdf containers (Alt, Seq, Bag) are listed in order.
+func parseXMP(packet []byte) map[string][]string {
+	values := map[string][]string{}
+	dec := xml.NewDecoder(bytes.NewReader(packet))
+	dec.Strict = false
+
+	var property string // dc property we are in, if any
+	var depth int       // nesting inside the property
+	var text strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF || err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if property == "" && t.Name.Space == dcNamespace {
+				property, depth = t.Name.Local, 0
+				text.Reset()
+				continue
+			}
+			if property != "" {
+				depth++
+				text.Reset()
+			}
+		case xml.CharData:
+			if property != "" {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if property == "" {
+				continue
+			}
+			if v := strings.TrimSpace(text.String()); v != "" {
+				values[property] = append(values[property], v)
+			}
+			text.Reset()
+			if depth == 0 {
+				property = ""
+				continue
+			}
+			depth--
+		}
+	}
+	return values
+}
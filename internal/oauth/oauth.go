@@ -0,0 +1,209 @@
+// Package oauth keeps an oauth2 access token fresh using the refresh token grant,
+// for XOAUTH2 smtp logins at providers which no longer accept app passwords
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"resty.dev/v3"
+)
+
+// token endpoints of the common providers
+const (
+	GoogleTokenURL    = "https://oauth2.googleapis.com/token"
+	MicrosoftTokenURL = "https://login.microsoftonline.com/common/oauth2/v2.0/token"
+)
+
+// expiryMargin renews access tokens this long before they expire, a login
+// should not race the expiry
+const expiryMargin = time.Minute
+
+var NoRefreshTokenErr = errors.New("no oauth2 refresh token, please provide one")
+
+// Config identifies the client at the provider
+type Config struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string   // empty for public clients
+	Scopes       []string // only sent when set, providers keep the granted ones otherwise
+}
+
+// Verify checks the values
+func (c *Config) Verify() error {
+	switch {
+	case strings.TrimSpace(c.TokenURL) == "":
+		return fmt.Errorf("TokenURL field should not be empty")
+	case strings.TrimSpace(c.ClientID) == "":
+		return fmt.Errorf("ClientID field should not be empty")
+	}
+	return nil
+}
+
+// Token is an access token and the refresh token to renew it
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time // zero when the access token is not known
+}
+
+// valid reports an access token which can still be used for a while
+func (t Token) valid() bool {
+	return t.AccessToken != "" && time.Until(t.Expiry) > expiryMargin
+}
+
+// Store keeps tokens across restarts. Providers may hand out a new refresh token
+// with every access token, which invalidates the old one.
+type Store interface {
+	Load(ctx context.Context) (Token, error) // a zero Token when nothing is stored
+	Save(ctx context.Context, token Token) error
+}
+
+// TokenSource returns valid access tokens, refreshing them when needed
+type TokenSource struct {
+	config Config
+	store  Store // nil keeps tokens in memory only
+	client *resty.Client
+
+	mu       sync.Mutex
+	token    Token
+	fallback string // configured refresh token, tried when the stored one was revoked
+}
+
+// NewTokenSource returns a token source for the client. The stored tokens are used
+// when there are any, refreshToken otherwise; it is stored for the next start.
+// A refreshToken differing from the stored one takes over once that stops working.
+func NewTokenSource(ctx context.Context, config Config, store Store, refreshToken string) (*TokenSource, error) {
+	if err := config.Verify(); err != nil {
+		return nil, fmt.Errorf("error while validating oauth2 details: %w", err)
+	}
+
+	refreshToken = strings.TrimSpace(refreshToken)
+	var token Token
+	if store != nil {
+		var err error
+		token, err = store.Load(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading oauth2 tokens, %w", err)
+		}
+	}
+	if token.RefreshToken == "" {
+		token = Token{RefreshToken: refreshToken}
+		if token.RefreshToken == "" {
+			return nil, NoRefreshTokenErr
+		}
+		if store != nil {
+			err := store.Save(ctx, token)
+			if err != nil {
+				return nil, fmt.Errorf("error while saving oauth2 tokens, %w", err)
+			}
+		}
+	}
+
+	client := resty.New().
+		SetRetryCount(2).
+		SetTimeout(30 * time.Second)
+	s := &TokenSource{config: config, store: store, client: client, token: token}
+	if refreshToken != token.RefreshToken {
+		s.fallback = refreshToken
+	}
+	return s, nil
+}
+
+// Token returns an access token which is valid for at least a minute
+func (s *TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token.valid() {
+		return s.token.AccessToken, nil
+	}
+
+	token, err := s.refresh(ctx, s.token.RefreshToken)
+	if err != nil && s.fallback != "" && ctx.Err() == nil {
+		slog.Warn("Stored oauth2 refresh token failed, trying the configured one", slog.String("error", err.Error()))
+		token, err = s.refresh(ctx, s.fallback)
+		if err == nil {
+			s.fallback = ""
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("error while refreshing oauth2 access token, %w", err)
+	}
+	s.token = token
+	if s.store != nil {
+		err = s.store.Save(ctx, token)
+		if err != nil {
+			// the access token still works, a rotated refresh token is lost on restart though
+			slog.Error("error while saving oauth2 tokens", slog.String("error", err.Error()))
+		}
+	}
+	return token.AccessToken, nil
+}
+
+// Close releases the http client
+func (s *TokenSource) Close() error {
+	return s.client.Close()
+}
+
+// tokenResponse is the reply of the token endpoint (RFC 6749 section 5)
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// refresh redeems a refresh token for a new access token
+func (s *TokenSource) refresh(ctx context.Context, refreshToken string) (Token, error) {
+	form := map[string]string{
+		"grant_type":    "refresh_token",
+		"refresh_token": refreshToken,
+		"client_id":     s.config.ClientID,
+	}
+	if s.config.ClientSecret != "" {
+		form["client_secret"] = s.config.ClientSecret
+	}
+	if len(s.config.Scopes) > 0 {
+		form["scope"] = strings.Join(s.config.Scopes, " ")
+	}
+
+	resp, err := s.client.R().
+		SetContext(ctx).
+		SetFormData(form).
+		SetHeader("Accept", "application/json").
+		Post(s.config.TokenURL)
+	if err != nil {
+		return Token{}, err
+	}
+	// not every provider labels the reply as json, errors may not be json at all
+	var result tokenResponse
+	_ = json.Unmarshal(resp.Bytes(), &result)
+	if resp.IsError() || result.AccessToken == "" {
+		if result.Error != "" {
+			return Token{}, fmt.Errorf("token endpoint replied %s: %s", result.Error, result.ErrorDescription)
+		}
+		return Token{}, fmt.Errorf("token endpoint replied with status %d", resp.StatusCode())
+	}
+
+	token := Token{
+		AccessToken:  result.AccessToken,
+		RefreshToken: result.RefreshToken,
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken // not rotated
+	}
+	if result.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	} else {
+		token.Expiry = time.Now().Add(time.Hour) // the usual lifetime when none is given
+	}
+	return token, nil
+}
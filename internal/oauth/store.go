@@ -0,0 +1,112 @@
+package oauth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/roshanlc/send-to-kindle/internal/database"
+)
+
+// keyInfo binds the derived key to its use, the secret also signs cookies
+const keyInfo = "send-to-kindle oauth2 tokens"
+
+// DBStore keeps the tokens of an account in the database, encrypted with AES-GCM
+type DBStore struct {
+	db   *database.DB
+	name string
+	aead cipher.AEAD
+}
+
+// NewDBStore returns a store for the tokens of the named account, the key is
+// derived from secret
+func NewDBStore(db *database.DB, name string, secret string) (*DBStore, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("secret should not be empty")
+	}
+	key, err := hkdf.Key(sha256.New, []byte(secret), nil, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &DBStore{db: db, name: name, aead: aead}, nil
+}
+
+// Load returns the stored tokens
+func (s *DBStore) Load(ctx context.Context) (Token, error) {
+	stored, err := s.db.GetOAuthToken(s.name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Token{}, nil
+	}
+	if err != nil {
+		return Token{}, err
+	}
+
+	refreshToken, err := s.open(stored.RefreshToken)
+	if err != nil {
+		return Token{}, fmt.Errorf("error while decrypting refresh token, was SECRETKEY changed? %w", err)
+	}
+	token := Token{RefreshToken: refreshToken}
+	if stored.AccessToken != nil {
+		// a token which can't be read is refreshed instead
+		if accessToken, err := s.open(stored.AccessToken); err == nil {
+			token.AccessToken = accessToken
+			token.Expiry = stored.ExpiresAt
+		}
+	}
+	return token, nil
+}
+
+// Save stores the tokens
+func (s *DBStore) Save(ctx context.Context, token Token) error {
+	refreshToken, err := s.seal(token.RefreshToken)
+	if err != nil {
+		return err
+	}
+	stored := database.OAuthToken{Name: s.name, RefreshToken: refreshToken}
+	if token.AccessToken != "" {
+		stored.AccessToken, err = s.seal(token.AccessToken)
+		if err != nil {
+			return err
+		}
+		stored.ExpiresAt = token.Expiry
+	}
+	return s.db.SaveOAuthToken(stored)
+}
+
+// seal encrypts a token, the random nonce is put in front of the ciphertext
+func (s *DBStore) seal(plain string) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plain)+s.aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	// the account name is authenticated too, tokens can't be swapped between rows
+	return s.aead.Seal(nonce, nonce, []byte(plain), []byte(s.name)), nil
+}
+
+// open decrypts a token sealed by seal
+func (s *DBStore) open(sealed []byte) (string, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return "", fmt.Errorf("sealed token is too short")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, []byte(s.name))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,92 @@
+package oauth
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/database/dbtest"
+)
+
+func TestDBStore(t *testing.T) {
+	ctx := context.Background()
+	db, _ := dbtest.New(t)
+	s, err := NewDBStore(db, "smtp", "secret key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing stored yet
+	token, err := s.Load(ctx)
+	if err != nil || token != (Token{}) {
+		t.Fatalf("got %+v, %v for an empty store", token, err)
+	}
+
+	want := Token{AccessToken: "access-1", RefreshToken: "refresh-1", Expiry: time.Now().Add(time.Hour).Truncate(time.Second)}
+	if err := s.Save(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	token, err = s.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != want.AccessToken || token.RefreshToken != want.RefreshToken || !token.Expiry.Equal(want.Expiry) {
+		t.Fatalf("got %+v, want %+v", token, want)
+	}
+
+	// the tokens are not stored in the clear, and sealing twice differs
+	stored, err := db.GetOAuthToken("smtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored.RefreshToken, []byte("refresh-1")) || bytes.Contains(stored.AccessToken, []byte("access-1")) {
+		t.Fatal("tokens are stored in plain text")
+	}
+	again, err := s.seal("refresh-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again, stored.RefreshToken) {
+		t.Fatal("sealing the same token twice gave the same bytes")
+	}
+
+	// another secret can't read the tokens
+	other, err := NewDBStore(db, "smtp", "another key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Load(ctx); err == nil {
+		t.Fatal("tokens were read with another secret")
+	}
+
+	// tokens copied to another account don't open
+	if err := db.SaveOAuthToken(database.OAuthToken{Name: "imap", RefreshToken: stored.RefreshToken}); err != nil {
+		t.Fatal(err)
+	}
+	imap, err := NewDBStore(db, "imap", "secret key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := imap.Load(ctx); err == nil {
+		t.Fatal("tokens of another account were accepted")
+	}
+
+	// a damaged access token is dropped, the refresh token is enough to go on
+	stored.AccessToken[len(stored.AccessToken)-1] ^= 0xff
+	if err := db.SaveOAuthToken(stored); err != nil {
+		t.Fatal(err)
+	}
+	token, err = s.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "" || token.RefreshToken != "refresh-1" {
+		t.Fatalf("got %+v, want only the refresh token", token)
+	}
+
+	if _, err := NewDBStore(db, "smtp", ""); err == nil {
+		t.Fatal("store without a secret was created")
+	}
+}
@@ -0,0 +1,61 @@
+package pdf
+
+import "maps"
+
+// inheritable are the page attributes which may be set on an ancestor in the page tree
+var inheritable = []Name{"Resources", "MediaBox", "CropBox", "Rotate"}
+
+// Page is a leaf of the page tree
+type Page struct {
+	Ref  Ref
+	Dict Dict // copy of the page dictionary, with inherited attributes filled in
+}
+
+// Pages returns the pages of the document in order
+func (f *File) Pages() []Page {
+	catalog := f.Dict(f.Trailer["Root"])
+	root, ok := catalog["Pages"].(Ref)
+	if !ok {
+		return nil
+	}
+
+	var pages []Page
+	seen := map[int]bool{}
+	var walk func(ref Ref, inherited Dict)
+	walk = func(ref Ref, inherited Dict) {
+		if seen[ref.Num] {
+			return // broken trees may have loops
+		}
+		seen[ref.Num] = true
+
+		d := f.Dict(ref)
+		if d == nil {
+			return
+		}
+		if d["Type"] == Name("Page") || d["Kids"] == nil {
+			page := maps.Clone(d)
+			for _, key := range inheritable {
+				if _, ok := page[key]; !ok && inherited[key] != nil {
+					page[key] = inherited[key]
+				}
+			}
+			pages = append(pages, Page{Ref: ref, Dict: page})
+			return
+		}
+
+		next := maps.Clone(inherited)
+		for _, key := range inheritable {
+			if v, ok := d[key]; ok {
+				next[key] = v
+			}
+		}
+		kids, _ := f.Resolve(d["Kids"]).(Array)
+		for _, kid := range kids {
+			if kidRef, ok := kid.(Ref); ok {
+				walk(kidRef, next)
+			}
+		}
+	}
+	walk(root, Dict{})
+	return pages
+}
@@ -0,0 +1,329 @@
+package pdf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var (
+	UnexpectedEndErr = errors.New("unexpected end of pdf data")
+	TooDeepErr       = errors.New("pdf values are nested too deep")
+)
+
+// maxDepth bounds the nesting of arrays and dictionaries, real files stay far below it
+const maxDepth = 100
+
+// parser reads PDF values starting at pos
+type parser struct {
+	data  []byte
+	pos   int
+	depth int // arrays and dictionaries being parsed
+}
+
+// isSpace reports PDF whitespace characters
+func isSpace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+// isDelimiter reports PDF delimiter characters
+func isDelimiter(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+// skipSpace skips whitespace and comments
+func (p *parser) skipSpace() {
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if c == '%' {
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' && p.data[p.pos] != '\r' {
+				p.pos++
+			}
+			continue
+		}
+		if !isSpace(c) {
+			return
+		}
+		p.pos++
+	}
+}
+
+// value parses the next value, references included
+func (p *parser) value() (any, error) {
+	v, err := p.direct()
+	if err != nil {
+		return nil, err
+	}
+
+	// a number may be the start of a "num gen R" reference
+	num, ok := v.(int64)
+	if !ok {
+		return v, nil
+	}
+	save := p.pos
+	p.skipSpace()
+	gen, err := p.direct()
+	if g, ok := gen.(int64); err == nil && ok {
+		p.skipSpace()
+		if p.pos < len(p.data) && p.data[p.pos] == 'R' &&
+			(p.pos+1 == len(p.data) || isSpace(p.data[p.pos+1]) || isDelimiter(p.data[p.pos+1])) {
+			p.pos++
+			return Ref{int(num), int(g)}, nil
+		}
+	}
+	p.pos = save
+	return v, nil
+}
+
+// direct parses the next value without looking for references
+func (p *parser) direct() (any, error) {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return nil, UnexpectedEndErr
+	}
+
+	switch c := p.data[p.pos]; {
+	case c == '<' && p.pos+1 < len(p.data) && p.data[p.pos+1] == '<':
+		if p.depth >= maxDepth {
+			return nil, TooDeepErr
+		}
+		p.pos += 2
+		p.depth++
+		defer func() { p.depth-- }()
+		return p.dict()
+	case c == '<':
+		p.pos++
+		return p.hexString()
+	case c == '(':
+		p.pos++
+		return p.literalString()
+	case c == '[':
+		if p.depth >= maxDepth {
+			return nil, TooDeepErr
+		}
+		p.pos++
+		p.depth++
+		defer func() { p.depth-- }()
+		return p.array()
+	case c == '/':
+		p.pos++
+		return p.name(), nil
+	default:
+		return p.keyword()
+	}
+}
+
+// dict parses a dictionary after the opening <<
+func (p *parser) dict() (Dict, error) {
+	d := Dict{}
+	for {
+		p.skipSpace()
+		if p.pos+1 >= len(p.data) {
+			return nil, UnexpectedEndErr
+		}
+		if p.data[p.pos] == '>' && p.data[p.pos+1] == '>' {
+			p.pos += 2
+			return d, nil
+		}
+		if p.data[p.pos] != '/' {
+			return nil, fmt.Errorf("expected a name as dictionary key at %d", p.pos)
+		}
+		p.pos++
+		key := p.name()
+		val, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		d[key] = val
+	}
+}
+
+// array parses an array after the opening [
+func (p *parser) array() (Array, error) {
+	a := Array{}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			return nil, UnexpectedEndErr
+		}
+		if p.data[p.pos] == ']' {
+			p.pos++
+			return a, nil
+		}
+		val, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, val)
+	}
+}
+
+// name parses a name after the /, decoding #xx escapes
+func (p *parser) name() Name {
+	var b []byte
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if isSpace(c) || isDelimiter(c) {
+			break
+		}
+		if c == '#' && p.pos+2 < len(p.data) {
+			if v, err := strconv.ParseUint(string(p.data[p.pos+1:p.pos+3]), 16, 8); err == nil {
+				b = append(b, byte(v))
+				p.pos += 3
+				continue
+			}
+		}
+		b = append(b, c)
+		p.pos++
+	}
+	return Name(b)
+}
+
+// hexString parses a hex string after the opening <
+func (p *parser) hexString() (String, error) {
+	end := bytes.IndexByte(p.data[p.pos:], '>')
+	if end < 0 {
+		return nil, UnexpectedEndErr
+	}
+	digits := make([]byte, 0, end)
+	for _, c := range p.data[p.pos : p.pos+end] {
+		if !isSpace(c) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	p.pos += end + 1
+	s, err := hex.DecodeString(string(digits))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex string: %w", err)
+	}
+	return String(s), nil
+}
+
+// literalString parses a literal string after the opening (, handling escapes and nested parentheses
+func (p *parser) literalString() (String, error) {
+	var b []byte
+	depth := 1
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return String(b), nil
+			}
+		case '\\':
+			if p.pos >= len(p.data) {
+				return nil, UnexpectedEndErr
+			}
+			e := p.data[p.pos]
+			p.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// line continuation
+				if p.pos < len(p.data) && p.data[p.pos] == '\n' {
+					p.pos++
+				}
+				continue
+			case '\n':
+				continue
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				v := int(e - '0')
+				for i := 0; i < 2 && p.pos < len(p.data) && p.data[p.pos] >= '0' && p.data[p.pos] <= '7'; i++ {
+					v = v*8 + int(p.data[p.pos]-'0')
+					p.pos++
+				}
+				c = byte(v)
+			default:
+				c = e
+			}
+		}
+		b = append(b, c)
+	}
+	return nil, UnexpectedEndErr
+}
+
+// keyword parses numbers, booleans and null
+func (p *parser) keyword() (any, error) {
+	start := p.pos
+	for p.pos < len(p.data) && !isSpace(p.data[p.pos]) && !isDelimiter(p.data[p.pos]) {
+		p.pos++
+	}
+	word := string(p.data[start:p.pos])
+	switch word {
+	case "":
+		return nil, fmt.Errorf("unexpected %q at %d", p.data[start], start)
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	if i, err := strconv.ParseInt(word, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(word, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unexpected keyword %q at %d", word, start)
+}
+
+// stream returns the raw data of a stream whose dictionary was just parsed.
+// /Length is used when it is direct and sane, else the data runs up to endstream.
+func (p *parser) stream(d Dict) []byte {
+	p.pos += len("stream")
+	// the keyword is followed by CRLF or LF
+	if p.pos < len(p.data) && p.data[p.pos] == '\r' {
+		p.pos++
+	}
+	if p.pos < len(p.data) && p.data[p.pos] == '\n' {
+		p.pos++
+	}
+	start := p.pos
+
+	if length, ok := d["Length"].(int64); ok && length >= 0 && length <= int64(len(p.data)-start) {
+		end := start + int(length)
+		rest := p.data[end:min(len(p.data), end+32)]
+		if bytes.Contains(rest, []byte("endstream")) {
+			p.pos = end
+			return p.data[start:end]
+		}
+	}
+
+	end := bytes.Index(p.data[start:], []byte("endstream"))
+	if end < 0 {
+		return p.data[start:]
+	}
+	data := p.data[start : start+end]
+	// drop the end of line before endstream
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	data = bytes.TrimSuffix(data, []byte("\r"))
+	p.pos = start + end
+	return data
+}
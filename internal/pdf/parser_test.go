@@ -0,0 +1,193 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParserValue(t *testing.T) {
+	tests := []struct {
+		in   string
+		want any
+	}{
+		{"42", int64(42)},
+		{"-1.5", -1.5},
+		{"true", true},
+		{"null", nil},
+		{"/Na#6De", Name("Name")},
+		{"(a (nested) \\(string\\)\\n)", String("a (nested) (string)\n")},
+		{"(\\101\\0612)", String("A12")},
+		{"<48 65 6C6C 6F>", String("Hello")},
+		{"<414>", String("A@")},
+		{"12 0 R", Ref{12, 0}},
+		{"[1 0 R 3]", Array{Ref{1, 0}, int64(3)}},
+		{"[1 0 /R]", Array{int64(1), int64(0), Name("R")}},
+		{"<< /Type /Page % comment\n /Kids [] >>", Dict{"Type": Name("Page"), "Kids": Array{}}},
+	}
+	for _, tt := range tests {
+		p := &parser{data: []byte(tt.in)}
+		got, err := p.value()
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", tt.want) {
+			t.Errorf("%q: got %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParserMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want error
+	}{
+		{"empty", "", UnexpectedEndErr},
+		{"open dict", "<< /A 1", UnexpectedEndErr},
+		{"open array", "[1 2", UnexpectedEndErr},
+		{"open string", "(abc", UnexpectedEndErr},
+		{"open hex string", "<4142", UnexpectedEndErr},
+		{"escape at end", "(abc\\", UnexpectedEndErr},
+		{"nested arrays", strings.Repeat("[", 100000), TooDeepErr},
+		{"nested dicts", strings.Repeat("<< /A ", 100000), TooDeepErr},
+		{"nested mixed", strings.Repeat("[<< /A ", 50000), TooDeepErr},
+	}
+	for _, tt := range tests {
+		p := &parser{data: []byte(tt.in)}
+		if _, err := p.value(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// nesting within the limit is fine
+	in := strings.Repeat("[", maxDepth) + strings.Repeat("]", maxDepth)
+	p := &parser{data: []byte(in)}
+	if _, err := p.value(); err != nil {
+		t.Errorf("%d nested arrays: %v", maxDepth, err)
+	}
+	if p.depth != 0 {
+		t.Errorf("depth is %d after parsing, want 0", p.depth)
+	}
+}
+
+func TestParserStreamLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int64
+		want   string
+	}{
+		{"exact", 5, "hello"},
+		{"short", 3, "hel"}, // trusted, endstream follows closely
+		{"negative", -10, "hello"},
+		{"past the end", 1 << 40, "hello"},
+		{"overflowing", 1<<63 - 1, "hello"},
+	}
+	for _, tt := range tests {
+		data := []byte("stream\nhello\nendstream")
+		p := &parser{data: data}
+		got := p.stream(Dict{"Length": tt.length})
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// buildPDF assembles a file out of object bodies, numbered from 1
+func buildPDF(trailer string, objects ...string) []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.5\n")
+	for i, obj := range objects {
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	if trailer != "" {
+		fmt.Fprintf(&b, "trailer\n%s\n", trailer)
+	}
+	b.WriteString("%%EOF\n")
+	return b.Bytes()
+}
+
+// objectStream returns an object stream holding body, with the given header
+func objectStream(n, first int, header, body string) string {
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write([]byte(header + body))
+	zw.Close()
+	return fmt.Sprintf("<< /Type /ObjStm /N %d /First %d /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream",
+		n, first, z.Len(), z.Bytes())
+}
+
+func TestParseObjectStream(t *testing.T) {
+	header := "3 0 4 14 "
+	body := "<< /A true >> [1 2 3]"
+	data := buildPDF("<< /Root 2 0 R >>",
+		objectStream(2, len(header), header, body),
+		"<< /Type /Catalog >>",
+	)
+
+	f, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != "1.5" {
+		t.Errorf("version %q, want 1.5", f.Version)
+	}
+	if d := f.Dict(Ref{3, 0}); d["A"] != true {
+		t.Errorf("object 3 is %#v", f.Objects[3])
+	}
+	if a, _ := f.Resolve(Ref{4, 0}).(Array); len(a) != 3 {
+		t.Errorf("object 4 is %#v", f.Objects[4])
+	}
+	if f.Dict(f.Trailer["Root"])["Type"] != Name("Catalog") {
+		t.Errorf("root is not the catalog")
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"offset before first", buildPDF("<< /Root 2 0 R >>",
+			objectStream(1, 6, "3 -99 ", "<< >>"), "<< >>")},
+		{"offset below zero", buildPDF("<< /Root 2 0 R >>",
+			objectStream(1, 6, "3 -6  ", "<< >>"), "<< >>")},
+		{"offset past the end", buildPDF("<< /Root 2 0 R >>",
+			objectStream(1, 6, "3 9999", "<< >>"), "<< >>")},
+		{"offset overflowing", buildPDF("<< /Root 2 0 R >>",
+			objectStream(1, 22, "3 9223372036854775800", "<< >>"), "<< >>")},
+		{"first past the end", buildPDF("<< /Root 2 0 R >>",
+			objectStream(1, 500, "3 0 ", "<< >>"), "<< >>")},
+		{"huge length", buildPDF("<< /Root 1 0 R >>",
+			"<< /Length 9223372036854775807 >>\nstream\nabc\nendstream")},
+		{"deep object", buildPDF("<< /Root 1 0 R >>",
+			strings.Repeat("[", 1<<20))},
+		{"deep trailer", buildPDF(strings.Repeat("<< /A ", 1<<18),
+			"<< >>")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// must not panic, an error is fine as long as it is reported
+			f, err := Parse(tt.data)
+			if err == nil && f == nil {
+				t.Fatal("no file and no error")
+			}
+			if f != nil {
+				if _, ok := f.Objects[3]; ok {
+					t.Errorf("object 3 was read from a bad offset: %#v", f.Objects[3])
+				}
+			}
+		})
+	}
+
+	if _, err := Parse([]byte("GIF89a")); !errors.Is(err, NotPDFErr) {
+		t.Errorf("got %v, want NotPDFErr", err)
+	}
+	if _, err := Parse([]byte("%PDF-1.4\n1 0 obj\n<< >>\nendobj\n")); !errors.Is(err, NoTrailerErr) {
+		t.Errorf("got %v, want NoTrailerErr", err)
+	}
+}
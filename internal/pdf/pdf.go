@@ -0,0 +1,265 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"unicode/utf16"
+)
+
+// Value types of PDF objects. Numbers are int64 or float64, booleans are bool
+// and null is nil.
+type (
+	Name   string
+	String []byte
+	Array  []any
+	Dict   map[Name]any
+	Ref    struct{ Num, Gen int }
+)
+
+// Object is an indirect object of a PDF file
+type Object struct {
+	Ref    Ref
+	Value  any
+	Stream []byte // raw (still encoded) stream data, nil if the object is not a stream
+}
+
+// File is a parsed PDF file. Objects are located by scanning the file instead of
+// trusting the cross-reference table, which also copes with slightly broken files.
+type File struct {
+	Version string
+	Objects map[int]*Object
+	Trailer Dict
+}
+
+var (
+	NotPDFErr     = errors.New("not a pdf file")
+	NoTrailerErr  = errors.New("pdf trailer could not be found")
+	objPattern    = regexp.MustCompile(`(\d+)[ \t\r\n\f]+(\d+)[ \t\r\n\f]+obj\b`)
+	headerPattern = regexp.MustCompile(`^%PDF-(\d\.\d)`)
+)
+
+// Parse reads all the objects of a PDF file, including those in object streams.
+// Files are untrusted, a bug tripped by a crafted one is returned as an error.
+func Parse(data []byte) (f *File, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			f, err = nil, fmt.Errorf("error while parsing pdf: %v", r)
+		}
+	}()
+
+	m := headerPattern.FindSubmatch(data)
+	if m == nil {
+		return nil, NotPDFErr
+	}
+
+	f = &File{
+		Version: string(m[1]),
+		Objects: map[int]*Object{},
+	}
+
+	// later definitions win, as incremental updates are appended to the file
+	for _, loc := range objPattern.FindAllSubmatchIndex(data, -1) {
+		num, _ := strconv.Atoi(string(data[loc[2]:loc[3]]))
+		gen, _ := strconv.Atoi(string(data[loc[4]:loc[5]]))
+
+		p := &parser{data: data, pos: loc[1]}
+		val, err := p.value()
+		if err != nil {
+			continue // skip objects we can't make sense of
+		}
+		obj := &Object{Ref: Ref{num, gen}, Value: val}
+
+		if _, ok := val.(Dict); ok {
+			p.skipSpace()
+			if bytes.HasPrefix(data[p.pos:], []byte("stream")) {
+				obj.Stream = p.stream(val.(Dict))
+			}
+		}
+		f.Objects[num] = obj
+	}
+
+	f.expandObjectStreams()
+
+	trailer, err := findTrailer(data, f)
+	if err != nil {
+		return nil, err
+	}
+	f.Trailer = trailer
+	return f, nil
+}
+
+// Resolve follows references until a direct value is reached
+func (f *File) Resolve(v any) any {
+	for range 32 { // guard against reference loops
+		ref, ok := v.(Ref)
+		if !ok {
+			return v
+		}
+		obj, ok := f.Objects[ref.Num]
+		if !ok {
+			return nil
+		}
+		v = obj.Value
+	}
+	return nil
+}
+
+// Dict resolves v into a dictionary, nil if it is not one
+func (f *File) Dict(v any) Dict {
+	d, _ := f.Resolve(v).(Dict)
+	return d
+}
+
+// Decode returns the decoded data of a stream object. Only FlateDecode (and no filter)
+// is supported, which is what is used for metadata and object streams.
+func (f *File) Decode(obj *Object) ([]byte, error) {
+	d, _ := obj.Value.(Dict)
+	switch filter := f.Resolve(d["Filter"]).(type) {
+	case nil:
+		return obj.Stream, nil
+	case Name:
+		if filter == "FlateDecode" {
+			return inflate(obj.Stream)
+		}
+		return nil, fmt.Errorf("unsupported stream filter %s", filter)
+	case Array:
+		if len(filter) == 1 && filter[0] == Name("FlateDecode") {
+			return inflate(obj.Stream)
+		}
+		return nil, fmt.Errorf("unsupported stream filters %v", filter)
+	default:
+		return nil, fmt.Errorf("invalid stream filter")
+	}
+}
+
+// inflate decompresses zlib data, returning what could be read of truncated streams
+func inflate(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	if err != nil && len(out) == 0 {
+		return nil, err
+	}
+	return out, nil
+}
+
+// expandObjectStreams adds the objects stored inside object streams (PDF 1.5+)
+func (f *File) expandObjectStreams() {
+	for _, obj := range f.Objects {
+		d, ok := obj.Value.(Dict)
+		if !ok || d["Type"] != Name("ObjStm") || obj.Stream == nil {
+			continue
+		}
+		data, err := f.Decode(obj)
+		if err != nil {
+			continue
+		}
+		n, _ := f.Resolve(d["N"]).(int64)
+		first, _ := f.Resolve(d["First"]).(int64)
+		if first <= 0 || int(first) > len(data) {
+			continue
+		}
+
+		// header holds pairs of object number and offset relative to First
+		p := &parser{data: data[:first]}
+		for range n {
+			num, err1 := p.value()
+			off, err2 := p.value()
+			numInt, ok1 := num.(int64)
+			offInt, ok2 := off.(int64)
+			if err1 != nil || err2 != nil || !ok1 || !ok2 {
+				break
+			}
+			if _, exists := f.Objects[int(numInt)]; exists {
+				continue // a directly defined object is an update of this one
+			}
+			if offInt < 0 || offInt >= int64(len(data))-first {
+				continue
+			}
+			vp := &parser{data: data, pos: int(first + offInt)}
+			val, err := vp.value()
+			if err != nil {
+				continue
+			}
+			f.Objects[int(numInt)] = &Object{Ref: Ref{int(numInt), 0}, Value: val}
+		}
+	}
+}
+
+// findTrailer returns the last trailer dictionary, or the dictionary of the
+// last cross-reference stream for files without a classic trailer
+func findTrailer(data []byte, f *File) (Dict, error) {
+	if i := bytes.LastIndex(data, []byte("trailer")); i >= 0 {
+		p := &parser{data: data, pos: i + len("trailer")}
+		if v, err := p.value(); err == nil {
+			if d, ok := v.(Dict); ok {
+				return d, nil
+			}
+		}
+	}
+
+	var trailer Dict
+	var best int
+	for num, obj := range f.Objects {
+		d, ok := obj.Value.(Dict)
+		if ok && d["Type"] == Name("XRef") && num >= best {
+			trailer, best = d, num
+		}
+	}
+	if trailer == nil {
+		return nil, NoTrailerErr
+	}
+	return trailer, nil
+}
+
+// Text decodes a PDF text string, which is either UTF-16BE with a byte order mark,
+// UTF-8 with a byte order mark or PDFDocEncoding (treated as Latin-1)
+func Text(v any) string {
+	s, ok := v.(String)
+	if !ok {
+		return ""
+	}
+	switch {
+	case bytes.HasPrefix(s, []byte{0xFE, 0xFF}):
+		units := make([]uint16, 0, len(s)/2)
+		for i := 2; i+1 < len(s); i += 2 {
+			units = append(units, uint16(s[i])<<8|uint16(s[i+1]))
+		}
+		return string(utf16.Decode(units))
+	case bytes.HasPrefix(s, []byte{0xEF, 0xBB, 0xBF}):
+		return string(s[3:])
+	default:
+		runes := make([]rune, len(s))
+		for i, b := range s {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+}
+
+// EncodeText encodes s as a PDF text string, in UTF-16BE unless it is plain ascii
+func EncodeText(s string) String {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return String(s)
+	}
+	b := []byte{0xFE, 0xFF}
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(u>>8), byte(u))
+	}
+	return String(b)
+}
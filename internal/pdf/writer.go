@@ -0,0 +1,201 @@
+package pdf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+)
+
+// Writer assembles a PDF file out of indirect objects
+type Writer struct {
+	objects map[int]*Object
+	next    int // number of the next added object
+}
+
+// NewWriter returns an empty writer
+func NewWriter() *Writer {
+	return &Writer{objects: map[int]*Object{}, next: 1}
+}
+
+// Add stores a new object and returns a reference to it. stream is the already
+// encoded stream data, nil for objects which are not streams.
+func (w *Writer) Add(value any, stream []byte) Ref {
+	ref := Ref{Num: w.next}
+	w.Set(ref, value, stream)
+	return ref
+}
+
+// Reserve returns a reference for an object which is Set later, useful for
+// objects referring to each other
+func (w *Writer) Reserve() Ref {
+	ref := Ref{Num: w.next}
+	w.next++
+	return ref
+}
+
+// Set stores the object with the given reference, replacing any previous one
+func (w *Writer) Set(ref Ref, value any, stream []byte) {
+	w.objects[ref.Num] = &Object{Ref: Ref{Num: ref.Num}, Value: value, Stream: stream}
+	w.next = max(w.next, ref.Num+1)
+}
+
+// WriteTo writes the file with a classic cross-reference table. The trailer must
+// hold at least /Root, /Size is filled in.
+func (w *Writer) WriteTo(out io.Writer, trailer Dict) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(out)}
+
+	// the binary comment marks the file as binary for transfer programs
+	fmt.Fprint(cw, "%PDF-1.7\n%\xE2\xE3\xCF\xD3\n")
+
+	nums := make([]int, 0, len(w.objects))
+	for num := range w.objects {
+		nums = append(nums, num)
+	}
+	slices.Sort(nums)
+
+	offsets := make(map[int]int64, len(nums))
+	for _, num := range nums {
+		obj := w.objects[num]
+		offsets[num] = cw.n
+		fmt.Fprintf(cw, "%d 0 obj\n", num)
+		if obj.Stream != nil {
+			d, ok := obj.Value.(Dict)
+			if !ok {
+				return cw.n, fmt.Errorf("stream object %d has no dictionary", num)
+			}
+			d = maps.Clone(d) // callers keep their dictionary untouched
+			d["Length"] = int64(len(obj.Stream))
+			writeValue(cw, d)
+			fmt.Fprint(cw, "\nstream\n")
+			cw.Write(obj.Stream)
+			fmt.Fprint(cw, "\nendstream")
+		} else {
+			writeValue(cw, obj.Value)
+		}
+		fmt.Fprint(cw, "\nendobj\n")
+	}
+
+	size := w.next
+	xref := cw.n
+	fmt.Fprintf(cw, "xref\n0 %d\n0000000000 65535 f \n", size)
+	for num := 1; num < size; num++ {
+		if off, ok := offsets[num]; ok {
+			fmt.Fprintf(cw, "%010d 00000 n \n", off)
+		} else {
+			fmt.Fprint(cw, "0000000000 65535 f \n")
+		}
+	}
+
+	trailer = maps.Clone(trailer)
+	trailer["Size"] = int64(size)
+	fmt.Fprint(cw, "trailer\n")
+	writeValue(cw, trailer)
+	fmt.Fprintf(cw, "\nstartxref\n%d\n%%%%EOF\n", xref)
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// writeValue serializes a direct value
+func writeValue(w io.Writer, v any) {
+	switch v := v.(type) {
+	case nil:
+		fmt.Fprint(w, "null")
+	case bool:
+		fmt.Fprint(w, strconv.FormatBool(v))
+	case int:
+		fmt.Fprint(w, strconv.Itoa(v))
+	case int64:
+		fmt.Fprint(w, strconv.FormatInt(v, 10))
+	case float64:
+		// pdf does not allow exponents
+		fmt.Fprint(w, strconv.FormatFloat(v, 'f', -1, 64))
+	case Name:
+		writeName(w, v)
+	case String:
+		writeString(w, v)
+	case Ref:
+		fmt.Fprintf(w, "%d %d R", v.Num, v.Gen)
+	case Array:
+		fmt.Fprint(w, "[")
+		for i, e := range v {
+			if i > 0 {
+				fmt.Fprint(w, " ")
+			}
+			writeValue(w, e)
+		}
+		fmt.Fprint(w, "]")
+	case Dict:
+		// sorted keys keep the output stable
+		keys := make([]Name, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		fmt.Fprint(w, "<<")
+		for _, k := range keys {
+			writeName(w, k)
+			fmt.Fprint(w, " ")
+			writeValue(w, v[k])
+			fmt.Fprint(w, " ")
+		}
+		fmt.Fprint(w, ">>")
+	default:
+		fmt.Fprint(w, "null")
+	}
+}
+
+// writeName writes a name, escaping delimiters, whitespace and non ascii bytes as #xx
+func writeName(w io.Writer, n Name) {
+	b := []byte{'/'}
+	for i := 0; i < len(n); i++ {
+		c := n[i]
+		if c < '!' || c > '~' || c == '#' || isDelimiter(c) {
+			b = append(b, fmt.Sprintf("#%02X", c)...)
+			continue
+		}
+		b = append(b, c)
+	}
+	w.Write(b)
+}
+
+// writeString writes a literal string, escaping the characters with a special meaning
+func writeString(w io.Writer, s String) {
+	b := []byte{'('}
+	for _, c := range s {
+		switch c {
+		case '(', ')', '\\':
+			b = append(b, '\\', c)
+		case '\r':
+			b = append(b, '\\', 'r')
+		case '\n':
+			b = append(b, '\\', 'n')
+		default:
+			b = append(b, c)
+		}
+	}
+	b = append(b, ')')
+	w.Write(b)
+}
+
+// countingWriter tracks the offset of the output and the first write error
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
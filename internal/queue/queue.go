@@ -1,7 +1,9 @@
 package queue
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -9,8 +11,26 @@ import (
 type Task struct {
 	ID  uuid.UUID
 	URL string
+
+	claim string // identifies the claim held on the task (durable queues only)
+}
+
+// Queue is implemented by the task queues the server workers consume from.
+// A dequeued task is claimed by the caller until it is acked or released.
+type Queue interface {
+	// Enqueue adds a task to the queue
+	Enqueue(task Task) error
+	// Dequeue blocks until a task is claimed or the context is done
+	Dequeue(ctx context.Context) (Task, error)
+	// Extend renews the claim on a task that is still being processed
+	Extend(task Task) error
+	// Ack removes a claimed task from the queue once it has been processed
+	Ack(task Task) error
+	// Release gives up the claim on a task, making it available again after delay
+	Release(task Task, delay time.Duration) error
 }
 
+// TaskQueue is an in-memory queue. Tasks are lost when the process exits.
 type TaskQueue struct {
 	queue []Task
 	lock  sync.Mutex
@@ -27,25 +47,58 @@ func NewTaskQueue() *TaskQueue {
 }
 
 // Enqueue adds a task to the queue
-func (t *TaskQueue) Enqueue(task Task) {
+func (t *TaskQueue) Enqueue(task Task) error {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
 	t.queue = append(t.queue, task)
 	t.cond.Signal()
+	return nil
 }
 
-// Dequeue blocks until a task is available
-func (t *TaskQueue) Dequeue() Task {
+// Dequeue blocks until a task is available or the context is done
+func (t *TaskQueue) Dequeue(ctx context.Context) (Task, error) {
+	// wake up the waiters when context is done
+	stop := context.AfterFunc(ctx, func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		t.cond.Broadcast()
+	})
+	defer stop()
+
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	if len(t.queue) == 0 {
+	for len(t.queue) == 0 {
+		if err := ctx.Err(); err != nil {
+			return Task{}, err
+		}
 		t.cond.Wait()
 	}
 	task := t.queue[0]
 	t.queue = t.queue[1:]
-	return task
+	return task, nil
+}
+
+// Extend is a no-op as in-memory claims do not expire
+func (t *TaskQueue) Extend(task Task) error {
+	return nil
+}
+
+// Ack is a no-op as the task was already removed while dequeuing
+func (t *TaskQueue) Ack(task Task) error {
+	return nil
+}
+
+// Release adds the task back to the queue after the given delay
+func (t *TaskQueue) Release(task Task, delay time.Duration) error {
+	if delay <= 0 {
+		return t.Enqueue(task)
+	}
+	time.AfterFunc(delay, func() {
+		_ = t.Enqueue(task)
+	})
+	return nil
 }
 
 // NewTask creates a task entity
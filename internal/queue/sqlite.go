@@ -0,0 +1,227 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// create queue table query
+	queueTableQuery = `CREATE TABLE IF NOT EXISTS task_queue(
+task_id TEXT PRIMARY KEY,               -- id of the task in tasks table
+url TEXT NOT NULL,                      -- URL to download/process
+available_at INTEGER NOT NULL,          -- unix millis after which the task can be claimed
+lease_until INTEGER NOT NULL DEFAULT 0, -- unix millis at which the current claim expires
+claim TEXT,                             -- identifies the current claim
+enqueued_at INTEGER NOT NULL            -- unix millis of insertion, used for ordering
+);
+
+CREATE INDEX IF NOT EXISTS idx_task_queue_available ON task_queue(available_at, lease_until);`
+
+	// queues the tasks left pending or ongoing by servers from before the queue table,
+	// they replayed such tasks on startup instead. Parts are sent along with their task.
+	backfillQuery = `INSERT INTO task_queue(task_id, url, available_at, enqueued_at)
+SELECT id, url, ?, ? + ROW_NUMBER() OVER (ORDER BY added_at, rowid) FROM tasks
+WHERE state IN ('pending', 'ongoing') AND parent_id IS NULL;`
+
+	// poll interval for checking delayed or expired tasks
+	pollInterval = time.Second
+)
+
+var (
+	ErrNilQueueDB    = errors.New("nil database connection for queue")
+	ErrClaimNotFound = errors.New("task is not claimed by the caller anymore")
+)
+
+// SQLiteQueue is a durable queue persisted in a sqlite table.
+// Dequeued tasks are leased for a duration, if the lease is not extended,
+// acked or released in time, the task becomes available to other workers again.
+type SQLiteQueue struct {
+	db     *sql.DB
+	lease  time.Duration
+	notify chan struct{} // wakes up a waiting Dequeue on local Enqueue
+}
+
+// NewSQLiteQueue returns a SQLiteQueue after creating the necessary table
+func NewSQLiteQueue(db *sql.DB, lease time.Duration) (*SQLiteQueue, error) {
+	if db == nil {
+		return nil, ErrNilQueueDB
+	}
+	if lease <= 0 {
+		return nil, fmt.Errorf("lease duration should be positive, got: %s", lease)
+	}
+
+	err := createQueueTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("error while creating queue table: %w", err)
+	}
+
+	return &SQLiteQueue{
+		db:     db,
+		lease:  lease,
+		notify: make(chan struct{}, 1),
+	}, nil
+}
+
+// createQueueTable creates the queue table, filling it from the tasks table when it is new
+func createQueueTable(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var queueExists, tasksExist bool
+	err = tx.QueryRow(`SELECT
+EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'task_queue'),
+EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'tasks');`).Scan(&queueExists, &tasksExist)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(queueTableQuery)
+	if err != nil {
+		return err
+	}
+
+	if !queueExists && tasksExist {
+		now := time.Now().UnixMilli()
+		_, err = tx.Exec(backfillQuery, now, now)
+		if err != nil {
+			return fmt.Errorf("error while queueing pending tasks: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Enqueue adds a task to the queue. Enqueuing an already queued task
+// makes it available immediately.
+func (q *SQLiteQueue) Enqueue(task Task) error {
+	now := time.Now().UnixMilli()
+	query := `INSERT INTO task_queue(task_id, url, available_at, enqueued_at) VALUES(?,?,?,?)
+ON CONFLICT(task_id) DO UPDATE SET available_at = excluded.available_at, lease_until = 0, claim = NULL;`
+
+	_, err := q.db.Exec(query, task.ID.String(), task.URL, now, now)
+	if err != nil {
+		return err
+	}
+
+	q.wake()
+	return nil
+}
+
+// Dequeue blocks until a task is claimed or the context is done
+func (q *SQLiteQueue) Dequeue(ctx context.Context) (Task, error) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		task, ok, err := q.claim(ctx)
+		if err != nil {
+			return Task{}, err
+		}
+		if ok {
+			return task, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return Task{}, ctx.Err()
+		case <-q.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim attempts to lease the oldest available task
+func (q *SQLiteQueue) claim(ctx context.Context) (Task, bool, error) {
+	now := time.Now()
+	claim := uuid.New().String()
+	query := `UPDATE task_queue SET lease_until = ?, claim = ?
+WHERE task_id = (
+	SELECT task_id FROM task_queue
+	WHERE available_at <= ? AND lease_until <= ?
+	ORDER BY enqueued_at LIMIT 1
+)
+RETURNING task_id, url;`
+
+	var id, url string
+	err := q.db.QueryRowContext(ctx, query,
+		now.Add(q.lease).UnixMilli(),
+		claim,
+		now.UnixMilli(),
+		now.UnixMilli(),
+	).Scan(&id, &url)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return Task{}, false, nil
+	}
+	if err != nil {
+		return Task{}, false, err
+	}
+
+	taskID, err := uuid.Parse(id)
+	if err != nil {
+		return Task{}, false, fmt.Errorf("invalid task id in queue %q: %w", id, err)
+	}
+
+	return Task{ID: taskID, URL: url, claim: claim}, true, nil
+}
+
+// Extend renews the lease on a claimed task
+func (q *SQLiteQueue) Extend(task Task) error {
+	query := `UPDATE task_queue SET lease_until = ? WHERE task_id = ? AND claim = ?;`
+	result, err := q.db.Exec(query, time.Now().Add(q.lease).UnixMilli(), task.ID.String(), task.claim)
+	if err != nil {
+		return err
+	}
+	return checkClaim(result)
+}
+
+// Ack removes a claimed task from the queue
+func (q *SQLiteQueue) Ack(task Task) error {
+	query := `DELETE FROM task_queue WHERE task_id = ? AND claim = ?;`
+	result, err := q.db.Exec(query, task.ID.String(), task.claim)
+	if err != nil {
+		return err
+	}
+	return checkClaim(result)
+}
+
+// Release drops the lease on a claimed task, making it available after delay
+func (q *SQLiteQueue) Release(task Task, delay time.Duration) error {
+	query := `UPDATE task_queue SET available_at = ?, lease_until = 0, claim = NULL WHERE task_id = ? AND claim = ?;`
+	result, err := q.db.Exec(query, time.Now().Add(delay).UnixMilli(), task.ID.String(), task.claim)
+	if err != nil {
+		return err
+	}
+	if delay <= 0 {
+		q.wake()
+	}
+	return checkClaim(result)
+}
+
+// wake notifies a waiting Dequeue without blocking
+func (q *SQLiteQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// checkClaim reports ErrClaimNotFound if the statement did not match the claim
+func checkClaim(result sql.Result) error {
+	r, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if r == 0 {
+		return ErrClaimNotFound
+	}
+	return nil
+}
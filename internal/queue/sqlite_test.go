@@ -0,0 +1,233 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	_ "modernc.org/sqlite"
+)
+
+// openTestDB returns a database in a file, so that every connection of the pool sees it
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "queue.db")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newTestQueue(t *testing.T, db *sql.DB, lease time.Duration) *SQLiteQueue {
+	t.Helper()
+	q, err := NewSQLiteQueue(db, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// dequeue claims a task, failing the test if none is available in time
+func dequeue(t *testing.T, q *SQLiteQueue) Task {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	task, err := q.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("dequeue: %v", err)
+	}
+	return task
+}
+
+// assertEmpty checks that no task can be claimed right now
+func assertEmpty(t *testing.T, q *SQLiteQueue) {
+	t.Helper()
+	task, ok, err := q.claim(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatalf("claimed %s, want no available task", task.ID)
+	}
+}
+
+func TestSQLiteQueueAck(t *testing.T) {
+	q := newTestQueue(t, openTestDB(t), time.Minute)
+	want := NewTask(uuid.New(), "https://example.com/a.epub")
+	if err := q.Enqueue(want); err != nil {
+		t.Fatal(err)
+	}
+
+	got := dequeue(t, q)
+	if got.ID != want.ID || got.URL != want.URL {
+		t.Fatalf("dequeued %v %q, want %v %q", got.ID, got.URL, want.ID, want.URL)
+	}
+	assertEmpty(t, q) // claimed tasks are not handed out twice
+
+	if err := q.Ack(got); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(got); !errors.Is(err, ErrClaimNotFound) {
+		t.Fatalf("second ack: got %v, want ErrClaimNotFound", err)
+	}
+}
+
+func TestSQLiteQueueOrder(t *testing.T) {
+	q := newTestQueue(t, openTestDB(t), time.Minute)
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	for _, id := range ids {
+		if err := q.Enqueue(NewTask(id, "https://example.com")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond) // enqueued_at has millisecond precision
+	}
+	for _, id := range ids {
+		if got := dequeue(t, q); got.ID != id {
+			t.Fatalf("dequeued %s, want %s", got.ID, id)
+		}
+	}
+}
+
+func TestSQLiteQueueLeaseExpiry(t *testing.T) {
+	lease := 100 * time.Millisecond
+	q := newTestQueue(t, openTestDB(t), lease)
+	if err := q.Enqueue(NewTask(uuid.New(), "https://example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	first := dequeue(t, q)
+	assertEmpty(t, q)
+
+	time.Sleep(lease + 50*time.Millisecond)
+	second := dequeue(t, q)
+	if second.ID != first.ID {
+		t.Fatalf("reclaimed %s, want %s", second.ID, first.ID)
+	}
+	if second.claim == first.claim {
+		t.Fatal("reclaimed task kept the expired claim")
+	}
+
+	// the expired claim can't touch the task anymore
+	for name, op := range map[string]func(Task) error{
+		"extend":  q.Extend,
+		"ack":     q.Ack,
+		"release": func(task Task) error { return q.Release(task, 0) },
+	} {
+		if err := op(first); !errors.Is(err, ErrClaimNotFound) {
+			t.Errorf("%s with expired claim: got %v, want ErrClaimNotFound", name, err)
+		}
+	}
+
+	if err := q.Extend(second); err != nil {
+		t.Fatalf("extend with current claim: %v", err)
+	}
+	if err := q.Ack(second); err != nil {
+		t.Fatalf("ack with current claim: %v", err)
+	}
+}
+
+func TestSQLiteQueueExtend(t *testing.T) {
+	lease := 150 * time.Millisecond
+	q := newTestQueue(t, openTestDB(t), lease)
+	if err := q.Enqueue(NewTask(uuid.New(), "https://example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	task := dequeue(t, q)
+	for range 3 {
+		time.Sleep(lease / 2)
+		if err := q.Extend(task); err != nil {
+			t.Fatal(err)
+		}
+		assertEmpty(t, q) // kept claimed past the first lease
+	}
+}
+
+func TestSQLiteQueueRelease(t *testing.T) {
+	q := newTestQueue(t, openTestDB(t), time.Minute)
+	if err := q.Enqueue(NewTask(uuid.New(), "https://example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	task := dequeue(t, q)
+	delay := 200 * time.Millisecond
+	if err := q.Release(task, delay); err != nil {
+		t.Fatal(err)
+	}
+	assertEmpty(t, q) // not before the delay
+
+	time.Sleep(delay + 50*time.Millisecond)
+	again := dequeue(t, q)
+	if again.ID != task.ID {
+		t.Fatalf("dequeued %s, want %s", again.ID, task.ID)
+	}
+	if err := q.Release(task, 0); !errors.Is(err, ErrClaimNotFound) {
+		t.Fatalf("release with old claim: got %v, want ErrClaimNotFound", err)
+	}
+}
+
+func TestSQLiteQueueReclaimAfterCrash(t *testing.T) {
+	db := openTestDB(t)
+	lease := 100 * time.Millisecond
+	q := newTestQueue(t, db, lease)
+	if err := q.Enqueue(NewTask(uuid.New(), "https://example.com")); err != nil {
+		t.Fatal(err)
+	}
+	crashed := dequeue(t, q) // never acked, as if the process died
+
+	// the restarted server opens the queue on the same table
+	restarted := newTestQueue(t, db, lease)
+	assertEmpty(t, restarted)
+	time.Sleep(lease + 50*time.Millisecond)
+
+	task := dequeue(t, restarted)
+	if task.ID != crashed.ID {
+		t.Fatalf("reclaimed %s, want %s", task.ID, crashed.ID)
+	}
+	if err := restarted.Ack(task); err != nil {
+		t.Fatal(err)
+	}
+	assertEmpty(t, restarted)
+}
+
+func TestSQLiteQueueBackfill(t *testing.T) {
+	db := openTestDB(t)
+	_, err := db.Exec(`CREATE TABLE tasks(id TEXT PRIMARY KEY, url TEXT, state TEXT, parent_id TEXT, added_at DATETIME);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, ongoing, done, part := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	_, err = db.Exec(`INSERT INTO tasks VALUES
+(?, 'https://example.com/pending', 'pending', NULL, '2024-01-01 10:00:00'),
+(?, 'https://example.com/ongoing', 'ongoing', NULL, '2024-01-01 11:00:00'),
+(?, 'https://example.com/done', 'complete', NULL, '2024-01-01 09:00:00'),
+(?, 'https://example.com/part', 'pending', ?, '2024-01-01 08:00:00');`,
+		pending.String(), ongoing.String(), done.String(), part.String(), ongoing.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := newTestQueue(t, db, time.Minute)
+	for _, want := range []uuid.UUID{pending, ongoing} {
+		task := dequeue(t, q)
+		if task.ID != want {
+			t.Fatalf("dequeued %s, want %s", task.ID, want)
+		}
+		if err := q.Ack(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertEmpty(t, q)
+
+	// only a new table is filled, acked tasks don't come back on restart
+	_, err = db.Exec(`UPDATE tasks SET state = 'pending';`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEmpty(t, newTestQueue(t, db, time.Minute))
+}
@@ -0,0 +1,83 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"syscall"
+	"time"
+)
+
+// temporary is implemented by errors which know if they are worth retrying,
+// e.g. downloader.StatusError
+type temporary interface {
+	Temporary() bool
+}
+
+// tempSendError is implemented by smtp delivery errors (go-mail's SendError)
+type tempSendError interface {
+	IsTemp() bool
+}
+
+// IsTransient reports whether the error is likely to go away on a later attempt.
+// Timeouts, dropped connections, 5xx http responses and 4xx smtp replies are transient.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// checked first, as the errors of net and net/http also implement Temporary,
+	// which reports false for refused and reset connections
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+
+	var s tempSendError
+	if errors.As(err, &s) {
+		return s.IsTemp()
+	}
+
+	var t temporary
+	if errors.As(err, &t) {
+		return t.Temporary()
+	}
+
+	return false
+}
+
+// Backoff returns the delay before the given attempt (starting at 1),
+// doubling from base and capped at max, with up to 10% jitter added.
+func Backoff(attempt int, base, max time.Duration) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	if jitter := int64(delay / 10); jitter > 0 {
+		delay += time.Duration(rand.Int64N(jitter))
+	}
+	return delay
+}
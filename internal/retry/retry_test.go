@@ -0,0 +1,167 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"resty.dev/v3"
+)
+
+// statusError stands in for downloader.StatusError
+type statusError struct{ code int }
+
+func (e statusError) Error() string   { return fmt.Sprintf("status %d", e.code) }
+func (e statusError) Temporary() bool { return e.code >= 500 }
+
+// sendError stands in for go-mail's SendError
+type sendError struct{ temp bool }
+
+func (e sendError) Error() string { return "send failed" }
+func (e sendError) IsTemp() bool  { return e.temp }
+
+// timeoutError is a net.Error which timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return false }
+
+// opError wraps errno the way the net package reports failed connections
+func opError(op string, errno syscall.Errno) error {
+	return &url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{
+		Op: op, Net: "tcp", Err: os.NewSyscallError(op, errno),
+	}}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain", errors.New("unsupported format"), false},
+		{"deadline", fmt.Errorf("download: %w", context.DeadlineExceeded), true},
+		{"canceled", context.Canceled, false},
+		{"unexpected eof", fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF), true},
+		{"refused", opError("dial", syscall.ECONNREFUSED), true},
+		{"reset", opError("read", syscall.ECONNRESET), true},
+		{"aborted", opError("read", syscall.ECONNABORTED), true},
+		{"other errno", opError("dial", syscall.EACCES), false},
+		{"timeout", &url.Error{Op: "Get", URL: "https://example.com", Err: timeoutError{}}, true},
+		{"dns temporary", &net.DNSError{Err: "server misbehaving", IsTemporary: true}, true},
+		{"dns not found", &net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{"5xx", fmt.Errorf("fetch: %w", statusError{503}), true},
+		{"4xx", fmt.Errorf("fetch: %w", statusError{404}), false},
+		{"smtp 4xx", fmt.Errorf("send: %w", sendError{temp: true}), true},
+		{"smtp 5xx", fmt.Errorf("send: %w", sendError{temp: false}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.want {
+				t.Fatalf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// refusedURL returns the url of a port nothing listens on
+func refusedURL(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return "http://" + addr + "/book.epub"
+}
+
+// resetURL returns the url of a server which resets the connection halfway
+// through the body
+func resetURL(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 4096)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			conn.Read(buf)
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 100000\r\n\r\nonly the start")
+			conn.(*net.TCPConn).SetLinger(0) // close with a reset
+			conn.Close()
+		}
+	}()
+	return "http://" + ln.Addr().String() + "/book.epub"
+}
+
+func TestIsTransientNetwork(t *testing.T) {
+	urls := map[string]string{
+		"refused": refusedURL(t),
+		"reset":   resetURL(t),
+	}
+	client := resty.New()
+	defer client.Close()
+
+	for name, u := range urls {
+		t.Run(name+"/net/http", func(t *testing.T) {
+			resp, err := http.Get(u)
+			if err == nil {
+				_, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			if err == nil || !IsTransient(err) {
+				t.Fatalf("error %v is not transient", err)
+			}
+		})
+		t.Run(name+"/resty", func(t *testing.T) {
+			resp, err := client.R().SetDoNotParseResponse(true).Get(u)
+			if err == nil {
+				_, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			if err == nil || !IsTransient(err) {
+				t.Fatalf("error %v is not transient", err)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := time.Second, 10*time.Second
+	tests := []struct {
+		attempt int
+		want    time.Duration // before jitter
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		got := Backoff(tt.attempt, base, max)
+		if got < tt.want || got > tt.want+tt.want/10 {
+			t.Errorf("Backoff(%d) = %s, want %s plus up to 10%%", tt.attempt, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/roshanlc/send-to-kindle/internal/convert"
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/downloader"
+	"github.com/roshanlc/send-to-kindle/internal/submit"
+)
+
+// openAPIDoc describes the routes under /api/v1, keep it in sync with them
+//
+//go:embed openapi.yaml
+var openAPIDoc []byte
+
+const (
+	defaultPageSize = 50 // tasks listed when no limit is given
+	maxPageSize     = 200
+	maxBatchSize    = 50 // tasks created by one batch request
+	maxAPIBodySize  = 1 << 20
+)
+
+// taskStates are the states tasks can be filtered by
+var taskStates = []database.TaskState{database.Pending, database.Ongoing, database.Completed, database.Failed, database.Dead}
+
+// apiError is sent under "error" for failed api requests
+type apiError struct {
+	status  int
+	Code    string `json:"code"`    // stable, for scripts to check
+	Message string `json:"message"` // meant for people
+}
+
+// apiTaskRequest asks for a task downloading a url
+type apiTaskRequest struct {
+	URL        string `json:"url"`
+	Format     string `json:"format"` // epub or pdf, the preferred format of the devices when empty
+	ConvertPDF bool   `json:"convert_pdf"`
+	Devices    []int  `json:"devices"` // ids of devices of the user, the default ones when empty
+}
+
+// apiBatchResult is the outcome of one task of a batch, either Task or Error is set
+type apiBatchResult struct {
+	Task  *database.Task `json:"task,omitempty"`
+	Error *apiError      `json:"error,omitempty"`
+}
+
+// APIDocHandler serves the OpenAPI document of the api
+func (s *Server) APIDocHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPIDoc)
+}
+
+// APINotFoundHandler answers requests for unknown api routes
+func (s *Server) APINotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, "not_found", "There is no such api route.")
+}
+
+// APITaskListHandler returns a page of the tasks of the user, filtered by state and
+// searched by title, author and url
+func (s *Server) APITaskListHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := database.TaskFilter{
+		Search: strings.TrimSpace(query.Get("q")),
+		Limit:  defaultPageSize,
+	}
+	for _, value := range query["state"] {
+		for _, state := range strings.Split(value, ",") {
+			state := database.TaskState(strings.TrimSpace(state))
+			if !slices.Contains(taskStates, state) {
+				writeAPIError(w, http.StatusBadRequest, "invalid_state", fmt.Sprintf("State %q is not known.", state))
+				return
+			}
+			filter.States = append(filter.States, state)
+		}
+	}
+
+	var err error
+	if value := query.Get("limit"); value != "" {
+		filter.Limit, err = strconv.Atoi(value)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxPageSize {
+			writeAPIError(w, http.StatusBadRequest, "invalid_limit", fmt.Sprintf("Limit should be between 1 and %d.", maxPageSize))
+			return
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		filter.Offset, err = strconv.Atoi(value)
+		if err != nil || filter.Offset < 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_offset", "Offset should not be negative.")
+			return
+		}
+	}
+
+	tasks, total, err := s.DB.FindTasks(currentUser(r).ID, filter)
+	if err != nil {
+		slog.Error("error while fetching tasks list", slog.String("error", err.Error()))
+		writeAPIError(w, http.StatusInternalServerError, "internal", InternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"tasks":  tasks,
+		"total":  total,
+		"limit":  filter.Limit,
+		"offset": filter.Offset,
+	})
+}
+
+// APITaskCreateHandler adds a task for a url
+func (s *Server) APITaskCreateHandler(w http.ResponseWriter, r *http.Request) {
+	var req apiTaskRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	task, apiErr := s.createAPITask(currentUser(r).ID, req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr.status, apiErr.Code, apiErr.Message)
+		return
+	}
+	writeJSON(w, http.StatusCreated, task)
+}
+
+// APITaskBatchHandler adds a task for every url of the batch. The results are in the
+// order of the batch, a task failing does not stop the others.
+func (s *Server) APITaskBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Tasks []apiTaskRequest `json:"tasks"`
+	}
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	if len(req.Tasks) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "empty_batch", "Please provide atleast one task.")
+		return
+	}
+	if len(req.Tasks) > maxBatchSize {
+		writeAPIError(w, http.StatusBadRequest, "batch_too_large", fmt.Sprintf("Atmost %d tasks can be created at once.", maxBatchSize))
+		return
+	}
+
+	results := make([]apiBatchResult, 0, len(req.Tasks))
+	for _, taskReq := range req.Tasks {
+		task, apiErr := s.createAPITask(currentUser(r).ID, taskReq)
+		if apiErr != nil {
+			results = append(results, apiBatchResult{Error: apiErr})
+			continue
+		}
+		results = append(results, apiBatchResult{Task: &task})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"results": results})
+}
+
+// APITaskGetHandler returns a task of the user along with its parts
+func (s *Server) APITaskGetHandler(w http.ResponseWriter, r *http.Request) {
+	task, ok := s.pathAPITask(w, r)
+	if !ok {
+		return
+	}
+	s.writeAPITask(w, task.ID)
+}
+
+// APITaskCancelHandler cancels a pending task of the user
+func (s *Server) APITaskCancelHandler(w http.ResponseWriter, r *http.Request) {
+	task, ok := s.pathAPITask(w, r)
+	if !ok {
+		return
+	}
+	err := s.Submit.Cancel(task)
+	if errors.Is(err, submit.NotPendingErr) {
+		writeAPIError(w, http.StatusConflict, "not_pending", "Only pending tasks can be cancelled.")
+		return
+	}
+	if err != nil {
+		slog.Error("error while cancelling task", slog.String("taskID", task.ID), slog.String("error", err.Error()))
+		writeAPIError(w, http.StatusInternalServerError, "internal", InternalServerError)
+		return
+	}
+	s.writeAPITask(w, task.ID)
+}
+
+// APITaskRetryHandler queues a failed task of the user again
+func (s *Server) APITaskRetryHandler(w http.ResponseWriter, r *http.Request) {
+	task, ok := s.pathAPITask(w, r)
+	if !ok {
+		return
+	}
+	err := s.Submit.Retry(task)
+	switch {
+	case errors.Is(err, submit.NotRetryableErr):
+		writeAPIError(w, http.StatusConflict, "not_retryable", "Only failed tasks and books rejected by Amazon can be retried.")
+		return
+	case errors.Is(err, submit.UploadGoneErr):
+		writeAPIError(w, http.StatusConflict, "upload_gone", "The uploaded file is not kept anymore, please upload it again.")
+		return
+	case errors.Is(err, submit.NotQueuedErr):
+		// the task is failed again, it is returned as such
+	case err != nil:
+		slog.Error("error while retrying task", slog.String("taskID", task.ID), slog.String("error", err.Error()))
+		writeAPIError(w, http.StatusInternalServerError, "internal", InternalServerError)
+		return
+	}
+	s.writeAPITask(w, task.ID)
+}
+
+// APITaskDeleteHandler deletes a task of the user which is not being processed
+func (s *Server) APITaskDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	task, ok := s.pathAPITask(w, r)
+	if !ok {
+		return
+	}
+	if task.State == database.Ongoing {
+		writeAPIError(w, http.StatusConflict, "task_ongoing", "Tasks can't be deleted while they are processed.")
+		return
+	}
+
+	err := s.DB.DeleteTask(task.ID)
+	if errors.Is(err, database.ErrNoRowDeleted) {
+		// a worker took it up since it was fetched
+		writeAPIError(w, http.StatusConflict, "task_ongoing", "Tasks can't be deleted while they are processed.")
+		return
+	}
+	if err != nil {
+		slog.Error("error while deleting task", slog.String("taskID", task.ID), slog.String("error", err.Error()))
+		writeAPIError(w, http.StatusInternalServerError, "internal", InternalServerError)
+		return
+	}
+	if task.LocalFile != "" {
+		// workers skip deleted tasks, the file of a pending one is of no use anymore
+		err = downloader.DeleteUploadDirectory(task.ID)
+		if err != nil {
+			slog.Error("error while deleting uploaded file", slog.String("taskID", task.ID), slog.String("error", err.Error()))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APIDeviceListHandler returns the devices of the user
+func (s *Server) APIDeviceListHandler(w http.ResponseWriter, r *http.Request) {
+	devices, err := s.DB.ListDevices(currentUser(r).ID)
+	if err != nil {
+		slog.Error("error while fetching devices list", slog.String("error", err.Error()))
+		writeAPIError(w, http.StatusInternalServerError, "internal", InternalServerError)
+		return
+	}
+	if devices == nil {
+		devices = []database.Device{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"devices": devices})
+}
+
+// createAPITask adds a task for the request and returns it. A task which could not be
+// queued is returned too, it is kept as failed.
+func (s *Server) createAPITask(userID int, req apiTaskRequest) (database.Task, *apiError) {
+	target, err := convert.ParseTarget(req.Format)
+	if err != nil {
+		return database.Task{}, &apiError{http.StatusBadRequest, "invalid_format", "Target format should be epub or pdf."}
+	}
+
+	taskID, err := s.Submit.AddURL(strings.TrimSpace(req.URL), submit.Options{
+		TargetFormat: target,
+		ConvertPDF:   req.ConvertPDF,
+		UserID:       userID,
+		Devices:      req.Devices,
+	})
+	switch {
+	case errors.Is(err, submit.InvalidURLErr):
+		return database.Task{}, &apiError{http.StatusBadRequest, "invalid_url", "URL should be valid."}
+	case errors.Is(err, submit.UnknownDeviceErr):
+		return database.Task{}, &apiError{http.StatusBadRequest, "unknown_device", "Devices should be ids of your devices."}
+	case errors.Is(err, submit.NotQueuedErr):
+	case err != nil:
+		slog.Error("error while adding task", slog.String("error", err.Error()))
+		return database.Task{}, &apiError{http.StatusInternalServerError, "internal", InternalServerError}
+	}
+
+	task, err := s.DB.GetTask(taskID)
+	if err != nil {
+		slog.Error("error while fetching task", slog.String("taskID", taskID), slog.String("error", err.Error()))
+		return database.Task{}, &apiError{http.StatusInternalServerError, "internal", InternalServerError}
+	}
+	return task, nil
+}
+
+// pathAPITask returns the task of the user with the id in the path, the response is
+// written when there is none. Parts are only reachable through their task.
+func (s *Server) pathAPITask(w http.ResponseWriter, r *http.Request) (database.Task, bool) {
+	task, err := s.DB.GetTask(strings.TrimSpace(r.PathValue("id")))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.Error("error while fetching task", slog.String("taskID", r.PathValue("id")), slog.String("error", err.Error()))
+		writeAPIError(w, http.StatusInternalServerError, "internal", InternalServerError)
+		return database.Task{}, false
+	}
+	if err != nil || task.UserID != currentUser(r).ID || task.ParentID != "" {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Task could not be found.")
+		return database.Task{}, false
+	}
+	return task, true
+}
+
+// writeAPITask writes the current state of a task along with its parts
+func (s *Server) writeAPITask(w http.ResponseWriter, taskID string) {
+	task, err := s.DB.GetTask(taskID)
+	if err == nil {
+		task.Parts, err = s.DB.ListTaskParts(taskID)
+	}
+	if err != nil {
+		slog.Error("error while fetching task", slog.String("taskID", taskID), slog.String("error", err.Error()))
+		writeAPIError(w, http.StatusInternalServerError, "internal", InternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, task)
+}
+
+// decodeAPIRequest reads the json body of the request into v, the response is written
+// when it can't be read. Requiring json keeps plain html forms of other sites out.
+func decodeAPIRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		writeAPIError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "Request body should be application/json.")
+		return false
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodySize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", "Request body could not be read: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// writeJSON writes v as the json body of the response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Error("error while encoding api response", slog.String("error", err.Error()))
+	}
+}
+
+// writeAPIError writes an api error as the body of the response
+func writeAPIError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, map[string]apiError{"error": {Code: code, Message: message}})
+}
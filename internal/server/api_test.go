@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/database"
+)
+
+func TestAPITaskDelete(t *testing.T) {
+	s := newTestServer(t)
+	aliceID, alice := addTestUser(t, s.DB, "alice@example.com", time.Time{})
+	_, bob := addTestUser(t, s.DB, "bob@example.com", time.Time{})
+
+	// a split book, one of its parts was sent
+	tasks := []database.Task{
+		{ID: "c0ffee00-0000-4000-8000-000000000001", UserID: aliceID, URL: "https://example.com/big.epub", State: database.Failed},
+		{ID: "c0ffee00-0000-4000-8000-000000000002", UserID: aliceID, URL: "https://example.com/big.epub", State: database.Completed,
+			ParentID: "c0ffee00-0000-4000-8000-000000000001", Part: 1},
+		{ID: "c0ffee00-0000-4000-8000-000000000003", UserID: aliceID, URL: "https://example.com/big.epub", State: database.Pending,
+			ParentID: "c0ffee00-0000-4000-8000-000000000001", Part: 2},
+		{ID: "c0ffee00-0000-4000-8000-000000000004", UserID: aliceID, URL: "https://example.com/now.epub", State: database.Ongoing},
+	}
+	for _, task := range tasks {
+		if err := s.DB.AddTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		taskID string
+		status int
+	}{
+		{"task of another user", bob, tasks[0].ID, http.StatusNotFound},
+		{"part", alice, tasks[2].ID, http.StatusNotFound},
+		{"ongoing", alice, tasks[3].ID, http.StatusConflict},
+		{"split book", alice, tasks[0].ID, http.StatusNoContent},
+		{"deleted", alice, tasks[0].ID, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodDelete, "/api/v1/tasks/"+tt.taskID, nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			s.mux.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	var left int
+	if err := s.DB.Database.QueryRow(`SELECT COUNT(*) FROM tasks;`).Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 1 {
+		t.Fatalf("%d tasks are left, want only the ongoing one", left)
+	}
+}
@@ -1,9 +1,15 @@
 package server
 
 import (
+	"database/sql"
+	"errors"
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
+
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
 )
 
 // showLoginPageHandler returns login page html template
@@ -26,18 +32,42 @@ func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, InternalServerError, http.StatusInternalServerError)
 		return
 	}
-	user := strings.TrimSpace(r.Form.Get("username"))
-	pass := strings.TrimSpace(r.Form.Get("password"))
-
-	if user == s.Config.Username && pass == s.Config.Password {
-		session, _ := s.CookieStore.Get(r, "session")
-		session.Values["authenticated"] = true
-		session.Save(r, w)
-		http.Redirect(w, r, "/", http.StatusFound)
+	email := strings.TrimSpace(r.Form.Get("username"))
+	pass := r.Form.Get("password")
+
+	user, err := s.DB.GetUserByEmail(email)
+	switch {
+	case err == nil:
+		ok, err := helper.ComparePassword(user.Password, pass)
+		if err != nil {
+			slog.Error("error while comparing password", slog.Int("userID", user.ID), slog.String("error", err.Error()))
+			break
+		}
+		if ok && user.Disabled {
+			err = s.Templates.ExecuteTemplate(w, Pages["LoginPage"], "This account is disabled")
+			if err != nil {
+				slog.Error("error while excuting LoginPage template", slog.String("error", err.Error()))
+				http.Error(w, InternalServerError, http.StatusInternalServerError)
+			}
+			return
+		}
+		if ok {
+			session, _ := s.CookieStore.Get(r, "session")
+			session.Values["user_id"] = user.ID
+			session.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+	case errors.Is(err, sql.ErrNoRows) || email == "":
+		// take as long as a wrong password, so that the time doesn't tell which emails have accounts
+		_, _ = helper.ComparePassword(dummyHash(), pass)
+	default:
+		slog.Error("error while fetching user", slog.String("error", err.Error()))
+		http.Error(w, InternalServerError, http.StatusInternalServerError)
 		return
 	}
 
-	err = s.Templates.ExecuteTemplate(w, Pages["LoginPage"], "Invalid username or password")
+	err = s.Templates.ExecuteTemplate(w, Pages["LoginPage"], "Invalid email or password")
 	if err != nil {
 		slog.Error("error while excuting LoginPage template", slog.String("error", err.Error()))
 		http.Error(w, InternalServerError, http.StatusInternalServerError)
@@ -45,11 +75,38 @@ func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// dummyHash is compared against for logins of unknown users
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := helper.HashPassword("no user has this password")
+	return hash
+})
+
 // Logout handler
 func (s *Server) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := s.CookieStore.Get(r, "session")
-	session.Values["authenticated"] = false
+	delete(session.Values, "user_id")
 	session.Save(r, w)
 	w.Header().Set("HX-Redirect", "/login")
 	w.WriteHeader(http.StatusOK)
 }
+
+// ctxKey keys values put in request contexts
+type ctxKey string
+
+const (
+	ctxUserKey  ctxKey = "user"
+	ctxTokenKey ctxKey = "token" // api token the request was authenticated with, if any
+)
+
+// currentUser returns the logged in user, put in the request context by authMiddleware
+func currentUser(r *http.Request) database.User {
+	user, _ := r.Context().Value(ctxUserKey).(database.User)
+	return user
+}
+
+// viaAPIToken reports whether the request was authenticated with an api token instead
+// of the session cookie
+func viaAPIToken(r *http.Request) bool {
+	_, ok := r.Context().Value(ctxTokenKey).(database.APIToken)
+	return ok
+}
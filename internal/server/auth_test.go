@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/database/dbtest"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+)
+
+// newTestServer returns a server with its routes set up on a fresh database
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	db, _ := dbtest.New(t)
+	s := &Server{
+		DB:          db,
+		Templates:   template.Must(template.ParseGlob("../../templates/*.html")),
+		CookieStore: sessions.NewCookieStore([]byte("0123456789abcdef0123456789abcdef")),
+	}
+	s.setupRouter()
+	return s
+}
+
+// addTestUser adds a user with an api token expiring at expires, zero for never
+func addTestUser(t *testing.T, db *database.DB, email string, expires time.Time) (int, string) {
+	t.Helper()
+	userID, err := db.AddUser(database.User{Name: email, Email: email, Password: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := helper.GenerateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddAPIToken(database.APIToken{
+		UserID:    userID,
+		Name:      "script",
+		TokenHash: helper.HashAPIToken(secret),
+		Prefix:    secret[:8],
+		ExpiresAt: expires,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID, secret
+}
+
+// sessionCookie returns the session cookie of a logged in user
+func sessionCookie(t *testing.T, s *Server, userID int) *http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	session, _ := s.CookieStore.Get(r, "session")
+	session.Values["user_id"] = userID
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()[0]
+}
+
+func TestAPITokenAuth(t *testing.T) {
+	s := newTestServer(t)
+	_, valid := addTestUser(t, s.DB, "alice@example.com", time.Time{})
+	_, expired := addTestUser(t, s.DB, "bob@example.com", time.Now().Add(-time.Minute))
+	disabledID, disabled := addTestUser(t, s.DB, "carol@example.com", time.Now().Add(time.Hour))
+	if err := s.DB.SetUserDisabled(disabledID, true); err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := helper.GenerateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+		code   string // error code of the api, none when empty
+	}{
+		{"valid", "Bearer " + valid, http.StatusOK, ""},
+		{"expired", "Bearer " + expired, http.StatusUnauthorized, "invalid_token"},
+		{"unknown", "Bearer " + unknown, http.StatusUnauthorized, "invalid_token"},
+		{"other scheme", "Basic " + valid, http.StatusUnauthorized, "invalid_token"},
+		{"empty bearer", "Bearer ", http.StatusUnauthorized, "invalid_token"},
+		{"disabled user", "Bearer " + disabled, http.StatusUnauthorized, "unauthorized"},
+		{"no token", "", http.StatusUnauthorized, "unauthorized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/devices", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			s.mux.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var body struct {
+				Error struct {
+					Code string `json:"code"`
+				} `json:"error"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error.Code != tt.code {
+				t.Fatalf("error code %q, want %q", body.Error.Code, tt.code)
+			}
+		})
+	}
+
+	token, err := s.DB.GetAPITokenByHash(helper.HashAPIToken(valid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.LastUsedAt.IsZero() {
+		t.Error("last use of the token was not recorded")
+	}
+}
+
+func TestDashboardTokenAuth(t *testing.T) {
+	s := newTestServer(t)
+	userID, valid := addTestUser(t, s.DB, "alice@example.com", time.Time{})
+	_, expired := addTestUser(t, s.DB, "bob@example.com", time.Now().Add(-time.Minute))
+	disabledID, disabled := addTestUser(t, s.DB, "carol@example.com", time.Time{})
+	if err := s.DB.SetUserDisabled(disabledID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		cookie bool
+		status int
+	}{
+		{"valid token", http.MethodGet, "/devices", "Bearer " + valid, false, http.StatusOK},
+		{"expired token", http.MethodGet, "/devices", "Bearer " + expired, false, http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "/devices", "Bearer stk_unknown", false, http.StatusUnauthorized},
+		{"disabled user token", http.MethodGet, "/devices", "Bearer " + disabled, false, http.StatusMovedPermanently},
+		{"token lists tokens", http.MethodGet, "/tokens", "Bearer " + valid, false, http.StatusForbidden},
+		{"token adds a token", http.MethodPost, "/tokens", "Bearer " + valid, false, http.StatusForbidden},
+		{"token deletes a token", http.MethodDelete, "/tokens/1", "Bearer " + valid, false, http.StatusForbidden},
+		{"session lists tokens", http.MethodGet, "/tokens", "", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if tt.cookie {
+				r.AddCookie(sessionCookie(t, s, userID))
+			}
+			w := httptest.NewRecorder()
+			s.mux.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	tokens, err := s.DB.ListAPITokens(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 {
+		t.Fatalf("user has %d tokens after the blocked requests, want 1", len(tokens))
+	}
+}
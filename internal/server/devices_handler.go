@@ -0,0 +1,166 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/roshanlc/send-to-kindle/internal/convert"
+	"github.com/roshanlc/send-to-kindle/internal/database"
+)
+
+// DeviceListHandler returns the table of devices of the user
+func (s *Server) DeviceListHandler(w http.ResponseWriter, r *http.Request) {
+	s.execDevicesResponse(w, r, http.StatusOK, "", "")
+}
+
+// DeviceAddHandler adds a device for the user, the first one is made the default
+func (s *Server) DeviceAddHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	device, err := s.parseDevice(r, user.ID, 0)
+	if err != nil {
+		s.execDevicesResponse(w, r, http.StatusBadRequest, "", err.Error())
+		return
+	}
+
+	devices, err := s.DB.ListDevices(user.ID)
+	if err != nil {
+		slog.Error("error while fetching devices list", slog.String("error", err.Error()))
+		s.execDevicesResponse(w, r, http.StatusInternalServerError, "", InternalServerError)
+		return
+	}
+	device.IsDefault = device.IsDefault || len(devices) == 0
+
+	_, err = s.DB.AddDevice(device)
+	if err != nil {
+		slog.Error("error while adding device", slog.Int("userID", user.ID), slog.String("error", err.Error()))
+		s.execDevicesResponse(w, r, http.StatusInternalServerError, "", InternalServerError)
+		return
+	}
+	s.execDevicesResponse(w, r, http.StatusOK, fmt.Sprintf("Device %s added.", device.Name), "")
+}
+
+// DeviceUpdateHandler changes a device of the user
+func (s *Server) DeviceUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := s.pathDevice(w, r)
+	if !ok {
+		return
+	}
+	device, err := s.parseDevice(r, currentUser(r).ID, deviceID)
+	if err != nil {
+		s.execDevicesResponse(w, r, http.StatusBadRequest, "", err.Error())
+		return
+	}
+
+	err = s.DB.UpdateDevice(device)
+	if err != nil {
+		slog.Error("error while updating device", slog.Int("deviceID", deviceID), slog.String("error", err.Error()))
+		s.execDevicesResponse(w, r, http.StatusInternalServerError, "", InternalServerError)
+		return
+	}
+	s.execDevicesResponse(w, r, http.StatusOK, fmt.Sprintf("Device %s updated.", device.Name), "")
+}
+
+// DeviceDeleteHandler deletes a device of the user, tasks submitted for it are still sent to it
+func (s *Server) DeviceDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := s.pathDevice(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.DB.DeleteDevice(currentUser(r).ID, deviceID)
+	if err != nil {
+		slog.Error("error while deleting device", slog.Int("deviceID", deviceID), slog.String("error", err.Error()))
+		s.execDevicesResponse(w, r, http.StatusInternalServerError, "", InternalServerError)
+		return
+	}
+	s.execDevicesResponse(w, r, http.StatusOK, "Device deleted.", "")
+}
+
+// pathDevice returns the id in the path of a device of the user, the response is
+// written when there is no such device
+func (s *Server) pathDevice(w http.ResponseWriter, r *http.Request) (int, bool) {
+	deviceID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		s.execDevicesResponse(w, r, http.StatusNotFound, "", "Device could not be found.")
+		return 0, false
+	}
+	_, err = s.DB.GetDevice(currentUser(r).ID, deviceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.execDevicesResponse(w, r, http.StatusNotFound, "", "Device could not be found.")
+		return 0, false
+	}
+	if err != nil {
+		slog.Error("error while fetching device", slog.Int("deviceID", deviceID), slog.String("error", err.Error()))
+		s.execDevicesResponse(w, r, http.StatusInternalServerError, "", InternalServerError)
+		return 0, false
+	}
+	return deviceID, true
+}
+
+// parseDevice reads and checks the device in the form, deviceID is 0 for new devices
+func (s *Server) parseDevice(r *http.Request, userID, deviceID int) (database.Device, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return database.Device{}, fmt.Errorf("Form could not be read.")
+	}
+
+	device := database.Device{
+		ID:        deviceID,
+		UserID:    userID,
+		Name:      strings.TrimSpace(r.Form.Get("name")),
+		Email:     strings.TrimSpace(r.Form.Get("email")),
+		IsDefault: r.Form.Get("default") != "",
+	}
+	target, err := convert.ParseTarget(r.Form.Get("format"))
+	if err != nil {
+		return database.Device{}, fmt.Errorf("Preferred format should be epub or pdf.")
+	}
+	device.Format = string(target)
+
+	if device.Name == "" {
+		return database.Device{}, fmt.Errorf("Device name should not be empty.")
+	}
+	if _, err := mail.ParseAddress(device.Email); err != nil {
+		return database.Device{}, fmt.Errorf("%s is not a valid email address.", device.Email)
+	}
+
+	devices, err := s.DB.ListDevices(userID)
+	if err != nil {
+		slog.Error("error while fetching devices list", slog.String("error", err.Error()))
+		return database.Device{}, errors.New(InternalServerError)
+	}
+	for _, other := range devices {
+		if other.ID != deviceID && strings.EqualFold(other.Name, device.Name) {
+			return database.Device{}, fmt.Errorf("You already have a device named %s.", other.Name)
+		}
+	}
+	return device, nil
+}
+
+// execDevicesResponse renders the table of devices with a message about the last change,
+// along with the device picker of the submit forms
+func (s *Server) execDevicesResponse(w http.ResponseWriter, r *http.Request, status int, message string, errMsg string) {
+	devices, err := s.DB.ListDevices(currentUser(r).ID)
+	if err != nil {
+		slog.Error("error while fetching devices list", slog.String("error", err.Error()))
+	}
+
+	w.WriteHeader(status)
+	err = s.Templates.ExecuteTemplate(w, Pages["DevicesListPage"], map[string]any{
+		"Devices": devices,
+		"OOB":     true,
+		"message": message,
+		"error":   errMsg,
+	})
+	if err != nil {
+		slog.Error("error while excuting devices-list template", slog.String("error", err.Error()))
+		http.Error(w, InternalServerError, http.StatusInternalServerError)
+		return
+	}
+}
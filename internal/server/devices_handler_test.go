@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/database"
+)
+
+func TestDevices(t *testing.T) {
+	s := newTestServer(t)
+	aliceID, _ := addTestUser(t, s.DB, "alice@example.com", time.Time{})
+	alice := sessionCookie(t, s, aliceID)
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		status int
+	}{
+		{"first", url.Values{"name": {"Paperwhite"}, "email": {"alice@kindle.com"}}, http.StatusOK},
+		{"second", url.Values{"name": {"Scribe"}, "email": {"scribe@kindle.com"}, "format": {"pdf"}}, http.StatusOK},
+		{"taken name", url.Values{"name": {"scribe"}, "email": {"other@kindle.com"}}, http.StatusBadRequest},
+		{"no name", url.Values{"name": {" "}, "email": {"other@kindle.com"}}, http.StatusBadRequest},
+		{"invalid email", url.Values{"name": {"Oasis"}, "email": {"nope"}}, http.StatusBadRequest},
+		{"unknown format", url.Values{"name": {"Oasis"}, "email": {"oasis@kindle.com"}, "format": {"mobi"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(s, alice, http.MethodPost, "/devices", tt.form); w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	devices, err := s.DB.ListDevices(aliceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || !devices[0].IsDefault || devices[1].IsDefault || devices[1].Format != "pdf" {
+		t.Fatalf("alice has devices %+v, want the first one as default", devices)
+	}
+	scribe := "/devices/" + strconv.Itoa(devices[1].ID)
+
+	w := serve(s, alice, http.MethodPost, scribe, url.Values{"name": {"Scribe"}, "email": {"scribe@kindle.com"}, "default": {"1"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: status %d: %s", w.Code, w.Body)
+	}
+	if defaults, err := s.DB.ListDefaultDevices(aliceID); err != nil || len(defaults) != 2 {
+		t.Fatalf("alice has default devices %v, %v", defaults, err)
+	}
+	if w := serve(s, alice, http.MethodDelete, scribe, nil); w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body)
+	}
+	if w := serve(s, alice, http.MethodDelete, scribe, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("deleting again: status %d", w.Code)
+	}
+}
+
+func TestDevicesOfOtherUsers(t *testing.T) {
+	s := newTestServer(t)
+	withSubmit(t, s)
+	aliceID, _ := addTestUser(t, s.DB, "alice@example.com", time.Time{})
+	bobID, bobToken := addTestUser(t, s.DB, "bob@example.com", time.Time{})
+	bob := sessionCookie(t, s, bobID)
+	paperwhite := database.Device{UserID: aliceID, Name: "Paperwhite", Email: "alice@kindle.com", IsDefault: true}
+	var err error
+	paperwhite.ID, err = s.DB.AddDevice(paperwhite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/devices/" + strconv.Itoa(paperwhite.ID)
+
+	// bob can't see, change or use the device of alice
+	if w := serve(s, bob, http.MethodGet, "/devices", nil); strings.Contains(w.Body.String(), paperwhite.Email) {
+		t.Error("the devices of bob show the one of alice")
+	}
+	if w := serve(s, bob, http.MethodPost, path, url.Values{"name": {"Mine"}, "email": {"bob@kindle.com"}}); w.Code != http.StatusNotFound {
+		t.Errorf("bob changing the device of alice got status %d", w.Code)
+	}
+	if w := serve(s, bob, http.MethodDelete, path, nil); w.Code != http.StatusNotFound {
+		t.Errorf("bob deleting the device of alice got status %d", w.Code)
+	}
+	form := url.Values{"url": {"https://example.com/book.epub"}, "device": {strconv.Itoa(paperwhite.ID)}}
+	if w := serve(s, bob, http.MethodPost, "/submit", form); w.Code != http.StatusBadRequest {
+		t.Errorf("bob sending to the device of alice got status %d", w.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/tasks", strings.NewReader(`{"url":"https://example.com/book.epub","devices":[`+strconv.Itoa(paperwhite.ID)+`]}`))
+	r.Header.Set("Authorization", "Bearer "+bobToken)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bob sending to the device of alice through the api got status %d: %s", w.Code, w.Body)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/devices", nil)
+	r.Header.Set("Authorization", "Bearer "+bobToken)
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	var body struct {
+		Devices []database.Device `json:"devices"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Devices) != 0 {
+		t.Errorf("the api lists devices %v for bob", body.Devices)
+	}
+
+	device, err := s.DB.GetDevice(aliceID, paperwhite.ID)
+	paperwhite.AddedAt = device.AddedAt
+	if err != nil || device != paperwhite {
+		t.Fatalf("device of alice is %+v, %v after the requests of bob", device, err)
+	}
+	var tasks int
+	if err := s.DB.Database.QueryRow(`SELECT COUNT(*) FROM tasks;`).Scan(&tasks); err != nil {
+		t.Fatal(err)
+	}
+	if tasks != 0 {
+		t.Fatalf("%d tasks were added", tasks)
+	}
+}
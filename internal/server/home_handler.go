@@ -5,11 +5,17 @@ import (
 	"net/http"
 )
 
-// HomeHandler serves the homepage (dashboard)
+// HomeHandler serves the homepage (dashboard) of the logged in user
 func (s *Server) HomeHandler(w http.ResponseWriter, r *http.Request) {
+	devices, err := s.DB.ListDevices(currentUser(r).ID)
+	if err != nil {
+		slog.Error("error while fetching devices list", slog.String("error", err.Error()))
+	}
+
 	w.WriteHeader(http.StatusOK)
-	err := s.Templates.ExecuteTemplate(w, Pages["HomePage"], map[string]any{
-		"SendTo": s.Config.SmtpTo,
+	err = s.Templates.ExecuteTemplate(w, Pages["HomePage"], map[string]any{
+		"Devices": devices,
+		"IsAdmin": currentUser(r).IsAdmin,
 	})
 	if err != nil {
 		slog.Error("error while excuting home template", slog.String("error", err.Error()))
@@ -1,9 +1,16 @@
 package server
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"log/slog"
 	"net/http"
 	"runtime/debug"
+	"strings"
+
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
 )
 
 var allowedOrigins = []string{
@@ -28,25 +35,139 @@ func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		// 	next.ServeHTTP(w, r)
 		// 	return
 		// }
-		session, err := s.CookieStore.Get(r, "session")
-
+		ctx, user, err := s.requestUser(r)
+		if errors.Is(err, errInvalidToken) {
+			// token clients can't follow the redirect to the login page
+			http.Error(w, "Invalid or expired API token.", http.StatusUnauthorized)
+			return
+		}
 		if err != nil {
-			slog.Error("error while excuting checking sessions", slog.String("error", err.Error()))
 			http.Error(w, InternalServerError, http.StatusInternalServerError)
 			return
 		}
 
-		auth, ok := session.Values["authenticated"].(bool)
-		if (!ok || !auth) && r.URL.Path == "/login" {
+		auth := user.ID != 0 && !user.Disabled
+		if !auth && r.URL.Path == "/login" {
 			// if not logged in and hits login page, go to login page
 			next.ServeHTTP(w, r)
 			return
-		} else if !ok || !auth {
+		} else if !auth {
 			http.Redirect(w, r, "/login", http.StatusMovedPermanently)
 			return
-		} else if auth && ok && r.URL.Path == "/login" {
+		} else if r.URL.Path == "/login" {
 			// if  logged in and hits login page, go to home page
 			http.Redirect(w, r, "/", http.StatusPermanentRedirect)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(ctx, ctxUserKey, user)))
+	}
+}
+
+// errInvalidToken is returned for bearer tokens which are unknown or expired
+var errInvalidToken = errors.New("invalid api token")
+
+// requestUser returns the user of the bearer token of the request, or of the session
+// cookie when there is no Authorization header, along with the request context carrying
+// the token. The user is the zero user when there is none.
+func (s *Server) requestUser(r *http.Request) (context.Context, database.User, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		user, err := s.sessionUser(r)
+		return r.Context(), user, err
+	}
+
+	scheme, secret, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(secret) == "" {
+		return nil, database.User{}, errInvalidToken
+	}
+	token, err := s.DB.GetAPITokenByHash(helper.HashAPIToken(strings.TrimSpace(secret)))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && token.Expired()) {
+		return nil, database.User{}, errInvalidToken
+	}
+	if err != nil {
+		slog.Error("error while fetching api token", slog.String("error", err.Error()))
+		return nil, database.User{}, err
+	}
+
+	user, err := s.DB.GetUserByID(token.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, database.User{}, errInvalidToken
+	}
+	if err != nil {
+		slog.Error("error while fetching token user", slog.Int("userID", token.UserID), slog.String("error", err.Error()))
+		return nil, database.User{}, err
+	}
+
+	err = s.DB.TouchAPIToken(token)
+	if err != nil {
+		slog.Error("error while updating api token last use", slog.Int("tokenID", token.ID), slog.String("error", err.Error()))
+	}
+	return context.WithValue(r.Context(), ctxTokenKey, token), user, nil
+}
+
+// sessionUser returns the user logged in with the session cookie of the request, the
+// zero user if there is none. The user is looked up on every request, so deleted and
+// disabled users are logged out.
+func (s *Server) sessionUser(r *http.Request) (database.User, error) {
+	session, err := s.CookieStore.Get(r, "session")
+	if err != nil {
+		slog.Error("error while excuting checking sessions", slog.String("error", err.Error()))
+		return database.User{}, err
+	}
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		return database.User{}, nil
+	}
+	user, err := s.DB.GetUserByID(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, nil
+	}
+	if err != nil {
+		slog.Error("error while fetching session user", slog.Int("userID", userID), slog.String("error", err.Error()))
+		return database.User{}, err
+	}
+	return user, nil
+}
+
+// apiAuthMiddleware protects the api routes like authMiddleware, it answers with an api
+// error instead of redirecting to the login page
+func (s *Server) apiAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, user, err := s.requestUser(r)
+		if errors.Is(err, errInvalidToken) {
+			writeAPIError(w, http.StatusUnauthorized, "invalid_token", "The API token is not valid or has expired.")
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal", InternalServerError)
+			return
+		}
+		if user.ID == 0 || user.Disabled {
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized", "Please log in or use an API token.")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(ctx, ctxUserKey, user)))
+	}
+}
+
+// adminMiddleware lets only admins through, it runs after authMiddleware
+func (s *Server) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !currentUser(r).IsAdmin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// sessionOnlyMiddleware keeps api tokens from managing tokens, it runs after authMiddleware
+func (s *Server) sessionOnlyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if viaAPIToken(r) {
+			http.Error(w, "API tokens can only be managed from the dashboard.", http.StatusForbidden)
+			return
 		}
 		next(w, r)
 	}
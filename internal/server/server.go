@@ -1,24 +1,31 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/gorilla/sessions"
 	"github.com/roshanlc/send-to-kindle/config"
 	"github.com/roshanlc/send-to-kindle/internal/database"
 	"github.com/roshanlc/send-to-kindle/internal/queue"
+	"github.com/roshanlc/send-to-kindle/internal/submit"
 )
 
 type Server struct {
 	Config      *config.ServerConfig  // reference to a server configuration
 	DB          *database.DB          // reference to a db instance
 	Templates   *template.Template    // templates
-	TaskQueue   *queue.TaskQueue      // Queue
+	TaskQueue   queue.Queue           // Queue
+	Submit      *submit.Service       // adds tasks to the db and the queue
 	mux         *http.ServeMux        // multiplexer
+	httpServer  *http.Server          // underlying http server
+	setupOnce   sync.Once             // guards router and http server setup
 	CookieStore *sessions.CookieStore // cookie store
 }
 
@@ -29,6 +36,11 @@ var Pages = map[string]string{
 	"SubmitPage":       "submit-form.html",
 	"SubmitResultPage": "submit-result.html",
 	"LoginPage":        "login.html",
+	"AdminUsersPage":   "admin-users.html",
+	"UsersListPage":    "users-list.html",
+	"DevicesListPage":  "devices-list.html",
+	"DevicePicker":     "device-picker.html",
+	"TokensListPage":   "tokens-list.html",
 }
 
 const (
@@ -49,6 +61,9 @@ func (s *Server) Verify() error {
 	if err := s.DB.Database.Ping(); err != nil {
 		return fmt.Errorf("Database ping failed: %w", err)
 	}
+	if s.TaskQueue == nil || s.Submit == nil {
+		return fmt.Errorf("TaskQueue and Submit references should be non-nil")
+	}
 	if s.Templates == nil {
 		return fmt.Errorf("Tempaltes reference should be non-nil")
 	}
@@ -78,22 +93,69 @@ func (s *Server) setupRouter() {
 	mux.HandleFunc("GET /", s.panicMiddleware(s.authMiddleware(s.HomeHandler)))
 	mux.HandleFunc("GET /history", s.panicMiddleware(s.authMiddleware(s.TaskListHandler)))
 	mux.HandleFunc("POST /submit", s.panicMiddleware(s.authMiddleware(s.TaskAddHandler)))
+	mux.HandleFunc("POST /upload", s.panicMiddleware(s.authMiddleware(s.TaskUploadHandler)))
 	mux.HandleFunc("DELETE /history/clear", s.panicMiddleware(s.authMiddleware(s.TaskRemoveCompletedHandler)))
 	mux.HandleFunc("POST /tasks/{id}", s.panicMiddleware(s.authMiddleware(s.TaskCancelHandler)))
+	mux.HandleFunc("GET /tasks/{id}/cover", s.panicMiddleware(s.authMiddleware(s.TaskCoverHandler)))
+	mux.HandleFunc("GET /devices", s.panicMiddleware(s.authMiddleware(s.DeviceListHandler)))
+	mux.HandleFunc("POST /devices", s.panicMiddleware(s.authMiddleware(s.DeviceAddHandler)))
+	mux.HandleFunc("POST /devices/{id}", s.panicMiddleware(s.authMiddleware(s.DeviceUpdateHandler)))
+	mux.HandleFunc("DELETE /devices/{id}", s.panicMiddleware(s.authMiddleware(s.DeviceDeleteHandler)))
+	mux.HandleFunc("GET /tokens", s.panicMiddleware(s.authMiddleware(s.sessionOnlyMiddleware(s.TokenListHandler))))
+	mux.HandleFunc("POST /tokens", s.panicMiddleware(s.authMiddleware(s.sessionOnlyMiddleware(s.TokenAddHandler))))
+	mux.HandleFunc("DELETE /tokens/{id}", s.panicMiddleware(s.authMiddleware(s.sessionOnlyMiddleware(s.TokenDeleteHandler))))
+	mux.HandleFunc("GET /admin/users", s.panicMiddleware(s.authMiddleware(s.adminMiddleware(s.AdminUsersHandler))))
+	mux.HandleFunc("GET /admin/users/list", s.panicMiddleware(s.authMiddleware(s.adminMiddleware(s.UserListHandler))))
+	mux.HandleFunc("POST /admin/users", s.panicMiddleware(s.authMiddleware(s.adminMiddleware(s.UserAddHandler))))
+	mux.HandleFunc("POST /admin/users/{id}", s.panicMiddleware(s.authMiddleware(s.adminMiddleware(s.UserUpdateHandler))))
+	mux.HandleFunc("POST /admin/users/{id}/{action}", s.panicMiddleware(s.authMiddleware(s.adminMiddleware(s.UserDisableHandler))))
+	mux.HandleFunc("DELETE /admin/users/{id}", s.panicMiddleware(s.authMiddleware(s.adminMiddleware(s.UserDeleteHandler))))
+
+	// json api for scripts, documented in openapi.yaml
+	mux.HandleFunc("GET /api/v1/openapi.yaml", s.panicMiddleware(s.APIDocHandler))
+	mux.HandleFunc("GET /api/v1/tasks", s.panicMiddleware(s.apiAuthMiddleware(s.APITaskListHandler)))
+	mux.HandleFunc("POST /api/v1/tasks", s.panicMiddleware(s.apiAuthMiddleware(s.APITaskCreateHandler)))
+	mux.HandleFunc("POST /api/v1/tasks/batch", s.panicMiddleware(s.apiAuthMiddleware(s.APITaskBatchHandler)))
+	mux.HandleFunc("GET /api/v1/tasks/{id}", s.panicMiddleware(s.apiAuthMiddleware(s.APITaskGetHandler)))
+	mux.HandleFunc("POST /api/v1/tasks/{id}/cancel", s.panicMiddleware(s.apiAuthMiddleware(s.APITaskCancelHandler)))
+	mux.HandleFunc("POST /api/v1/tasks/{id}/retry", s.panicMiddleware(s.apiAuthMiddleware(s.APITaskRetryHandler)))
+	mux.HandleFunc("DELETE /api/v1/tasks/{id}", s.panicMiddleware(s.apiAuthMiddleware(s.APITaskDeleteHandler)))
+	mux.HandleFunc("GET /api/v1/devices", s.panicMiddleware(s.apiAuthMiddleware(s.APIDeviceListHandler)))
+	for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
+		mux.HandleFunc(method+" /api/v1/", s.panicMiddleware(s.APINotFoundHandler))
+	}
 
 	s.mux = mux
 }
 
+// setup prepares the router and the http server, only once
+func (s *Server) setup() {
+	s.setupOnce.Do(func() {
+		// setup routes and stuff
+		slog.Info("setting up router")
+		s.setupRouter()
+
+		s.httpServer = &http.Server{
+			Addr:    ":" + s.Config.ServerPort,
+			Handler: s.mux,
+		}
+	})
+}
+
 func (s *Server) Start() {
-	// setup routes and stuff
-	slog.Info("setting up router")
-	s.setupRouter()
+	s.setup()
 
 	slog.Info("starting server...", slog.String("port", s.Config.ServerPort))
 	// start the server
-	err := http.ListenAndServe(":"+s.Config.ServerPort, s.mux)
-	if err != nil {
+	err := s.httpServer.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		slog.Error("error while starting server", slog.String("error", err.Error()))
 		return
 	}
 }
+
+// Shutdown gracefully stops the server
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.setup()
+	return s.httpServer.Shutdown(ctx)
+}
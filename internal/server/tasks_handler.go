@@ -1,22 +1,26 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 
-	"github.com/google/uuid"
+	"github.com/roshanlc/send-to-kindle/internal/convert"
 	"github.com/roshanlc/send-to-kindle/internal/database"
-	"github.com/roshanlc/send-to-kindle/internal/helper"
-	"github.com/roshanlc/send-to-kindle/internal/queue"
+	"github.com/roshanlc/send-to-kindle/internal/downloader"
+	"github.com/roshanlc/send-to-kindle/internal/format"
+	"github.com/roshanlc/send-to-kindle/internal/submit"
 )
 
-// TaskListHandler returns a list of tasks with details
+// TaskListHandler returns a list of the tasks of the user with details
 func (s *Server) TaskListHandler(w http.ResponseWriter, r *http.Request) {
 
 	var tasks []database.Task
 	// data from history
-	tasks, err := s.DB.ListTask([]database.TaskState{})
+	tasks, err := s.DB.ListTask(currentUser(r).ID, []database.TaskState{})
 
 	if err != nil {
 		slog.Error("error while fetching tasks list", slog.String("error", err.Error()))
@@ -35,7 +39,6 @@ func (s *Server) TaskListHandler(w http.ResponseWriter, r *http.Request) {
 func (s *Server) TaskAddHandler(w http.ResponseWriter, r *http.Request) {
 	var isValid bool = true
 	var errMsg string
-	var taskID uuid.UUID
 	values := map[string]any{}
 	// form parsing
 	err := r.ParseForm()
@@ -60,6 +63,27 @@ func (s *Server) TaskAddHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	target, err := convert.ParseTarget(r.Form.Get("format"))
+	if err != nil {
+		values["isValid"] = false
+		values["error"] = "Target format should be epub or pdf."
+		w.WriteHeader(http.StatusBadRequest)
+		s.execSubmitResponse(values, w, r)
+		return
+	}
+
+	// PDFs are sent with the convert subject when asked for
+	convertPDF := r.Form.Get("convert") != ""
+
+	devices, err := formDevices(r)
+	if err != nil {
+		values["isValid"] = false
+		values["error"] = "Please pick devices from the list."
+		w.WriteHeader(http.StatusBadRequest)
+		s.execSubmitResponse(values, w, r)
+		return
+	}
+
 	// TODO: also verify url thoroughly
 
 	urls := strings.Split(url, ",")
@@ -67,7 +91,17 @@ func (s *Server) TaskAddHandler(w http.ResponseWriter, r *http.Request) {
 
 	for _, u := range urls {
 		u := strings.TrimSpace(u)
-		if !helper.IsURLValid(u) {
+
+		// task additon to db and then to queue
+		taskID, err := s.Submit.AddURL(u, submit.Options{TargetFormat: target, ConvertPDF: convertPDF, UserID: currentUser(r).ID, Devices: devices})
+		switch {
+		case errors.Is(err, submit.UnknownDeviceErr):
+			values["isValid"] = false
+			values["error"] = "Please pick devices from the list."
+			w.WriteHeader(http.StatusBadRequest)
+			s.execSubmitResponse(values, w, r)
+			return
+		case errors.Is(err, submit.InvalidURLErr):
 			errMsg = "URL input should be valid."
 			isValid = false
 			values["isValid"] = isValid
@@ -75,34 +109,20 @@ func (s *Server) TaskAddHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 			s.execSubmitResponse(values, w, r)
 			return
-		}
-
-		// task additon to db and then to queue
-
-		// generate new id
-		taskID = helper.GenerateID()
-
-		// add to database
-		err = s.DB.AddTask(database.Task{
-			ID:    taskID.String(),  // id of the task
-			URL:   u,                // url of task
-			State: database.Pending, // state of task
-		})
-
-		var task queue.Task
-		if err != nil {
+		case errors.Is(err, submit.NotQueuedErr):
 			isValid = false
-			slog.Error("error while adding task to db", slog.String("error", err.Error()))
+			errMsg = "Task could not be queued."
+			continue
+		case err != nil:
+			isValid = false
+			slog.Error("error while adding task", slog.String("error", err.Error()))
 			w.WriteHeader(http.StatusInternalServerError)
 			values["isValid"] = isValid
 			values["error"] = errMsg
 			s.execSubmitResponse(values, w, r)
 			continue
 		}
-		task = queue.NewTask(taskID, u)
-		// enqueue the task
-		s.TaskQueue.Enqueue(task)
-		tIDs = append(tIDs, taskID.String())
+		tIDs = append(tIDs, taskID)
 	}
 	values["isValid"] = isValid
 	values["error"] = errMsg
@@ -111,6 +131,102 @@ func (s *Server) TaskAddHandler(w http.ResponseWriter, r *http.Request) {
 	s.execSubmitResponse(values, w, r)
 }
 
+// maxUploadFiles caps the books uploaded in one request
+const maxUploadFiles = 10
+
+// TaskUploadHandler adds a task for every uploaded book, the books skip the downloader
+func (s *Server) TaskUploadHandler(w http.ResponseWriter, r *http.Request) {
+	values := map[string]any{}
+	fail := func(status int, errMsg string) {
+		values["isValid"] = false
+		values["error"] = errMsg
+		w.WriteHeader(status)
+		s.execSubmitResponse(values, w, r)
+	}
+
+	// the size of every file is checked when it is saved, this bounds the request
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadFiles*(s.Config.MaxUploadSize+1<<20))
+	err := r.ParseMultipartForm(32 << 20) // larger files are buffered on disk
+	if err != nil {
+		fail(http.StatusBadRequest, "Upload could not be read, it may be too large.")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		fail(http.StatusBadRequest, "Please choose a file to upload.")
+		return
+	}
+	if len(files) > maxUploadFiles {
+		fail(http.StatusBadRequest, fmt.Sprintf("Atmost %d files can be uploaded at once.", maxUploadFiles))
+		return
+	}
+
+	target, err := convert.ParseTarget(r.FormValue("format"))
+	if err != nil {
+		fail(http.StatusBadRequest, "Target format should be epub or pdf.")
+		return
+	}
+	devices, err := formDevices(r)
+	if err != nil {
+		fail(http.StatusBadRequest, "Please pick devices from the list.")
+		return
+	}
+	opts := submit.Options{TargetFormat: target, ConvertPDF: r.FormValue("convert") != "", UserID: currentUser(r).ID, Devices: devices}
+
+	var errMsgs []string
+	tIDs := make([]string, 0, len(files))
+	for _, header := range files {
+		file, err := header.Open()
+		if err != nil {
+			errMsgs = append(errMsgs, header.Filename+": could not be read.")
+			continue
+		}
+		taskID, err := s.Submit.AddFile(header.Filename, file, opts)
+		file.Close()
+		switch {
+		case errors.Is(err, format.UnsupportedFormatErr), errors.Is(err, downloader.UploadTooLargeErr):
+			errMsgs = append(errMsgs, header.Filename+": "+err.Error()+".")
+			continue
+		case errors.Is(err, submit.UnknownDeviceErr):
+			fail(http.StatusBadRequest, "Please pick devices from the list.")
+			return
+		case errors.Is(err, submit.NotQueuedErr):
+			errMsgs = append(errMsgs, header.Filename+": task could not be queued.")
+			continue
+		case err != nil:
+			slog.Error("error while adding upload task", slog.String("filename", header.Filename), slog.String("error", err.Error()))
+			errMsgs = append(errMsgs, header.Filename+": something went wrong.")
+			continue
+		}
+		tIDs = append(tIDs, taskID)
+	}
+
+	if len(tIDs) == 0 {
+		fail(http.StatusBadRequest, strings.Join(errMsgs, " "))
+		return
+	}
+	values["isValid"] = len(errMsgs) == 0
+	values["error"] = strings.Join(errMsgs, " ")
+	values["taskID"] = tIDs
+	w.WriteHeader(http.StatusOK)
+	s.execSubmitResponse(values, w, r)
+}
+
+// formDevices returns the ids of the devices picked in the form, none for the default ones
+func formDevices(r *http.Request) ([]int, error) {
+	var devices []int
+	for _, value := range r.Form["device"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, id)
+	}
+	return devices, nil
+}
+
 func (s *Server) execSubmitResponse(values map[string]any, w http.ResponseWriter, r *http.Request) {
 	err := s.Templates.ExecuteTemplate(w, Pages["SubmitResultPage"], values)
 	if err != nil {
@@ -120,9 +236,9 @@ func (s *Server) execSubmitResponse(values map[string]any, w http.ResponseWriter
 	}
 }
 
-// TaskAddHandler removes completed tasks from history
+// TaskAddHandler removes completed tasks of the user from history
 func (s *Server) TaskRemoveCompletedHandler(w http.ResponseWriter, r *http.Request) {
-	err := s.DB.DeleteCompletedTasks()
+	err := s.DB.DeleteCompletedTasks(currentUser(r).ID)
 	if err != nil {
 		slog.Error("error while deleting completed tasks", slog.String("error", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
@@ -145,24 +261,20 @@ func (s *Server) TaskCancelHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	t, err := s.DB.GetTask(taskID)
-	if err != nil {
+	if err != nil || t.UserID != currentUser(r).ID {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("please provide a valid taskID"))
 		return
 	}
 
-	if t.State != database.Pending {
+	err = s.Submit.Cancel(t)
+	if errors.Is(err, submit.NotPendingErr) {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("please provide a valid taskID"))
 		return
 	}
-
-	t.State = database.Failed
-	t.ErrorMsg = "Task cancelled by user"
-
-	err = s.DB.UpdateTask(t)
 	if err != nil {
-		slog.Error("error while updating task status to cancelled(failed)", slog.String("taskID", taskID))
+		slog.Error("error while cancelling task", slog.String("taskID", taskID), slog.String("error", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("something went wrong"))
 		return
@@ -171,3 +283,25 @@ func (s *Server) TaskCancelHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Task cancelled successfully."))
 }
+
+// TaskCoverHandler serves the cover thumbnail of a task
+func (s *Server) TaskCoverHandler(w http.ResponseWriter, r *http.Request) {
+	taskID := strings.TrimSpace(r.PathValue("id"))
+
+	t, err := s.DB.GetTask(taskID)
+	if err != nil || t.UserID != currentUser(r).ID {
+		http.NotFound(w, r)
+		return
+	}
+
+	cover, coverType, err := s.DB.GetTaskCover(taskID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", coverType)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+	w.Write(cover)
+}
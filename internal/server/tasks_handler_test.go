@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/config"
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/downloader"
+	"github.com/roshanlc/send-to-kindle/internal/queue"
+	"github.com/roshanlc/send-to-kindle/internal/submit"
+)
+
+var testPDF = []byte("%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\ntrailer\n<< /Root 1 0 R >>\n%%EOF\n")
+
+// withSubmit lets the server add tasks, uploads are kept in a temporary directory
+func withSubmit(t *testing.T, s *Server) {
+	t.Helper()
+	downloader.SetDownloadDirectory(t.TempDir())
+	q, err := queue.NewSQLiteQueue(s.DB.Database, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Config = &config.ServerConfig{MaxUploadSize: 1 << 20}
+	s.Submit = submit.NewService(s.DB, q, s.Config.MaxUploadSize)
+}
+
+// upload posts the files, by name, to the upload form along with the picked devices
+func upload(t *testing.T, s *Server, cookie *http.Cookie, files map[string][]byte, devices ...int) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, data := range files {
+		part, err := form.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	for _, device := range devices {
+		form.WriteField("device", strconv.Itoa(device))
+	}
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestTaskUpload(t *testing.T) {
+	s := newTestServer(t)
+	withSubmit(t, s)
+	aliceID, _ := addTestUser(t, s.DB, "alice@example.com", time.Time{})
+	bobID, _ := addTestUser(t, s.DB, "bob@example.com", time.Time{})
+	alice, bob := sessionCookie(t, s, aliceID), sessionCookie(t, s, bobID)
+	scribe, err := s.DB.AddDevice(database.Device{UserID: aliceID, Name: "Scribe", Email: "scribe@kindle.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobsKindle, err := s.DB.AddDevice(database.Device{UserID: bobID, Name: "Kindle", Email: "bob@kindle.com", IsDefault: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		files   map[string][]byte
+		devices []int
+		status  int
+		sendTo  []string // addresses of the added tasks, none when nothing is added
+	}{
+		{"book", map[string][]byte{"book.pdf": testPDF}, []int{scribe}, http.StatusOK, []string{"scribe@kindle.com"}},
+		{"device of another user", map[string][]byte{"book.pdf": testPDF}, []int{bobsKindle}, http.StatusBadRequest, nil},
+		{"unsupported file", map[string][]byte{"notes.txt": {0, 1, 2, 3}}, nil, http.StatusBadRequest, nil},
+		{"too large", map[string][]byte{"big.pdf": append(testPDF, make([]byte, 1<<20)...)}, []int{scribe}, http.StatusBadRequest, nil},
+		{"no file", nil, nil, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, _, err := s.DB.FindTasks(aliceID, database.TaskFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := upload(t, s, alice, tt.files, tt.devices...)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			after, _, err := s.DB.FindTasks(aliceID, database.TaskFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			added := after[:len(after)-len(before)]
+			if tt.sendTo == nil {
+				if len(added) != 0 {
+					t.Fatalf("%d tasks were added", len(added))
+				}
+				return
+			}
+			if len(added) != 1 || !slices.Equal(added[0].SendTo, tt.sendTo) || added[0].LocalFile == "" {
+				t.Fatalf("added %+v, want one uploaded task sent to %v", added, tt.sendTo)
+			}
+		})
+	}
+
+	// the uploads of alice are hers alone
+	tasks, _, err := s.DB.FindTasks(aliceID, database.TaskFilter{})
+	if err != nil || len(tasks) != 1 {
+		t.Fatalf("alice has tasks %v, %v", tasks, err)
+	}
+	taskID := tasks[0].ID
+	if w := serve(s, bob, http.MethodGet, "/history", nil); strings.Contains(w.Body.String(), taskID) {
+		t.Error("the upload of alice is in the history of bob")
+	}
+	if w := serve(s, bob, http.MethodPost, "/tasks/"+taskID, nil); w.Code != http.StatusNotFound {
+		t.Errorf("bob cancelling the upload of alice got status %d", w.Code)
+	}
+	if w := serve(s, bob, http.MethodGet, "/tasks/"+taskID+"/cover", nil); w.Code != http.StatusNotFound {
+		t.Errorf("bob fetching the cover of alice's upload got status %d", w.Code)
+	}
+	task, err := s.DB.GetTask(taskID)
+	if err != nil || task.State != database.Pending {
+		t.Fatalf("upload of alice is %v, %v after the requests of bob", task.State, err)
+	}
+	if w := serve(s, alice, http.MethodGet, "/history", nil); !strings.Contains(w.Body.String(), taskID) {
+		t.Error("the upload is not in the history of alice")
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+)
+
+// maxTokenDays bounds the expiry of api tokens
+const maxTokenDays = 3650
+
+// TokenListHandler returns the table of api tokens of the user
+func (s *Server) TokenListHandler(w http.ResponseWriter, r *http.Request) {
+	s.execTokensResponse(w, r, http.StatusOK, "", "", "")
+}
+
+// TokenAddHandler creates an api token for the user, the token is only shown in the response
+func (s *Server) TokenAddHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	err := r.ParseForm()
+	if err != nil {
+		s.execTokensResponse(w, r, http.StatusBadRequest, "", "Form could not be read.", "")
+		return
+	}
+
+	name := strings.TrimSpace(r.Form.Get("name"))
+	var days int
+	if value := r.Form.Get("expires_days"); value != "" {
+		days, err = strconv.Atoi(value)
+	}
+	switch {
+	case name == "":
+		err = fmt.Errorf("Token name should not be empty.")
+	case err != nil || days < 0 || days > maxTokenDays:
+		err = fmt.Errorf("Expiry should be between 1 and %d days, or never.", maxTokenDays)
+	}
+	if err != nil {
+		s.execTokensResponse(w, r, http.StatusBadRequest, "", err.Error(), "")
+		return
+	}
+
+	tokens, err := s.DB.ListAPITokens(user.ID)
+	if err != nil {
+		slog.Error("error while fetching api tokens list", slog.String("error", err.Error()))
+		s.execTokensResponse(w, r, http.StatusInternalServerError, "", InternalServerError, "")
+		return
+	}
+	for _, other := range tokens {
+		if strings.EqualFold(other.Name, name) {
+			s.execTokensResponse(w, r, http.StatusBadRequest, "", fmt.Sprintf("You already have a token named %s.", other.Name), "")
+			return
+		}
+	}
+
+	secret, err := helper.GenerateAPIToken()
+	if err != nil {
+		slog.Error("error while generating api token", slog.String("error", err.Error()))
+		s.execTokensResponse(w, r, http.StatusInternalServerError, "", InternalServerError, "")
+		return
+	}
+	token := database.APIToken{
+		UserID:    user.ID,
+		Name:      name,
+		TokenHash: helper.HashAPIToken(secret),
+		Prefix:    secret[:len(helper.APITokenPrefix)+6],
+	}
+	if days > 0 {
+		token.ExpiresAt = time.Now().AddDate(0, 0, days)
+	}
+	tokenID, err := s.DB.AddAPIToken(token)
+	if err != nil {
+		slog.Error("error while adding api token", slog.Int("userID", user.ID), slog.String("error", err.Error()))
+		s.execTokensResponse(w, r, http.StatusInternalServerError, "", InternalServerError, "")
+		return
+	}
+
+	slog.Info("api token added", slog.Int("tokenID", tokenID), slog.Int("userID", user.ID))
+	s.execTokensResponse(w, r, http.StatusOK, fmt.Sprintf("Token %s added.", name), "", secret)
+}
+
+// TokenDeleteHandler revokes an api token of the user
+func (s *Server) TokenDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	tokenID, err := strconv.Atoi(r.PathValue("id"))
+	if err == nil {
+		err = s.DB.DeleteAPIToken(user.ID, tokenID)
+	}
+	if errors.Is(err, database.ErrNoRowDeleted) || errors.Is(err, strconv.ErrSyntax) || errors.Is(err, strconv.ErrRange) {
+		s.execTokensResponse(w, r, http.StatusNotFound, "", "Token could not be found.", "")
+		return
+	}
+	if err != nil {
+		slog.Error("error while deleting api token", slog.Int("tokenID", tokenID), slog.String("error", err.Error()))
+		s.execTokensResponse(w, r, http.StatusInternalServerError, "", InternalServerError, "")
+		return
+	}
+
+	slog.Info("api token revoked", slog.Int("tokenID", tokenID), slog.Int("userID", user.ID))
+	s.execTokensResponse(w, r, http.StatusOK, "Token revoked.", "", "")
+}
+
+// execTokensResponse renders the table of api tokens with a message about the last
+// change, and a new token which is shown only this once
+func (s *Server) execTokensResponse(w http.ResponseWriter, r *http.Request, status int, message string, errMsg string, newToken string) {
+	tokens, err := s.DB.ListAPITokens(currentUser(r).ID)
+	if err != nil {
+		slog.Error("error while fetching api tokens list", slog.String("error", err.Error()))
+	}
+
+	// a token is a password, it must not linger in caches
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err = s.Templates.ExecuteTemplate(w, Pages["TokensListPage"], map[string]any{
+		"Tokens":   tokens,
+		"NewToken": newToken,
+		"message":  message,
+		"error":    errMsg,
+	})
+	if err != nil {
+		slog.Error("error while excuting tokens-list template", slog.String("error", err.Error()))
+		http.Error(w, InternalServerError, http.StatusInternalServerError)
+		return
+	}
+}
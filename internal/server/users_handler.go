@@ -0,0 +1,314 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+)
+
+// minPasswordLength is the shortest password admins may set
+const minPasswordLength = 8
+
+// AdminUsersHandler serves the page admins manage the users on
+func (s *Server) AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	err := s.Templates.ExecuteTemplate(w, Pages["AdminUsersPage"], nil)
+	if err != nil {
+		slog.Error("error while excuting admin users template", slog.String("error", err.Error()))
+		http.Error(w, InternalServerError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// UserListHandler returns the table of users
+func (s *Server) UserListHandler(w http.ResponseWriter, r *http.Request) {
+	s.execUsersResponse(w, r, http.StatusOK, "", "")
+}
+
+// UserAddHandler creates a user
+func (s *Server) UserAddHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.execUsersResponse(w, r, http.StatusBadRequest, "", "Form could not be read.")
+		return
+	}
+
+	user := database.User{
+		Name:    strings.TrimSpace(r.Form.Get("name")),
+		Email:   strings.TrimSpace(r.Form.Get("email")),
+		IsAdmin: r.Form.Get("admin") != "",
+	}
+	password := r.Form.Get("password")
+	kindles, err := parseRecipients(r.Form.Get("smtp_to"))
+	switch {
+	case user.Name == "" || user.Email == "":
+		err = fmt.Errorf("Name and email should not be empty.")
+	case len(password) < minPasswordLength:
+		err = fmt.Errorf("Password should have atleast %d characters.", minPasswordLength)
+	}
+	if err != nil {
+		s.execUsersResponse(w, r, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	if s.emailTaken(w, r, user.Email, 0) {
+		return
+	}
+
+	user.Password, err = helper.HashPassword(password)
+	if err != nil {
+		slog.Error("error while hashing password", slog.String("error", err.Error()))
+		s.execUsersResponse(w, r, http.StatusInternalServerError, "", InternalServerError)
+		return
+	}
+	userID, err := s.DB.AddUser(user)
+	if err != nil {
+		slog.Error("error while adding user", slog.String("error", err.Error()))
+		s.execUsersResponse(w, r, http.StatusInternalServerError, "", InternalServerError)
+		return
+	}
+	// the user renames them and adds more on the dashboard
+	for _, address := range kindles {
+		_, err = s.DB.AddDevice(database.Device{UserID: userID, Name: address, Email: address, IsDefault: true})
+		if err != nil {
+			slog.Error("error while adding device", slog.Int("userID", userID), slog.String("error", err.Error()))
+		}
+	}
+
+	slog.Info("user added", slog.Int("userID", userID), slog.Int("by", currentUser(r).ID))
+	s.execUsersResponse(w, r, http.StatusOK, fmt.Sprintf("User %s added.", user.Email), "")
+}
+
+// UserUpdateHandler changes the details, password, role and Kindle addresses of a user.
+// An empty password keeps the current one.
+func (s *Server) UserUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.pathUser(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		s.execUsersResponse(w, r, http.StatusBadRequest, "", "Form could not be read.")
+		return
+	}
+
+	update := database.User{
+		ID:    user.ID,
+		Name:  strings.TrimSpace(r.Form.Get("name")),
+		Email: strings.TrimSpace(r.Form.Get("email")),
+	}
+	password := r.Form.Get("password")
+	isAdmin := r.Form.Get("admin") != ""
+	kindles, err := parseRecipients(r.Form.Get("smtp_to"))
+	switch {
+	case update.Name == "" || update.Email == "":
+		err = fmt.Errorf("Name and email should not be empty.")
+	case password != "" && len(password) < minPasswordLength:
+		err = fmt.Errorf("Password should have atleast %d characters.", minPasswordLength)
+	case !isAdmin && user.ID == currentUser(r).ID:
+		err = fmt.Errorf("You can't revoke your own admin role.")
+	}
+	if err != nil {
+		s.execUsersResponse(w, r, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	if s.emailTaken(w, r, update.Email, user.ID) {
+		return
+	}
+
+	if password != "" {
+		update.Password, err = helper.HashPassword(password)
+		if err != nil {
+			slog.Error("error while hashing password", slog.String("error", err.Error()))
+			s.execUsersResponse(w, r, http.StatusInternalServerError, "", InternalServerError)
+			return
+		}
+	}
+	err = s.DB.UpdateUser(update)
+	if err == nil && isAdmin != user.IsAdmin {
+		err = s.DB.SetUserAdmin(user.ID, isAdmin)
+	}
+	if err == nil && r.Form.Has("smtp_to") {
+		err = s.setKindles(user.ID, kindles)
+	}
+	if err != nil {
+		slog.Error("error while updating user", slog.Int("userID", user.ID), slog.String("error", err.Error()))
+		s.execUsersResponse(w, r, http.StatusInternalServerError, "", InternalServerError)
+		return
+	}
+
+	slog.Info("user updated", slog.Int("userID", user.ID), slog.Bool("passwordReset", password != ""), slog.Int("by", currentUser(r).ID))
+	s.execUsersResponse(w, r, http.StatusOK, fmt.Sprintf("User %s updated.", update.Email), "")
+}
+
+// UserDisableHandler disables or enables a user, depending on the action in the path
+func (s *Server) UserDisableHandler(w http.ResponseWriter, r *http.Request) {
+	var disabled bool
+	switch r.PathValue("action") {
+	case "disable":
+		disabled = true
+	case "enable":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	user, ok := s.pathUser(w, r)
+	if !ok {
+		return
+	}
+	if user.ID == currentUser(r).ID {
+		s.execUsersResponse(w, r, http.StatusBadRequest, "", "You can't disable yourself.")
+		return
+	}
+
+	err := s.DB.SetUserDisabled(user.ID, disabled)
+	if err != nil {
+		slog.Error("error while disabling user", slog.Int("userID", user.ID), slog.String("error", err.Error()))
+		s.execUsersResponse(w, r, http.StatusInternalServerError, "", InternalServerError)
+		return
+	}
+
+	slog.Info("user disabled", slog.Int("userID", user.ID), slog.Bool("disabled", disabled), slog.Int("by", currentUser(r).ID))
+	s.execUsersResponse(w, r, http.StatusOK, fmt.Sprintf("User %s %sd.", user.Email, r.PathValue("action")), "")
+}
+
+// UserDeleteHandler deletes a user along with their tasks and devices
+func (s *Server) UserDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.pathUser(w, r)
+	if !ok {
+		return
+	}
+	if user.ID == currentUser(r).ID {
+		s.execUsersResponse(w, r, http.StatusBadRequest, "", "You can't delete yourself.")
+		return
+	}
+
+	err := s.DB.DeleteUser(user.ID)
+	if err != nil {
+		slog.Error("error while deleting user", slog.Int("userID", user.ID), slog.String("error", err.Error()))
+		s.execUsersResponse(w, r, http.StatusInternalServerError, "", InternalServerError)
+		return
+	}
+
+	slog.Info("user deleted", slog.Int("userID", user.ID), slog.Int("by", currentUser(r).ID))
+	s.execUsersResponse(w, r, http.StatusOK, fmt.Sprintf("User %s deleted.", user.Email), "")
+}
+
+// setKindles makes the addresses the devices of the user. Devices of addresses which
+// are kept stay as they are, the user renames new ones on the dashboard.
+func (s *Server) setKindles(userID int, kindles []string) error {
+	devices, err := s.DB.ListDevices(userID)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if slices.ContainsFunc(kindles, func(address string) bool { return strings.EqualFold(address, device.Email) }) {
+			continue
+		}
+		if err = s.DB.DeleteDevice(userID, device.ID); err != nil {
+			return err
+		}
+	}
+	for _, address := range kindles {
+		if slices.ContainsFunc(devices, func(device database.Device) bool { return strings.EqualFold(address, device.Email) }) {
+			continue
+		}
+		_, err = s.DB.AddDevice(database.Device{UserID: userID, Name: address, Email: address, IsDefault: true})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pathUser returns the user of the id in the path, the response is written when there is none
+func (s *Server) pathUser(w http.ResponseWriter, r *http.Request) (database.User, bool) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		s.execUsersResponse(w, r, http.StatusNotFound, "", "User could not be found.")
+		return database.User{}, false
+	}
+	user, err := s.DB.GetUserByID(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.execUsersResponse(w, r, http.StatusNotFound, "", "User could not be found.")
+		return database.User{}, false
+	}
+	if err != nil {
+		slog.Error("error while fetching user", slog.Int("userID", userID), slog.String("error", err.Error()))
+		s.execUsersResponse(w, r, http.StatusInternalServerError, "", InternalServerError)
+		return database.User{}, false
+	}
+	return user, true
+}
+
+// emailTaken reports whether another user than userID has the email, the response
+// is written if so
+func (s *Server) emailTaken(w http.ResponseWriter, r *http.Request, email string, userID int) bool {
+	other, err := s.DB.GetUserByEmail(email)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) || (err == nil && other.ID == userID):
+		return false
+	case err != nil:
+		slog.Error("error while fetching user", slog.String("error", err.Error()))
+		s.execUsersResponse(w, r, http.StatusInternalServerError, "", InternalServerError)
+	default:
+		s.execUsersResponse(w, r, http.StatusBadRequest, "", "Another user has this email.")
+	}
+	return true
+}
+
+// parseRecipients splits a comma separated list of Kindle addresses
+func parseRecipients(value string) ([]string, error) {
+	var recipients []string
+	for _, address := range strings.Split(value, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if _, err := mail.ParseAddress(address); err != nil {
+			return nil, fmt.Errorf("%s is not a valid email address.", address)
+		}
+		if slices.ContainsFunc(recipients, func(other string) bool { return strings.EqualFold(other, address) }) {
+			continue
+		}
+		recipients = append(recipients, address)
+	}
+	return recipients, nil
+}
+
+// execUsersResponse renders the table of users with a message about the last change
+func (s *Server) execUsersResponse(w http.ResponseWriter, r *http.Request, status int, message string, errMsg string) {
+	users, err := s.DB.ListUsers()
+	if err != nil {
+		slog.Error("error while fetching users list", slog.String("error", err.Error()))
+	}
+	devices := make(map[int][]database.Device, len(users))
+	for _, user := range users {
+		devices[user.ID], err = s.DB.ListDevices(user.ID)
+		if err != nil {
+			slog.Error("error while fetching devices list", slog.Int("userID", user.ID), slog.String("error", err.Error()))
+		}
+	}
+
+	w.WriteHeader(status)
+	err = s.Templates.ExecuteTemplate(w, Pages["UsersListPage"], map[string]any{
+		"Users":     users,
+		"Devices":   devices,
+		"CurrentID": currentUser(r).ID,
+		"message":   message,
+		"error":     errMsg,
+	})
+	if err != nil {
+		slog.Error("error while excuting users-list template", slog.String("error", err.Error()))
+		http.Error(w, InternalServerError, http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+)
+
+// addTestAdmin adds a user with the admin role and returns its session cookie
+func addTestAdmin(t *testing.T, s *Server, email string) (int, *http.Cookie) {
+	t.Helper()
+	adminID, _ := addTestUser(t, s.DB, email, time.Time{})
+	if err := s.DB.SetUserAdmin(adminID, true); err != nil {
+		t.Fatal(err)
+	}
+	return adminID, sessionCookie(t, s, adminID)
+}
+
+// serve sends a request with the form, if any, and the cookie through the routes
+func serve(s *Server, cookie *http.Cookie, method, path string, form url.Values) *httptest.ResponseRecorder {
+	var r *http.Request
+	if form == nil {
+		r = httptest.NewRequest(method, path, nil)
+	} else {
+		r = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminOnly(t *testing.T) {
+	s := newTestServer(t)
+	adminID, _ := addTestAdmin(t, s, "admin@example.com")
+	bobID, _ := addTestUser(t, s.DB, "bob@example.com", time.Time{})
+	bob := sessionCookie(t, s, bobID)
+	admin := "/admin/users/" + strconv.Itoa(adminID)
+
+	requests := []struct {
+		method, path string
+		form         url.Values
+	}{
+		{http.MethodGet, "/admin/users", nil},
+		{http.MethodGet, "/admin/users/list", nil},
+		{http.MethodPost, "/admin/users", url.Values{"name": {"eve"}, "email": {"eve@example.com"}, "password": {"long enough"}, "admin": {"1"}}},
+		{http.MethodPost, "/admin/users/" + strconv.Itoa(bobID), url.Values{"name": {"bob"}, "email": {"bob@example.com"}, "admin": {"1"}}},
+		{http.MethodPost, admin, url.Values{"name": {"admin"}, "email": {"admin@example.com"}, "password": {"taken over"}, "smtp_to": {"bob@kindle.com"}}},
+		{http.MethodPost, admin + "/disable", nil},
+		{http.MethodDelete, admin, nil},
+	}
+	for _, req := range requests {
+		if w := serve(s, bob, req.method, req.path, req.form); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s by a user got status %d, want %d", req.method, req.path, w.Code, http.StatusForbidden)
+		}
+	}
+
+	users, err := s.DB.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("there are %d users, want 2", len(users))
+	}
+	for _, user := range users {
+		if user.IsAdmin != (user.ID == adminID) || user.Disabled {
+			t.Errorf("user %s is admin %v, disabled %v", user.Email, user.IsAdmin, user.Disabled)
+		}
+	}
+	devices, err := s.DB.ListDevices(adminID)
+	if err != nil || len(devices) != 0 {
+		t.Fatalf("admin has devices %v, %v", devices, err)
+	}
+}
+
+func TestAdminManagesUsers(t *testing.T) {
+	s := newTestServer(t)
+	adminID, cookie := addTestAdmin(t, s, "admin@example.com")
+	admin := "/admin/users/" + strconv.Itoa(adminID)
+
+	// adding
+	w := serve(s, cookie, http.MethodPost, "/admin/users", url.Values{
+		"name": {"carol"}, "email": {"carol@example.com"}, "password": {"long enough"}, "smtp_to": {"carol@kindle.com, scribe@kindle.com"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	carol, err := s.DB.GetUserByEmail("carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if carol.IsAdmin || carol.Disabled {
+		t.Fatalf("carol is admin %v, disabled %v", carol.IsAdmin, carol.Disabled)
+	}
+	devices, err := s.DB.ListDefaultDevices(carol.ID)
+	if err != nil || len(devices) != 2 {
+		t.Fatalf("carol has default devices %v, %v", devices, err)
+	}
+	path := "/admin/users/" + strconv.Itoa(carol.ID)
+
+	rejected := []struct {
+		name         string
+		method, path string
+		form         url.Values
+	}{
+		{"taken email", http.MethodPost, "/admin/users", url.Values{"name": {"c"}, "email": {"carol@example.com"}, "password": {"long enough"}}},
+		{"short password", http.MethodPost, "/admin/users", url.Values{"name": {"d"}, "email": {"d@example.com"}, "password": {"short"}}},
+		{"invalid kindle", http.MethodPost, "/admin/users", url.Values{"name": {"d"}, "email": {"d@example.com"}, "password": {"long enough"}, "smtp_to": {"nope"}}},
+		{"email of another user", http.MethodPost, path, url.Values{"name": {"carol"}, "email": {"admin@example.com"}}},
+		{"own admin role", http.MethodPost, admin, url.Values{"name": {"admin"}, "email": {"admin@example.com"}}},
+		{"disabling oneself", http.MethodPost, admin + "/disable", nil},
+		{"deleting oneself", http.MethodDelete, admin, nil},
+	}
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(s, cookie, tt.method, tt.path, tt.form); w.Code != http.StatusBadRequest {
+				t.Fatalf("status %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+		})
+	}
+	if w := serve(s, cookie, http.MethodPost, "/admin/users/999/disable", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("disabling an unknown user got status %d", w.Code)
+	}
+
+	// editing
+	w = serve(s, cookie, http.MethodPost, path, url.Values{"name": {"Carol"}, "email": {"carol@example.org"}, "password": {"new password"}, "admin": {"1"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	carol, err = s.DB.GetUserByID(carol.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match, _ := helper.ComparePassword(carol.Password, "new password"); !match || carol.Name != "Carol" || carol.Email != "carol@example.org" || !carol.IsAdmin {
+		t.Fatalf("carol is %+v after the edit", carol)
+	}
+
+	// disabling, enabling and deleting
+	for _, action := range []string{"disable", "enable"} {
+		if w := serve(s, cookie, http.MethodPost, path+"/"+action, nil); w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", action, w.Code)
+		}
+		carol, err = s.DB.GetUserByID(carol.ID)
+		if err != nil || carol.Disabled != (action == "disable") {
+			t.Fatalf("carol is disabled %v after %s, %v", carol.Disabled, action, err)
+		}
+	}
+	err = s.DB.AddTask(database.Task{ID: "c0ffee00-0000-4000-8000-000000000001", UserID: carol.ID, URL: "https://example.com/a.epub", State: database.Pending})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(s, cookie, http.MethodDelete, path, nil); w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d", w.Code)
+	}
+	if _, err := s.DB.GetUserByID(carol.ID); err == nil {
+		t.Fatal("carol was not deleted")
+	}
+	var left int
+	if err := s.DB.Database.QueryRow(`SELECT (SELECT COUNT(*) FROM tasks) + (SELECT COUNT(*) FROM devices);`).Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Fatalf("%d tasks and devices of carol are left", left)
+	}
+}
+
+func TestUserUpdateKindles(t *testing.T) {
+	s := newTestServer(t)
+	_, cookie := addTestAdmin(t, s, "admin@example.com")
+	bobID, _ := addTestUser(t, s.DB, "bob@example.com", time.Time{})
+	_, err := s.DB.AddDevice(database.Device{UserID: bobID, Name: "Paperwhite", Email: "bob@kindle.com", IsDefault: true, Format: "epub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/admin/users/" + strconv.Itoa(bobID)
+
+	tests := []struct {
+		name    string
+		smtpTo  []string // none for a form without the field
+		devices []string // names and addresses of bob's devices afterwards
+	}{
+		{"added", []string{"bob@kindle.com, Scribe@Kindle.com, scribe@kindle.com"}, []string{"Paperwhite bob@kindle.com", "Scribe@Kindle.com Scribe@Kindle.com"}},
+		{"left out", nil, []string{"Paperwhite bob@kindle.com", "Scribe@Kindle.com Scribe@Kindle.com"}},
+		{"removed", []string{"scribe@kindle.com"}, []string{"Scribe@Kindle.com Scribe@Kindle.com"}},
+		{"cleared", []string{""}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"name": {"bob"}, "email": {"bob@example.com"}}
+			if tt.smtpTo != nil {
+				form["smtp_to"] = tt.smtpTo
+			}
+			w := serve(s, cookie, http.MethodPost, path, form)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+
+			devices, err := s.DB.ListDevices(bobID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, device := range devices {
+				got = append(got, device.Name+" "+device.Email)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.devices, ",") {
+				t.Fatalf("bob has devices %v, want %v", got, tt.devices)
+			}
+		})
+	}
+
+	w := serve(s, cookie, http.MethodPost, path, url.Values{"name": {"bob"}, "email": {"bob@example.com"}, "smtp_to": {"not an address"}})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d for an invalid address, want %d", w.Code, http.StatusBadRequest)
+	}
+}
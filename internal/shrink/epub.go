@@ -0,0 +1,445 @@
+package shrink
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/roshanlc/send-to-kindle/internal/imaging"
+)
+
+const (
+	maxEntryBytes = 256 << 20 // archive entries larger than this are not read
+	opfOverhead   = 64 << 10  // room left for the package document and zip headers of a part
+)
+
+var (
+	itemPattern      = regexp.MustCompile(`[ \t]*<item\b[^>]*>(?:\r?\n)?`) // along with its line, when it is dropped
+	itemrefPattern   = regexp.MustCompile(`[ \t]*<itemref\b[^>]*>(?:\r?\n)?`)
+	referencePattern = regexp.MustCompile(`[ \t]*<reference\b[^>]*>(?:\r?\n)?`)
+	titlePattern     = regexp.MustCompile(`(<dc:title\b[^>]*>)([^<]*)(</dc:title>)`)
+	idPattern        = regexp.MustCompile(`(<dc:identifier\b[^>]*>)([^<]*)(</dc:identifier>)`)
+	linkPattern      = regexp.MustCompile(`(?i)\b(?:src|href|xlink:href|poster)\s*=\s*["']([^"']+)["']`)
+	hrefAttrPattern  = regexp.MustCompile(`\bhref\s*=\s*["']([^"']*)["']`)
+	idrefAttrPattern = regexp.MustCompile(`\bidref\s*=\s*["']([^"']*)["']`)
+)
+
+// opfPackage is the part of the package document needed to split a book
+type opfPackage struct {
+	Meta []struct {
+		Name    string `xml:"name,attr"`
+		Content string `xml:"content,attr"`
+	} `xml:"metadata>meta"`
+	Items []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine []struct {
+		IDRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+// compressEPUB rewrites a book at the best deflate level, with JPEG and PNG
+// images downscaled. Names and media types of the entries stay the same.
+func compressEPUB(ctx context.Context, src string, dst string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+	zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, flate.BestCompression)
+	})
+
+	err = copyMimetype(zw, r.File)
+	if err != nil {
+		return err
+	}
+	for _, f := range r.File {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if f.Name == "mimetype" {
+			continue
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			return err
+		}
+
+		method := zip.Deflate
+		ext := strings.ToLower(path.Ext(f.Name))
+		switch ext {
+		case ".jpg", ".jpeg", ".png":
+			small, mediaType, err := imaging.Resize(data, maxImageWidth, maxImageHeight, imageQuality)
+			if err == nil && len(small) < len(data) && (mediaType == "image/png") == (ext == ".png") {
+				data = small
+			}
+			method = zip.Store // already compressed
+		case ".gif":
+			method = zip.Store
+		}
+
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: method, Modified: f.Modified})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// splitEPUB splits a book into parts of consecutive spine documents, each within
+// limit bytes. Every part holds the stylesheets, fonts and cover, along with the
+// images its documents use.
+func splitEPUB(ctx context.Context, src string, limit int64) ([]string, error) {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	files := map[string]*zip.File{}
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+
+	opfPath, err := rootfile(files)
+	if err != nil {
+		return nil, err
+	}
+	opfData, err := readZipFile(files[opfPath])
+	if err != nil {
+		return nil, err
+	}
+	var pkg opfPackage
+	err = xml.Unmarshal(opfData, &pkg)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing package document, %w", err)
+	}
+
+	// manifest items by id, named by their path in the archive
+	opfDir := path.Dir(opfPath)
+	itemNames := map[string]string{}
+	mediaTypes := map[string]string{}
+	var cover, coverID string
+	for _, m := range pkg.Meta {
+		if m.Name == "cover" {
+			coverID = m.Content
+		}
+	}
+	for _, item := range pkg.Items {
+		name := resolveHref(opfDir, item.Href)
+		itemNames[item.ID] = name
+		mediaTypes[name] = item.MediaType
+		if item.ID == coverID || strings.Contains(item.Properties, "cover-image") {
+			cover = name
+		}
+	}
+
+	var chapters []string
+	inSpine := map[string]bool{}
+	for _, ref := range pkg.Spine {
+		if name, ok := itemNames[ref.IDRef]; ok && files[name] != nil && !inSpine[name] {
+			chapters = append(chapters, name)
+			inSpine[name] = true
+		}
+	}
+	if len(chapters) < 2 {
+		return nil, fmt.Errorf("%w: a single document can't be split", TooLargeErr)
+	}
+
+	// images and documents outside the spine go with the chapters using them,
+	// everything else is needed by every part
+	splittable := func(name string) bool {
+		mediaType := mediaTypes[name]
+		return name != cover && !inSpine[name] && files[name] != nil &&
+			(strings.HasPrefix(mediaType, "image/") || mediaType == "application/xhtml+xml")
+	}
+	deps := make([][]string, len(chapters))
+	used := map[string]bool{}
+	for i, chapter := range chapters {
+		deps[i], err = chapterDeps(files, chapter, splittable)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range deps[i] {
+			used[d] = true
+		}
+	}
+	var common []string
+	var commonSize int64
+	for _, f := range r.File {
+		if !inSpine[f.Name] && !used[f.Name] && f.Name != opfPath {
+			common = append(common, f.Name)
+			commonSize += int64(f.CompressedSize64)
+		}
+	}
+
+	budget := limit - commonSize - opfOverhead
+	if budget <= 0 {
+		return nil, fmt.Errorf("%w: content shared by all parts is larger than the limit", TooLargeErr)
+	}
+
+	// chapters are packed into parts in reading order
+	var groups [][2]int
+	start := 0
+	var sum int64
+	for i, chapter := range chapters {
+		size := int64(files[chapter].CompressedSize64)
+		for _, d := range deps[i] {
+			size += int64(files[d].CompressedSize64)
+		}
+		if i > start && sum+size > budget {
+			groups = append(groups, [2]int{start, i})
+			start, sum = i, 0
+		}
+		sum += size
+	}
+	groups = append(groups, [2]int{start, len(chapters)})
+	if len(groups) < 2 {
+		return nil, fmt.Errorf("%w: book could not be split", TooLargeErr)
+	}
+
+	var paths []string
+	for i, g := range groups {
+		if ctx.Err() != nil {
+			removeAll(paths)
+			return nil, ctx.Err()
+		}
+
+		keep := map[string]bool{opfPath: true}
+		for _, name := range common {
+			keep[name] = true
+		}
+		for c := g[0]; c < g[1]; c++ {
+			keep[chapters[c]] = true
+			for _, d := range deps[c] {
+				keep[d] = true
+			}
+		}
+
+		dst := partName(src, i+1, len(groups))
+		paths = append(paths, dst)
+		opf := rewriteOPF(string(opfData), opfDir, itemNames, keep, i+1, len(groups))
+		err = writeEPUBPart(r.File, keep, opfPath, opf, dst)
+		if err != nil {
+			removeAll(paths)
+			return nil, err
+		}
+		size, err := fileSize(dst)
+		if err != nil {
+			removeAll(paths)
+			return nil, err
+		}
+		if size > limit {
+			removeAll(paths)
+			return nil, fmt.Errorf("%w: part %d is still %d bytes", TooLargeErr, i+1, size)
+		}
+	}
+	return paths, nil
+}
+
+// rootfile returns the path of the package document from META-INF/container.xml
+func rootfile(files map[string]*zip.File) (string, error) {
+	f := files["META-INF/container.xml"]
+	if f == nil {
+		return "", fmt.Errorf("epub has no container.xml")
+	}
+	data, err := readZipFile(f)
+	if err != nil {
+		return "", err
+	}
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	err = xml.Unmarshal(data, &container)
+	if err != nil || len(container.Rootfiles) == 0 || files[container.Rootfiles[0].FullPath] == nil {
+		return "", fmt.Errorf("epub package document not found")
+	}
+	return container.Rootfiles[0].FullPath, nil
+}
+
+// chapterDeps returns the splittable entries a document refers to, following
+// references of documents outside the spine as well
+func chapterDeps(files map[string]*zip.File, chapter string, splittable func(string) bool) ([]string, error) {
+	var deps []string
+	seen := map[string]bool{chapter: true}
+	queue := []string{chapter}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		data, err := readZipFile(files[name])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range linkPattern.FindAllStringSubmatch(string(data), -1) {
+			dep := resolveHref(path.Dir(name), m[1])
+			if dep == "" || seen[dep] || !splittable(dep) {
+				continue
+			}
+			seen[dep] = true
+			deps = append(deps, dep)
+			if strings.HasSuffix(dep, "html") {
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return deps, nil
+}
+
+// resolveHref returns the archive path of a relative link, empty for external links
+func resolveHref(dir string, href string) string {
+	href, _, _ = strings.Cut(href, "#")
+	href, _, _ = strings.Cut(href, "?")
+	if href == "" || strings.Contains(href, ":") {
+		return ""
+	}
+	if unescaped, err := url.PathUnescape(href); err == nil {
+		href = unescaped
+	}
+	return path.Join(dir, href)
+}
+
+// rewriteOPF drops the entries missing from a part from the package document and
+// marks the title and identifier as those of the i-th of n parts
+func rewriteOPF(opf string, opfDir string, itemNames map[string]string, keep map[string]bool, i, n int) string {
+	attr := func(tag string, pattern *regexp.Regexp) string {
+		m := pattern.FindStringSubmatch(tag)
+		if m == nil {
+			return ""
+		}
+		return m[1]
+	}
+	kept := func(href string) bool {
+		name := resolveHref(opfDir, href)
+		return name == "" || keep[name]
+	}
+
+	opf = itemPattern.ReplaceAllStringFunc(opf, func(tag string) string {
+		if kept(attr(tag, hrefAttrPattern)) {
+			return tag
+		}
+		return ""
+	})
+	opf = itemrefPattern.ReplaceAllStringFunc(opf, func(tag string) string {
+		if keep[itemNames[attr(tag, idrefAttrPattern)]] {
+			return tag
+		}
+		return ""
+	})
+	opf = referencePattern.ReplaceAllStringFunc(opf, func(tag string) string {
+		if kept(attr(tag, hrefAttrPattern)) {
+			return tag
+		}
+		return ""
+	})
+
+	titled := false
+	opf = titlePattern.ReplaceAllStringFunc(opf, func(tag string) string {
+		if titled {
+			return tag
+		}
+		titled = true
+		m := titlePattern.FindStringSubmatch(tag)
+		return m[1] + partTitle(m[2], i, n) + m[3]
+	})
+	return idPattern.ReplaceAllString(opf, fmt.Sprintf("${1}${2}-part-%d${3}", i))
+}
+
+// writeEPUBPart writes the kept entries of a book, with opf as its package document
+func writeEPUBPart(entries []*zip.File, keep map[string]bool, opfPath string, opf string, dst string) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+
+	err = copyMimetype(zw, entries)
+	if err != nil {
+		return err
+	}
+	for _, f := range entries {
+		switch {
+		case f.Name == "mimetype" || !keep[f.Name]:
+		case f.Name == opfPath:
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: f.Modified})
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(w, opf)
+			if err != nil {
+				return err
+			}
+		default:
+			err = zw.Copy(f) // without decompressing
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// copyMimetype writes the mimetype entry, which must come first and be stored uncompressed
+func copyMimetype(zw *zip.Writer, entries []*zip.File) error {
+	data := []byte("application/epub+zip")
+	modified := time.Now()
+	for _, f := range entries {
+		if f.Name == "mimetype" {
+			modified = f.Modified
+			break
+		}
+	}
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// readZipFile reads an archive entry
+func readZipFile(f *zip.File) ([]byte, error) {
+	if f.UncompressedSize64 > maxEntryBytes {
+		return nil, fmt.Errorf("%s is too large", f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, maxEntryBytes))
+}
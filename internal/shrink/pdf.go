@@ -0,0 +1,378 @@
+package shrink
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/roshanlc/send-to-kindle/internal/imaging"
+	"github.com/roshanlc/send-to-kindle/internal/pdf"
+)
+
+const (
+	maxImageWidth  = 1600 // images are downscaled to fit, about the resolution of large e-readers
+	maxImageHeight = 2400
+	imageQuality   = 75
+)
+
+var EncryptedPDFErr = errors.New("encrypted pdf can't be rewritten")
+
+// pdfCopier copies objects of a parsed file into a writer, following references
+type pdfCopier struct {
+	ctx      context.Context
+	f        *pdf.File
+	w        *pdf.Writer
+	refs     map[int]pdf.Ref // numbers of objects in f to their references in w
+	skip     map[int]bool    // objects left out, references to them become null
+	compress bool            // recompress streams while copying
+}
+
+// newPDFCopier returns a copier from f to w
+func newPDFCopier(ctx context.Context, f *pdf.File, w *pdf.Writer, skip map[int]bool) *pdfCopier {
+	return &pdfCopier{ctx: ctx, f: f, w: w, refs: map[int]pdf.Ref{}, skip: skip}
+}
+
+// copy returns v with every object it references copied into the writer
+func (c *pdfCopier) copy(v any) any {
+	switch v := v.(type) {
+	case pdf.Ref:
+		if ref, ok := c.refs[v.Num]; ok {
+			return ref
+		}
+		obj, ok := c.f.Objects[v.Num]
+		if !ok || c.skip[v.Num] {
+			return nil
+		}
+		ref := c.w.Reserve()
+		c.refs[v.Num] = ref
+
+		value, stream := obj.Value, obj.Stream
+		if stream != nil {
+			d := maps.Clone(value.(pdf.Dict))
+			delete(d, "Length") // may be a reference, the writer sets it
+			if c.compress && c.ctx.Err() == nil {
+				d, stream = c.recompress(d, stream)
+			}
+			value = d
+		}
+		c.w.Set(ref, c.copy(value), stream)
+		return ref
+	case pdf.Array:
+		out := make(pdf.Array, len(v))
+		for i, item := range v {
+			out[i] = c.copy(item)
+		}
+		return out
+	case pdf.Dict:
+		out := make(pdf.Dict, len(v))
+		for k, item := range v {
+			out[k] = c.copy(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// recompress returns a smaller encoding of a stream when it finds one. Flate streams
+// are deflated again at the best level, unfiltered streams get deflated and JPEG
+// images are downscaled.
+func (c *pdfCopier) recompress(d pdf.Dict, stream []byte) (pdf.Dict, []byte) {
+	filter := c.f.Resolve(d["Filter"])
+	if filters, ok := filter.(pdf.Array); ok && len(filters) == 1 {
+		filter = filters[0]
+	}
+
+	switch filter {
+	case nil:
+		out, err := deflate(stream)
+		if err == nil && len(out) < len(stream) {
+			d["Filter"] = pdf.Name("FlateDecode")
+			return d, out
+		}
+	case pdf.Name("FlateDecode"):
+		data, err := c.f.Decode(&pdf.Object{Value: d, Stream: stream})
+		if err != nil {
+			break
+		}
+		out, err := deflate(data)
+		if err == nil && len(out) < len(stream) {
+			return d, out
+		}
+	case pdf.Name("DCTDecode"):
+		return c.downscaleJPEG(d, stream)
+	}
+	return d, stream
+}
+
+// downscaleJPEG downscales and re-encodes a JPEG image. Only plain RGB and grayscale
+// images are touched, others need color handling which is not worth the trouble.
+func (c *pdfCopier) downscaleJPEG(d pdf.Dict, stream []byte) (pdf.Dict, []byte) {
+	colorSpace := c.f.Resolve(d["ColorSpace"])
+	gray := colorSpace == pdf.Name("DeviceGray")
+	if d["Subtype"] != pdf.Name("Image") || (!gray && colorSpace != pdf.Name("DeviceRGB")) || d["Decode"] != nil {
+		return d, stream
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(stream))
+	if err != nil {
+		return d, stream
+	}
+	img = imaging.Downscale(img, maxImageWidth, maxImageHeight)
+
+	// the encoded components have to match the declared color space
+	bounds := img.Bounds()
+	var dst draw.Image = image.NewRGBA(bounds)
+	if gray {
+		dst = image.NewGray(bounds)
+	}
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: imageQuality})
+	if err != nil || buf.Len() >= len(stream) {
+		return d, stream
+	}
+	d["Width"] = int64(bounds.Dx())
+	d["Height"] = int64(bounds.Dy())
+	return d, buf.Bytes()
+}
+
+// deflate compresses data at the best zlib level
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = zw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	return buf.Bytes(), err
+}
+
+// readPDF parses a pdf file which is not encrypted
+func readPDF(path string) (*pdf.File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := pdf.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if f.Trailer["Encrypt"] != nil {
+		return nil, EncryptedPDFErr
+	}
+	return f, nil
+}
+
+// writePDF writes the objects collected in w to path
+func writePDF(w *pdf.Writer, trailer pdf.Dict, path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteTo(out, trailer)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// compressPDF rewrites a pdf with recompressed streams. Objects no longer in use
+// and object streams are dropped on the way.
+func compressPDF(ctx context.Context, src string, dst string) error {
+	f, err := readPDF(src)
+	if err != nil {
+		return err
+	}
+
+	w := pdf.NewWriter()
+	c := newPDFCopier(ctx, f, w, nil)
+	c.compress = true
+	trailer := pdf.Dict{"Root": c.copy(f.Trailer["Root"])}
+	for _, key := range []pdf.Name{"Info", "ID"} {
+		if v := f.Trailer[key]; v != nil {
+			trailer[key] = c.copy(v)
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return writePDF(w, trailer, dst)
+}
+
+// splitPDF splits a pdf into parts of consecutive pages, each within limit bytes
+func splitPDF(ctx context.Context, src string, limit int64) ([]string, error) {
+	f, err := readPDF(src)
+	if err != nil {
+		return nil, err
+	}
+	pages := f.Pages()
+	if len(pages) < 2 {
+		return nil, fmt.Errorf("%w: a single page can't be split", TooLargeErr)
+	}
+	size, err := fileSize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	// parts hold their own pages only, the rest of the page tree is left out
+	skip := map[int]bool{}
+	for num, obj := range f.Objects {
+		if d, ok := obj.Value.(pdf.Dict); ok && (d["Type"] == pdf.Name("Pages") || d["Type"] == pdf.Name("Catalog")) {
+			skip[num] = true
+		}
+	}
+	for _, p := range pages {
+		skip[p.Ref.Num] = true
+	}
+
+	// pages are balanced by the size of what they use
+	weights := make([]int64, len(pages))
+	for i, p := range pages {
+		weights[i] = streamSize(f, p.Dict, skip, map[int]bool{})
+	}
+
+	title := pdf.Text(f.Dict(f.Trailer["Info"])["Title"])
+	if strings.TrimSpace(title) == "" {
+		title = strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))
+	}
+
+	// parts sharing fonts and images are larger than their share of the file,
+	// so more parts are tried until they all fit
+	for n := max(2, int((size+limit-1)/limit)); ; n = max(n+1, n*5/4) {
+		n = min(n, len(pages))
+		groups := balance(weights, n)
+		var paths []string
+		fits := true
+		for i, g := range groups {
+			path := partName(src, i+1, len(groups))
+			paths = append(paths, path)
+			err = writePDFPart(ctx, f, pages[g[0]:g[1]], skip, partTitle(title, i+1, len(groups)), path)
+			if err != nil {
+				removeAll(paths)
+				return nil, err
+			}
+			partSize, err := fileSize(path)
+			if err != nil {
+				removeAll(paths)
+				return nil, err
+			}
+			if partSize > limit {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			return paths, nil
+		}
+		removeAll(paths)
+		if n == len(pages) {
+			return nil, fmt.Errorf("%w: a single page is larger than the limit", TooLargeErr)
+		}
+	}
+}
+
+// writePDFPart writes a pdf holding the given pages of f
+func writePDFPart(ctx context.Context, f *pdf.File, pages []pdf.Page, skip map[int]bool, title string, path string) error {
+	w := pdf.NewWriter()
+	c := newPDFCopier(ctx, f, w, skip)
+
+	// links and annotations may refer to the pages, so they are mapped before copying
+	pagesRef := w.Reserve()
+	for _, p := range pages {
+		c.refs[p.Ref.Num] = w.Reserve()
+	}
+	kids := make(pdf.Array, 0, len(pages))
+	for _, p := range pages {
+		d := maps.Clone(p.Dict)
+		delete(d, "Parent")
+		d = c.copy(d).(pdf.Dict)
+		d["Parent"] = pagesRef
+		ref := c.refs[p.Ref.Num]
+		w.Set(ref, d, nil)
+		kids = append(kids, ref)
+	}
+	w.Set(pagesRef, pdf.Dict{"Type": pdf.Name("Pages"), "Kids": kids, "Count": len(kids)}, nil)
+
+	info := pdf.Dict{}
+	if d := f.Dict(f.Trailer["Info"]); d != nil {
+		info = c.copy(d).(pdf.Dict)
+	}
+	info["Title"] = pdf.EncodeText(title)
+
+	trailer := pdf.Dict{
+		"Root": w.Add(pdf.Dict{"Type": pdf.Name("Catalog"), "Pages": pagesRef}, nil),
+		"Info": w.Add(info, nil),
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return writePDF(w, trailer, path)
+}
+
+// streamSize returns the size of the streams reachable from v
+func streamSize(f *pdf.File, v any, skip map[int]bool, seen map[int]bool) int64 {
+	var size int64
+	switch v := v.(type) {
+	case pdf.Ref:
+		obj, ok := f.Objects[v.Num]
+		if !ok || skip[v.Num] || seen[v.Num] {
+			return 0
+		}
+		seen[v.Num] = true
+		size += int64(len(obj.Stream)) + streamSize(f, obj.Value, skip, seen)
+	case pdf.Array:
+		for _, item := range v {
+			size += streamSize(f, item, skip, seen)
+		}
+	case pdf.Dict:
+		for _, item := range v {
+			size += streamSize(f, item, skip, seen)
+		}
+	}
+	return size
+}
+
+// balance splits weighted items into at most n consecutive groups of about the same
+// total weight, returned as [start, end) index pairs
+func balance(weights []int64, n int) [][2]int {
+	var total int64
+	for _, w := range weights {
+		total += w
+	}
+	if total == 0 {
+		// nothing to go by, split by count
+		weights = slices.Repeat([]int64{1}, len(weights))
+		total = int64(len(weights))
+	}
+
+	var groups [][2]int
+	start := 0
+	var sum int64
+	for i, w := range weights {
+		// an item starts a new group when its middle is past the next boundary
+		boundary := total * int64(len(groups)+1) / int64(n)
+		if i > start && len(groups) < n-1 && sum+w/2 > boundary {
+			groups = append(groups, [2]int{start, i})
+			start = i
+		}
+		sum += w
+	}
+	return append(groups, [2]int{start, len(weights)})
+}
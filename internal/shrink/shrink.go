@@ -0,0 +1,110 @@
+// Package shrink makes books fit within the attachment size accepted by mail servers,
+// first by recompressing them and then by splitting them into parts
+package shrink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/roshanlc/send-to-kindle/internal/format"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+)
+
+var TooLargeErr = errors.New("file is larger than the attachment size limit")
+
+// Fit returns the files to send in place of the file at path so that none is larger
+// than limit bytes. That is the file itself when it fits. PDFs and EPUBs are
+// recompressed with downscaled images in place, and when that is not enough split
+// into numbered parts next to the file, which is removed then.
+func Fit(ctx context.Context, path string, limit int64) ([]string, error) {
+	taskID := helper.GetIDFromContext(ctx).String()
+
+	size, err := fileSize(path)
+	if err != nil {
+		return nil, err
+	}
+	if size <= limit {
+		return []string{path}, nil
+	}
+
+	detected, _, err := format.Detect(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while detecting file format, %w", err)
+	}
+	var compress func(ctx context.Context, src, dst string) error
+	var split func(ctx context.Context, src string, limit int64) ([]string, error)
+	switch detected {
+	case format.PDF:
+		compress, split = compressPDF, splitPDF
+	case format.EPUB:
+		compress, split = compressEPUB, splitEPUB
+	default:
+		return nil, fmt.Errorf("%w: %s file of %d bytes can't be made smaller", TooLargeErr, detected, size)
+	}
+
+	slog.Info("File is over the attachment size limit, recompressing", slog.Int64("size", size), slog.Int64("limit", limit), slog.String("taskID", taskID))
+	tmp := path + ".part"
+	err = compress(ctx, path, tmp)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return nil, fmt.Errorf("error while recompressing file, %w", err)
+	}
+	compressed, err := fileSize(tmp)
+	if err != nil {
+		return nil, err
+	}
+	if compressed < size {
+		err = os.Rename(tmp, path)
+		if err != nil {
+			return nil, fmt.Errorf("error while saving recompressed file, %w", err)
+		}
+		size = compressed
+	} else {
+		_ = os.Remove(tmp)
+	}
+	if size <= limit {
+		slog.Info("Recompressed file fits the limit", slog.Int64("size", size), slog.String("taskID", taskID))
+		return []string{path}, nil
+	}
+
+	slog.Info("Recompressed file is still too large, splitting", slog.Int64("size", size), slog.String("taskID", taskID))
+	parts, err := split(ctx, path, limit)
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(path)
+	slog.Info("Split file into parts", slog.Int("parts", len(parts)), slog.String("taskID", taskID))
+	return parts, nil
+}
+
+// partName returns the path of the i-th (1 based) of n parts of the file at path
+func partName(path string, i, n int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s (part %d of %d)%s", strings.TrimSuffix(path, ext), i, n, ext)
+}
+
+// partTitle returns the title of the i-th (1 based) of n parts of a book
+func partTitle(title string, i, n int) string {
+	return fmt.Sprintf("%s (Part %d of %d)", title, i, n)
+}
+
+// removeAll deletes the given files, used to clean up parts after a failure
+func removeAll(paths []string) {
+	for _, p := range paths {
+		_ = os.Remove(p)
+	}
+}
+
+// fileSize returns the size of a file
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,257 @@
+package shrink
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/roshanlc/send-to-kindle/internal/epub"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+)
+
+// noise returns n bytes of text which hardly compresses
+func noise(t *testing.T, n int) string {
+	t.Helper()
+	b := make([]byte, n*3/4)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// writeBook writes a book with a chapter of each of the given bodies
+func writeBook(t *testing.T, dir string, bodies ...string) string {
+	t.Helper()
+	book := &epub.Book{Title: "Big Book", Authors: []string{"A. Writer"}, Identifier: "urn:uuid:big"}
+	for i, body := range bodies {
+		book.Chapters = append(book.Chapters, epub.Chapter{Title: fmt.Sprintf("Chapter %d", i+1), Body: "<p>" + body + "</p>"})
+	}
+	path := filepath.Join(dir, "big.epub")
+	if err := book.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// storeEntries rewrites an archive without compression, as some tools do
+func storeEntries(t *testing.T, path string) {
+	t.Helper()
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	out, err := os.Create(path + ".stored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(out)
+	for _, f := range r.File {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(w, rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	if err := os.Rename(path+".stored", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dirNames lists the files left in a directory
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// readEntry returns an entry of an archive
+func readEntry(t *testing.T, path string, name string) string {
+	t.Helper()
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.Name == name {
+			data, err := readZipFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(data)
+		}
+	}
+	t.Fatalf("%s has no %s", path, name)
+	return ""
+}
+
+func TestFitWithinLimit(t *testing.T) {
+	path := writeBook(t, t.TempDir(), "short")
+	paths, err := Fit(helper.GenerateIDWithContext(), path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != path {
+		t.Fatalf("got %v, want the file itself", paths)
+	}
+}
+
+func TestFitCompresses(t *testing.T) {
+	dir := t.TempDir()
+	path := writeBook(t, dir, strings.Repeat("All work and no play makes Jack a dull boy. ", 5000))
+	storeEntries(t, path)
+	before, _ := fileSize(path)
+
+	limit := before / 4
+	paths, err := Fit(helper.GenerateIDWithContext(), path, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ := fileSize(path)
+	if len(paths) != 1 || paths[0] != path || after > limit {
+		t.Fatalf("got %v of %d bytes, want the file recompressed within %d", paths, after, limit)
+	}
+	if names := dirNames(t, dir); len(names) != 1 {
+		t.Fatalf("files left behind: %v", names)
+	}
+	if mimetype := readEntry(t, path, "mimetype"); mimetype != "application/epub+zip" {
+		t.Fatalf("mimetype %q", mimetype)
+	}
+}
+
+func TestFitSplits(t *testing.T) {
+	dir := t.TempDir()
+	bodies := []string{noise(t, 60<<10), noise(t, 60<<10), noise(t, 60<<10), noise(t, 60<<10)}
+	path := writeBook(t, dir, bodies...)
+
+	var limit int64 = 150 << 10
+	paths, err := Fit(helper.GenerateIDWithContext(), path, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) < 2 {
+		t.Fatalf("got %v, want parts", paths)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("split file was left behind")
+	}
+
+	found := 0
+	for i, part := range paths {
+		if want := fmt.Sprintf("big (part %d of %d).epub", i+1, len(paths)); filepath.Base(part) != want {
+			t.Errorf("part %d is named %s, want %s", i+1, filepath.Base(part), want)
+		}
+		if size, _ := fileSize(part); size > limit {
+			t.Errorf("part %d is %d bytes, over the limit", i+1, size)
+		}
+		opf := readEntry(t, part, "OEBPS/content.opf")
+		if want := fmt.Sprintf("<dc:title>Big Book (Part %d of %d)</dc:title>", i+1, len(paths)); !strings.Contains(opf, want) {
+			t.Errorf("part %d lacks %s", i+1, want)
+		}
+		if want := fmt.Sprintf("urn:uuid:big-part-%d", i+1); !strings.Contains(opf, want) {
+			t.Errorf("part %d lacks identifier %s", i+1, want)
+		}
+		for c, body := range bodies {
+			if strings.Contains(opf, fmt.Sprintf(`href="%s"`, epub.ChapterName(c))) &&
+				strings.Contains(readEntry(t, part, "OEBPS/"+epub.ChapterName(c)), body) {
+				found++
+			}
+		}
+	}
+	if found != len(bodies) {
+		t.Fatalf("%d chapters in the parts, want each of the %d once", found, len(bodies))
+	}
+}
+
+func TestFitCleansUpOnFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		book   func(t *testing.T, dir string) string
+		ctx    func() context.Context
+		limit  int64
+		target error
+	}{
+		{
+			name: "chapter over the limit",
+			book: func(t *testing.T, dir string) string {
+				return writeBook(t, dir, noise(t, 90<<10), noise(t, 300<<10), noise(t, 90<<10))
+			},
+			ctx:    helper.GenerateIDWithContext,
+			limit:  200 << 10,
+			target: TooLargeErr,
+		},
+		{
+			name:   "single chapter",
+			book:   func(t *testing.T, dir string) string { return writeBook(t, dir, noise(t, 300<<10)) },
+			ctx:    helper.GenerateIDWithContext,
+			limit:  200 << 10,
+			target: TooLargeErr,
+		},
+		{
+			name: "not a book",
+			book: func(t *testing.T, dir string) string {
+				path := filepath.Join(dir, "big.txt")
+				if err := os.WriteFile(path, []byte(noise(t, 300<<10)), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			},
+			ctx:    helper.GenerateIDWithContext,
+			limit:  200 << 10,
+			target: TooLargeErr,
+		},
+		{
+			name: "cancelled",
+			book: func(t *testing.T, dir string) string { return writeBook(t, dir, noise(t, 300<<10), noise(t, 300<<10)) },
+			ctx: func() context.Context {
+				ctx, cancel := context.WithCancel(helper.GenerateIDWithContext())
+				cancel()
+				return ctx
+			},
+			limit:  200 << 10,
+			target: context.Canceled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := tt.book(t, dir)
+			_, err := Fit(tt.ctx(), path, tt.limit)
+			if !errors.Is(err, tt.target) {
+				t.Fatalf("got %v, want %v", err, tt.target)
+			}
+			// the file is kept for the error to be looked into, parts and temporary files are not
+			if names := dirNames(t, dir); len(names) != 1 || names[0] != filepath.Base(path) {
+				t.Fatalf("files left: %v", names)
+			}
+		})
+	}
+}
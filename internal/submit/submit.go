@@ -0,0 +1,219 @@
+// Package submit turns submissions into queued tasks. The dashboard and the other
+// ways books come in, such as email-in, all add tasks through it.
+package submit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/roshanlc/send-to-kindle/internal/database"
+	"github.com/roshanlc/send-to-kindle/internal/downloader"
+	"github.com/roshanlc/send-to-kindle/internal/format"
+	"github.com/roshanlc/send-to-kindle/internal/helper"
+	"github.com/roshanlc/send-to-kindle/internal/queue"
+)
+
+var (
+	InvalidURLErr    = errors.New("url is not valid")
+	NotQueuedErr     = errors.New("task could not be queued")
+	UnknownDeviceErr = errors.New("device is not known")
+	NotPendingErr    = errors.New("task is not pending")
+	NotRetryableErr  = errors.New("task has not failed")
+	UploadGoneErr    = errors.New("uploaded file is not kept anymore")
+	NoOwnerErr       = errors.New("task has no owner")
+)
+
+// uploadScheme prefixes the name of an uploaded file in the url of its task, it is
+// shown in the history and keeps uploads apart in the per host limit
+const uploadScheme = "upload:"
+
+// Options are the choices made for a submission
+type Options struct {
+	TargetFormat format.Format // empty for the preferred format of the devices, automatic if they differ
+	ConvertPDF   bool          // have Send to Kindle convert a PDF to Kindle format
+	UserID       int           // owner of the task, 0 for none
+	Devices      []int         // ids of the devices of the owner to send to, the default ones when empty
+	TaskID       string        // id of the task, a new one when empty
+}
+
+// Service adds tasks to the database and the queue
+type Service struct {
+	db            *database.DB
+	queue         queue.Queue
+	maxUploadSize int64 // bytes, 0 for no limit
+}
+
+// NewService returns a service adding tasks to db and q
+func NewService(db *database.DB, q queue.Queue, maxUploadSize int64) *Service {
+	return &Service{db: db, queue: q, maxUploadSize: maxUploadSize}
+}
+
+// AddURL adds a task downloading the url and returns its id
+func (s *Service) AddURL(rawURL string, opts Options) (string, error) {
+	if !helper.IsURLValid(rawURL) {
+		return "", fmt.Errorf("%w: %q", InvalidURLErr, rawURL)
+	}
+	task, err := s.newTask(taskID(opts), opts)
+	if err != nil {
+		return "", err
+	}
+	task.URL = rawURL
+	return s.add(task)
+}
+
+// AddFile adds a task sending an uploaded book and returns its id. Errors of
+// downloader.SaveUpload are returned for files which are not accepted.
+func (s *Service) AddFile(name string, r io.Reader, opts Options) (string, error) {
+	task, err := s.newTask(taskID(opts), opts)
+	if err != nil {
+		return "", err
+	}
+	taskID := task.ID
+	path, err := downloader.SaveUpload(taskID, name, r, s.maxUploadSize)
+	if err != nil {
+		return "", err
+	}
+	name = filepath.Base(path) // sanitized, with the extension of the content
+	task.URL = uploadScheme + name
+	task.Title = name
+	task.LocalFile = path
+	id, err := s.add(task)
+	if err != nil {
+		_ = downloader.DeleteUploadDirectory(taskID) // no worker will ever send it
+	}
+	return id, err
+}
+
+// taskID returns the id chosen in opts, a new one when there is none
+func taskID(opts Options) string {
+	if opts.TaskID != "" {
+		return opts.TaskID
+	}
+	return helper.GenerateID().String()
+}
+
+// newTask returns a task with the choices of opts, sent to the devices of the owner
+func (s *Service) newTask(taskID string, opts Options) (database.Task, error) {
+	task := database.Task{
+		ID:           taskID,
+		UserID:       opts.UserID,
+		TargetFormat: string(opts.TargetFormat),
+		ConvertPDF:   opts.ConvertPDF,
+	}
+	if opts.UserID == 0 {
+		return database.Task{}, NoOwnerErr // it would have nowhere to go
+	}
+
+	var devices []database.Device
+	var err error
+	if len(opts.Devices) == 0 {
+		devices, err = s.db.ListDefaultDevices(opts.UserID)
+	} else {
+		devices, err = s.pickDevices(opts.UserID, opts.Devices)
+	}
+	if err != nil {
+		return database.Task{}, fmt.Errorf("error while picking devices, %w", err)
+	}
+
+	preferred := ""
+	for i, device := range devices {
+		task.SendTo = append(task.SendTo, device.Email)
+		if i == 0 {
+			preferred = device.Format
+		} else if device.Format != preferred {
+			preferred = "" // one file is sent to all of them
+		}
+	}
+	if task.TargetFormat == "" {
+		task.TargetFormat = preferred
+	}
+	return task, nil
+}
+
+// pickDevices returns the devices of the user with the given ids
+func (s *Service) pickDevices(userID int, deviceIDs []int) ([]database.Device, error) {
+	all, err := s.db.ListDevices(userID)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]database.Device, 0, len(deviceIDs))
+	for _, id := range deviceIDs {
+		i := slices.IndexFunc(all, func(d database.Device) bool { return d.ID == id })
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %d", UnknownDeviceErr, id)
+		}
+		if !slices.ContainsFunc(devices, func(d database.Device) bool { return d.ID == id }) {
+			devices = append(devices, all[i])
+		}
+	}
+	return devices, nil
+}
+
+// add stores the task as pending and queues it. A task which could not be queued
+// stays in the history as failed, its id is returned along with NotQueuedErr.
+func (s *Service) add(task database.Task) (string, error) {
+	task.State = database.Pending
+	err := s.db.AddTask(task)
+	if err != nil {
+		return "", fmt.Errorf("error while adding task to db, %w", err)
+	}
+	return task.ID, s.enqueue(task)
+}
+
+// enqueue queues a pending task, it is marked as failed when that is not possible
+func (s *Service) enqueue(task database.Task) error {
+	id, err := helper.GetUUIDFromID(task.ID)
+	if err == nil {
+		err = s.queue.Enqueue(queue.NewTask(id, task.URL))
+	}
+	if err != nil {
+		slog.Error("error while adding task to queue", slog.String("taskID", task.ID), slog.String("error", err.Error()))
+		_ = s.db.UpdateTask(database.Task{
+			ID:       task.ID,
+			State:    database.Failed,
+			ErrorMsg: "Task could not be queued",
+		})
+		return NotQueuedErr
+	}
+	return nil
+}
+
+// Retry queues a failed task again with its attempts reset, as do tasks whose book
+// was rejected by Amazon. Uploads can only be retried while their file is kept.
+func (s *Service) Retry(task database.Task) error {
+	if task.State != database.Failed && task.State != database.Dead && task.DeliveryStatus != database.DeliveryRejected {
+		return NotRetryableErr
+	}
+	if task.LocalFile != "" {
+		if _, err := os.Stat(task.LocalFile); err != nil {
+			return UploadGoneErr
+		}
+	}
+
+	err := s.db.ResetTask(task.ID)
+	if err != nil {
+		return fmt.Errorf("error while resetting task, %w", err)
+	}
+	return s.enqueue(task)
+}
+
+// Cancel marks a pending task as failed, workers skip it when they get to it
+func (s *Service) Cancel(task database.Task) error {
+	if task.State != database.Pending {
+		return NotPendingErr
+	}
+	err := s.db.UpdateTask(database.Task{
+		ID:       task.ID,
+		State:    database.Failed,
+		ErrorMsg: "Task cancelled by user",
+	})
+	if err != nil {
+		return fmt.Errorf("error while updating task status to cancelled(failed), %w", err)
+	}
+	return nil
+}